@@ -0,0 +1,27 @@
+package app
+
+import (
+	"expvar"
+	nethttp "net/http"
+	"os"
+)
+
+// defaultDebugAddress keeps the debug server on the loopback interface when DEBUG_ADDR isn't set
+const defaultDebugAddress = "127.0.0.1:6060"
+
+// debugAddress is where the debug server listens: on DEBUG_ADDR if set, e.g. 10.0.0.5:6060 for an internal network,
+// otherwise only on the loopback interface
+func debugAddress() string {
+	if addr := os.Getenv("DEBUG_ADDR"); addr != "" {
+		return addr
+	}
+	return defaultDebugAddress
+}
+
+// debugServer serves the expvars on its own listener, apart from the public router, since they tell about the rooms
+// and the connections of every student
+func debugServer(addr string) *nethttp.Server {
+	mux := nethttp.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	return &nethttp.Server{Addr: addr, Handler: mux}
+}
@@ -3,12 +3,16 @@ package app
 import (
 	"chat/messaging/delivery/http"
 	roomHttp "chat/room/delivery/http"
+	"chat/utils/ratelimit"
 	"fmt"
 	"github.com/gin-gonic/gin"
 )
 
 func mapChatUrls(mw Middleware, r *gin.Engine, mh *http.MessageHandler) {
 
+	r.GET("/chat", func(c *gin.Context) {
+		mh.ServeUserWs(c.Writer, c.Request)
+	})
 	r.GET("/chat/:roomID", func(c *gin.Context) {
 		roomID := c.Param("roomID")
 		ctx := c.Request.Context()
@@ -19,9 +23,18 @@ func mapChatUrls(mw Middleware, r *gin.Engine, mh *http.MessageHandler) {
 
 	const pathRoomID = "chat/:roomID"
 	router.POST(pathRoomID, mh.LoadMessages)
-	router.PUT(pathRoomID, mh.EditMessage)
-	router.DELETE(fmt.Sprintf("%s/:timestamp", pathRoomID), mh.DeleteMessage)
-	router.POST("chat/joinRequest/:roomID", mh.JoinRequest)
+	router.PUT(pathRoomID, mw.RateLimit(ratelimit.Edit), mh.EditMessage)
+	router.POST(fmt.Sprintf("%s/messages", pathRoomID), mw.RateLimit(ratelimit.Send), mh.PostMessage)
+	router.GET(fmt.Sprintf("%s/messages", pathRoomID), mh.GetHistory)
+	router.GET(fmt.Sprintf("%s/messages/:messageID/revisions", pathRoomID), mh.GetRevisions)
+	router.GET(fmt.Sprintf("%s/search", pathRoomID), mh.SearchMessages)
+	router.DELETE(fmt.Sprintf("%s/:messageID", pathRoomID), mw.RateLimit(ratelimit.Delete), mh.DeleteMessage)
+	router.PUT(fmt.Sprintf("%s/read", pathRoomID), mh.MarkRead)
+	router.GET(fmt.Sprintf("%s/read", pathRoomID), mh.GetReadPositions)
+	router.GET(fmt.Sprintf("%s/online", pathRoomID), mh.GetOnlineMembers)
+	router.GET(fmt.Sprintf("%s/stream", pathRoomID), mh.StreamEvents)
+	router.GET("search", mh.SearchMessages)
+	router.POST("chat/joinRequest/:roomID", mw.RateLimit(ratelimit.JoinRequest), mh.JoinRequest)
 	router.POST("chat/rejectRequest/:roomID/:userID", mh.RejectJoinRequest)
 }
 
@@ -29,7 +42,7 @@ func mapRoomURLs(mw Middleware, r *gin.Engine, rh *roomHttp.RoomHandler) {
 	router := r.Group("/api/rooms")
 	router.Use(mw.AuthMiddleware())
 
-	router.POST("", rh.SaveRoom)
+	router.POST("", mw.RateLimit(ratelimit.RoomCreate), rh.SaveRoom)
 	router.GET("", rh.GetChatRoomsFor)
 	router.GET("/class/:className", rh.GetChatRoomsByClass)
 	router.PUT("/add/:roomID/:id", rh.AddUserToRoom)
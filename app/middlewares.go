@@ -1,66 +1,45 @@
 package app
 
 import (
-	"chat/utils/errors"
-	"github.com/dgrijalva/jwt-go"
+	"chat/utils/auth"
+	"chat/utils/ratelimit"
+	"errors"
 	"github.com/gin-gonic/gin"
-	"github.com/sony/gobreaker"
 	"log"
 	"net/http"
-	"os"
 	"strings"
-	"time"
 )
 
 // Middleware defines the contracts
 type Middleware interface {
 	AuthMiddleware() gin.HandlerFunc
+	RateLimit(action ratelimit.Action) gin.HandlerFunc
 }
 
-type middleware struct{}
+type middleware struct {
+	verifier auth.TokenVerifier
+	limiter  *ratelimit.Limiter
+}
 
 // NewMiddleware is a constructor
-func NewMiddleware() Middleware {
-	return &middleware{}
+func NewMiddleware(verifier auth.TokenVerifier, limiter *ratelimit.Limiter) Middleware {
+	return &middleware{verifier: verifier, limiter: limiter}
 }
 
-// AuthMiddleware checks if it has a jwt token and then requests the auth service to verify it for us
+// AuthMiddleware checks if it has a jwt token and then has the verifier check it, the same way the websockets do
 func (h *middleware) AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authToken := c.Request.Header.Get("Authorization")
-		if authToken == "" || authToken[:7] != "Bearer " {
+		if !strings.HasPrefix(authToken, "Bearer ") {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"error": "not authorized, missing bearer token",
 			})
 			c.Abort()
 			return
 		}
-		client := &http.Client{}
-		url := os.Getenv("AUTH_URL")
-		circuitBeakerSettings := gobreaker.Settings{
-			Name:          "auth",
-			MaxRequests:   5,
-			Interval:      time.Millisecond*50,
-			Timeout:       time.Second,
-			ReadyToTrip:   nil,
-			OnStateChange: nil,
-			IsSuccessful:  nil,
-		}
-		cb := gobreaker.NewCircuitBreaker(circuitBeakerSettings)
-		cbResponse, err := cb.Execute(func() (interface{}, error) {
-			request, err := http.NewRequest("GET", url, nil)
-			if err != nil {
-				return nil, err
-			}
-			request.Header.Set("Authorization", authToken)
-			response, err := client.Do(request)
-			if err != nil {
-				return nil, err
-			}
-			return response, nil
-		})
 
-		if err != nil {
+		loggedID, err := h.verifier.Verify(c.Request.Context(), strings.TrimPrefix(authToken, "Bearer "))
+		if errors.Is(err, auth.ErrUnavailable) {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"error": "some error occurred while making a request",
 			})
@@ -68,39 +47,19 @@ func (h *middleware) AuthMiddleware() gin.HandlerFunc {
 			c.Abort()
 			return
 		}
-
-		response, ok := cbResponse.(*http.Response)
-		if !ok {
-			c.JSON(http.StatusInternalServerError, errors.NewInternalServerError("some error occurred with cb"))
-			return
-		}
-
-		if response.StatusCode == 200 {
-			jwtToken := strings.Replace(c.Request.Header.Get("Authorization"), "Bearer ", "", 1)
-
-			token, _, err := new(jwt.Parser).ParseUnverified(jwtToken, jwt.MapClaims{})
-			if err != nil {
-				c.JSON(http.StatusBadRequest, errors.NewBadRequestError("invalid token. I think"))
-				return
-			}
-			var loggedID string
-			if claims, ok := token.Claims.(jwt.MapClaims); ok {
-				iss := claims["iss"]
-				if f, ok := iss.(string); ok {
-					loggedID = f
-				}
-			} else {
-				c.JSON(http.StatusBadRequest, errors.NewBadRequestError("invalid token. I think"))
-				return
-			}
-			c.Set("loggedID", loggedID)
-			c.Next()
-		} else {
+		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"error": "not authorized",
 			})
 			c.Abort()
 			return
 		}
+		c.Set("loggedID", loggedID)
+		c.Next()
 	}
 }
+
+// RateLimit limits the action for the logged in student, it must come after AuthMiddleware
+func (h *middleware) RateLimit(action ratelimit.Action) gin.HandlerFunc {
+	return h.limiter.Handler(action)
+}
@@ -0,0 +1,43 @@
+package app
+
+import (
+	"chat/messaging/repository"
+	"chat/messaging/repository/cassandra"
+	"context"
+	"github.com/gocql/gocql"
+	"log"
+	"os"
+)
+
+// Migrate runs the named migration against CASSANDRA_HOST. message-ids copies chat.messages, keyed by sent timestamp,
+// and message-buckets copies chat.messages_by_id, keyed by timeuuid with a partition per room, to
+// chat.messages_by_bucket and chat.messages_by_author. message-authors copies the messages of chat.messages_by_bucket
+// saved before chat.messages_by_author existed, and message-terms indexes those saved before chat.message_terms did
+func Migrate(name string) {
+	cluster := gocql.NewCluster(os.Getenv("CASSANDRA_HOST"))
+	session, err := cluster.CreateSession()
+	failOnError(err, "Failed to connect to Cassandra")
+	defer session.Close()
+
+	mr := repository.NewChatRepository(cassandra.NewSession(session))
+	switch name {
+	case "message-ids":
+		migrated, err := mr.MigrateMessageIDs(context.Background())
+		log.Printf("Migrated %d messages", migrated)
+		failOnError(err, "Failed to migrate the message ids")
+	case "message-buckets":
+		migrated, err := mr.MigrateMessageBuckets(context.Background())
+		log.Printf("Migrated %d messages", migrated)
+		failOnError(err, "Failed to migrate the message buckets")
+	case "message-authors":
+		migrated, err := mr.MigrateMessageAuthors(context.Background())
+		log.Printf("Migrated %d messages", migrated)
+		failOnError(err, "Failed to migrate the message authors")
+	case "message-terms":
+		migrated, err := mr.MigrateMessageTerms(context.Background())
+		log.Printf("Indexed %d messages", migrated)
+		failOnError(err, "Failed to index the message terms")
+	default:
+		log.Fatalf("Unknown migration %q", name)
+	}
+}
@@ -0,0 +1,22 @@
+package app
+
+import (
+	"chat/messaging/repository"
+	"fmt"
+	"os"
+	"time"
+)
+
+// messageRetention reads how long the body of a deleted message is kept from MESSAGE_RETENTION, e.g. 720h. With 0, it
+// is purged as soon as the message is deleted
+func messageRetention() (time.Duration, error) {
+	value := os.Getenv("MESSAGE_RETENTION")
+	if value == "" {
+		return repository.DefaultRetention, nil
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention < 0 {
+		return 0, fmt.Errorf("MESSAGE_RETENTION must be a duration, e.g. 720h, got %q", value)
+	}
+	return retention, nil
+}
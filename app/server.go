@@ -11,11 +11,19 @@ import (
 	studentRepository "chat/student/repository"
 	studentUseCase "chat/student/usecase"
 	"chat/utils"
+	"chat/utils/auth"
+	"chat/utils/ratelimit"
+	"context"
+	"expvar"
 	"github.com/gin-gonic/gin"
 	"github.com/gocql/gocql"
 	"github.com/streadway/amqp"
 	"log"
+	nethttp "net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -32,7 +40,7 @@ func failOnError(err error, msg string) {
 	}
 }
 
-// Start runs the server
+// Start runs the server until it receives SIGINT or SIGTERM, then shuts it down within SHUTDOWN_TIMEOUT
 func Start() {
 	cluster := gocql.NewCluster(os.Getenv("CASSANDRA_HOST"))
 
@@ -44,24 +52,36 @@ func Start() {
 
 	mail := utils.NewSimpleMail()
 	mr := repository.NewChatRepository(cassandra.NewSession(session))
+	retention, err := messageRetention()
+	failOnError(err, "Failed to read the message retention")
+	mr.SetRetention(retention)
 	rr := roomRepository.NewRoomRepository(cassandra.NewSession(session))
 	sr := studentRepository.NewStudentRepository(cassandra.NewSession(session))
 
 	mu := usecase.NewMessageUseCase(time.Second*2, mr, rr, sr, mail)
-	ru := roomUseCase.NewRoomUseCase(rr, sr, time.Second*2)
+	ru := roomUseCase.NewRoomUseCase(rr, sr, http.NewHub(), time.Second*2)
 
-	mh := http.NewMessageHandler(mu)
+	verifier, err := auth.NewVerifierFromEnv()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	limiter, err := ratelimit.NewFromEnv()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	mh := http.NewMessageHandler(mu, verifier)
+	mh.SetRateLimiter(limiter)
 	rh := http2.NewRoomHandler(ru)
 
 	su := studentUseCase.NewStudentUseCase(*sr)
 
 	conn, err := amqp.Dial(os.Getenv("RABBIT_URL"))
 	failOnError(err, "Failed to connect to RabbitMQ")
-	defer conn.Close()
 
 	ch, err := conn.Channel()
 	failOnError(err, "Failed to open a channel")
-	defer ch.Close()
 
 	err = ch.ExchangeDeclare(
 		"profile", // name
@@ -74,14 +94,71 @@ func Start() {
 	)
 	failOnError(err, "Failed to declare an exchange")
 
-	go su.ListenStudentCreation(ch)
-	go su.ListenStudentEdit(ch)
-	go su.ListenStudentDelete(ch)
+	var listeners sync.WaitGroup
+	for _, listen := range []func(*amqp.Channel){su.ListenStudentCreation, su.ListenStudentEdit, su.ListenStudentDelete} {
+		listeners.Add(1)
+		go func(listen func(*amqp.Channel)) {
+			defer listeners.Done()
+			listen(ch)
+		}(listen)
+	}
+
+	mw := NewMiddleware(verifier, limiter)
 
-	mw := NewMiddleware()
+	// the relay has a connection of its own, which it dials again when it drops
+	relay, err := http.NewAMQPRelay(func() (*amqp.Connection, error) { return amqp.Dial(os.Getenv("RABBIT_URL")) })
+	failOnError(err, "Failed to set up the relay")
+
+	overflowPolicy, err := http.ParseOverflowPolicy(os.Getenv("WS_OVERFLOW_POLICY"))
+	failOnError(err, "Failed to read the websocket overflow policy")
 
 	mainHub := http.NewHub()
+	mainHub.SetRelay(relay)
+	mainHub.SetOverflowPolicy(overflowPolicy)
+	expvar.Publish("hub_send_queues", expvar.Func(func() interface{} { return mainHub.QueueStats() }))
+	expvar.Publish("hub_active_rooms", expvar.Func(func() interface{} { return mainHub.ActiveRooms() }))
+	if remote, ok := verifier.(*auth.RemoteVerifier); ok {
+		expvar.Publish("auth_remote", expvar.Func(func() interface{} { return remote.Stats() }))
+	}
+	timeout, err := shutdownTimeout()
+	failOnError(err, "Failed to read the shutdown timeout")
+
 	go mainHub.StartHubListener()
-	router := Server(mh, rh, mw)
-	router.Run()
+	srv := &nethttp.Server{Addr: address(), Handler: Server(mh, rh, mw)}
+	srv.RegisterOnShutdown(mainHub.StopStreams)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != nethttp.ErrServerClosed {
+			log.Fatalf("server stopped with err %s", err)
+		}
+	}()
+	debug := debugServer(debugAddress())
+	go func() {
+		if err := debug.ListenAndServe(); err != nil && err != nethttp.ErrServerClosed {
+			log.Fatalf("debug server stopped with err %s", err)
+		}
+	}()
+
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-signals.Done()
+	stop()
+
+	// nothing in flight is lost: the server stops accepting connections and finishes the requests it is handling,
+	// the event streams included, then the websockets are closed after their queued events and the relay once they
+	// are published, then the student listeners finish the deliveries they received, and last the connections to
+	// rabbitmq, including its channels, and cassandra are closed
+	log.Printf("shutting down within %s", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	shutdown(ctx, []shutdownStep{
+		{"stop accepting connections", srv.Shutdown},
+		{"stop the debug server", debug.Shutdown},
+		{"close the websockets", mainHub.Shutdown},
+		{"close the relay connection", func(context.Context) error { return relay.Close() }},
+		{"stop the student listeners", stopListeners(func() error { return su.StopListening(ch) }, &listeners)},
+		{"close the rabbitmq connection", func(context.Context) error { return conn.Close() }},
+		{"close the cassandra session", func(context.Context) error {
+			session.Close()
+			return nil
+		}},
+	})
 }
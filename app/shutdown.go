@@ -0,0 +1,72 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultShutdownTimeout is how long the shutdown can take when SHUTDOWN_TIMEOUT isn't set
+const defaultShutdownTimeout = time.Second * 15
+
+// shutdownTimeout reads the deadline of the shutdown from SHUTDOWN_TIMEOUT, e.g. 30s
+func shutdownTimeout() (time.Duration, error) {
+	value := os.Getenv("SHUTDOWN_TIMEOUT")
+	if value == "" {
+		return defaultShutdownTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("SHUTDOWN_TIMEOUT must be a positive duration, e.g. 30s, got %q", value)
+	}
+	return timeout, nil
+}
+
+// address is where the server listens, like gin's Run: on PORT if set, otherwise on 8080
+func address() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
+
+// shutdownStep is one step of the shutdown, run within the deadline
+type shutdownStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// shutdown runs the steps in order. A step that fails is logged and the next one runs anyway, so the connections are
+// always closed. Once the deadline is over, the remaining steps are still run, but they don't wait for anything
+func shutdown(ctx context.Context, steps []shutdownStep) {
+	for _, step := range steps {
+		if err := step.run(ctx); err != nil {
+			log.Printf("shutdown: couldn't %s with err %s", step.name, err.Error())
+			continue
+		}
+		log.Printf("shutdown: %s", step.name)
+	}
+}
+
+// stopListeners stops the student listeners and waits for them to handle the deliveries they already received
+func stopListeners(stopListening func() error, listeners *sync.WaitGroup) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if err := stopListening(); err != nil {
+			return err
+		}
+		done := make(chan struct{})
+		go func() {
+			listeners.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
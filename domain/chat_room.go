@@ -5,6 +5,9 @@ import (
 	"time"
 )
 
+// MaxUnreadCount is as far as the unread messages of a room are counted, a room with more shows as "99+"
+const MaxUnreadCount = 100
+
 // ChatRoom struct
 type ChatRoom struct {
 	RoomID   		string    `json:"room_id"`
@@ -14,6 +17,8 @@ type ChatRoom struct {
 	Students 		[]Student `json:"students"`
 	Class    		string    `json:"class"`
 	MaxParticipants int 	  `json:"max_participants"`
+	LastMessage     *Message  `json:"last_message,omitempty"`
+	UnreadCount     int64     `json:"unread_count"`
 }
 
 // StudentChatRooms struct
@@ -42,6 +47,23 @@ type RoomRepository interface {
 	// RemoveRoomForParticipants deals with chat.student_rooms and removes the chatroom from each student's list
 	RemoveRoomForParticipants(ctx context.Context, roomID string, users []Student) error
 
+	// chat.room_activity methods
+	// SaveLastMessage keeps the latest message of the room. An older message never replaces a newer one, and an edit
+	// or the tombstone of the latest message replaces the revision it edited or deleted
+	SaveLastMessage(ctx context.Context, message *Message) error
+	// GetLastMessage returns nil if nothing was sent in the room yet
+	GetLastMessage(ctx context.Context, roomID string) (*Message, error)
+
+	// chat.unread_messages methods
+	// AddUnread counts the message as unread for each student
+	AddUnread(ctx context.Context, message *Message, userIDs []string) error
+	// RemoveUnread stops counting the message as unread for each student, once it is deleted
+	RemoveUnread(ctx context.Context, message *Message, userIDs []string) error
+	// ClearUnread stops counting the messages of the room sent up to the timestamp as unread for the student
+	ClearUnread(ctx context.Context, roomID string, userID string, timeStamp time.Time) error
+	// GetUnreadCount counts the unread messages of the student in the room up to MaxUnreadCount
+	GetUnreadCount(ctx context.Context, roomID string, userID string) (int64, error)
+
 	// batch
 	SaveRoomAndAddRoomForAllParticipants(ctx context.Context, room *ChatRoom) error
 	RemoveRoomForParticipantsAndDeleteRoom(ctx context.Context, room *ChatRoom) error
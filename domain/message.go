@@ -2,33 +2,154 @@ package domain
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
-// Message struct
+// ErrMessageChanged is returned when a message was edited or deleted since it was read
+var ErrMessageChanged = errors.New("the message was edited or deleted since it was read")
+
+// Message struct. MessageID is a timeuuid holding the time the message was sent, it identifies the message in its room.
+// EditCount is how many times the body was edited, the last time at EditedAt, which is zero until the first edit. A
+// deleted message stays in the history as a tombstone, deleted at DeletedAt by DeletedBy, the author or the admin of
+// the room. Only the admin sees its body, until it is purged, and who deleted it
 type Message struct {
+	MessageID     string
 	RoomID        string
 	SentTimestamp time.Time
 	FromStudentID string
 	MessageBody   string
+	EditedAt      time.Time
+	EditCount     int
+	DeletedAt     time.Time
+	DeletedBy     string
+}
+
+// MessageRevision is a body a message had. Revision 0 is the body it was sent with, and each edit adds the next one.
+// WrittenAt is when the body was sent or edited in
+type MessageRevision struct {
+	Revision    int       `json:"revision"`
+	MessageBody string    `json:"message_body"`
+	WrittenAt   time.Time `json:"written_at"`
+}
+
+// MessageFilter narrows the messages of a room to those of one member, sent in the [From, To) window. A zero field
+// doesn't narrow them
+type MessageFilter struct {
+	FromStudentID string
+	From          time.Time
+	To            time.Time
+}
+
+// HistoryQuery picks the page of a room's history to load. At most one of Before, After and Around is set, each a
+// message id: Before and After exclude the message, Around centers the page on it. With none, the page is the latest
+// messages. The filter applies to every message of the page but the one Around is
+type HistoryQuery struct {
+	Before string
+	After  string
+	Around string
+	Limit  int
+	Filter MessageFilter
+}
+
+// MessagePage is a page of a room's history, oldest first. HasOlder tells if messages were sent before the first one
+type MessagePage struct {
+	Messages []Message
+	HasOlder bool
+}
+
+// SearchQuery is a search for the messages that have every term of Text, in the room or, without one, in every room of
+// the user. Before is the id of the last hit of the previous page, the hits are the messages sent before it
+type SearchQuery struct {
+	Text   string
+	RoomID string
+	Before string
+	Limit  int
+}
+
+// SearchHit is a message a search found, with the part of its body around the terms highlighted
+type SearchHit struct {
+	Message Message
+	Snippet string
+}
+
+// SearchResult is a page of search hits, newest first. HasMore tells if older messages match too
+type SearchResult struct {
+	Hits    []SearchHit
+	HasMore bool
+}
+
+// ReadPosition is the watermark of what a student has read in a room. Every message sent up to LastRead is read
+type ReadPosition struct {
+	RoomID    string    `json:"room_id"`
+	StudentID string    `json:"student_id"`
+	LastRead  time.Time `json:"last_read"`
 }
 
 // MessageRepository interface defines the functions all chatRepositories should have
 type MessageRepository interface {
 	SaveMessage(ctx context.Context, message *Message) error
-	EditMessage(ctx context.Context, message *Message) error
-	GetMessage(ctx context.Context, roomID string, timeStamp time.Time) (*Message, error)
-	GetMessages(ctx context.Context, roomID string, timeStamp time.Time, limit int) ([]Message, error)
-	DeleteMessage(ctx context.Context, roomID string, timeStamp time.Time) error
+	// EditMessage replaces the body of the message, as long as the message still is at the previous revision, with its
+	// body, and isn't deleted, and records that revision. Otherwise it returns ErrMessageChanged
+	EditMessage(ctx context.Context, message *Message, previous MessageRevision) error
+	GetMessage(ctx context.Context, roomID string, messageID string) (*Message, error)
+	// GetMessages returns the messages of the filter sent before the timestamp, newest first
+	GetMessages(ctx context.Context, roomID string, timeStamp time.Time, limit int, filter MessageFilter) ([]Message, error)
+	GetMessagesSince(ctx context.Context, roomID string, timeStamp time.Time, limit int) ([]Message, error)
+	// GetMessagesBefore returns the messages of the filter sent before the message, newest first
+	GetMessagesBefore(ctx context.Context, roomID string, messageID string, limit int, filter MessageFilter) ([]Message, error)
+	// GetMessagesAfter returns the messages of the filter sent after the message, oldest first
+	GetMessagesAfter(ctx context.Context, roomID string, messageID string, limit int, filter MessageFilter) ([]Message, error)
+	// GetRevisions returns the revisions the edits of the message replaced, oldest first
+	GetRevisions(ctx context.Context, roomID string, messageID string) ([]MessageRevision, error)
+	// DeleteMessage turns the message into a tombstone, deleted at its DeletedAt by its DeletedBy. Its body is purged
+	// once the retention window is over, its revisions and terms right away. It returns ErrMessageChanged if the
+	// message was edited or deleted since it was read
+	DeleteMessage(ctx context.Context, message *Message) error
+	// SearchMessages returns the messages of the room that have every term, sent before the message unless before is
+	// empty, newest first
+	SearchMessages(ctx context.Context, roomID string, terms []string, before string, limit int) ([]Message, error)
+	SaveReadPosition(ctx context.Context, position *ReadPosition) error
+	GetReadPosition(ctx context.Context, roomID string, studentID string) (*ReadPosition, error)
+	GetReadPositions(ctx context.Context, roomID string) ([]ReadPosition, error)
+	// ClaimIdempotencyKey records that the student's key is used for the message. If the key was already claimed, it
+	// returns false and the id of the message it was claimed for
+	ClaimIdempotencyKey(ctx context.Context, roomID string, studentID string, key string, messageID string) (string, bool, error)
+	// ReleaseIdempotencyKey forgets the key, so that it can be claimed again
+	ReleaseIdempotencyKey(ctx context.Context, roomID string, studentID string, key string) error
 }
 
 // MessageUseCase defines the functionality messages encapsulate
 type MessageUseCase interface {
 	SaveMessage(ctx context.Context, message *Message) error
-	EditMessage(ctx context.Context, roomID string, userID string, timeStamp time.Time, message string) (*Message, error)
-	GetMessages(ctx context.Context, roomID string, timeStamp time.Time, limit int) ([]Message, error)
-	DeleteMessage(ctx context.Context, roomID string, timeStamp time.Time, userID string) (*Message, error)
+	// SendMessage saves the message like SaveMessage. If the sender already sent a message to the room with the same
+	// idempotency key, that message is returned instead and duplicate is true
+	SendMessage(ctx context.Context, message *Message, idempotencyKey string) (saved *Message, duplicate bool, err error)
+	// EditMessage replaces the body of the author's message. An empty body deletes it, and the tombstone is returned
+	EditMessage(ctx context.Context, roomID string, userID string, messageID string, message string) (*Message, error)
+	// GetMessages returns the messages of the filter sent before the timestamp, newest first
+	GetMessages(ctx context.Context, roomID string, timeStamp time.Time, limit int, filter MessageFilter) ([]Message, error)
+	// GetMessagesSince returns the messages sent after the timestamp, oldest first. Used to replay what a client
+	// missed while it was disconnected
+	GetMessagesSince(ctx context.Context, roomID string, timeStamp time.Time, limit int) ([]Message, error)
+	// GetMessagesAfter returns the messages sent after the message, oldest first. Used to replay what a client missed
+	// since the last message it received
+	GetMessagesAfter(ctx context.Context, roomID string, messageID string, limit int) ([]Message, error)
+	// GetHistory returns a page of at most query.Limit messages of the room, as long as the user is a member
+	GetHistory(ctx context.Context, roomID string, userID string, query HistoryQuery) (*MessagePage, error)
+	// GetRevisions returns every revision of the message, oldest first and the current body last, as long as the user
+	// is a member of the room
+	GetRevisions(ctx context.Context, roomID string, userID string, messageID string) ([]MessageRevision, error)
+	// DeleteMessage lets the author or the admin of the room delete the message. It returns the tombstone as the
+	// members see it
+	DeleteMessage(ctx context.Context, roomID string, messageID string, userID string) (*Message, error)
+	// SearchMessages returns a page of the messages matching the query, only ever in rooms the user is a member of
+	SearchMessages(ctx context.Context, userID string, query SearchQuery) (*SearchResult, error)
 	IsAuthorized(ctx context.Context, userID, roomID string) bool
 	JoinRequest(ctx context.Context, roomID string, userID string, timeStamp time.Time) error
 	SendRejection(ctx context.Context, roomID string, userID string, loggedID string) error
+	// MarkRead moves the student's read position forward. An older timestamp leaves it as is
+	MarkRead(ctx context.Context, roomID string, userID string, timeStamp time.Time) (*ReadPosition, error)
+	// GetReadPositions returns the read positions of all the members, as long as the user is one of them
+	GetReadPositions(ctx context.Context, roomID string, userID string) ([]ReadPosition, error)
 }
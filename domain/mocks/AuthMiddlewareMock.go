@@ -1,6 +1,7 @@
 package mocks
 
 import (
+	"chat/utils/ratelimit"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/mock"
 )
@@ -18,4 +19,11 @@ func (m *MiddlewareMock) AuthMiddleware() gin.HandlerFunc {
 		c.Set("loggedID", id)
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+
+// RateLimit doesn't limit anything
+func (m *MiddlewareMock) RateLimit(action ratelimit.Action) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+	}
+}
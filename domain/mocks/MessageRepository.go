@@ -16,22 +16,36 @@ type MessageRepository struct {
 	mock.Mock
 }
 
-// DeleteMessage provides a mock function with given fields: ctx, roomID, timeStamp
-func (_m *MessageRepository) DeleteMessage(ctx context.Context, roomID string, timeStamp time.Time) error {
-	ret := _m.Called(ctx, roomID, timeStamp)
+// ClaimIdempotencyKey provides a mock function with given fields: ctx, roomID, studentID, key, messageID
+func (_m *MessageRepository) ClaimIdempotencyKey(ctx context.Context, roomID string, studentID string, key string, messageID string) (string, bool, error) {
+	ret := _m.Called(ctx, roomID, studentID, key, messageID)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, string, time.Time) error); ok {
-		r0 = rf(ctx, roomID, timeStamp)
+	var r0 string
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string, string) string); ok {
+		r0 = rf(ctx, roomID, studentID, key, messageID)
 	} else {
-		r0 = ret.Error(0)
+		r0 = ret.Get(0).(string)
 	}
 
-	return r0
+	var r1 bool
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string, string) bool); ok {
+		r1 = rf(ctx, roomID, studentID, key, messageID)
+	} else {
+		r1 = ret.Get(1).(bool)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, string, string, string, string) error); ok {
+		r2 = rf(ctx, roomID, studentID, key, messageID)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
 }
 
-// EditMessage provides a mock function with given fields: ctx, message
-func (_m *MessageRepository) EditMessage(ctx context.Context, message *domain.Message) error {
+// DeleteMessage provides a mock function with given fields: ctx, message
+func (_m *MessageRepository) DeleteMessage(ctx context.Context, message *domain.Message) error {
 	ret := _m.Called(ctx, message)
 
 	var r0 error
@@ -44,13 +58,27 @@ func (_m *MessageRepository) EditMessage(ctx context.Context, message *domain.Me
 	return r0
 }
 
-// GetMessage provides a mock function with given fields: ctx, roomID, timeStamp
-func (_m *MessageRepository) GetMessage(ctx context.Context, roomID string, timeStamp time.Time) (*domain.Message, error) {
-	ret := _m.Called(ctx, roomID, timeStamp)
+// EditMessage provides a mock function with given fields: ctx, message, previous
+func (_m *MessageRepository) EditMessage(ctx context.Context, message *domain.Message, previous domain.MessageRevision) error {
+	ret := _m.Called(ctx, message, previous)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *domain.Message, domain.MessageRevision) error); ok {
+		r0 = rf(ctx, message, previous)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetMessage provides a mock function with given fields: ctx, roomID, messageID
+func (_m *MessageRepository) GetMessage(ctx context.Context, roomID string, messageID string) (*domain.Message, error) {
+	ret := _m.Called(ctx, roomID, messageID)
 
 	var r0 *domain.Message
-	if rf, ok := ret.Get(0).(func(context.Context, string, time.Time) *domain.Message); ok {
-		r0 = rf(ctx, roomID, timeStamp)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) *domain.Message); ok {
+		r0 = rf(ctx, roomID, messageID)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*domain.Message)
@@ -58,8 +86,8 @@ func (_m *MessageRepository) GetMessage(ctx context.Context, roomID string, time
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(context.Context, string, time.Time) error); ok {
-		r1 = rf(ctx, roomID, timeStamp)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, roomID, messageID)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -67,8 +95,77 @@ func (_m *MessageRepository) GetMessage(ctx context.Context, roomID string, time
 	return r0, r1
 }
 
-// GetMessages provides a mock function with given fields: ctx, roomID, timeStamp, limit
-func (_m *MessageRepository) GetMessages(ctx context.Context, roomID string, timeStamp time.Time, limit int) ([]domain.Message, error) {
+// GetMessages provides a mock function with given fields: ctx, roomID, timeStamp, limit, filter
+func (_m *MessageRepository) GetMessages(ctx context.Context, roomID string, timeStamp time.Time, limit int, filter domain.MessageFilter) ([]domain.Message, error) {
+	ret := _m.Called(ctx, roomID, timeStamp, limit, filter)
+
+	var r0 []domain.Message
+	if rf, ok := ret.Get(0).(func(context.Context, string, time.Time, int, domain.MessageFilter) []domain.Message); ok {
+		r0 = rf(ctx, roomID, timeStamp, limit, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.Message)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, time.Time, int, domain.MessageFilter) error); ok {
+		r1 = rf(ctx, roomID, timeStamp, limit, filter)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetMessagesAfter provides a mock function with given fields: ctx, roomID, messageID, limit, filter
+func (_m *MessageRepository) GetMessagesAfter(ctx context.Context, roomID string, messageID string, limit int, filter domain.MessageFilter) ([]domain.Message, error) {
+	ret := _m.Called(ctx, roomID, messageID, limit, filter)
+
+	var r0 []domain.Message
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, int, domain.MessageFilter) []domain.Message); ok {
+		r0 = rf(ctx, roomID, messageID, limit, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.Message)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, int, domain.MessageFilter) error); ok {
+		r1 = rf(ctx, roomID, messageID, limit, filter)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetMessagesBefore provides a mock function with given fields: ctx, roomID, messageID, limit, filter
+func (_m *MessageRepository) GetMessagesBefore(ctx context.Context, roomID string, messageID string, limit int, filter domain.MessageFilter) ([]domain.Message, error) {
+	ret := _m.Called(ctx, roomID, messageID, limit, filter)
+
+	var r0 []domain.Message
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, int, domain.MessageFilter) []domain.Message); ok {
+		r0 = rf(ctx, roomID, messageID, limit, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.Message)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, int, domain.MessageFilter) error); ok {
+		r1 = rf(ctx, roomID, messageID, limit, filter)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetMessagesSince provides a mock function with given fields: ctx, roomID, timeStamp, limit
+func (_m *MessageRepository) GetMessagesSince(ctx context.Context, roomID string, timeStamp time.Time, limit int) ([]domain.Message, error) {
 	ret := _m.Called(ctx, roomID, timeStamp, limit)
 
 	var r0 []domain.Message
@@ -90,6 +187,89 @@ func (_m *MessageRepository) GetMessages(ctx context.Context, roomID string, tim
 	return r0, r1
 }
 
+// GetReadPosition provides a mock function with given fields: ctx, roomID, studentID
+func (_m *MessageRepository) GetReadPosition(ctx context.Context, roomID string, studentID string) (*domain.ReadPosition, error) {
+	ret := _m.Called(ctx, roomID, studentID)
+
+	var r0 *domain.ReadPosition
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) *domain.ReadPosition); ok {
+		r0 = rf(ctx, roomID, studentID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*domain.ReadPosition)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, roomID, studentID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetReadPositions provides a mock function with given fields: ctx, roomID
+func (_m *MessageRepository) GetReadPositions(ctx context.Context, roomID string) ([]domain.ReadPosition, error) {
+	ret := _m.Called(ctx, roomID)
+
+	var r0 []domain.ReadPosition
+	if rf, ok := ret.Get(0).(func(context.Context, string) []domain.ReadPosition); ok {
+		r0 = rf(ctx, roomID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.ReadPosition)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, roomID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetRevisions provides a mock function with given fields: ctx, roomID, messageID
+func (_m *MessageRepository) GetRevisions(ctx context.Context, roomID string, messageID string) ([]domain.MessageRevision, error) {
+	ret := _m.Called(ctx, roomID, messageID)
+
+	var r0 []domain.MessageRevision
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) []domain.MessageRevision); ok {
+		r0 = rf(ctx, roomID, messageID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.MessageRevision)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, roomID, messageID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ReleaseIdempotencyKey provides a mock function with given fields: ctx, roomID, studentID, key
+func (_m *MessageRepository) ReleaseIdempotencyKey(ctx context.Context, roomID string, studentID string, key string) error {
+	ret := _m.Called(ctx, roomID, studentID, key)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) error); ok {
+		r0 = rf(ctx, roomID, studentID, key)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // SaveMessage provides a mock function with given fields: ctx, message
 func (_m *MessageRepository) SaveMessage(ctx context.Context, message *domain.Message) error {
 	ret := _m.Called(ctx, message)
@@ -103,3 +283,40 @@ func (_m *MessageRepository) SaveMessage(ctx context.Context, message *domain.Me
 
 	return r0
 }
+
+// SaveReadPosition provides a mock function with given fields: ctx, position
+func (_m *MessageRepository) SaveReadPosition(ctx context.Context, position *domain.ReadPosition) error {
+	ret := _m.Called(ctx, position)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *domain.ReadPosition) error); ok {
+		r0 = rf(ctx, position)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SearchMessages provides a mock function with given fields: ctx, roomID, terms, before, limit
+func (_m *MessageRepository) SearchMessages(ctx context.Context, roomID string, terms []string, before string, limit int) ([]domain.Message, error) {
+	ret := _m.Called(ctx, roomID, terms, before, limit)
+
+	var r0 []domain.Message
+	if rf, ok := ret.Get(0).(func(context.Context, string, []string, string, int) []domain.Message); ok {
+		r0 = rf(ctx, roomID, terms, before, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.Message)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, []string, string, int) error); ok {
+		r1 = rf(ctx, roomID, terms, before, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
@@ -16,13 +16,13 @@ type MessageUseCase struct {
 	mock.Mock
 }
 
-// DeleteMessage provides a mock function with given fields: ctx, roomID, timeStamp, userID
-func (_m *MessageUseCase) DeleteMessage(ctx context.Context, roomID string, timeStamp time.Time, userID string) (*domain.Message, error) {
-	ret := _m.Called(ctx, roomID, timeStamp, userID)
+// DeleteMessage provides a mock function with given fields: ctx, roomID, messageID, userID
+func (_m *MessageUseCase) DeleteMessage(ctx context.Context, roomID string, messageID string, userID string) (*domain.Message, error) {
+	ret := _m.Called(ctx, roomID, messageID, userID)
 
 	var r0 *domain.Message
-	if rf, ok := ret.Get(0).(func(context.Context, string, time.Time, string) *domain.Message); ok {
-		r0 = rf(ctx, roomID, timeStamp, userID)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) *domain.Message); ok {
+		r0 = rf(ctx, roomID, messageID, userID)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*domain.Message)
@@ -30,8 +30,8 @@ func (_m *MessageUseCase) DeleteMessage(ctx context.Context, roomID string, time
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(context.Context, string, time.Time, string) error); ok {
-		r1 = rf(ctx, roomID, timeStamp, userID)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string) error); ok {
+		r1 = rf(ctx, roomID, messageID, userID)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -39,13 +39,13 @@ func (_m *MessageUseCase) DeleteMessage(ctx context.Context, roomID string, time
 	return r0, r1
 }
 
-// EditMessage provides a mock function with given fields: ctx, roomID, userID, timeStamp, message
-func (_m *MessageUseCase) EditMessage(ctx context.Context, roomID string, userID string, timeStamp time.Time, message string) (*domain.Message, error) {
-	ret := _m.Called(ctx, roomID, userID, timeStamp, message)
+// EditMessage provides a mock function with given fields: ctx, roomID, userID, messageID, message
+func (_m *MessageUseCase) EditMessage(ctx context.Context, roomID string, userID string, messageID string, message string) (*domain.Message, error) {
+	ret := _m.Called(ctx, roomID, userID, messageID, message)
 
 	var r0 *domain.Message
-	if rf, ok := ret.Get(0).(func(context.Context, string, string, time.Time, string) *domain.Message); ok {
-		r0 = rf(ctx, roomID, userID, timeStamp, message)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string, string) *domain.Message); ok {
+		r0 = rf(ctx, roomID, userID, messageID, message)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*domain.Message)
@@ -53,8 +53,8 @@ func (_m *MessageUseCase) EditMessage(ctx context.Context, roomID string, userID
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(context.Context, string, string, time.Time, string) error); ok {
-		r1 = rf(ctx, roomID, userID, timeStamp, message)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string, string) error); ok {
+		r1 = rf(ctx, roomID, userID, messageID, message)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -62,8 +62,77 @@ func (_m *MessageUseCase) EditMessage(ctx context.Context, roomID string, userID
 	return r0, r1
 }
 
-// GetMessages provides a mock function with given fields: ctx, roomID, timeStamp, limit
-func (_m *MessageUseCase) GetMessages(ctx context.Context, roomID string, timeStamp time.Time, limit int) ([]domain.Message, error) {
+// GetHistory provides a mock function with given fields: ctx, roomID, userID, query
+func (_m *MessageUseCase) GetHistory(ctx context.Context, roomID string, userID string, query domain.HistoryQuery) (*domain.MessagePage, error) {
+	ret := _m.Called(ctx, roomID, userID, query)
+
+	var r0 *domain.MessagePage
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, domain.HistoryQuery) *domain.MessagePage); ok {
+		r0 = rf(ctx, roomID, userID, query)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*domain.MessagePage)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, domain.HistoryQuery) error); ok {
+		r1 = rf(ctx, roomID, userID, query)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetMessages provides a mock function with given fields: ctx, roomID, timeStamp, limit, filter
+func (_m *MessageUseCase) GetMessages(ctx context.Context, roomID string, timeStamp time.Time, limit int, filter domain.MessageFilter) ([]domain.Message, error) {
+	ret := _m.Called(ctx, roomID, timeStamp, limit, filter)
+
+	var r0 []domain.Message
+	if rf, ok := ret.Get(0).(func(context.Context, string, time.Time, int, domain.MessageFilter) []domain.Message); ok {
+		r0 = rf(ctx, roomID, timeStamp, limit, filter)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.Message)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, time.Time, int, domain.MessageFilter) error); ok {
+		r1 = rf(ctx, roomID, timeStamp, limit, filter)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetMessagesAfter provides a mock function with given fields: ctx, roomID, messageID, limit
+func (_m *MessageUseCase) GetMessagesAfter(ctx context.Context, roomID string, messageID string, limit int) ([]domain.Message, error) {
+	ret := _m.Called(ctx, roomID, messageID, limit)
+
+	var r0 []domain.Message
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, int) []domain.Message); ok {
+		r0 = rf(ctx, roomID, messageID, limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.Message)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, int) error); ok {
+		r1 = rf(ctx, roomID, messageID, limit)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetMessagesSince provides a mock function with given fields: ctx, roomID, timeStamp, limit
+func (_m *MessageUseCase) GetMessagesSince(ctx context.Context, roomID string, timeStamp time.Time, limit int) ([]domain.Message, error) {
 	ret := _m.Called(ctx, roomID, timeStamp, limit)
 
 	var r0 []domain.Message
@@ -85,6 +154,52 @@ func (_m *MessageUseCase) GetMessages(ctx context.Context, roomID string, timeSt
 	return r0, r1
 }
 
+// GetReadPositions provides a mock function with given fields: ctx, roomID, userID
+func (_m *MessageUseCase) GetReadPositions(ctx context.Context, roomID string, userID string) ([]domain.ReadPosition, error) {
+	ret := _m.Called(ctx, roomID, userID)
+
+	var r0 []domain.ReadPosition
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) []domain.ReadPosition); ok {
+		r0 = rf(ctx, roomID, userID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.ReadPosition)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, roomID, userID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetRevisions provides a mock function with given fields: ctx, roomID, userID, messageID
+func (_m *MessageUseCase) GetRevisions(ctx context.Context, roomID string, userID string, messageID string) ([]domain.MessageRevision, error) {
+	ret := _m.Called(ctx, roomID, userID, messageID)
+
+	var r0 []domain.MessageRevision
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) []domain.MessageRevision); ok {
+		r0 = rf(ctx, roomID, userID, messageID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]domain.MessageRevision)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string) error); ok {
+		r1 = rf(ctx, roomID, userID, messageID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // IsAuthorized provides a mock function with given fields: ctx, userID, roomID
 func (_m *MessageUseCase) IsAuthorized(ctx context.Context, userID string, roomID string) bool {
 	ret := _m.Called(ctx, userID, roomID)
@@ -113,6 +228,29 @@ func (_m *MessageUseCase) JoinRequest(ctx context.Context, roomID string, userID
 	return r0
 }
 
+// MarkRead provides a mock function with given fields: ctx, roomID, userID, timeStamp
+func (_m *MessageUseCase) MarkRead(ctx context.Context, roomID string, userID string, timeStamp time.Time) (*domain.ReadPosition, error) {
+	ret := _m.Called(ctx, roomID, userID, timeStamp)
+
+	var r0 *domain.ReadPosition
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, time.Time) *domain.ReadPosition); ok {
+		r0 = rf(ctx, roomID, userID, timeStamp)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*domain.ReadPosition)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, time.Time) error); ok {
+		r1 = rf(ctx, roomID, userID, timeStamp)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // SaveMessage provides a mock function with given fields: ctx, message
 func (_m *MessageUseCase) SaveMessage(ctx context.Context, message *domain.Message) error {
 	ret := _m.Called(ctx, message)
@@ -127,6 +265,59 @@ func (_m *MessageUseCase) SaveMessage(ctx context.Context, message *domain.Messa
 	return r0
 }
 
+// SearchMessages provides a mock function with given fields: ctx, userID, query
+func (_m *MessageUseCase) SearchMessages(ctx context.Context, userID string, query domain.SearchQuery) (*domain.SearchResult, error) {
+	ret := _m.Called(ctx, userID, query)
+
+	var r0 *domain.SearchResult
+	if rf, ok := ret.Get(0).(func(context.Context, string, domain.SearchQuery) *domain.SearchResult); ok {
+		r0 = rf(ctx, userID, query)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*domain.SearchResult)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, domain.SearchQuery) error); ok {
+		r1 = rf(ctx, userID, query)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SendMessage provides a mock function with given fields: ctx, message, idempotencyKey
+func (_m *MessageUseCase) SendMessage(ctx context.Context, message *domain.Message, idempotencyKey string) (*domain.Message, bool, error) {
+	ret := _m.Called(ctx, message, idempotencyKey)
+
+	var r0 *domain.Message
+	if rf, ok := ret.Get(0).(func(context.Context, *domain.Message, string) *domain.Message); ok {
+		r0 = rf(ctx, message, idempotencyKey)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*domain.Message)
+		}
+	}
+
+	var r1 bool
+	if rf, ok := ret.Get(1).(func(context.Context, *domain.Message, string) bool); ok {
+		r1 = rf(ctx, message, idempotencyKey)
+	} else {
+		r1 = ret.Get(1).(bool)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, *domain.Message, string) error); ok {
+		r2 = rf(ctx, message, idempotencyKey)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
 // SendRejection provides a mock function with given fields: ctx, roomID, userID, loggedID
 func (_m *MessageUseCase) SendRejection(ctx context.Context, roomID string, userID string, loggedID string) error {
 	ret := _m.Called(ctx, roomID, userID, loggedID)
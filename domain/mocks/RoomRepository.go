@@ -7,6 +7,8 @@ import (
 	context "context"
 
 	mock "github.com/stretchr/testify/mock"
+
+	time "time"
 )
 
 // RoomRepository is an autogenerated mock type for the RoomRepository type
@@ -56,6 +58,34 @@ func (_m *RoomRepository) AddRoomForParticipants(ctx context.Context, roomID str
 	return r0
 }
 
+// AddUnread provides a mock function with given fields: ctx, message, userIDs
+func (_m *RoomRepository) AddUnread(ctx context.Context, message *domain.Message, userIDs []string) error {
+	ret := _m.Called(ctx, message, userIDs)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *domain.Message, []string) error); ok {
+		r0 = rf(ctx, message, userIDs)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ClearUnread provides a mock function with given fields: ctx, roomID, userID, timeStamp
+func (_m *RoomRepository) ClearUnread(ctx context.Context, roomID string, userID string, timeStamp time.Time) error {
+	ret := _m.Called(ctx, roomID, userID, timeStamp)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, time.Time) error); ok {
+		r0 = rf(ctx, roomID, userID, timeStamp)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // DeleteRoom provides a mock function with given fields: ctx, roomID
 func (_m *RoomRepository) DeleteRoom(ctx context.Context, roomID string) error {
 	ret := _m.Called(ctx, roomID)
@@ -93,6 +123,29 @@ func (_m *RoomRepository) GetChatRoomsByClass(ctx context.Context, className str
 	return r0, r1
 }
 
+// GetLastMessage provides a mock function with given fields: ctx, roomID
+func (_m *RoomRepository) GetLastMessage(ctx context.Context, roomID string) (*domain.Message, error) {
+	ret := _m.Called(ctx, roomID)
+
+	var r0 *domain.Message
+	if rf, ok := ret.Get(0).(func(context.Context, string) *domain.Message); ok {
+		r0 = rf(ctx, roomID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*domain.Message)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, roomID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetRoom provides a mock function with given fields: ctx, roomID
 func (_m *RoomRepository) GetRoom(ctx context.Context, roomID string) (*domain.ChatRoom, error) {
 	ret := _m.Called(ctx, roomID)
@@ -139,6 +192,27 @@ func (_m *RoomRepository) GetRoomsFor(ctx context.Context, userID string) (*doma
 	return r0, r1
 }
 
+// GetUnreadCount provides a mock function with given fields: ctx, roomID, userID
+func (_m *RoomRepository) GetUnreadCount(ctx context.Context, roomID string, userID string) (int64, error) {
+	ret := _m.Called(ctx, roomID, userID)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) int64); ok {
+		r0 = rf(ctx, roomID, userID)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, roomID, userID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // RemoveParticipantFromRoom provides a mock function with given fields: ctx, userID, roomID
 func (_m *RoomRepository) RemoveParticipantFromRoom(ctx context.Context, userID string, roomID string) error {
 	ret := _m.Called(ctx, userID, roomID)
@@ -209,6 +283,34 @@ func (_m *RoomRepository) RemoveRoomForParticipantsAndDeleteRoom(ctx context.Con
 	return r0
 }
 
+// RemoveUnread provides a mock function with given fields: ctx, message, userIDs
+func (_m *RoomRepository) RemoveUnread(ctx context.Context, message *domain.Message, userIDs []string) error {
+	ret := _m.Called(ctx, message, userIDs)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *domain.Message, []string) error); ok {
+		r0 = rf(ctx, message, userIDs)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SaveLastMessage provides a mock function with given fields: ctx, message
+func (_m *RoomRepository) SaveLastMessage(ctx context.Context, message *domain.Message) error {
+	ret := _m.Called(ctx, message)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *domain.Message) error); ok {
+		r0 = rf(ctx, message)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // SaveRoom provides a mock function with given fields: ctx, room
 func (_m *RoomRepository) SaveRoom(ctx context.Context, room *domain.ChatRoom) error {
 	ret := _m.Called(ctx, room)
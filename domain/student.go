@@ -28,4 +28,5 @@ type StudentUseCase interface {
 	ListenStudentCreation(channel *amqp.Channel)
 	ListenStudentEdit(channel *amqp.Channel)
 	ListenStudentDelete(channel *amqp.Channel)
+	StopListening(channel *amqp.Channel) error
 }
@@ -1 +1,12 @@
 package domain
+
+// SubscriptionNotifier lets the room use case reach the live subscriptions to a room, i.e. the open websockets, when
+// the members of the room change
+type SubscriptionNotifier interface {
+	// MemberAdded tells the room about the new member
+	MemberAdded(roomID string, userID string)
+	// MemberRemoved closes the subscriptions of the student to the room and tells the rest of the room
+	MemberRemoved(roomID string, userID string)
+	// RoomDeleted closes every subscription to the room and tells its members
+	RoomDeleted(roomID string, members []string)
+}
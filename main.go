@@ -3,6 +3,7 @@ package main
 import (
 	"chat/app"
 	"github.com/joho/godotenv"
+	"os"
 )
 
 func main() {
@@ -10,5 +11,10 @@ func main() {
 	//load .env file from given path
 	godotenv.Load(".env")
 
+	// go run . migrate <migration> runs a migration instead of the server
+	if len(os.Args) == 3 && os.Args[1] == "migrate" {
+		app.Migrate(os.Args[2])
+		return
+	}
 	app.Start()
 }
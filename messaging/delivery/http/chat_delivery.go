@@ -2,19 +2,21 @@ package http
 
 import (
 	"chat/domain"
+	"chat/utils/auth"
 	"chat/utils/errors"
 	"chat/utils/httputils"
+	"chat/utils/ratelimit"
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
 	"github.com/gorilla/websocket"
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -27,6 +29,29 @@ var upgrader = websocket.Upgrader{
 type connection struct {
 	ws   *websocket.Conn
 	send chan Event
+	// closeCode and closeReason are set by the hub before it closes send, when it has something to tell the client
+	closeCode   int
+	closeReason string
+	// multiplexed connections are shared by subscriptions to several rooms, see ServeUserWs. Unregistering one of
+	// them doesn't close the connection, so send is never closed and end closes closed instead
+	multiplexed bool
+	closed      chan struct{}
+	ending      sync.Once
+}
+
+// end records why the hub closes the connection. A multiplexed connection is closed right away, any other is closed
+// when its subscription is unregistered
+func (c *connection) end(code int, reason string) {
+	if !c.multiplexed {
+		c.closeCode = code
+		c.closeReason = reason
+		return
+	}
+	c.ending.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.closed)
+	})
 }
 
 type subscription struct {
@@ -38,6 +63,14 @@ type subscription struct {
 type Event struct {
 	MessageType MessageType `json:"message_type"`
 	Message     domain.Message
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// Typing is only meaningful for Typing events, where false means the student stopped typing
+	Typing bool `json:"typing,omitempty"`
+	// RoomID tags the events written to a multiplexed connection with the room they are about
+	RoomID string `json:"room_id,omitempty"`
+	// origin is the connection the event came from, if any. It never leaves the instance
+	origin *connection
 }
 
 type MessageType int
@@ -46,11 +79,66 @@ const (
 	Send MessageType = iota
 	Edit
 	Delete
+	Ack
+	Error
+	Typing
+	Read
+	Joined
+	Left
+	MemberAdded
+	MemberRemoved
+	RoomDeleted
+	Subscribed
+	Unsubscribed
+	ReplayIncomplete
+)
+
+// InboundFrame is what clients write to the websocket. Type decides how the payload is read, and ClientMsgID is echoed
+// back in the ack or error frame so that the client can match the answer to what it sent. On a multiplexed
+// connection, RoomID says which room the frame is for
+type InboundFrame struct {
+	Type        string          `json:"type"`
+	ClientMsgID string          `json:"client_msg_id"`
+	RoomID      string          `json:"room_id,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// SendPayload is the payload of a send frame
+type SendPayload struct {
+	MessageBody string `json:"message_body"`
+}
+
+// TypingPayload is the payload of a typing frame
+type TypingPayload struct {
+	Typing bool `json:"typing"`
+}
+
+// ReadPayload is the payload of a read frame, and the body of a mark read request
+type ReadPayload struct {
+	LastRead time.Time `json:"last_read"`
+}
+
+const (
+	FrameSend   = "send"
+	FrameTyping = "typing"
+	FrameRead   = "read"
+	// FrameSubscribe and FrameUnsubscribe are only understood by multiplexed connections
+	FrameSubscribe   = "subscribe"
+	FrameUnsubscribe = "unsubscribe"
 )
 
+// reply is an event meant only for the connection of the subscription, rather than the whole room
+type reply struct {
+	sub   subscription
+	event Event
+}
+
 const missingIdError = "Must provide room id"
 const invalidRequestBody = "invalid request body"
 
+// maxIdempotencyKeyLength keeps the keys clients pick to a reasonable size, a uuid fits easily
+const maxIdempotencyKeyLength = 255
+
 func NewSendEvent(message domain.Message) Event {
 	return Event{
 		MessageType: Send,
@@ -72,48 +160,191 @@ func NewDeleteEvent(message domain.Message) Event {
 	}
 }
 
-// hub is the heart of the chat app. This is what is used to hold "rooms", register and unregister when connecting and
-// disconnecting, and broadcast. Whenever a message is sent to broadcast channel, it is delivered to all the connections
-// in room
-type hub struct {
-	rooms      map[string]map[subscription]bool
-	broadcast  chan Event
-	Register   chan subscription
-	unregister chan subscription
+// NewTypingEvent tells the room that the student started or stopped typing. It is never persisted
+func NewTypingEvent(roomID string, userID string, typing bool) Event {
+	return Event{
+		MessageType: Typing,
+		Message:     domain.Message{RoomID: roomID, FromStudentID: userID},
+		Typing:      typing,
+	}
 }
 
-var (
-	singleton hub
-	once      sync.Once
-	mainHub   = NewHub()
-)
+// NewReadEvent tells the room how far the student has read. The message carries the student as sender and the read
+// position as timestamp
+func NewReadEvent(position domain.ReadPosition) Event {
+	return Event{
+		MessageType: Read,
+		Message:     domain.Message{RoomID: position.RoomID, FromStudentID: position.StudentID, SentTimestamp: position.LastRead},
+	}
+}
 
-func NewHub() hub {
-	once.Do(func() {
-		singleton = hub{
-			broadcast:  make(chan Event),
-			Register:   make(chan subscription),
-			unregister: make(chan subscription),
-			rooms:      make(map[string]map[subscription]bool),
-		}
-	})
+// NewJoinedEvent tells the room that the student came online, i.e. opened their first socket to the room
+func NewJoinedEvent(roomID string, userID string) Event {
+	return Event{
+		MessageType: Joined,
+		Message:     domain.Message{RoomID: roomID, FromStudentID: userID},
+	}
+}
+
+// NewLeftEvent tells the room that the student went offline, i.e. closed their last socket to the room
+func NewLeftEvent(roomID string, userID string) Event {
+	return Event{
+		MessageType: Left,
+		Message:     domain.Message{RoomID: roomID, FromStudentID: userID},
+	}
+}
+
+// NewMemberAddedEvent tells the room that the student was added to it
+func NewMemberAddedEvent(roomID string, userID string) Event {
+	return Event{
+		MessageType: MemberAdded,
+		Message:     domain.Message{RoomID: roomID, FromStudentID: userID},
+	}
+}
+
+// NewMemberRemovedEvent tells the room that the student was removed from it, or left it
+func NewMemberRemovedEvent(roomID string, userID string) Event {
+	return Event{
+		MessageType: MemberRemoved,
+		Message:     domain.Message{RoomID: roomID, FromStudentID: userID},
+	}
+}
 
-	return singleton
+// NewRoomDeletedEvent tells the room that it was deleted
+func NewRoomDeletedEvent(roomID string) Event {
+	return Event{
+		MessageType: RoomDeleted,
+		Message:     domain.Message{RoomID: roomID},
+	}
+}
+
+// from marks the event as coming from the connection, so that it isn't echoed back to it
+func (e Event) from(c *connection) Event {
+	e.origin = c
+	return e
+}
+
+// aboutSender tells if the event is only news to the students other than the one it is about
+func (e Event) aboutSender() bool {
+	return e.MessageType == Typing || e.MessageType == Joined || e.MessageType == Left
+}
+
+// NewAckEvent confirms to the sender that the message was persisted. The message carries its key
+func NewAckEvent(clientMsgID string, message domain.Message) Event {
+	return Event{
+		MessageType: Ack,
+		Message:     message,
+		ClientMsgID: clientMsgID,
+	}
+}
+
+// NewErrorEvent tells the sender that the frame with the given id could not be handled
+func NewErrorEvent(clientMsgID string, err string) Event {
+	return Event{
+		MessageType: Error,
+		ClientMsgID: clientMsgID,
+		Error:       err,
+	}
 }
 
 const (
-	maxMessageSize int64 = 1024
-	pongWait             = time.Minute * 5
-	pingPeriod           = time.Minute * 4
-	writeWait            = time.Minute
+	maxMessageSize    int64 = 1024
+	pongWait                = time.Minute * 5
+	pingPeriod              = time.Minute * 4
+	writeWait               = time.Minute
+	relayBufferSize         = 256
+	maxReplayMessages       = 500
+	replayPageSize          = 100
+	typingInterval          = time.Second * 3
+	typingMinInterval       = time.Millisecond * 500
 )
 
-func (s *subscription) readPump(u domain.MessageUseCase) {
+// typingThrottle keeps a chatty client from flooding the room with typing events. Two typing events of a connection
+// are at least typingMinInterval apart, and the same state is only repeated once per typingInterval. The states a
+// client goes through in between are held back, and only the one it ends up in is broadcast once the interval is over
+type typingThrottle struct {
+	mu      sync.Mutex
+	typing  bool
+	last    time.Time
+	pending bool
+	held    *time.Timer
+	stopped bool
+}
+
+// offer broadcasts the typing state now, later, or not at all
+func (t *typingThrottle) offer(typing bool, now time.Time, broadcast func(typing bool)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	if t.held != nil {
+		t.pending = typing
+		return
+	}
+	if typing == t.typing && now.Sub(t.last) < typingInterval {
+		return
+	}
+	if wait := typingMinInterval - now.Sub(t.last); !t.last.IsZero() && wait > 0 {
+		t.pending = typing
+		t.held = time.AfterFunc(wait, func() { t.release(broadcast) })
+		return
+	}
+	t.typing = typing
+	t.last = now
+	broadcast(typing)
+}
+
+// release broadcasts the state held back, unless the client went back to the one the room already knows
+func (t *typingThrottle) release(broadcast func(typing bool)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.held = nil
+	if t.stopped || t.pending == t.typing {
+		return
+	}
+	t.typing = t.pending
+	t.last = time.Now()
+	broadcast(t.typing)
+}
+
+// stop drops the state held back, once the connection left the room
+func (t *typingThrottle) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	if t.held != nil {
+		t.held.Stop()
+		t.held = nil
+	}
+}
+
+func (s *subscription) readPump(u domain.MessageUseCase, limiter *ratelimit.Limiter) {
 	c := s.conn
+	var throttle typingThrottle
 	defer func() {
-		mainHub.unregister <- *s
+		throttle.stop()
+		mainHub.unregister(*s)
+		mainHub.pumps.Done()
 		c.ws.Close()
 	}()
+	c.readFrames(s.reply, func(frame InboundFrame) {
+		switch frame.Type {
+		case FrameSend:
+			s.handleSend(u, limiter, frame)
+		case FrameTyping:
+			s.handleTyping(&throttle, frame)
+		case FrameRead:
+			s.handleRead(u, frame)
+		default:
+			s.reply(NewErrorEvent(frame.ClientMsgID, fmt.Sprintf("unknown frame type %q", frame.Type)))
+		}
+	})
+}
+
+// readFrames hands every frame the client writes to handle, until the websocket is closed. A frame that isn't json
+// gets an error through reply
+func (c *connection) readFrames(reply func(Event), handle func(InboundFrame)) {
 	c.ws.SetReadLimit(maxMessageSize)
 	_ = c.ws.SetReadDeadline(time.Now().Add(pongWait))
 	c.ws.SetPongHandler(func(string) error { _ = c.ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
@@ -123,37 +354,124 @@ func (s *subscription) readPump(u domain.MessageUseCase) {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
 				log.Printf("error: %v", err)
 			}
-			break
+			return
 		}
-		m := domain.Message{RoomID: s.roomID, SentTimestamp: time.Now().UTC(), FromStudentID: s.userID, MessageBody: string(msg)}
-		err = u.SaveMessage(context.Background(), &m)
-		if err != nil {
-			log.Printf("Failed to save message with err %s", err.Error())
+		var frame InboundFrame
+		if err = json.Unmarshal(msg, &frame); err != nil {
+			reply(NewErrorEvent("", "frame must be a json object with a type, client_msg_id and payload"))
+			continue
 		}
-		mainHub.broadcast <- NewSendEvent(m)
+		handle(frame)
 	}
 }
 
-func (s *subscription) writePump() {
+// handleSend persists the message and only broadcasts it to the room once it's saved. The connection that sent it gets
+// an ack with the persisted message instead, or an error frame if it couldn't be saved. A student over their send
+// limit gets an error frame too, the connection stays open
+func (s *subscription) handleSend(u domain.MessageUseCase, limiter *ratelimit.Limiter, frame InboundFrame) {
+	if ok, retryAfter := limiter.Allow(s.userID, ratelimit.Send); !ok {
+		s.reply(NewErrorEvent(frame.ClientMsgID, fmt.Sprintf("too many messages, retry in %d seconds", ratelimit.RetryAfterSeconds(retryAfter))))
+		return
+	}
+	var payload SendPayload
+	if err := json.Unmarshal(frame.Payload, &payload); err != nil || payload.MessageBody == "" {
+		s.reply(NewErrorEvent(frame.ClientMsgID, "send payload must have a message_body"))
+		return
+	}
+
+	m := newMessage(s.roomID, s.userID, payload.MessageBody)
+	err := u.SaveMessage(context.Background(), &m)
+	if err != nil {
+		log.Printf("Failed to save message with err %s", err.Error())
+		s.reply(NewErrorEvent(frame.ClientMsgID, "message could not be saved"))
+		return
+	}
+	s.reply(NewAckEvent(frame.ClientMsgID, m))
+	mainHub.broadcast(NewSendEvent(m).from(s.conn))
+}
+
+// newMessage is the message the student sends to the room now, over the socket or over rest. Cassandra stores
+// timestamps in milliseconds, truncating here makes the sent_timestamp sent back the one read back later, e.g. as a
+// since cursor. The message id, not the timestamp, is what identifies the message
+func newMessage(roomID string, studentID string, body string) domain.Message {
+	return domain.Message{RoomID: roomID, SentTimestamp: time.Now().UTC().Truncate(time.Millisecond), FromStudentID: studentID, MessageBody: body}
+}
+
+// handleTyping fans the typing state out to the rest of the room, when the throttle lets it through
+func (s *subscription) handleTyping(throttle *typingThrottle, frame InboundFrame) {
+	var payload TypingPayload
+	if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+		s.reply(NewErrorEvent(frame.ClientMsgID, "typing payload must have a typing flag"))
+		return
+	}
+	throttle.offer(payload.Typing, time.Now(), func(typing bool) {
+		mainHub.broadcast(NewTypingEvent(s.roomID, s.userID, typing).from(s.conn))
+	})
+}
+
+// handleRead moves the student's read position forward and lets the rest of the room know
+func (s *subscription) handleRead(u domain.MessageUseCase, frame InboundFrame) {
+	var payload ReadPayload
+	if err := json.Unmarshal(frame.Payload, &payload); err != nil || payload.LastRead.IsZero() {
+		s.reply(NewErrorEvent(frame.ClientMsgID, "read payload must have a last_read timestamp"))
+		return
+	}
+
+	position, err := u.MarkRead(context.Background(), s.roomID, s.userID, payload.LastRead)
+	if err != nil {
+		log.Printf("Failed to mark messages read with err %s", err.Error())
+		s.reply(NewErrorEvent(frame.ClientMsgID, "read position could not be saved"))
+		return
+	}
+	mainHub.broadcast(NewReadEvent(*position).from(s.conn))
+}
+
+// reply goes through the hub, so that it is never sent to a connection the hub already closed
+func (s *subscription) reply(e Event) {
+	mainHub.direct(reply{sub: *s, event: e})
+}
+
+// writePump writes the events of the connection to the websocket. If replay is not nil, the live events are held back
+// until the replayed messages have been written. The live events for messages that were already replayed are skipped,
+// so the client sees every message once and in order
+func (s *subscription) writePump(replay <-chan []Event) {
 	c := s.conn
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.ws.Close()
+		mainHub.pumps.Done()
 	}()
+	replaying := replay != nil
+	var pending []Event
 	for {
 		select {
+		case replayed := <-replay:
+			for _, e := range afterReplay(replayed, pending) {
+				if err := s.writeEvent(e); err != nil {
+					return
+				}
+			}
+			replay, replaying, pending = nil, false, nil
+		case <-c.closed:
+			// the events queued before a multiplexed connection was closed are still written
+			for _, e := range drain(c.send) {
+				if err := s.writeEvent(e); err != nil {
+					return
+				}
+			}
+			c.writeClose()
+			return
 		case message, ok := <-c.send:
 			if !ok {
-				c.write(websocket.CloseMessage, []byte{})
+				c.writeClose()
 				return
 			}
-			res, err := json.Marshal(message)
-			if err != nil {
-				log.Printf("message %s couldn't be sent to %s in room %s.", message.Message, s.userID, s.roomID)
+			if replaying {
+				pending = append(pending, message)
+				continue
 			}
-			if err = c.write(websocket.TextMessage, res); err != nil {
-				log.Printf("message %s couldn't be sent to %s in room %s.", message.Message, s.userID, s.roomID)
+			if err := s.writeEvent(message); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -164,110 +482,118 @@ func (s *subscription) writePump() {
 	}
 }
 
+func (s *subscription) writeEvent(message Event) error {
+	res, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("message %s couldn't be sent to %s in room %s.", message.Message.MessageID, s.userID, s.roomID)
+		return nil
+	}
+	if err = s.conn.write(websocket.TextMessage, res); err != nil {
+		log.Printf("message %s couldn't be sent to %s in room %s.", message.Message.MessageID, s.userID, s.roomID)
+		return err
+	}
+	return nil
+}
+
 func (c *connection) write(mt int, payload []byte) error {
 	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
 	return c.ws.WriteMessage(mt, payload)
 }
 
-// ServeWs is the handleFunc for connecting to a room's websocket. A user must be authorized, i.e. already added to
-// the room before he can connect to the room. Otherwise, returns 401.
-func (h *MessageHandler) ServeWs(w http.ResponseWriter, r *http.Request, roomID string, ctx context.Context) {
-
-	tokenParam, ok := r.URL.Query()["token"]
+// writeClose sends the close frame, with the code and reason the hub left if any
+func (c *connection) writeClose() {
+	payload := []byte{}
+	if c.closeCode != 0 {
+		payload = websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+	}
+	c.write(websocket.CloseMessage, payload)
+}
 
-	if !ok || len(tokenParam[0]) < 1 {
+// loggedInUser verifies the token of the request, usually the token query parameter since browsers can't set headers
+// on a websocket. Clients that can may send it as a bearer token instead
+func (h *MessageHandler) loggedInUser(r *http.Request) (string, bool) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if token == "" {
 		log.Println("Url Param 'token' is missing")
-		return
+		return "", false
 	}
-	tokenString := r.URL.Query()["token"][0]
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("SECRET_KEY")), nil
-	})
+	userID, err := h.verifier.Verify(r.Context(), token)
 	if err != nil {
-		log.Println("NOT logged in")
+		log.Printf("NOT logged in: %s", err.Error())
+		return "", false
+	}
+	return userID, true
+}
+
+// ServeWs is the handleFunc for connecting to a room's websocket. A user must be authorized, i.e. already added to
+// the room before he can connect to the room. Otherwise, returns 401. A client reconnecting can pass the id of the
+// last message it received as since, or the time it was sent at, and the messages it missed are sent before any live
+// event. If they can't all be sent, a ReplayIncomplete event follows them.
+func (h *MessageHandler) ServeWs(w http.ResponseWriter, r *http.Request, roomID string, ctx context.Context) {
+	userID, ok := h.loggedInUser(r)
+	if !ok {
 		return
 	}
-	standardClaims := token.Claims.(*jwt.StandardClaims)
 
-	authorized := h.u.IsAuthorized(ctx, standardClaims.Issuer, roomID)
+	authorized := h.u.IsAuthorized(ctx, userID, roomID)
 	if !authorized {
 		w.WriteHeader(http.StatusUnauthorized)
 		io.WriteString(w, "Not authorized to enter the room number "+roomID)
 		return
 	}
+
+	var cursor replayCursor
+	if sinceParam := r.URL.Query().Get("since"); sinceParam != "" {
+		var ok bool
+		if cursor, ok = parseReplayCursor(sinceParam); !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "since must be the id of a message or an RFC3339 timestamp")
+			return
+		}
+	}
+
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err.Error())
 		return
 	}
-	c := &connection{send: make(chan Event), ws: ws}
-	s := subscription{c, roomID, standardClaims.Issuer}
+	c := &connection{send: make(chan Event, sendBufferSize), ws: ws}
+	s := subscription{c, roomID, userID}
 	if authorized {
-		mainHub.Register <- s
-	}
-	go s.writePump()
-	go s.readPump(h.u)
-}
-
-// StartHubListener starts the functioning of the hub with respect to registering, unregistering and broadcasting
-func (h *hub) StartHubListener() {
-	for {
-		select {
-		case s := <-h.Register:
-			h.RegisterCase(s)
-		case s := <-h.unregister:
-			h.UnregisterCase(s)
-		case m := <-h.broadcast:
-			subscriptions := h.rooms[m.Message.RoomID]
-			for s := range subscriptions {
-				if m.Message.FromStudentID == s.userID {
-					continue
-				}
-				select {
-				case s.conn.send <- m:
-				default:
-					close(s.conn.send)
-					delete(subscriptions, s)
-					if len(subscriptions) == 0 {
-						delete(h.rooms, m.Message.RoomID)
-					}
-				}
-			}
-
-		}
-	}
-}
-
-func (h *hub) RegisterCase(s subscription) {
-	connections := h.rooms[s.roomID]
-	if connections == nil {
-		connections = make(map[subscription]bool)
-		h.rooms[s.roomID] = connections
+		mainHub.Register(s)
 	}
-	h.rooms[s.roomID][s] = true
-}
 
-func (h *hub) UnregisterCase(s subscription) {
-	connections := h.rooms[s.roomID]
-	if connections != nil {
-		if _, ok := connections[s]; ok {
-			delete(connections, s)
-			close(s.conn.send)
-			if len(connections) == 0 {
-				delete(h.rooms, s.roomID)
-			}
-		}
+	// the subscription is registered before the missed messages are loaded, so anything saved in between is either
+	// in the replay or held back by writePump, and never lost
+	var replay <-chan []Event
+	if !cursor.isZero() {
+		replay = h.loadMissed(s, cursor)
 	}
+	mainHub.pumps.Add(2)
+	go s.writePump(replay)
+	go s.readPump(h.u, h.limiter)
 }
 
 // MessageHandler is the standard delivery handler for messaging service
 type MessageHandler struct {
-	u domain.MessageUseCase
+	u        domain.MessageUseCase
+	verifier auth.TokenVerifier
+	limiter  *ratelimit.Limiter
 }
 
-// NewMessageHandler instantiates and returns a new MessageHandler
-func NewMessageHandler(u domain.MessageUseCase) *MessageHandler {
-	return &MessageHandler{u: u}
+// NewMessageHandler instantiates and returns a new MessageHandler. The verifier checks the tokens of the websockets,
+// the REST endpoints are checked by the middleware
+func NewMessageHandler(u domain.MessageUseCase, verifier auth.TokenVerifier) *MessageHandler {
+	return &MessageHandler{u: u, verifier: verifier}
+}
+
+// SetRateLimiter limits the send frames of the websockets, the REST endpoints are limited by the middleware. It must
+// be called before the handler serves anything
+func (h *MessageHandler) SetRateLimiter(l *ratelimit.Limiter) {
+	h.limiter = l
 }
 
 func (h *MessageHandler) LoadMessages(c *gin.Context) {
@@ -291,7 +617,7 @@ func (h *MessageHandler) LoadMessages(c *gin.Context) {
 
 	ctx := c.Request.Context()
 
-	msgs, err := h.u.GetMessages(ctx, room, message.SentTimestamp, limit)
+	msgs, err := h.u.GetMessages(ctx, room, message.SentTimestamp, limit, domain.MessageFilter{})
 
 	if err != nil {
 		errors.SetRESTError(err, c)
@@ -301,6 +627,51 @@ func (h *MessageHandler) LoadMessages(c *gin.Context) {
 	c.JSON(http.StatusOK, msgs)
 }
 
+// PostMessage sends a message to the room without a websocket. It is saved and broadcast like a send frame, and the
+// saved message is returned with its key. A client retrying passes the same Idempotency-Key header to get the message
+// it already sent back, without it being saved or broadcast again
+func (h *MessageHandler) PostMessage(c *gin.Context) {
+	roomID := c.Param("roomID")
+	key, _ := c.Get("loggedID")
+	loggedID, _ := key.(string)
+
+	var payload SendPayload
+	err := c.ShouldBindJSON(&payload)
+	if err != nil || payload.MessageBody == "" {
+		c.JSON(http.StatusBadRequest, errors.NewBadRequestError(invalidRequestBody))
+		return
+	}
+	if int64(len(payload.MessageBody)) > maxMessageSize {
+		c.JSON(http.StatusBadRequest, errors.NewBadRequestError(fmt.Sprintf("message_body can't be longer than %d bytes", maxMessageSize)))
+		return
+	}
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		c.JSON(http.StatusBadRequest, errors.NewBadRequestError(fmt.Sprintf("Idempotency-Key can't be longer than %d characters", maxIdempotencyKeyLength)))
+		return
+	}
+
+	ctx := c.Request.Context()
+	if !h.u.IsAuthorized(ctx, loggedID, roomID) {
+		c.JSON(http.StatusUnauthorized, errors.NewUnauthorizedError("Not authorized to send messages to room "+roomID))
+		return
+	}
+
+	m := newMessage(roomID, loggedID, payload.MessageBody)
+	saved, duplicate, err := h.u.SendMessage(ctx, &m, idempotencyKey)
+	if err != nil {
+		errors.SetRESTError(err, c)
+		return
+	}
+	if duplicate {
+		c.JSON(http.StatusOK, saved)
+		return
+	}
+
+	mainHub.broadcast(NewSendEvent(*saved))
+	c.JSON(http.StatusCreated, saved)
+}
+
 func (h *MessageHandler) EditMessage(c *gin.Context) {
 	key, _ := c.Get("loggedID")
 	loggedID, _ := key.(string)
@@ -309,7 +680,7 @@ func (h *MessageHandler) EditMessage(c *gin.Context) {
 
 	var message domain.Message
 	err := c.ShouldBindJSON(&message)
-	if err != nil || message.FromStudentID == "" || message.RoomID == "" {
+	if err != nil || message.FromStudentID == "" || message.RoomID == "" || !validMessageID(message.MessageID) {
 		c.JSON(http.StatusBadRequest, errors.NewBadRequestError(invalidRequestBody))
 		return
 	}
@@ -319,37 +690,42 @@ func (h *MessageHandler) EditMessage(c *gin.Context) {
 		return
 	}
 
-	editedMessage, err := h.u.EditMessage(ctx, message.RoomID, message.FromStudentID, message.SentTimestamp, message.MessageBody)
+	editedMessage, err := h.u.EditMessage(ctx, message.RoomID, message.FromStudentID, message.MessageID, message.MessageBody)
 
 	if err != nil {
 		errors.SetRESTError(err, c)
 		return
 	}
 
-	mainHub.broadcast <- NewEditEvent(message)
+	if !editedMessage.DeletedAt.IsZero() {
+		// an empty body deletes the message
+		mainHub.broadcast(NewDeleteEvent(*editedMessage))
+		c.JSON(http.StatusAccepted, httputils.NewResponse("message deleted"))
+		return
+	}
+
+	mainHub.broadcast(NewEditEvent(*editedMessage))
 	c.JSON(http.StatusOK, editedMessage)
 }
 
 func (h *MessageHandler) DeleteMessage(c *gin.Context) {
 	roomID := c.Param("roomID")
-	timestamp := c.Param("timestamp")
-	sentTimestamp, err := time.Parse(time.RFC3339, timestamp)
-	if err != nil {
-		fmt.Println(err)
-		errors.SetRESTError(err, c)
+	messageID := c.Param("messageID")
+	if !validMessageID(messageID) {
+		c.JSON(http.StatusBadRequest, errors.NewBadRequestError("messageID must be the timeuuid of a message"))
 		return
 	}
 	key, _ := c.Get("loggedID")
 	loggedID, _ := key.(string)
 	ctx := c.Request.Context()
 
-	message, err := h.u.DeleteMessage(ctx, roomID, sentTimestamp, loggedID)
+	message, err := h.u.DeleteMessage(ctx, roomID, messageID, loggedID)
 	if err != nil {
 		errors.SetRESTError(err, c)
 		return
 	}
 
-	mainHub.broadcast <- NewDeleteEvent(*message)
+	mainHub.broadcast(NewDeleteEvent(*message))
 	c.JSON(http.StatusAccepted, httputils.NewResponse("message deleted"))
 }
 
@@ -388,3 +764,64 @@ func (h *MessageHandler) RejectJoinRequest(c *gin.Context) {
 
 	c.JSON(http.StatusOK, httputils.NewResponse("Decline Join Request Sent"))
 }
+
+// MarkRead moves the logged user's read position in the room forward and lets the rest of the room know
+func (h *MessageHandler) MarkRead(c *gin.Context) {
+	roomID := c.Param("roomID")
+	key, _ := c.Get("loggedID")
+	loggedID, _ := key.(string)
+
+	var payload ReadPayload
+	err := c.ShouldBindJSON(&payload)
+	if err != nil || payload.LastRead.IsZero() {
+		c.JSON(http.StatusBadRequest, errors.NewBadRequestError(invalidRequestBody))
+		return
+	}
+
+	ctx := c.Request.Context()
+	position, err := h.u.MarkRead(ctx, roomID, loggedID, payload.LastRead)
+	if err != nil {
+		errors.SetRESTError(err, c)
+		return
+	}
+
+	mainHub.broadcast(NewReadEvent(*position))
+	c.JSON(http.StatusOK, position)
+}
+
+// GetReadPositions returns how far each member of the room has read
+func (h *MessageHandler) GetReadPositions(c *gin.Context) {
+	roomID := c.Param("roomID")
+	key, _ := c.Get("loggedID")
+	loggedID, _ := key.(string)
+
+	ctx := c.Request.Context()
+	positions, err := h.u.GetReadPositions(ctx, roomID, loggedID)
+	if err != nil {
+		errors.SetRESTError(err, c)
+		return
+	}
+
+	c.JSON(http.StatusOK, positions)
+}
+
+// GetOnlineMembers returns the members of the room that currently have a socket open to it, on any instance
+func (h *MessageHandler) GetOnlineMembers(c *gin.Context) {
+	roomID := c.Param("roomID")
+	key, _ := c.Get("loggedID")
+	loggedID, _ := key.(string)
+
+	ctx := c.Request.Context()
+	if !h.u.IsAuthorized(ctx, loggedID, roomID) {
+		c.JSON(http.StatusUnauthorized, errors.NewUnauthorizedError("Not authorized to see who is online in room "+roomID))
+		return
+	}
+
+	c.JSON(http.StatusOK, OnlineMembers{RoomID: roomID, Online: mainHub.Online(roomID)})
+}
+
+// validMessageID tells if the id is a timeuuid, the only kind of id a message has
+func validMessageID(id string) bool {
+	u, err := gocql.ParseUUID(id)
+	return err == nil && u.Version() == 1
+}
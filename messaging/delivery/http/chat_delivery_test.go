@@ -1,22 +1,29 @@
 package http_test
 
 import (
+	"bufio"
 	"chat/app"
 	"chat/domain"
 	"chat/domain/mocks"
 	"chat/messaging/delivery/http"
+	"chat/utils/auth"
 	"chat/utils/errors"
+	"chat/utils/ratelimit"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/bxcodec/faker/v3"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/gocql/gocql"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	nethttp "net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -34,7 +41,7 @@ const errorMassage = "can't write message to socket"
 
 func TestMessageSending(t *testing.T) {
 	mockMessageUsecase := new(mocks.MessageUseCase)
-	mh := http.NewMessageHandler(mockMessageUsecase)
+	mh := http.NewMessageHandler(mockMessageUsecase, testVerifier)
 	mw := new(mocks.MiddlewareMock)
 	server := httptest.NewServer(app.Server(mh, nil, mw))
 	defer server.Close()
@@ -46,8 +53,7 @@ func TestMessageSending(t *testing.T) {
 		assert.Fail(t, "unable to get test server url")
 	}
 	addr.Scheme = "ws"
-	mainHub := http.NewHub()
-	go mainHub.StartHubListener()
+	startHub()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
 		Issuer:    "1",                               // reserved claim
 	})
@@ -78,21 +84,12 @@ func TestMessageSending(t *testing.T) {
 			assert.Fail(t, err.Error())
 		}
 
-		response, errChan := readyToReadMethod(wsDefault)
-
-		err = ws.WriteMessage(websocket.TextMessage, []byte(messageBody))
+		err = ws.WriteMessage(websocket.TextMessage, sendFrame(messageBody))
 		assert.NoError(t, err, errorMassage)
-		select {
-		case r := <-response:
-			var event http.Event
-			err = json.Unmarshal(r, &event)
-			assert.NoError(t, err, "error unmarshalling")
-			assert.Equal(t, messageBody, event.Message.MessageBody, "invalid message body")
-			assert.Equal(t, validChatRoomID, event.Message.RoomID, "invalid room id received")
-			// todo: test the id after auth connection
-		case e := <-errChan:
-			assert.Fail(t, e.Error())
-		}
+		event := nextEvent(t, wsDefault)
+		assert.Equal(t, messageBody, event.Message.MessageBody, "invalid message body")
+		assert.Equal(t, validChatRoomID, event.Message.RoomID, "invalid room id received")
+		// todo: test the id after auth connection
 	})
 
 	// test if unauthorized person can register
@@ -129,7 +126,7 @@ func TestMessageSending(t *testing.T) {
 
 		response, errChan := readyToReadMethod(wsDefault)
 
-		err = ws.WriteMessage(websocket.TextMessage, []byte(messageBody))
+		err = ws.WriteMessage(websocket.TextMessage, sendFrame(messageBody))
 		assert.NoError(t, err, errorMassage)
 		select {
 		case <-response:
@@ -156,20 +153,284 @@ func TestMessageSending(t *testing.T) {
 			assert.Fail(t, err.Error())
 		}
 
-		response, errChan := readyToReadMethod(wsDefault)
+		err = ws.WriteMessage(websocket.TextMessage, sendFrame(messageBody))
+		assert.NoError(t, err, errorMassage)
+		for {
+			response, errChan := readyToReadMethod(wsDefault)
+			var event http.Event
+			select {
+			case r := <-response:
+				_ = json.Unmarshal(r, &event)
+			case e := <-errChan:
+				assert.Error(t, e)
+				return
+			}
+			// the other subtests' sockets of the same user are also in the room, and get its events
+			if event.Message.RoomID == invalidChatRoomID {
+				assert.Fail(t, "received message in a different room. What?!")
+				return
+			}
+		}
+	})
+}
 
-		_ = wsDefault.SetReadDeadline(time.Now().Add(time.Second))
+func TestMessageAcks(t *testing.T) {
+	mockMessageUsecase := new(mocks.MessageUseCase)
+	mh := http.NewMessageHandler(mockMessageUsecase, testVerifier)
+	mw := new(mocks.MiddlewareMock)
+	server := httptest.NewServer(app.Server(mh, nil, mw))
+	defer server.Close()
+
+	addr, err := url.Parse(server.URL)
+	if err != nil {
+		assert.Fail(t, "unable to get test server url")
+	}
+	addr.Scheme = "ws"
+	startHub()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		Issuer: "1",
+	})
+	signedToken, err := token.SignedString([]byte(os.Getenv("SECRET_KEY")))
+	tokenQuery := fmt.Sprintf("?token=%s", signedToken)
+	mockMessageUsecase.
+		On("IsAuthorized", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(true)
+
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), validChatRoomID, tokenQuery), nil)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer ws.Close()
+
+	t.Run("ack carries the persisted message", func(t *testing.T) {
+		mockMessageUsecase.On("SaveMessage", mock.Anything, mock.Anything).Return(nil).Once()
+
+		err = ws.WriteMessage(websocket.TextMessage, frame(http.FrameSend, "c-1", http.SendPayload{MessageBody: messageBody}))
+		assert.NoError(t, err, errorMassage)
+
+		event := nextEvent(t, ws)
+		assert.Equal(t, http.Ack, event.MessageType)
+		assert.Equal(t, "c-1", event.ClientMsgID)
+		assert.Equal(t, messageBody, event.Message.MessageBody)
+		assert.Equal(t, validChatRoomID, event.Message.RoomID)
+		assert.False(t, event.Message.SentTimestamp.IsZero())
+	})
+
+	t.Run("error when save fails", func(t *testing.T) {
+		mockMessageUsecase.On("SaveMessage", mock.Anything, mock.Anything).Return(errors.NewInternalServerError("down")).Once()
+
+		err = ws.WriteMessage(websocket.TextMessage, frame(http.FrameSend, "c-2", http.SendPayload{MessageBody: messageBody}))
+		assert.NoError(t, err, errorMassage)
+
+		event := nextEvent(t, ws)
+		assert.Equal(t, http.Error, event.MessageType)
+		assert.Equal(t, "c-2", event.ClientMsgID)
+		assert.NotEmpty(t, event.Error)
+	})
+
+	t.Run("error on invalid frame", func(t *testing.T) {
 		err = ws.WriteMessage(websocket.TextMessage, []byte(messageBody))
 		assert.NoError(t, err, errorMassage)
-		select {
-		case <-response:
-			assert.Fail(t, "received message in a different room. What?!")
-		case e := <-errChan:
-			assert.Error(t, e)
+
+		event := nextEvent(t, ws)
+		assert.Equal(t, http.Error, event.MessageType)
+	})
+
+	t.Run("error on unknown type", func(t *testing.T) {
+		err = ws.WriteMessage(websocket.TextMessage, frame("shout", "c-3", nil))
+		assert.NoError(t, err, errorMassage)
+
+		event := nextEvent(t, ws)
+		assert.Equal(t, http.Error, event.MessageType)
+		assert.Equal(t, "c-3", event.ClientMsgID)
+	})
+	mockMessageUsecase.AssertExpectations(t)
+}
+
+func TestMessageReplay(t *testing.T) {
+	mockMessageUsecase := new(mocks.MessageUseCase)
+	mh := http.NewMessageHandler(mockMessageUsecase, testVerifier)
+	mw := new(mocks.MiddlewareMock)
+	server := httptest.NewServer(app.Server(mh, nil, mw))
+	defer server.Close()
+
+	addr, err := url.Parse(server.URL)
+	if err != nil {
+		assert.Fail(t, "unable to get test server url")
+	}
+	addr.Scheme = "ws"
+	startHub()
+	const replayRoomID = "replay"
+	mockMessageUsecase.
+		On("IsAuthorized", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(true)
+
+	t.Run("invalid since", func(t *testing.T) {
+		_, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), replayRoomID,
+			testTokenQuery("1")+"&since=yesterday"), nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("missed messages before live ones without duplicates", func(t *testing.T) {
+		var saved domain.Message
+		missed := domain.Message{MessageID: gocql.TimeUUID().String(), RoomID: replayRoomID,
+			SentTimestamp: time.Now().UTC().Add(-time.Minute).Truncate(time.Millisecond), FromStudentID: "2", MessageBody: "missed"}
+		release := make(chan time.Time)
+		mockMessageUsecase.On("SaveMessage", mock.Anything, mock.Anything).
+			Run(func(args mock.Arguments) {
+				m := args.Get(1).(*domain.Message)
+				m.MessageID = gocql.UUIDFromTime(m.SentTimestamp).String()
+				saved = *m
+			}).
+			Return(nil)
+		mockMessageUsecase.On("GetMessagesSince", mock.Anything, replayRoomID, mock.Anything, mock.AnythingOfType("int")).
+			WaitUntil(release).
+			Return(func(_ context.Context, _ string, _ time.Time, _ int) []domain.Message {
+				return []domain.Message{missed, saved}
+			}, nil).Once()
+
+		since := url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339))
+		reader, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), replayRoomID,
+			testTokenQuery("1")+"&since="+since), nil)
+		if err != nil {
+			assert.Fail(t, err.Error())
+		}
+		defer reader.Close()
+		writer, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), replayRoomID, testTokenQuery("2")), nil)
+		if err != nil {
+			assert.Fail(t, err.Error())
+		}
+		defer writer.Close()
+
+		err = writer.WriteMessage(websocket.TextMessage, sendFrame("live"))
+		assert.NoError(t, err, errorMassage)
+		ack := nextEvent(t, writer)
+		assert.Equal(t, http.Ack, ack.MessageType)
+		time.Sleep(100 * time.Millisecond)
+		release <- time.Now()
+
+		assert.Equal(t, "missed", nextEvent(t, reader).Message.MessageBody)
+		assert.Equal(t, "live", nextEvent(t, reader).Message.MessageBody)
+
+		err = writer.WriteMessage(websocket.TextMessage, sendFrame("after"))
+		assert.NoError(t, err, errorMassage)
+		assert.Equal(t, "after", nextEvent(t, reader).Message.MessageBody)
+	})
+	mockMessageUsecase.AssertExpectations(t)
+}
+
+func TestTypingEvents(t *testing.T) {
+	mockMessageUsecase := new(mocks.MessageUseCase)
+	mh := http.NewMessageHandler(mockMessageUsecase, testVerifier)
+	mw := new(mocks.MiddlewareMock)
+	server := httptest.NewServer(app.Server(mh, nil, mw))
+	defer server.Close()
+
+	addr, err := url.Parse(server.URL)
+	if err != nil {
+		assert.Fail(t, "unable to get test server url")
+	}
+	addr.Scheme = "ws"
+	startHub()
+	const typingRoomID = "typing"
+	mockMessageUsecase.
+		On("IsAuthorized", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(true)
+
+	reader, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), typingRoomID, testTokenQuery("1")), nil)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer reader.Close()
+	writer, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), typingRoomID, testTokenQuery("2")), nil)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer writer.Close()
+
+	t.Run("repeated typing frames are throttled", func(t *testing.T) {
+		for _, typing := range []bool{true, true, false} {
+			assert.NoError(t, writer.WriteMessage(websocket.TextMessage, frame(http.FrameTyping, "", http.TypingPayload{Typing: typing})))
 		}
+
+		started := nextEvent(t, reader)
+		assert.Equal(t, http.Typing, started.MessageType)
+		assert.True(t, started.Typing)
+		assert.Equal(t, "2", started.Message.FromStudentID)
+		assert.Equal(t, typingRoomID, started.Message.RoomID)
+
+		stopped := nextEvent(t, reader)
+		assert.Equal(t, http.Typing, stopped.MessageType)
+		assert.False(t, stopped.Typing)
+	})
+
+	t.Run("invalid typing payload", func(t *testing.T) {
+		assert.NoError(t, writer.WriteMessage(websocket.TextMessage, frame(http.FrameTyping, "t-1", "yes")))
+
+		event := nextEvent(t, writer)
+		assert.Equal(t, http.Error, event.MessageType)
+		assert.Equal(t, "t-1", event.ClientMsgID)
+	})
+	mockMessageUsecase.AssertNotCalled(t, "SaveMessage", mock.Anything, mock.Anything)
+}
+
+var hubStarted sync.Once
+
+// startHub starts the listener of the hub every test shares, only once since it isn't meant to have several
+func startHub() {
+	hubStarted.Do(func() {
+		go http.NewHub().StartHubListener()
 	})
 }
 
+// testVerifier accepts the tokens of testTokenQuery
+var testVerifier = auth.NewHMACVerifier([]byte(os.Getenv("SECRET_KEY")), auth.Options{})
+
+func testTokenQuery(issuer string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Issuer: issuer})
+	signedToken, _ := token.SignedString([]byte(os.Getenv("SECRET_KEY")))
+	return fmt.Sprintf("?token=%s", signedToken)
+}
+
+func frame(frameType string, clientMsgID string, payload interface{}) []byte {
+	p, _ := json.Marshal(payload)
+	f, _ := json.Marshal(http.InboundFrame{Type: frameType, ClientMsgID: clientMsgID, Payload: p})
+	return f
+}
+
+func sendFrame(body string) []byte {
+	return frame(http.FrameSend, "", http.SendPayload{MessageBody: body})
+}
+
+func readEvent(t *testing.T, response chan []byte, errChan chan error) http.Event {
+	var event http.Event
+	select {
+	case r := <-response:
+		err := json.Unmarshal(r, &event)
+		assert.NoError(t, err, "error unmarshalling")
+	case e := <-errChan:
+		assert.Fail(t, e.Error())
+	}
+	return event
+}
+
+// nextEvent returns the next event that isn't about presence, which depends on the order the sockets connected in.
+// Tests about presence use nextPresenceEvent
+func nextEvent(t *testing.T, ws *websocket.Conn) http.Event {
+	for {
+		response, errChan := readyToReadMethod(ws)
+		event := readEvent(t, response, errChan)
+		if event.MessageType != http.Joined && event.MessageType != http.Left {
+			return event
+		}
+	}
+}
+
+func nextPresenceEvent(t *testing.T, ws *websocket.Conn) http.Event {
+	response, errChan := readyToReadMethod(ws)
+	return readEvent(t, response, errChan)
+}
+
 func readyToReadMethod(wsDefault *websocket.Conn) (chan []byte, chan error) {
 	response := make(chan []byte)
 	errChan := make(chan error)
@@ -190,15 +451,14 @@ func readyToReadMethod(wsDefault *websocket.Conn) (chan []byte, chan error) {
 
 func TestLoadMessages(t *testing.T) {
 	mockUseCase := new(mocks.MessageUseCase)
-	mh := http.NewMessageHandler(mockUseCase)
+	mh := http.NewMessageHandler(mockUseCase, testVerifier)
 	mw := new(mocks.MiddlewareMock)
 	r := app.Server(mh, nil, mw)
 
 	var retrievedMessages []domain.Message
 	err := faker.FakeData(&retrievedMessages)
 	assert.NoError(t, err)
-	mainHub := http.NewHub()
-	go mainHub.StartHubListener()
+	startHub()
 	var mockMessage domain.Message
 	err = faker.FakeData(&mockMessage.SentTimestamp)
 	assert.NoError(t, err)
@@ -207,7 +467,7 @@ func TestLoadMessages(t *testing.T) {
 
 	t.Run("success", func(t *testing.T) {
 		mockUseCase.On("GetMessages", mock.Anything, mock.AnythingOfType("string"),
-			mock.Anything, mock.AnythingOfType("int")).
+			mock.Anything, mock.AnythingOfType("int"), domain.MessageFilter{}).
 			Return(retrievedMessages, nil).
 			Once()
 		getBody, err := json.Marshal(mockMessage)
@@ -223,7 +483,7 @@ func TestLoadMessages(t *testing.T) {
 
 	t.Run("no limit", func(t *testing.T) {
 		mockUseCase.On("GetMessages", mock.Anything, mock.AnythingOfType("string"),
-			mock.Anything, mock.AnythingOfType("int")).
+			mock.Anything, mock.AnythingOfType("int"), domain.MessageFilter{}).
 			Return(retrievedMessages, nil).
 			Once()
 		getBody, err := json.Marshal(mockMessage)
@@ -250,7 +510,7 @@ func TestLoadMessages(t *testing.T) {
 	t.Run(restError, func(t *testing.T) {
 		restErr := errors.NewConflictError(errorOccurredMessage)
 		mockUseCase.On("GetMessages", mock.Anything, mock.AnythingOfType("string"),
-			mock.Anything, mock.AnythingOfType("int")).
+			mock.Anything, mock.AnythingOfType("int"), domain.MessageFilter{}).
 			Return(nil, restErr).
 			Once()
 		getBody, err := json.Marshal(mockMessage)
@@ -265,24 +525,236 @@ func TestLoadMessages(t *testing.T) {
 	})
 }
 
+func TestGetHistory(t *testing.T) {
+	mockUseCase := new(mocks.MessageUseCase)
+	mh := http.NewMessageHandler(mockUseCase, testVerifier)
+	mw := new(mocks.MiddlewareMock)
+	r := app.Server(mh, nil, mw)
+	startHub()
+	older := domain.Message{MessageID: gocql.TimeUUID().String(), RoomID: validChatRoomID, MessageBody: "older"}
+	newer := domain.Message{MessageID: gocql.TimeUUID().String(), RoomID: validChatRoomID, MessageBody: "newer"}
+
+	get := func(query string) (*httptest.ResponseRecorder, http.HistoryPage) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/chat/%s/messages%s", validChatRoomID, query), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var page http.HistoryPage
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return w, page
+	}
+
+	var prev, next string
+	t.Run("latest", func(t *testing.T) {
+		mockUseCase.On("GetHistory", mock.Anything, validChatRoomID, mock.AnythingOfType("string"), domain.HistoryQuery{Limit: 2}).
+			Return(&domain.MessagePage{Messages: []domain.Message{older, newer}, HasOlder: true}, nil).
+			Once()
+
+		w, page := get("?limit=2")
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, []domain.Message{older, newer}, page.Messages)
+		assert.NotEmpty(t, page.Prev)
+		assert.NotEmpty(t, page.Next)
+		assert.NotContains(t, page.Prev, older.MessageID)
+		prev, next = page.Prev, page.Next
+		mockUseCase.AssertExpectations(t)
+	})
+
+	t.Run("cursors are message ids", func(t *testing.T) {
+		mockUseCase.On("GetHistory", mock.Anything, validChatRoomID, mock.AnythingOfType("string"), domain.HistoryQuery{Before: older.MessageID, Limit: 10}).
+			Return(&domain.MessagePage{Messages: []domain.Message{}}, nil).
+			Once()
+		mockUseCase.On("GetHistory", mock.Anything, validChatRoomID, mock.AnythingOfType("string"), domain.HistoryQuery{After: newer.MessageID, Limit: 10}).
+			Return(&domain.MessagePage{Messages: []domain.Message{}, HasOlder: true}, nil).
+			Once()
+
+		w, page := get("?before=" + prev)
+		assert.Equal(t, 200, w.Code)
+		assert.Empty(t, page.Prev)
+
+		// nothing newer yet, the client is told to ask from the same place again
+		w, page = get("?after=" + next)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, next, page.Next)
+		mockUseCase.AssertExpectations(t)
+	})
+
+	t.Run("around a message", func(t *testing.T) {
+		mockUseCase.On("GetHistory", mock.Anything, validChatRoomID, mock.AnythingOfType("string"), domain.HistoryQuery{Around: newer.MessageID, Limit: 100}).
+			Return(&domain.MessagePage{Messages: []domain.Message{older, newer}}, nil).
+			Once()
+
+		w, page := get("?limit=1000&around=" + newer.MessageID)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Len(t, page.Messages, 2)
+		assert.Empty(t, page.Prev)
+		mockUseCase.AssertExpectations(t)
+	})
+
+	t.Run("filtered", func(t *testing.T) {
+		from := time.Date(2021, time.November, 1, 0, 0, 0, 0, time.UTC)
+		to := time.Date(2021, time.December, 1, 0, 0, 0, 0, time.UTC)
+		filter := domain.MessageFilter{FromStudentID: "pam", From: from, To: to}
+		mockUseCase.On("GetHistory", mock.Anything, validChatRoomID, mock.AnythingOfType("string"), domain.HistoryQuery{Limit: 10, Filter: filter}).
+			Return(&domain.MessagePage{Messages: []domain.Message{older}}, nil).
+			Once()
+
+		w, page := get("?from_student_id=pam&from=2021-11-01T00:00:00Z&to=2021-12-01T00:00:00Z")
+
+		assert.Equal(t, 200, w.Code)
+		assert.Len(t, page.Messages, 1)
+		mockUseCase.AssertExpectations(t)
+	})
+
+	t.Run("invalid filters", func(t *testing.T) {
+		for _, query := range []string{"?from=yesterday", "?to=2021-11-01", "?from=2021-12-01T00:00:00Z&to=2021-11-01T00:00:00Z"} {
+			w, _ := get(query)
+			assert.Equal(t, 400, w.Code, query)
+		}
+		mockUseCase.AssertExpectations(t)
+	})
+
+	t.Run("invalid cursors", func(t *testing.T) {
+		for _, query := range []string{"?before=" + older.MessageID, "?after=nope", "?around=" + prev, "?before=" + prev + "&after=" + next} {
+			w, _ := get(query)
+			assert.Equal(t, 400, w.Code, query)
+		}
+		mockUseCase.AssertExpectations(t)
+	})
+
+	t.Run(restError, func(t *testing.T) {
+		restErr := errors.NewUnauthorizedError(errorOccurredMessage)
+		mockUseCase.On("GetHistory", mock.Anything, validChatRoomID, mock.AnythingOfType("string"), mock.Anything).
+			Return(nil, restErr).
+			Once()
+
+		w, _ := get("")
+
+		assert.Equal(t, restErr.Code, w.Code)
+		mockUseCase.AssertExpectations(t)
+	})
+}
+
+func TestSearchMessages(t *testing.T) {
+	mockUseCase := new(mocks.MessageUseCase)
+	mh := http.NewMessageHandler(mockUseCase, testVerifier)
+	mw := new(mocks.MiddlewareMock)
+	r := app.Server(mh, nil, mw)
+	startHub()
+	newer := domain.Message{MessageID: gocql.TimeUUID().String(), RoomID: validChatRoomID, MessageBody: "lunch?"}
+	older := domain.Message{MessageID: gocql.TimeUUID().String(), RoomID: "2", MessageBody: "Lunch!"}
+
+	get := func(path string) (*httptest.ResponseRecorder, http.SearchPage) {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var page http.SearchPage
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return w, page
+	}
+
+	var next string
+	t.Run("in every room", func(t *testing.T) {
+		mockUseCase.On("SearchMessages", mock.Anything, mock.AnythingOfType("string"), domain.SearchQuery{Text: "lunch", Limit: 2}).
+			Return(&domain.SearchResult{Hits: []domain.SearchHit{
+				{Message: newer, Snippet: "<mark>lunch</mark>?"},
+				{Message: older, Snippet: "<mark>Lunch</mark>!"},
+			}, HasMore: true}, nil).
+			Once()
+
+		w, page := get("/api/search?q=lunch&limit=2")
+
+		assert.Equal(t, 200, w.Code)
+		assert.Len(t, page.Hits, 2)
+		assert.Equal(t, newer, page.Hits[0].Message)
+		assert.Equal(t, "<mark>lunch</mark>?", page.Hits[0].Snippet)
+		assert.Equal(t, page.Hits[1].Cursor, page.Next)
+		next = page.Next
+		mockUseCase.AssertExpectations(t)
+	})
+
+	t.Run("hit cursors page the history", func(t *testing.T) {
+		mockUseCase.On("GetHistory", mock.Anything, "2", mock.AnythingOfType("string"), domain.HistoryQuery{Before: older.MessageID, Limit: 10}).
+			Return(&domain.MessagePage{Messages: []domain.Message{}}, nil).
+			Once()
+
+		w, _ := get("/api/chat/2/messages?before=" + next)
+
+		assert.Equal(t, 200, w.Code)
+		mockUseCase.AssertExpectations(t)
+	})
+
+	t.Run("in a room, after the last page", func(t *testing.T) {
+		mockUseCase.On("SearchMessages", mock.Anything, mock.AnythingOfType("string"),
+			domain.SearchQuery{Text: "lunch", RoomID: validChatRoomID, Before: older.MessageID, Limit: 50}).
+			Return(&domain.SearchResult{Hits: []domain.SearchHit{}}, nil).
+			Once()
+
+		w, page := get(fmt.Sprintf("/api/chat/%s/search?q=lunch&limit=1000&before=%s", validChatRoomID, next))
+
+		assert.Equal(t, 200, w.Code)
+		assert.Empty(t, page.Hits)
+		assert.Empty(t, page.Next)
+		mockUseCase.AssertExpectations(t)
+	})
+
+	t.Run("invalid cursor", func(t *testing.T) {
+		w, _ := get("/api/search?q=lunch&before=" + older.MessageID)
+
+		assert.Equal(t, 400, w.Code)
+		mockUseCase.AssertExpectations(t)
+	})
+
+	t.Run(restError, func(t *testing.T) {
+		restErr := errors.NewBadRequestError(errorOccurredMessage)
+		mockUseCase.On("SearchMessages", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
+			Return(nil, restErr).
+			Once()
+
+		w, _ := get("/api/search?q=a")
+
+		assert.Equal(t, restErr.Code, w.Code)
+		mockUseCase.AssertExpectations(t)
+	})
+}
+
 func TestEditMessage(t *testing.T) {
 	mockUseCase := new(mocks.MessageUseCase)
-	mh := http.NewMessageHandler(mockUseCase)
+	mh := http.NewMessageHandler(mockUseCase, testVerifier)
 	mw := new(mocks.MiddlewareMock)
 	r := app.Server(mh, nil, mw)
 
+	server := httptest.NewServer(r)
+	defer server.Close()
+	addr, err := url.Parse(server.URL)
+	if err != nil {
+		assert.Fail(t, "unable to get test server url")
+	}
+	addr.Scheme = "ws"
+
 	var editedMessage domain.Message
-	err := faker.FakeData(&editedMessage)
+	err = faker.FakeData(&editedMessage)
 	assert.NoError(t, err)
+	editedMessage.MessageID = gocql.TimeUUID().String()
+	editedMessage.DeletedAt, editedMessage.DeletedBy = time.Time{}, ""
+
+	startHub()
+	mockUseCase.On("IsAuthorized", mock.Anything, mock.AnythingOfType("string"), editedMessage.RoomID).Return(true)
+	monitor, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), editedMessage.RoomID, testTokenQuery("1")), nil)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer monitor.Close()
 
-	mainHub := http.NewHub()
-	go mainHub.StartHubListener()
 	t.Run("success", func(t *testing.T) {
 		putBody, err := json.Marshal(editedMessage)
 		assert.NoError(t, err)
+		persisted := editedMessage
+		persisted.EditedAt, persisted.EditCount = time.Now().UTC().Truncate(time.Millisecond), 2
 		mockUseCase.On("EditMessage", mock.Anything, mock.AnythingOfType("string"),
 			mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("string")).
-			Return(&editedMessage, nil).Once()
+			Return(&persisted, nil).Once()
 
 		reader := strings.NewReader(string(putBody))
 		reqFound := httptest.NewRequest("PUT", fmt.Sprintf(putChatPath,
@@ -292,6 +764,36 @@ func TestEditMessage(t *testing.T) {
 		w := httptest.NewRecorder()
 		r.ServeHTTP(w, reqFound)
 		assert.Equal(t, 200, w.Code)
+
+		// the room is told about the message as it was saved, not as it was sent
+		event := nextEvent(t, monitor)
+		assert.Equal(t, http.Edit, event.MessageType)
+		assert.Equal(t, 2, event.Message.EditCount)
+		assert.True(t, persisted.EditedAt.Equal(event.Message.EditedAt))
+		mockUseCase.AssertExpectations(t)
+	})
+
+	t.Run("empty body deletes the message", func(t *testing.T) {
+		emptied := editedMessage
+		emptied.MessageBody = ""
+		putBody, err := json.Marshal(emptied)
+		assert.NoError(t, err)
+		tombstone := emptied
+		tombstone.DeletedAt = time.Now().UTC()
+		mockUseCase.On("EditMessage", mock.Anything, editedMessage.RoomID, editedMessage.FromStudentID,
+			editedMessage.MessageID, "").
+			Return(&tombstone, nil).Once()
+
+		reqFound := httptest.NewRequest("PUT", fmt.Sprintf(putChatPath, editedMessage.RoomID), strings.NewReader(string(putBody)))
+		reqFound.Header.Set("id", editedMessage.FromStudentID)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, reqFound)
+		assert.Equal(t, 202, w.Code)
+
+		event := nextEvent(t, monitor)
+		assert.Equal(t, http.Delete, event.MessageType)
+		assert.Equal(t, editedMessage.MessageID, event.Message.MessageID)
+		assert.False(t, event.Message.DeletedAt.IsZero())
 		mockUseCase.AssertExpectations(t)
 	})
 
@@ -320,6 +822,20 @@ func TestEditMessage(t *testing.T) {
 		mockUseCase.AssertExpectations(t)
 	})
 
+	t.Run("timestamp instead of message id", func(t *testing.T) {
+		withoutID := editedMessage
+		withoutID.MessageID = ""
+		putBody, err := json.Marshal(withoutID)
+		assert.NoError(t, err)
+
+		reqFound := httptest.NewRequest("PUT", fmt.Sprintf(putChatPath, editedMessage.RoomID), strings.NewReader(string(putBody)))
+		reqFound.Header.Set("id", editedMessage.FromStudentID)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, reqFound)
+		assert.Equal(t, 400, w.Code)
+		mockUseCase.AssertExpectations(t)
+	})
+
 	t.Run(restError, func(t *testing.T) {
 		putBody, err := json.Marshal(editedMessage)
 		assert.NoError(t, err)
@@ -340,9 +856,62 @@ func TestEditMessage(t *testing.T) {
 	})
 }
 
+func TestGetRevisions(t *testing.T) {
+	mockUseCase := new(mocks.MessageUseCase)
+	mh := http.NewMessageHandler(mockUseCase, testVerifier)
+	mw := new(mocks.MiddlewareMock)
+	r := app.Server(mh, nil, mw)
+	startHub()
+	messageID := gocql.TimeUUID().String()
+	revisionsPath := "/api/chat/%s/messages/%s/revisions"
+
+	t.Run("success", func(t *testing.T) {
+		sent := time.Date(2021, time.November, 3, 14, 5, 7, 0, time.UTC)
+		revisions := []domain.MessageRevision{
+			{Revision: 0, MessageBody: "lunch at noon?", WrittenAt: sent},
+			{Revision: 1, MessageBody: "lunch at one?", WrittenAt: sent.Add(time.Minute)},
+		}
+		mockUseCase.On("GetRevisions", mock.Anything, validChatRoomID, "jim", messageID).
+			Return(revisions, nil).Once()
+
+		req := httptest.NewRequest("GET", fmt.Sprintf(revisionsPath, validChatRoomID, messageID), nil)
+		req.Header.Set("id", "jim")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		var got []domain.MessageRevision
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+		assert.Equal(t, revisions, got)
+		mockUseCase.AssertExpectations(t)
+	})
+
+	t.Run("invalid message id", func(t *testing.T) {
+		req := httptest.NewRequest("GET", fmt.Sprintf(revisionsPath, validChatRoomID, "2021-11-03T14:05:07Z"), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code)
+		mockUseCase.AssertExpectations(t)
+	})
+
+	t.Run(restError, func(t *testing.T) {
+		restErr := errors.NewUnauthorizedError(errorOccurredMessage)
+		mockUseCase.On("GetRevisions", mock.Anything, validChatRoomID, mock.AnythingOfType("string"), messageID).
+			Return(nil, restErr).Once()
+
+		req := httptest.NewRequest("GET", fmt.Sprintf(revisionsPath, validChatRoomID, messageID), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, restErr.Code, w.Code)
+		mockUseCase.AssertExpectations(t)
+	})
+}
+
 func TestDeleteMessage(t *testing.T) {
 	mockUseCase := new(mocks.MessageUseCase)
-	mh := http.NewMessageHandler(mockUseCase)
+	mh := http.NewMessageHandler(mockUseCase, testVerifier)
 	mw := new(mocks.MiddlewareMock)
 	r := app.Server(mh, nil, mw)
 
@@ -350,15 +919,14 @@ func TestDeleteMessage(t *testing.T) {
 	var deletedMessage domain.Message
 	err := faker.FakeData(&deletedMessage)
 	assert.NoError(t, err)
-	mainHub := http.NewHub()
-	go mainHub.StartHubListener()
+	deletedMessage.MessageID = gocql.TimeUUID().String()
+	startHub()
 	t.Run("success", func(t *testing.T) {
-		mockUseCase.On("DeleteMessage", mock.Anything, mock.AnythingOfType("string"),
-			mock.Anything, mock.AnythingOfType("string")).
+		mockUseCase.On("DeleteMessage", mock.Anything, deletedMessage.RoomID,
+			deletedMessage.MessageID, mock.AnythingOfType("string")).
 			Return(&deletedMessage, nil).Once()
-		fmt.Println(deletedMessage)
 		reqFound := httptest.NewRequest("DELETE", fmt.Sprintf(deleteEndpoint,
-			deletedMessage.RoomID, "2022-03-27T00:05:25.005Z"), nil)
+			deletedMessage.RoomID, deletedMessage.MessageID), nil)
 
 		reqFound.Header.Set("id", deletedMessage.FromStudentID)
 		w := httptest.NewRecorder()
@@ -373,7 +941,7 @@ func TestDeleteMessage(t *testing.T) {
 			mock.Anything, mock.AnythingOfType("string")).
 			Return(nil, restErr).Once()
 		reqFound := httptest.NewRequest("DELETE", fmt.Sprintf(deleteEndpoint,
-			deletedMessage.RoomID, "2022-03-27T00:05:25.005Z"), nil)
+			deletedMessage.RoomID, deletedMessage.MessageID), nil)
 
 		w := httptest.NewRecorder()
 		r.ServeHTTP(w, reqFound)
@@ -387,7 +955,7 @@ func TestDeleteMessage(t *testing.T) {
 			mock.Anything, mock.AnythingOfType("string")).
 			Return(nil, restErr).Once()
 		reqFound := httptest.NewRequest("DELETE", fmt.Sprintf(deleteEndpoint,
-			deletedMessage.RoomID, "2022-03-27T00:05:25.005Z"), nil)
+			deletedMessage.RoomID, deletedMessage.MessageID), nil)
 
 		reqFound.Header.Set("id", "avc")
 		w := httptest.NewRecorder()
@@ -403,7 +971,7 @@ func TestDeleteMessage(t *testing.T) {
 			Return(nil, restErr).Once()
 
 		reqFound := httptest.NewRequest("DELETE", fmt.Sprintf(deleteEndpoint,
-			deletedMessage.RoomID, "2022-03-27T00:05:25.005Z"), nil)
+			deletedMessage.RoomID, deletedMessage.MessageID), nil)
 
 		reqFound.Header.Set("id", deletedMessage.FromStudentID)
 		w := httptest.NewRecorder()
@@ -412,11 +980,21 @@ func TestDeleteMessage(t *testing.T) {
 		mockUseCase.AssertExpectations(t)
 	})
 
+	t.Run("timestamp instead of message id", func(t *testing.T) {
+		reqFound := httptest.NewRequest("DELETE", fmt.Sprintf(deleteEndpoint,
+			deletedMessage.RoomID, "2022-03-27T00:05:25.005Z"), nil)
+
+		reqFound.Header.Set("id", deletedMessage.FromStudentID)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, reqFound)
+		assert.Equal(t, 400, w.Code)
+		mockUseCase.AssertExpectations(t)
+	})
 }
 
 func TestJoinRequest(t *testing.T) {
 	mockUseCase := new(mocks.MessageUseCase)
-	mh := http.NewMessageHandler(mockUseCase)
+	mh := http.NewMessageHandler(mockUseCase, testVerifier)
 	mw := new(mocks.MiddlewareMock)
 	r := app.Server(mh, nil, mw)
 
@@ -453,7 +1031,7 @@ func TestJoinRequest(t *testing.T) {
 
 func TestRejectJoinRequest(t *testing.T) {
 	mockUseCase := new(mocks.MessageUseCase)
-	mh := http.NewMessageHandler(mockUseCase)
+	mh := http.NewMessageHandler(mockUseCase, testVerifier)
 	mw := new(mocks.MiddlewareMock)
 	r := app.Server(mh, nil, mw)
 
@@ -488,3 +1066,758 @@ func TestRejectJoinRequest(t *testing.T) {
 		mockUseCase.AssertExpectations(t)
 	})
 }
+
+func TestReadReceipts(t *testing.T) {
+	mockMessageUsecase := new(mocks.MessageUseCase)
+	mh := http.NewMessageHandler(mockMessageUsecase, testVerifier)
+	mw := new(mocks.MiddlewareMock)
+	r := app.Server(mh, nil, mw)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	addr, err := url.Parse(server.URL)
+	if err != nil {
+		assert.Fail(t, "unable to get test server url")
+	}
+	addr.Scheme = "ws"
+	startHub()
+	const readRoomID = "read"
+	readPath := fmt.Sprintf("/api/chat/%s/read", readRoomID)
+	lastRead := time.Now().UTC().Truncate(time.Millisecond)
+	position := domain.ReadPosition{RoomID: readRoomID, StudentID: "2", LastRead: lastRead}
+	mockMessageUsecase.
+		On("IsAuthorized", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(true)
+
+	monitor, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), readRoomID, testTokenQuery("1")), nil)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer monitor.Close()
+	reader, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), readRoomID, testTokenQuery("2")), nil)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer reader.Close()
+
+	t.Run("read frame", func(t *testing.T) {
+		mockMessageUsecase.On("MarkRead", mock.Anything, readRoomID, "2", mock.Anything).Return(&position, nil).Once()
+
+		err = reader.WriteMessage(websocket.TextMessage, frame(http.FrameRead, "r-1", http.ReadPayload{LastRead: lastRead}))
+		assert.NoError(t, err, errorMassage)
+
+		event := nextEvent(t, monitor)
+		assert.Equal(t, http.Read, event.MessageType)
+		assert.Equal(t, "2", event.Message.FromStudentID)
+		assert.True(t, lastRead.Equal(event.Message.SentTimestamp))
+	})
+
+	t.Run("read frame error", func(t *testing.T) {
+		mockMessageUsecase.On("MarkRead", mock.Anything, readRoomID, "2", mock.Anything).
+			Return(nil, errors.NewInternalServerError(errorOccurredMessage)).Once()
+
+		err = reader.WriteMessage(websocket.TextMessage, frame(http.FrameRead, "r-2", http.ReadPayload{LastRead: lastRead}))
+		assert.NoError(t, err, errorMassage)
+
+		event := nextEvent(t, reader)
+		assert.Equal(t, http.Error, event.MessageType)
+		assert.Equal(t, "r-2", event.ClientMsgID)
+	})
+
+	t.Run("mark read", func(t *testing.T) {
+		mockMessageUsecase.On("MarkRead", mock.Anything, readRoomID, "2", mock.Anything).Return(&position, nil).Once()
+		body, _ := json.Marshal(http.ReadPayload{LastRead: lastRead})
+		req := httptest.NewRequest("PUT", readPath, strings.NewReader(string(body)))
+		req.Header.Set("id", "2")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+
+		event := nextEvent(t, monitor)
+		assert.Equal(t, http.Read, event.MessageType)
+	})
+
+	t.Run("mark read: "+invalidDataMessage, func(t *testing.T) {
+		req := httptest.NewRequest("PUT", readPath, strings.NewReader(invalidBodyMessage))
+		req.Header.Set("id", "2")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, 400, w.Code)
+	})
+
+	t.Run("mark read: "+restError, func(t *testing.T) {
+		restErr := errors.NewUnauthorizedError(errorOccurredMessage)
+		mockMessageUsecase.On("MarkRead", mock.Anything, readRoomID, "3", mock.Anything).Return(nil, restErr).Once()
+		body, _ := json.Marshal(http.ReadPayload{LastRead: lastRead})
+		req := httptest.NewRequest("PUT", readPath, strings.NewReader(string(body)))
+		req.Header.Set("id", "3")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, restErr.Code, w.Code)
+	})
+
+	t.Run("get read positions", func(t *testing.T) {
+		mockMessageUsecase.On("GetReadPositions", mock.Anything, readRoomID, "1").
+			Return([]domain.ReadPosition{position}, nil).Once()
+		req := httptest.NewRequest("GET", readPath, nil)
+		req.Header.Set("id", "1")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+		var positions []domain.ReadPosition
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &positions))
+		assert.Len(t, positions, 1)
+	})
+
+	t.Run("get read positions: "+restError, func(t *testing.T) {
+		restErr := errors.NewUnauthorizedError(errorOccurredMessage)
+		mockMessageUsecase.On("GetReadPositions", mock.Anything, readRoomID, "3").Return(nil, restErr).Once()
+		req := httptest.NewRequest("GET", readPath, nil)
+		req.Header.Set("id", "3")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, restErr.Code, w.Code)
+	})
+	mockMessageUsecase.AssertExpectations(t)
+}
+
+func TestPresenceEvents(t *testing.T) {
+	mockMessageUsecase := new(mocks.MessageUseCase)
+	mh := http.NewMessageHandler(mockMessageUsecase, testVerifier)
+	mw := new(mocks.MiddlewareMock)
+	r := app.Server(mh, nil, mw)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	addr, err := url.Parse(server.URL)
+	if err != nil {
+		assert.Fail(t, "unable to get test server url")
+	}
+	addr.Scheme = "ws"
+	startHub()
+	const presenceRoomID = "presence"
+	onlinePath := fmt.Sprintf("/api/chat/%s/online", presenceRoomID)
+	mockMessageUsecase.
+		On("IsAuthorized", mock.Anything, "3", presenceRoomID).
+		Return(false)
+	mockMessageUsecase.
+		On("IsAuthorized", mock.Anything, mock.AnythingOfType("string"), presenceRoomID).
+		Return(true)
+
+	getOnline := func(userID string) (int, http.OnlineMembers) {
+		req := httptest.NewRequest("GET", onlinePath, nil)
+		req.Header.Set("id", userID)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var online http.OnlineMembers
+		_ = json.Unmarshal(w.Body.Bytes(), &online)
+		return w.Code, online
+	}
+
+	monitor, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), presenceRoomID, testTokenQuery("1")), nil)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer monitor.Close()
+
+	t.Run("joined and left once for two tabs", func(t *testing.T) {
+		laptop, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), presenceRoomID, testTokenQuery("2")), nil)
+		if err != nil {
+			assert.Fail(t, err.Error())
+		}
+		joined := nextPresenceEvent(t, monitor)
+		assert.Equal(t, http.Joined, joined.MessageType)
+		assert.Equal(t, "2", joined.Message.FromStudentID)
+
+		phone, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), presenceRoomID, testTokenQuery("2")), nil)
+		if err != nil {
+			assert.Fail(t, err.Error())
+		}
+		code, online := getOnline("1")
+		assert.Equal(t, 200, code)
+		assert.Equal(t, []string{"1", "2"}, online.Online)
+
+		_ = laptop.Close()
+		_ = phone.Close()
+		left := nextPresenceEvent(t, monitor)
+		assert.Equal(t, http.Left, left.MessageType)
+		assert.Equal(t, "2", left.Message.FromStudentID)
+
+		code, online = getOnline("1")
+		assert.Equal(t, 200, code)
+		assert.Equal(t, []string{"1"}, online.Online)
+	})
+
+	t.Run("online: unauthorized", func(t *testing.T) {
+		code, _ := getOnline("3")
+		assert.Equal(t, 401, code)
+	})
+}
+
+func TestMultiDeviceDelivery(t *testing.T) {
+	mockMessageUsecase := new(mocks.MessageUseCase)
+	mh := http.NewMessageHandler(mockMessageUsecase, testVerifier)
+	mw := new(mocks.MiddlewareMock)
+	server := httptest.NewServer(app.Server(mh, nil, mw))
+	defer server.Close()
+
+	addr, err := url.Parse(server.URL)
+	if err != nil {
+		assert.Fail(t, "unable to get test server url")
+	}
+	addr.Scheme = "ws"
+	startHub()
+	const devicesRoomID = "devices"
+	mockMessageUsecase.
+		On("IsAuthorized", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(true)
+	mockMessageUsecase.On("SaveMessage", mock.Anything, mock.Anything).Return(nil)
+
+	laptop, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), devicesRoomID, testTokenQuery("1")), nil)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer laptop.Close()
+	phone, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), devicesRoomID, testTokenQuery("1")), nil)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer phone.Close()
+
+	t.Run("ack on the sending device, message on the others", func(t *testing.T) {
+		err = laptop.WriteMessage(websocket.TextMessage, frame(http.FrameSend, "m-1", http.SendPayload{MessageBody: messageBody}))
+		assert.NoError(t, err, errorMassage)
+
+		ack := nextEvent(t, laptop)
+		assert.Equal(t, http.Ack, ack.MessageType)
+		assert.Equal(t, "m-1", ack.ClientMsgID)
+
+		event := nextEvent(t, phone)
+		assert.Equal(t, http.Send, event.MessageType)
+		assert.Equal(t, messageBody, event.Message.MessageBody)
+		assert.Empty(t, event.ClientMsgID)
+
+		response, errChan := readyToReadMethod(laptop)
+		select {
+		case <-response:
+			assert.Fail(t, "the sending device received its own message")
+		case e := <-errChan:
+			assert.Error(t, e)
+		}
+	})
+
+	t.Run("typing isn't echoed to the other devices", func(t *testing.T) {
+		phone2, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), devicesRoomID, testTokenQuery("1")), nil)
+		if err != nil {
+			assert.Fail(t, err.Error())
+		}
+		defer phone2.Close()
+		assert.NoError(t, phone2.WriteMessage(websocket.TextMessage, frame(http.FrameTyping, "", http.TypingPayload{Typing: true})))
+
+		response, errChan := readyToReadMethod(phone)
+		select {
+		case <-response:
+			assert.Fail(t, "the student saw themselves typing")
+		case e := <-errChan:
+			assert.Error(t, e)
+		}
+	})
+}
+
+func TestRemovedMemberIsDisconnected(t *testing.T) {
+	mockMessageUsecase := new(mocks.MessageUseCase)
+	mh := http.NewMessageHandler(mockMessageUsecase, testVerifier)
+	mw := new(mocks.MiddlewareMock)
+	server := httptest.NewServer(app.Server(mh, nil, mw))
+	defer server.Close()
+
+	addr, err := url.Parse(server.URL)
+	if err != nil {
+		assert.Fail(t, "unable to get test server url")
+	}
+	addr.Scheme = "ws"
+	startHub()
+	const removedRoomID = "removed"
+	mockMessageUsecase.
+		On("IsAuthorized", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(true)
+
+	monitor, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), removedRoomID, testTokenQuery("1")), nil)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer monitor.Close()
+	removed, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), removedRoomID, testTokenQuery("2")), nil)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer removed.Close()
+
+	http.NewHub().MemberRemoved(removedRoomID, "2")
+
+	event := nextEvent(t, monitor)
+	assert.Equal(t, http.MemberRemoved, event.MessageType)
+	assert.Equal(t, "2", event.Message.FromStudentID)
+
+	_ = removed.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = removed.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, http.CloseRemovedFromRoom), "expected a close frame, got %v", err)
+}
+
+// streamEvent is a server-sent event as read by the client
+type streamEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// nextStreamEvent reads the next event that isn't about presence, skipping the pings
+func nextStreamEvent(t *testing.T, stream *bufio.Reader) streamEvent {
+	lines := make(chan streamEvent)
+	go func() {
+		for {
+			var e streamEvent
+			for {
+				line, err := stream.ReadString('\n')
+				if err != nil {
+					close(lines)
+					return
+				}
+				line = strings.TrimSuffix(line, "\n")
+				if line == "" {
+					break
+				}
+				switch {
+				case strings.HasPrefix(line, "id: "):
+					e.id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "event: "):
+					e.event = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					e.data = strings.TrimPrefix(line, "data: ")
+				}
+			}
+			var event http.Event
+			if e.data == "" || e.event == "" && json.Unmarshal([]byte(e.data), &event) == nil &&
+				(event.MessageType == http.Joined || event.MessageType == http.Left) {
+				continue
+			}
+			lines <- e
+			return
+		}
+	}()
+	select {
+	case e, ok := <-lines:
+		if !ok {
+			assert.Fail(t, "stream ended")
+		}
+		return e
+	case <-time.After(time.Second):
+		assert.Fail(t, "expected a stream event")
+		return streamEvent{}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	mockMessageUsecase := new(mocks.MessageUseCase)
+	mh := http.NewMessageHandler(mockMessageUsecase, testVerifier)
+	mw := new(mocks.MiddlewareMock)
+	server := httptest.NewServer(app.Server(mh, nil, mw))
+	defer server.Close()
+
+	addr, err := url.Parse(server.URL)
+	if err != nil {
+		assert.Fail(t, "unable to get test server url")
+	}
+	addr.Scheme = "ws"
+	startHub()
+	const streamRoomID = "stream"
+	streamPath := fmt.Sprintf("%s/api/chat/%s/stream", server.URL, streamRoomID)
+	mockMessageUsecase.On("IsAuthorized", mock.Anything, "3", streamRoomID).Return(false)
+	mockMessageUsecase.
+		On("IsAuthorized", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(true)
+	mockMessageUsecase.On("SaveMessage", mock.Anything, mock.Anything).Return(nil)
+
+	open := func(userID string, lastEventID string) (*nethttp.Response, error) {
+		req, _ := nethttp.NewRequest("GET", streamPath, nil)
+		req.Header.Set("id", userID)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		return server.Client().Do(req)
+	}
+	// online waits for the stream of the user to be registered
+	online := func(userID string) {
+		assert.Eventually(t, func() bool {
+			req, _ := nethttp.NewRequest("GET", fmt.Sprintf("%s/api/chat/%s/online", server.URL, streamRoomID), nil)
+			req.Header.Set("id", userID)
+			res, err := server.Client().Do(req)
+			if err != nil {
+				return false
+			}
+			defer res.Body.Close()
+			var members http.OnlineMembers
+			_ = json.NewDecoder(res.Body).Decode(&members)
+			for _, member := range members.Online {
+				if member == userID {
+					return true
+				}
+			}
+			return false
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	t.Run("unauthorized", func(t *testing.T) {
+		res, err := open("3", "")
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, nethttp.StatusUnauthorized, res.StatusCode)
+	})
+
+	t.Run("invalid Last-Event-ID", func(t *testing.T) {
+		res, err := open("1", "yesterday")
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, nethttp.StatusBadRequest, res.StatusCode)
+	})
+
+	t.Run("live events", func(t *testing.T) {
+		res, err := open("1", "")
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+		online("1")
+
+		writer, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), streamRoomID, testTokenQuery("2")), nil)
+		if err != nil {
+			assert.Fail(t, err.Error())
+		}
+		defer writer.Close()
+		err = writer.WriteMessage(websocket.TextMessage, sendFrame("over sse"))
+		assert.NoError(t, err, errorMassage)
+
+		e := nextStreamEvent(t, bufio.NewReader(res.Body))
+		var event http.Event
+		assert.NoError(t, json.Unmarshal([]byte(e.data), &event))
+		assert.Equal(t, http.Send, event.MessageType)
+		assert.Equal(t, "over sse", event.Message.MessageBody)
+		assert.Equal(t, event.Message.MessageID, e.id)
+	})
+
+	t.Run("resume from Last-Event-ID", func(t *testing.T) {
+		sent := time.Now().UTC().Add(-time.Minute).Truncate(time.Millisecond)
+		// a message sent in the same millisecond as the last one seen is still replayed
+		lastSeen := gocql.UUIDFromTime(sent).String()
+		missed := domain.Message{MessageID: gocql.UUIDFromTime(sent).String(), RoomID: streamRoomID, SentTimestamp: sent,
+			FromStudentID: "2", MessageBody: "missed"}
+		mockMessageUsecase.On("GetMessagesAfter", mock.Anything, streamRoomID, lastSeen, mock.AnythingOfType("int")).
+			Return([]domain.Message{missed}, nil).Once()
+
+		res, err := open("1", lastSeen)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		e := nextStreamEvent(t, bufio.NewReader(res.Body))
+		var event http.Event
+		assert.NoError(t, json.Unmarshal([]byte(e.data), &event))
+		assert.Equal(t, "missed", event.Message.MessageBody)
+		assert.Equal(t, missed.MessageID, e.id)
+	})
+
+	t.Run("resume from a timestamp Last-Event-ID", func(t *testing.T) {
+		lastSeen := time.Now().UTC().Add(-time.Minute).Truncate(time.Millisecond)
+		missed := domain.Message{MessageID: gocql.UUIDFromTime(lastSeen.Add(time.Second)).String(), RoomID: streamRoomID,
+			SentTimestamp: lastSeen.Add(time.Second), FromStudentID: "2", MessageBody: "missed"}
+		mockMessageUsecase.On("GetMessagesSince", mock.Anything, streamRoomID, lastSeen, mock.AnythingOfType("int")).
+			Return([]domain.Message{missed}, nil).Once()
+
+		res, err := open("1", lastSeen.Format(time.RFC3339Nano))
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		e := nextStreamEvent(t, bufio.NewReader(res.Body))
+		assert.Equal(t, missed.MessageID, e.id)
+	})
+
+	t.Run("closed by the hub", func(t *testing.T) {
+		res, err := open("4", "")
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		online("4")
+
+		http.NewHub().MemberRemoved(streamRoomID, "4")
+
+		stream := bufio.NewReader(res.Body)
+		for {
+			e := nextStreamEvent(t, stream)
+			if e.event == "" {
+				continue
+			}
+			var closed http.StreamClose
+			assert.NoError(t, json.Unmarshal([]byte(e.data), &closed))
+			assert.Equal(t, "close", e.event)
+			assert.Equal(t, http.CloseRemovedFromRoom, closed.Code)
+			break
+		}
+	})
+	mockMessageUsecase.AssertExpectations(t)
+}
+
+func TestPostMessage(t *testing.T) {
+	mockMessageUsecase := new(mocks.MessageUseCase)
+	mh := http.NewMessageHandler(mockMessageUsecase, testVerifier)
+	mw := new(mocks.MiddlewareMock)
+	r := app.Server(mh, nil, mw)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	addr, err := url.Parse(server.URL)
+	if err != nil {
+		assert.Fail(t, "unable to get test server url")
+	}
+	addr.Scheme = "ws"
+	startHub()
+	const postRoomID = "post"
+	postPath := fmt.Sprintf("/api/chat/%s/messages", postRoomID)
+	mockMessageUsecase.On("IsAuthorized", mock.Anything, "3", postRoomID).Return(false)
+	mockMessageUsecase.
+		On("IsAuthorized", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(true)
+
+	monitor, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), postRoomID, testTokenQuery("1")), nil)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer monitor.Close()
+
+	post := func(userID string, idempotencyKey string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", postPath, strings.NewReader(body))
+		req.Header.Set("id", userID)
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	body := func(messageBody string) string {
+		b, _ := json.Marshal(http.SendPayload{MessageBody: messageBody})
+		return string(b)
+	}
+	saved := func(_ context.Context, m *domain.Message, _ string) *domain.Message { return m }
+
+	t.Run("success", func(t *testing.T) {
+		mockMessageUsecase.On("SendMessage", mock.Anything, mock.AnythingOfType("*domain.Message"), "first").
+			Return(saved, false, nil).Once()
+
+		w := post("2", "first", body("over rest"))
+		assert.Equal(t, 201, w.Code)
+		var message domain.Message
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &message))
+		assert.Equal(t, postRoomID, message.RoomID)
+		assert.Equal(t, "2", message.FromStudentID)
+		assert.False(t, message.SentTimestamp.IsZero())
+
+		event := nextEvent(t, monitor)
+		assert.Equal(t, http.Send, event.MessageType)
+		assert.Equal(t, "over rest", event.Message.MessageBody)
+		assert.True(t, message.SentTimestamp.Equal(event.Message.SentTimestamp))
+	})
+
+	t.Run("retry isn't broadcast again", func(t *testing.T) {
+		first := domain.Message{RoomID: postRoomID, SentTimestamp: time.Now().UTC().Add(-time.Second).Truncate(time.Millisecond),
+			FromStudentID: "2", MessageBody: "once"}
+		mockMessageUsecase.On("SendMessage", mock.Anything, mock.AnythingOfType("*domain.Message"), "retried").
+			Return(&first, true, nil).Once()
+		mockMessageUsecase.On("SendMessage", mock.Anything, mock.AnythingOfType("*domain.Message"), "").
+			Return(saved, false, nil).Once()
+
+		w := post("2", "retried", body("once"))
+		assert.Equal(t, 200, w.Code)
+		var message domain.Message
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &message))
+		assert.True(t, first.SentTimestamp.Equal(message.SentTimestamp))
+
+		w = post("2", "", body("next"))
+		assert.Equal(t, 201, w.Code)
+		assert.Equal(t, "next", nextEvent(t, monitor).Message.MessageBody)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		w := post("3", "", body("let me in"))
+		assert.Equal(t, 401, w.Code)
+	})
+
+	t.Run(invalidBodyMessage, func(t *testing.T) {
+		assert.Equal(t, 400, post("2", "", invalidBodyMessage).Code)
+		assert.Equal(t, 400, post("2", "", body("")).Code)
+	})
+
+	t.Run("message body too long", func(t *testing.T) {
+		w := post("2", "", body(strings.Repeat("b", 1025)))
+		assert.Equal(t, 400, w.Code)
+	})
+
+	t.Run("idempotency key too long", func(t *testing.T) {
+		w := post("2", strings.Repeat("k", 256), body("too long"))
+		assert.Equal(t, 400, w.Code)
+	})
+
+	t.Run(restError, func(t *testing.T) {
+		mockMessageUsecase.On("SendMessage", mock.Anything, mock.AnythingOfType("*domain.Message"), "busy").
+			Return(nil, false, errors.NewConflictError(errorOccurredMessage)).Once()
+
+		w := post("2", "busy", body("busy"))
+		assert.Equal(t, 409, w.Code)
+	})
+	mockMessageUsecase.AssertExpectations(t)
+}
+
+func TestMultiplexedSocket(t *testing.T) {
+	mockMessageUsecase := new(mocks.MessageUseCase)
+	mh := http.NewMessageHandler(mockMessageUsecase, testVerifier)
+	mw := new(mocks.MiddlewareMock)
+	server := httptest.NewServer(app.Server(mh, nil, mw))
+	defer server.Close()
+
+	addr, err := url.Parse(server.URL)
+	if err != nil {
+		assert.Fail(t, "unable to get test server url")
+	}
+	addr.Scheme = "ws"
+	startHub()
+	const firstRoomID, secondRoomID, forbiddenRoomID = "mux-1", "mux-2", "mux-3"
+	mockMessageUsecase.On("IsAuthorized", mock.Anything, mock.AnythingOfType("string"), forbiddenRoomID).Return(false)
+	mockMessageUsecase.
+		On("IsAuthorized", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(true)
+	mockMessageUsecase.On("SaveMessage", mock.Anything, mock.Anything).Return(nil)
+
+	userSocket, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s/chat%s", addr.String(), testTokenQuery("1")), nil)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer userSocket.Close()
+	subscribe := func(roomID string, clientMsgID string) {
+		f, _ := json.Marshal(http.InboundFrame{Type: http.FrameSubscribe, ClientMsgID: clientMsgID, RoomID: roomID})
+		assert.NoError(t, userSocket.WriteMessage(websocket.TextMessage, f), errorMassage)
+	}
+	roomFrame := func(frameType string, roomID string, clientMsgID string, payload interface{}) []byte {
+		p, _ := json.Marshal(payload)
+		f, _ := json.Marshal(http.InboundFrame{Type: frameType, ClientMsgID: clientMsgID, RoomID: roomID, Payload: p})
+		return f
+	}
+
+	t.Run("subscribe", func(t *testing.T) {
+		subscribe(firstRoomID, "s-1")
+		event := nextEvent(t, userSocket)
+		assert.Equal(t, http.Subscribed, event.MessageType)
+		assert.Equal(t, firstRoomID, event.RoomID)
+		assert.Equal(t, "s-1", event.ClientMsgID)
+
+		subscribe(secondRoomID, "s-2")
+		assert.Equal(t, http.Subscribed, nextEvent(t, userSocket).MessageType)
+	})
+
+	t.Run("subscribe unauthorized", func(t *testing.T) {
+		subscribe(forbiddenRoomID, "s-3")
+		event := nextEvent(t, userSocket)
+		assert.Equal(t, http.Error, event.MessageType)
+		assert.Equal(t, "s-3", event.ClientMsgID)
+	})
+
+	t.Run("events of every room are tagged", func(t *testing.T) {
+		writer, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), secondRoomID, testTokenQuery("2")), nil)
+		if err != nil {
+			assert.Fail(t, err.Error())
+		}
+		defer writer.Close()
+
+		err = writer.WriteMessage(websocket.TextMessage, sendFrame("to the second room"))
+		assert.NoError(t, err, errorMassage)
+		assert.Equal(t, http.Ack, nextEvent(t, writer).MessageType)
+		event := nextEvent(t, userSocket)
+		assert.Equal(t, http.Send, event.MessageType)
+		assert.Equal(t, secondRoomID, event.RoomID)
+		assert.Equal(t, "to the second room", event.Message.MessageBody)
+
+		err = userSocket.WriteMessage(websocket.TextMessage, roomFrame(http.FrameSend, secondRoomID, "m-1", http.SendPayload{MessageBody: "answer"}))
+		assert.NoError(t, err, errorMassage)
+		ack := nextEvent(t, userSocket)
+		assert.Equal(t, http.Ack, ack.MessageType)
+		assert.Equal(t, secondRoomID, ack.RoomID)
+		assert.Equal(t, "answer", nextEvent(t, writer).Message.MessageBody)
+	})
+
+	t.Run("frame for a room it isn't subscribed to", func(t *testing.T) {
+		err = userSocket.WriteMessage(websocket.TextMessage, roomFrame(http.FrameSend, forbiddenRoomID, "m-2", http.SendPayload{MessageBody: "sneaky"}))
+		assert.NoError(t, err, errorMassage)
+		event := nextEvent(t, userSocket)
+		assert.Equal(t, http.Error, event.MessageType)
+		assert.Equal(t, "m-2", event.ClientMsgID)
+	})
+
+	t.Run("added to a room", func(t *testing.T) {
+		http.NewHub().MemberAdded("mux-4", "1")
+		event := nextEvent(t, userSocket)
+		assert.Equal(t, http.MemberAdded, event.MessageType)
+		assert.Equal(t, "mux-4", event.RoomID)
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		err = userSocket.WriteMessage(websocket.TextMessage, roomFrame(http.FrameUnsubscribe, firstRoomID, "u-1", nil))
+		assert.NoError(t, err, errorMassage)
+		event := nextEvent(t, userSocket)
+		assert.Equal(t, http.Unsubscribed, event.MessageType)
+		assert.Equal(t, firstRoomID, event.RoomID)
+
+		err = userSocket.WriteMessage(websocket.TextMessage, roomFrame(http.FrameTyping, firstRoomID, "t-1", http.TypingPayload{Typing: true}))
+		assert.NoError(t, err, errorMassage)
+		assert.Equal(t, http.Error, nextEvent(t, userSocket).MessageType)
+	})
+}
+
+func TestSendRateLimit(t *testing.T) {
+	mockMessageUsecase := new(mocks.MessageUseCase)
+	mh := http.NewMessageHandler(mockMessageUsecase, testVerifier)
+	mh.SetRateLimiter(ratelimit.New(map[ratelimit.Action]ratelimit.Rule{ratelimit.Send: {Burst: 1, Per: time.Minute}}))
+	mw := new(mocks.MiddlewareMock)
+	server := httptest.NewServer(app.Server(mh, nil, mw))
+	defer server.Close()
+
+	addr, err := url.Parse(server.URL)
+	if err != nil {
+		assert.Fail(t, "unable to get test server url")
+	}
+	addr.Scheme = "ws"
+	startHub()
+	const limitedRoomID = "limited"
+	mockMessageUsecase.On("IsAuthorized", mock.Anything, "1", limitedRoomID).Return(true)
+	mockMessageUsecase.On("SaveMessage", mock.Anything, mock.Anything).Return(nil).Once()
+
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf(chatRoomPath, addr.String(), limitedRoomID, testTokenQuery("1")), nil)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	defer ws.Close()
+
+	assert.NoError(t, ws.WriteMessage(websocket.TextMessage, frame(http.FrameSend, "c-1", http.SendPayload{MessageBody: messageBody})), errorMassage)
+	event := nextEvent(t, ws)
+	assert.Equal(t, http.Ack, event.MessageType)
+	assert.Equal(t, "c-1", event.ClientMsgID)
+
+	// over the limit the message isn't saved, and the connection stays open for the next ones
+	for _, clientMsgID := range []string{"c-2", "c-3"} {
+		assert.NoError(t, ws.WriteMessage(websocket.TextMessage, frame(http.FrameSend, clientMsgID, http.SendPayload{MessageBody: messageBody})), errorMassage)
+		event = nextEvent(t, ws)
+		assert.Equal(t, http.Error, event.MessageType)
+		assert.Equal(t, clientMsgID, event.ClientMsgID)
+		assert.Equal(t, "too many messages, retry in 60 seconds", event.Error)
+	}
+	mockMessageUsecase.AssertNumberOfCalls(t, "SaveMessage", 1)
+}
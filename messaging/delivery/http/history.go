@@ -0,0 +1,159 @@
+package http
+
+import (
+	"chat/domain"
+	"chat/utils/errors"
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"github.com/gocql/gocql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxHistoryLimit bounds how many messages a page of history holds
+const maxHistoryLimit = 100
+
+const invalidCursor = "before and after must be cursors of a page, around the id of a message"
+
+// HistoryPage is a page of a room's history, oldest message first. Prev loads the messages before the page, it is
+// left out once the page starts at the room's first message. Next loads the messages after the page. It is there even
+// when nothing newer was sent yet, so a client that reconnects can load what it missed
+type HistoryPage struct {
+	Messages []domain.Message `json:"messages"`
+	Prev     string           `json:"prev,omitempty"`
+	Next     string           `json:"next,omitempty"`
+}
+
+// GetHistory returns a page of the room's history. Without a query, the page is the latest messages. before and after
+// take the prev and next cursors of another page, around takes the id of a message, e.g. a search hit or a mention, to
+// jump to it. limit is 10 by default. from_student_id narrows the page to the messages of a member, and from and to to
+// the messages sent in [from, to). The cursors of a filtered page are meant for the same filter
+func (h *MessageHandler) GetHistory(c *gin.Context) {
+	roomID := c.Param("roomID")
+	key, _ := c.Get("loggedID")
+	loggedID, _ := key.(string)
+
+	query := domain.HistoryQuery{Around: c.Query("around"), Limit: 10}
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit > 0 {
+		query.Limit = limit
+	}
+	if query.Limit > maxHistoryLimit {
+		query.Limit = maxHistoryLimit
+	}
+
+	given := 0
+	for _, param := range []string{"before", "after", "around"} {
+		if c.Query(param) != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		c.JSON(http.StatusBadRequest, errors.NewBadRequestError("Only one of before, after and around can be given"))
+		return
+	}
+	filter, ok := parseFilter(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, errors.NewBadRequestError("from and to must be RFC3339 times, from before to"))
+		return
+	}
+	query.Filter = filter
+	if query.Before, ok = decodeCursor(c.Query("before")); !ok {
+		c.JSON(http.StatusBadRequest, errors.NewBadRequestError(invalidCursor))
+		return
+	}
+	if query.After, ok = decodeCursor(c.Query("after")); !ok {
+		c.JSON(http.StatusBadRequest, errors.NewBadRequestError(invalidCursor))
+		return
+	}
+	if query.Around != "" && !validMessageID(query.Around) {
+		c.JSON(http.StatusBadRequest, errors.NewBadRequestError(invalidCursor))
+		return
+	}
+
+	ctx := c.Request.Context()
+	page, err := h.u.GetHistory(ctx, roomID, loggedID, query)
+	if err != nil {
+		errors.SetRESTError(err, c)
+		return
+	}
+
+	response := HistoryPage{Messages: page.Messages}
+	if len(page.Messages) > 0 {
+		if page.HasOlder {
+			response.Prev = encodeCursor(page.Messages[0].MessageID)
+		}
+		response.Next = encodeCursor(page.Messages[len(page.Messages)-1].MessageID)
+	} else if query.After != "" {
+		// nothing was sent since, the client asks again from the same place
+		response.Next = c.Query("after")
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetRevisions returns every body the message had, oldest first and the current one last
+func (h *MessageHandler) GetRevisions(c *gin.Context) {
+	roomID := c.Param("roomID")
+	messageID := c.Param("messageID")
+	if !validMessageID(messageID) {
+		c.JSON(http.StatusBadRequest, errors.NewBadRequestError("messageID must be the timeuuid of a message"))
+		return
+	}
+	key, _ := c.Get("loggedID")
+	loggedID, _ := key.(string)
+
+	ctx := c.Request.Context()
+	revisions, err := h.u.GetRevisions(ctx, roomID, loggedID, messageID)
+	if err != nil {
+		errors.SetRESTError(err, c)
+		return
+	}
+
+	c.JSON(http.StatusOK, revisions)
+}
+
+// parseFilter reads the filter of the query. It is invalid if a time isn't RFC3339, or if the window is empty
+func parseFilter(c *gin.Context) (domain.MessageFilter, bool) {
+	filter := domain.MessageFilter{FromStudentID: c.Query("from_student_id")}
+	for _, param := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if value := c.Query(param.name); value != "" {
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return filter, false
+			}
+			*param.t = t.UTC()
+		}
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return filter, false
+	}
+	return filter, true
+}
+
+// encodeCursor hides the message id the page stops at, so clients don't build cursors of their own
+func encodeCursor(messageID string) string {
+	id, err := gocql.ParseUUID(messageID)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(id.Bytes())
+}
+
+// decodeCursor returns the message id of the cursor. An empty cursor is valid and has no id
+func decodeCursor(cursor string) (string, bool) {
+	if cursor == "" {
+		return "", true
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", false
+	}
+	id, err := gocql.UUIDFromBytes(b)
+	if err != nil || id.Version() != 1 {
+		return "", false
+	}
+	return id.String(), true
+}
@@ -0,0 +1,415 @@
+package http
+
+import (
+	"github.com/gocql/gocql"
+	"github.com/gorilla/websocket"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// roomIdleTimeout is how long the loop of a room keeps running once nobody is connected to the room
+	roomIdleTimeout = time.Second * 30
+	// presenceInterval is how often a room publishes who is connected to it on this instance
+	presenceInterval = time.Second * 20
+	// presenceTTL is how long the students of another instance are online without a heartbeat from it
+	presenceTTL = presenceInterval * 3
+	// relayBackoff is how long the hub waits before listening to the relay again once it dropped, doubled after each
+	// failure up to maxRelayBackoff
+	relayBackoff    = time.Second
+	maxRelayBackoff = time.Second * 30
+)
+
+// hub is the heart of the chat app. This is what is used to hold "rooms", register and unregister when connecting and
+// disconnecting, and broadcast. Whenever a message is broadcast, it is delivered to all the connections in room.
+// Every room with connections on this instance has its own event loop, so a busy room never slows down the others.
+// The loop of a room is started by the first connection and stops once the room has been idle for a while. When a
+// relay is set, the event is also published to the other instances, and the events they publish are delivered to
+// the connections in room on this instance
+type hub struct {
+	mu          sync.RWMutex
+	rooms       map[string]*roomHub
+	outbound    chan RelayMessage
+	relay       Relay
+	instanceID  string
+	idleTimeout time.Duration
+
+	presenceInterval time.Duration
+	presenceTTL      time.Duration
+	relayBackoff     time.Duration
+
+	overflowPolicy OverflowPolicy
+	counters       queueCounters
+
+	// stopped and relayClosed are set by Shutdown, pumps counts the readPumps and writePumps still running and
+	// published is closed once publishToRelay is done
+	stopped     bool
+	relayClosed bool
+	pumps       sync.WaitGroup
+	publishing  int32
+	published   chan struct{}
+
+	// streamsStopped is closed by StopStreams
+	streamsStopped chan struct{}
+	stopStreams    sync.Once
+
+	// users are the multiplexed connections of each student, see ServeUserWs
+	usersMu sync.Mutex
+	users   map[string]map[*userSocket]bool
+}
+
+var (
+	singleton *hub
+	once      sync.Once
+	mainHub   = NewHub()
+)
+
+// NewHub returns the hub shared by every connection of this instance
+func NewHub() *hub {
+	once.Do(func() {
+		singleton = newHub()
+	})
+
+	return singleton
+}
+
+func newHub() *hub {
+	return &hub{
+		rooms:       make(map[string]*roomHub),
+		outbound:    make(chan RelayMessage, relayBufferSize),
+		instanceID:  gocql.TimeUUID().String(),
+		idleTimeout: roomIdleTimeout,
+		published:   make(chan struct{}),
+
+		presenceInterval: presenceInterval,
+		presenceTTL:      presenceTTL,
+		relayBackoff:     relayBackoff,
+
+		streamsStopped: make(chan struct{}),
+
+		users: make(map[string]map[*userSocket]bool),
+	}
+}
+
+// SetRelay connects the hub to the other instances. It must be called before anything is registered
+func (h *hub) SetRelay(r Relay) {
+	h.relay = r
+}
+
+// StartHubListener publishes the hub's events to the relay and delivers the events of the other instances, until the
+// relay closes. The rooms run their own loops, so without a relay there is nothing to listen to and it returns
+func (h *hub) StartHubListener() {
+	if h.relay == nil {
+		return
+	}
+	atomic.StoreInt32(&h.publishing, 1)
+	go h.publishToRelay()
+	h.listenToRelay()
+}
+
+// Register adds the subscription to its room, starting the room's loop if needed
+func (h *hub) Register(s subscription) {
+	h.do(s.roomID, true, func(r *roomHub) { r.RegisterCase(s) })
+}
+
+func (h *hub) unregister(s subscription) {
+	h.do(s.roomID, false, func(r *roomHub) { r.UnregisterCase(s) })
+}
+
+func (h *hub) direct(rp reply) {
+	h.do(rp.sub.roomID, false, func(r *roomHub) { r.DirectCase(rp) })
+}
+
+// broadcast delivers the event to the room on this instance, if anyone is connected to it here, and to the other
+// instances
+func (h *hub) broadcast(m Event) {
+	h.do(m.Message.RoomID, false, func(r *roomHub) { r.BroadcastCase(m) })
+	if h.relay != nil {
+		h.queueForRelay(RelayMessage{Event: m})
+	}
+}
+
+// ActiveRooms returns how many rooms have a running loop
+func (h *hub) ActiveRooms() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.rooms)
+}
+
+// do hands f over to the loop of the room. When the room has no loop, one is started if create is set, otherwise f
+// is dropped and false is returned. A loop that stops in the meantime never takes f, so f is handed over to the loop
+// that replaces it
+func (h *hub) do(roomID string, create bool, f func(*roomHub)) bool {
+	for {
+		r := h.room(roomID, create)
+		if r == nil {
+			return false
+		}
+		select {
+		case r.inbox <- f:
+			return true
+		case <-r.done:
+		}
+	}
+}
+
+func (h *hub) room(roomID string, create bool) *roomHub {
+	h.mu.RLock()
+	r := h.rooms[roomID]
+	h.mu.RUnlock()
+	if r != nil || !create {
+		return r
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if r = h.rooms[roomID]; r == nil {
+		r = newRoomHub(h, roomID)
+		h.rooms[roomID] = r
+		go r.run()
+	}
+	return r
+}
+
+// retire forgets the room, the next event for it starts a new loop
+func (h *hub) retire(r *roomHub) {
+	h.mu.Lock()
+	if h.rooms[r.roomID] == r {
+		delete(h.rooms, r.roomID)
+	}
+	h.mu.Unlock()
+	close(r.done)
+}
+
+// queueForRelay hands the event over to publishToRelay without ever blocking the room. If the broker can't keep up,
+// the event is only delivered locally. Once Shutdown closed the relay, the event is only delivered locally too
+func (h *hub) queueForRelay(m RelayMessage) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.relayClosed {
+		return
+	}
+	select {
+	case h.outbound <- m:
+	default:
+		log.Printf("relay buffer is full, event for room %s was only delivered locally", m.Event.Message.RoomID)
+	}
+}
+
+func (h *hub) publishToRelay() {
+	defer close(h.published)
+	for m := range h.outbound {
+		m.Origin = h.instanceID
+		err := h.relay.Publish(m)
+		if err != nil {
+			log.Printf("failed to publish event for room %s to relay with err %s", m.Event.Message.RoomID, err.Error())
+		}
+	}
+}
+
+// listenToRelay passes the events published by the other instances to their rooms, or to the student they are
+// addressed to, until Shutdown closes the relay. Each time it starts listening, it asks the other instances who is
+// online, since it only hears about the students that join afterwards otherwise. When the relay drops, it listens
+// again after relayBackoff, twice as long after each failure up to maxRelayBackoff
+func (h *hub) listenToRelay() {
+	backoff := h.relayBackoff
+	for {
+		messages, err := h.relay.Messages()
+		if err == nil {
+			h.queueForRelay(RelayMessage{SyncPresence: true})
+			backoff = h.relayBackoff
+			h.deliverFromRelay(messages)
+		}
+		if h.isRelayClosed() {
+			log.Println("relay closed, no longer receiving events from other instances")
+			return
+		}
+		if err != nil {
+			log.Printf("failed to listen to relay with err %s, retrying in %s", err.Error(), backoff)
+		} else {
+			log.Printf("relay dropped, listening again in %s", backoff)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRelayBackoff {
+			backoff = maxRelayBackoff
+		}
+	}
+}
+
+// deliverFromRelay delivers the events until the relay drops. Events this instance published are skipped since they
+// were already delivered locally. Only a student joining, or a heartbeat with students online, starts the loop of a
+// room, any other event for a room nobody is connected to on this instance has nowhere to go
+func (h *hub) deliverFromRelay(messages <-chan RelayMessage) {
+	for m := range messages {
+		if m.Origin == h.instanceID {
+			continue
+		}
+		if m.UserID != "" {
+			h.deliverToUser(m.UserID, m.Event)
+			continue
+		}
+		if m.SyncPresence {
+			h.publishPresence()
+			continue
+		}
+		if hb := m.Heartbeat; hb != nil {
+			origin, now := m.Origin, time.Now()
+			h.do(hb.RoomID, len(hb.Online) > 0, func(r *roomHub) { r.HeartbeatCase(origin, hb.Online, now) })
+			continue
+		}
+		m := m
+		h.do(m.Event.Message.RoomID, m.Event.MessageType == Joined, func(r *roomHub) { r.RemoteCase(m) })
+	}
+}
+
+func (h *hub) isRelayClosed() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.relayClosed
+}
+
+// publishPresence has every room publish its heartbeat
+func (h *hub) publishPresence() {
+	h.mu.RLock()
+	roomIDs := make([]string, 0, len(h.rooms))
+	for roomID := range h.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	h.mu.RUnlock()
+	for _, roomID := range roomIDs {
+		h.do(roomID, false, func(r *roomHub) { r.publishPresence() })
+	}
+}
+
+// roomHub is the loop of a single room. Everything about the room is only touched from run, the rest of the hub
+// hands work over through inbox
+type roomHub struct {
+	hub      *hub
+	roomID   string
+	subs     map[subscription]bool
+	presence remotePresence
+	inbox    chan func(*roomHub)
+	done     chan struct{}
+}
+
+func newRoomHub(h *hub, roomID string) *roomHub {
+	return &roomHub{
+		hub:      h,
+		roomID:   roomID,
+		subs:     make(map[subscription]bool),
+		presence: make(remotePresence),
+		inbox:    make(chan func(*roomHub)),
+		done:     make(chan struct{}),
+	}
+}
+
+// run handles the work for the room until the room has been idle for the hub's idleTimeout, i.e. nobody was
+// connected to it on any instance. Every presenceInterval, it publishes who is connected to it on this instance and
+// forgets the students of the instances it stopped hearing from
+func (r *roomHub) run() {
+	idle := time.NewTimer(r.hub.idleTimeout)
+	defer idle.Stop()
+	heartbeat := time.NewTicker(r.hub.presenceInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case f := <-r.inbox:
+			f(r)
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(r.hub.idleTimeout)
+		case now := <-heartbeat.C:
+			r.expirePresence(now)
+			r.publishPresence()
+		case <-idle.C:
+			if len(r.subs) == 0 && len(r.presence) == 0 {
+				r.hub.retire(r)
+				return
+			}
+			// the students of the other instances may still expire, so the room is checked again later
+			idle.Reset(r.hub.idleTimeout)
+		}
+	}
+}
+
+// RegisterCase adds the subscription to the room. The first socket of a student in the room announces them as joined.
+// Once the hub is shutting down, the connection is closed instead
+func (r *roomHub) RegisterCase(s subscription) {
+	if r.hub.isStopped() {
+		s.conn.end(websocket.CloseGoingAway, shutdownCloseReason)
+		if !s.conn.multiplexed {
+			close(s.conn.send)
+		}
+		return
+	}
+	first := r.localConnections(s.userID) == 0
+	wasOnline := r.isOnline(s.userID)
+	r.subs[s] = true
+	if first {
+		r.announce(NewJoinedEvent(s.roomID, s.userID), !wasOnline)
+	}
+}
+
+// UnregisterCase removes the subscription from the room and closes its connection, unless the connection is
+// multiplexed. The last socket of a student in the room announces them as left
+func (r *roomHub) UnregisterCase(s subscription) {
+	if _, ok := r.subs[s]; ok {
+		delete(r.subs, s)
+		if !s.conn.multiplexed {
+			close(s.conn.send)
+		}
+		if r.localConnections(s.userID) == 0 {
+			r.announce(NewLeftEvent(s.roomID, s.userID), !r.isOnline(s.userID))
+		}
+	}
+}
+
+// BroadcastCase delivers the event to every connection in the room on this instance, except the one it came from.
+// The sender's other connections get it like everyone else's
+func (r *roomHub) BroadcastCase(m Event) {
+	for s := range r.subs {
+		if s.conn == m.origin {
+			continue
+		}
+		// a student doesn't need to see themselves typing, joining or leaving on their other devices
+		if m.aboutSender() && m.Message.FromStudentID == s.userID {
+			continue
+		}
+		if code, reason, ok := m.closes(s); ok {
+			if s.conn.multiplexed {
+				// only the subscription to this room ends, the student is told through notifyUser
+				r.UnregisterCase(s)
+			} else {
+				r.disconnect(s, code, reason)
+			}
+			continue
+		}
+		r.sendTo(s, m)
+	}
+}
+
+// DirectCase delivers the event to the subscription only, as long as it is still registered
+func (r *roomHub) DirectCase(rp reply) {
+	if _, ok := r.subs[rp.sub]; ok {
+		r.sendTo(rp.sub, rp.event)
+	}
+}
+
+// sendTo queues the event for a single connection. When the connection's queue is full, the overflow policy decides
+// what happens. The events for a multiplexed connection are tagged with the room
+func (r *roomHub) sendTo(s subscription, m Event) {
+	if s.conn.multiplexed {
+		m.RoomID = s.roomID
+	}
+	select {
+	case s.conn.send <- m:
+	default:
+		r.overflow(s, m)
+	}
+}
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"chat/domain"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRoomLoops(t *testing.T) {
+	h := newHub()
+	h.idleTimeout = 50 * time.Millisecond
+
+	t.Run("idle room is torn down", func(t *testing.T) {
+		s := newTestSubscription("office", "jim")
+		h.Register(s)
+		assert.Equal(t, 1, h.ActiveRooms())
+
+		h.unregister(s)
+		assert.Eventually(t, func() bool { return h.ActiveRooms() == 0 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("room with a connection stays up", func(t *testing.T) {
+		s := newTestSubscription("office", "jim")
+		h.Register(s)
+		time.Sleep(3 * h.idleTimeout)
+		assert.Equal(t, 1, h.ActiveRooms())
+
+		h.broadcast(NewSendEvent(domain.Message{RoomID: "office", FromStudentID: "pam", MessageBody: "still here"}))
+		expectEvent(t, s, "still here")
+		h.unregister(s)
+	})
+
+	t.Run("broadcast to a room nobody is in", func(t *testing.T) {
+		assert.Eventually(t, func() bool { return h.ActiveRooms() == 0 }, time.Second, 10*time.Millisecond)
+		h.broadcast(NewSendEvent(domain.Message{RoomID: "allstars", FromStudentID: "pam", MessageBody: "anyone?"}))
+		assert.Equal(t, 0, h.ActiveRooms())
+	})
+
+	t.Run("busy room doesn't hold up the others", func(t *testing.T) {
+		release := make(chan struct{})
+		h.do("busy", true, func(r *roomHub) { <-release })
+		defer close(release)
+
+		s := newTestSubscription("office", "jim")
+		h.Register(s)
+		h.broadcast(NewSendEvent(domain.Message{RoomID: "office", FromStudentID: "pam", MessageBody: "not stuck"}))
+		expectEvent(t, s, "not stuck")
+	})
+}
+
+// BenchmarkHubBroadcast broadcasts to many rooms at once, each with a single connection reading its events
+func BenchmarkHubBroadcast(b *testing.B) {
+	for _, rooms := range []int{10, 1000, 5000} {
+		b.Run(fmt.Sprintf("rooms=%d", rooms), func(b *testing.B) {
+			h := newHub()
+			subs := make([]subscription, rooms)
+			for i := range subs {
+				subs[i] = subscription{conn: &connection{send: make(chan Event, sendBufferSize)}, roomID: fmt.Sprint(i), userID: "jim"}
+				h.Register(subs[i])
+				go func(s subscription) {
+					for range s.conn.send {
+					}
+				}(subs[i])
+			}
+			var next int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&next, 1) % int64(rooms)
+					h.broadcast(NewSendEvent(domain.Message{RoomID: subs[i].roomID, FromStudentID: "pam", MessageBody: "hi"}))
+				}
+			})
+			b.StopTimer()
+			for _, s := range subs {
+				h.unregister(s)
+			}
+		})
+	}
+}
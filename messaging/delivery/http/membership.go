@@ -0,0 +1,44 @@
+package http
+
+// Close codes sent to the subscriptions the hub closes because of a membership change. They are in the range the
+// websocket protocol leaves to applications
+const (
+	CloseRemovedFromRoom = 4001
+	CloseRoomDeleted     = 4002
+)
+
+// MemberAdded tells the room, on every instance, about the new member, and the member's multiplexed connections
+func (h *hub) MemberAdded(roomID string, userID string) {
+	e := NewMemberAddedEvent(roomID, userID)
+	h.broadcast(e)
+	h.notifyUser(userID, e)
+}
+
+// MemberRemoved closes the student's subscriptions to the room, on every instance, and tells the rest of the room
+// and the student's multiplexed connections
+func (h *hub) MemberRemoved(roomID string, userID string) {
+	e := NewMemberRemovedEvent(roomID, userID)
+	h.broadcast(e)
+	h.notifyUser(userID, e)
+}
+
+// RoomDeleted closes every subscription to the room, on every instance, and tells the multiplexed connections of
+// its members
+func (h *hub) RoomDeleted(roomID string, members []string) {
+	e := NewRoomDeletedEvent(roomID)
+	h.broadcast(e)
+	for _, userID := range members {
+		h.notifyUser(userID, e)
+	}
+}
+
+// closes tells if the event ends the subscription, and with which close code and reason
+func (e Event) closes(s subscription) (int, string, bool) {
+	switch {
+	case e.MessageType == MemberRemoved && e.Message.FromStudentID == s.userID:
+		return CloseRemovedFromRoom, "removed from room", true
+	case e.MessageType == RoomDeleted:
+		return CloseRoomDeleted, "room deleted", true
+	}
+	return 0, "", false
+}
@@ -0,0 +1,87 @@
+package http
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// expectClosed waits for the hub to close the subscription, skipping whatever was queued before
+func expectClosed(t *testing.T, s subscription, code int) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-s.conn.send:
+			if ok {
+				continue
+			}
+			assert.Equal(t, code, s.conn.closeCode)
+			return
+		case <-timeout:
+			assert.Fail(t, "expected the subscription of "+s.userID+" to be closed")
+			return
+		}
+	}
+}
+
+func expectMembership(t *testing.T, s subscription, messageType MessageType, userID string) {
+	e, ok := nextMessage(s, time.Second)
+	if !ok {
+		assert.Fail(t, "expected a membership event for "+s.userID)
+		return
+	}
+	assert.Equal(t, messageType, e.MessageType)
+	assert.Equal(t, userID, e.Message.FromStudentID)
+}
+
+func TestMembershipChanges(t *testing.T) {
+	broker := NewLocalBroker()
+	first := newHub()
+	first.SetRelay(broker.Relay())
+	second := newHub()
+	second.SetRelay(broker.Relay())
+	go first.StartHubListener()
+	go second.StartHubListener()
+
+	t.Run("member added", func(t *testing.T) {
+		jim := newTestSubscription("office", "jim")
+		first.Register(jim)
+
+		second.MemberAdded("office", "pam")
+		expectMembership(t, jim, MemberAdded, "pam")
+		first.unregister(jim)
+	})
+
+	t.Run("member removed on every instance", func(t *testing.T) {
+		jim := newTestSubscription("office", "jim")
+		pamLaptop := newTestSubscription("office", "pam")
+		pamPhone := newTestSubscription("office", "pam")
+		first.Register(jim)
+		first.Register(pamLaptop)
+		second.Register(pamPhone)
+
+		first.MemberRemoved("office", "pam")
+		expectClosed(t, pamLaptop, CloseRemovedFromRoom)
+		expectClosed(t, pamPhone, CloseRemovedFromRoom)
+		expectMembership(t, jim, MemberRemoved, "pam")
+		assert.Eventually(t, func() bool {
+			online := first.Online("office")
+			return len(online) == 1 && online[0] == "jim"
+		}, time.Second, 10*time.Millisecond)
+		first.unregister(jim)
+	})
+
+	t.Run("room deleted", func(t *testing.T) {
+		jim := newTestSubscription("office", "jim")
+		pam := newTestSubscription("office", "pam")
+		kevin := newTestSubscription("accounting", "kevin")
+		first.Register(jim)
+		second.Register(pam)
+		first.Register(kevin)
+
+		second.RoomDeleted("office", []string{"jim", "pam"})
+		expectClosed(t, jim, CloseRoomDeleted)
+		expectClosed(t, pam, CloseRoomDeleted)
+		expectNoEvent(t, kevin)
+	})
+}
@@ -0,0 +1,178 @@
+package http
+
+import (
+	"sort"
+	"time"
+)
+
+// OnlineMembers is the body of the online members response
+type OnlineMembers struct {
+	RoomID string   `json:"room_id"`
+	Online []string `json:"online"`
+}
+
+// remotePresence holds, for each student of a room, the other instances on which the student has a socket open, with
+// when each of them last told so. It is built from the Joined and Left events and the heartbeats the other instances
+// publish. An instance that went away without announcing its students as left stops sending heartbeats, so its
+// students expire after the hub's presenceTTL
+type remotePresence map[string]map[string]time.Time
+
+func (p remotePresence) add(userID string, instanceID string, now time.Time) {
+	instances := p[userID]
+	if instances == nil {
+		instances = make(map[string]time.Time)
+		p[userID] = instances
+	}
+	instances[instanceID] = now
+}
+
+func (p remotePresence) remove(userID string, instanceID string) {
+	delete(p[userID], instanceID)
+	if len(p[userID]) == 0 {
+		delete(p, userID)
+	}
+}
+
+// PresenceHeartbeat is the full list of the students connected to a room on the instance that publishes it
+type PresenceHeartbeat struct {
+	RoomID string   `json:"room_id"`
+	Online []string `json:"online"`
+}
+
+// Online returns the ids of the students that have a socket open to the room, on this instance or any other, sorted
+func (h *hub) Online(roomID string) []string {
+	online := make(chan []string, 1)
+	if !h.do(roomID, false, func(r *roomHub) { online <- r.OnlineCase() }) {
+		return []string{}
+	}
+	return <-online
+}
+
+// OnlineCase answers from what the room knows about this instance and the others
+func (r *roomHub) OnlineCase() []string {
+	seen := make(map[string]bool)
+	online := make([]string, 0)
+	for s := range r.subs {
+		if !seen[s.userID] {
+			seen[s.userID] = true
+			online = append(online, s.userID)
+		}
+	}
+	for userID := range r.presence {
+		if !seen[userID] {
+			seen[userID] = true
+			online = append(online, userID)
+		}
+	}
+	sort.Strings(online)
+	return online
+}
+
+// RemoteCase delivers an event published by another instance. Joined and Left events update what the room knows
+// about the other instances, and are only delivered when the student went from offline to online or the other way
+// around
+func (r *roomHub) RemoteCase(m RelayMessage) {
+	e := m.Event
+	switch e.MessageType {
+	case Joined:
+		wasOnline := r.isOnline(e.Message.FromStudentID)
+		r.presence.add(e.Message.FromStudentID, m.Origin, time.Now())
+		if wasOnline {
+			return
+		}
+	case Left:
+		r.presence.remove(e.Message.FromStudentID, m.Origin)
+		if r.isOnline(e.Message.FromStudentID) {
+			return
+		}
+	}
+	r.BroadcastCase(e)
+}
+
+// HeartbeatCase replaces what the room knows about the instance that published the heartbeat with the students it
+// lists. The students that went from offline to online or the other way around are announced to the room on this
+// instance, as if their Joined or Left events had arrived
+func (r *roomHub) HeartbeatCase(origin string, online []string, now time.Time) {
+	listed := make(map[string]bool, len(online))
+	for _, userID := range online {
+		listed[userID] = true
+		wasOnline := r.isOnline(userID)
+		r.presence.add(userID, origin, now)
+		if !wasOnline {
+			r.BroadcastCase(NewJoinedEvent(r.roomID, userID))
+		}
+	}
+	for userID, instances := range r.presence {
+		if _, ok := instances[origin]; ok && !listed[userID] {
+			r.presence.remove(userID, origin)
+			if !r.isOnline(userID) {
+				r.BroadcastCase(NewLeftEvent(r.roomID, userID))
+			}
+		}
+	}
+}
+
+// expirePresence forgets the students an instance hasn't told about for longer than the hub's presenceTTL, and
+// announces those that are no longer online anywhere as left
+func (r *roomHub) expirePresence(now time.Time) {
+	for userID, instances := range r.presence {
+		expired := false
+		for origin, seen := range instances {
+			if now.Sub(seen) > r.hub.presenceTTL {
+				r.presence.remove(userID, origin)
+				expired = true
+			}
+		}
+		if expired && !r.isOnline(userID) {
+			r.BroadcastCase(NewLeftEvent(r.roomID, userID))
+		}
+	}
+}
+
+// publishPresence sends the other instances the heartbeat of the room, as long as anyone is connected to it here
+func (r *roomHub) publishPresence() {
+	if r.hub.relay == nil || len(r.subs) == 0 {
+		return
+	}
+	r.hub.queueForRelay(RelayMessage{Heartbeat: &PresenceHeartbeat{RoomID: r.roomID, Online: r.localUsers()}})
+}
+
+// announce publishes a change in the student's presence on this instance to the other instances, so that they can
+// keep track of it. It is only delivered to the room on this instance when deliver is set, i.e. when the student
+// isn't connected through another instance
+func (r *roomHub) announce(e Event, deliver bool) {
+	if deliver {
+		r.BroadcastCase(e)
+	}
+	if r.hub.relay != nil {
+		r.hub.queueForRelay(RelayMessage{Event: e})
+	}
+}
+
+func (r *roomHub) localConnections(userID string) int {
+	count := 0
+	for s := range r.subs {
+		if s.userID == userID {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *roomHub) isOnline(userID string) bool {
+	return r.localConnections(userID) > 0 || len(r.presence[userID]) > 0
+}
+
+// localUsers returns the ids of the students that have a socket open to the room on this instance, sorted
+func (r *roomHub) localUsers() []string {
+	seen := make(map[string]bool)
+	users := make([]string, 0)
+	for s := range r.subs {
+		if !seen[s.userID] {
+			seen[s.userID] = true
+			users = append(users, s.userID)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
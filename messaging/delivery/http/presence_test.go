@@ -0,0 +1,156 @@
+package http
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func expectPresence(t *testing.T, s subscription, messageType MessageType, userID string) {
+	select {
+	case e := <-s.conn.send:
+		assert.Equal(t, messageType, e.MessageType)
+		assert.Equal(t, userID, e.Message.FromStudentID)
+	case <-time.After(time.Second):
+		assert.Fail(t, "expected a presence event for "+s.userID)
+	}
+}
+
+func expectNoPresence(t *testing.T, s subscription) {
+	select {
+	case e := <-s.conn.send:
+		assert.Fail(t, "received an unexpected event", e.Message.FromStudentID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPresence(t *testing.T) {
+	h := newHub()
+
+	watcher := newTestSubscription("office", "jim")
+	laptop := newTestSubscription("office", "pam")
+	phone := newTestSubscription("office", "pam")
+	h.Register(watcher)
+
+	t.Run("joined once for several tabs", func(t *testing.T) {
+		h.Register(laptop)
+		expectPresence(t, watcher, Joined, "pam")
+
+		h.Register(phone)
+		expectNoPresence(t, watcher)
+		assert.Equal(t, []string{"jim", "pam"}, h.Online("office"))
+	})
+
+	t.Run("left once the last tab closes", func(t *testing.T) {
+		h.unregister(laptop)
+		expectNoPresence(t, watcher)
+		assert.Equal(t, []string{"jim", "pam"}, h.Online("office"))
+
+		h.unregister(phone)
+		expectPresence(t, watcher, Left, "pam")
+		assert.Equal(t, []string{"jim"}, h.Online("office"))
+	})
+
+	t.Run("nobody online", func(t *testing.T) {
+		assert.Equal(t, []string{}, h.Online("allstars"))
+	})
+}
+
+func TestPresenceAcrossInstances(t *testing.T) {
+	broker := NewLocalBroker()
+	first := newHub()
+	first.SetRelay(broker.Relay())
+	second := newHub()
+	second.SetRelay(broker.Relay())
+	go first.StartHubListener()
+	go second.StartHubListener()
+
+	watcher := newTestSubscription("office", "jim")
+	remote := newTestSubscription("office", "pam")
+	local := newTestSubscription("office", "pam")
+	first.Register(watcher)
+
+	t.Run("joined on another instance", func(t *testing.T) {
+		second.Register(remote)
+		expectPresence(t, watcher, Joined, "pam")
+		assert.Equal(t, []string{"jim", "pam"}, first.Online("office"))
+	})
+
+	t.Run("already online on another instance", func(t *testing.T) {
+		first.Register(local)
+		expectNoPresence(t, watcher)
+	})
+
+	t.Run("still online on this instance", func(t *testing.T) {
+		second.unregister(remote)
+		expectNoPresence(t, watcher)
+		assert.Equal(t, []string{"jim", "pam"}, first.Online("office"))
+	})
+
+	t.Run("left everywhere", func(t *testing.T) {
+		first.unregister(local)
+		expectPresence(t, watcher, Left, "pam")
+		assert.Eventually(t, func() bool {
+			online := second.Online("office")
+			return len(online) == 1 && online[0] == "jim"
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestPresenceExpires(t *testing.T) {
+	broker := NewLocalBroker()
+	h := newHub()
+	h.idleTimeout = 50 * time.Millisecond
+	h.presenceInterval = 20 * time.Millisecond
+	h.presenceTTL = 300 * time.Millisecond
+	h.SetRelay(broker.Relay())
+	go h.StartHubListener()
+	crashed := broker.Relay()
+
+	watcher := newTestSubscription("office", "jim")
+	h.Register(watcher)
+
+	t.Run("students of an instance that went away", func(t *testing.T) {
+		assert.NoError(t, crashed.Publish(RelayMessage{Origin: "crashed", Event: NewJoinedEvent("office", "pam")}))
+		expectPresence(t, watcher, Joined, "pam")
+
+		// the instance never says pam left, nor sends a heartbeat
+		expectPresence(t, watcher, Left, "pam")
+		assert.Equal(t, []string{"jim"}, h.Online("office"))
+	})
+
+	t.Run("heartbeat without a student", func(t *testing.T) {
+		assert.NoError(t, crashed.Publish(RelayMessage{Origin: "other", Heartbeat: &PresenceHeartbeat{RoomID: "office", Online: []string{"pam", "dwight"}}}))
+		expectPresence(t, watcher, Joined, "pam")
+		expectPresence(t, watcher, Joined, "dwight")
+
+		// the Left event of pam was lost
+		assert.NoError(t, crashed.Publish(RelayMessage{Origin: "other", Heartbeat: &PresenceHeartbeat{RoomID: "office", Online: []string{"dwight"}}}))
+		expectPresence(t, watcher, Left, "pam")
+		assert.Equal(t, []string{"dwight", "jim"}, h.Online("office"))
+	})
+
+	t.Run("room is torn down once the students expired", func(t *testing.T) {
+		h.unregister(watcher)
+		assert.NoError(t, crashed.Publish(RelayMessage{Origin: "crashed", Event: NewJoinedEvent("allstars", "pam")}))
+		assert.Eventually(t, func() bool { return h.ActiveRooms() == 0 }, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestPresenceSyncOnStartup(t *testing.T) {
+	broker := NewLocalBroker()
+	first := newHub()
+	first.SetRelay(broker.Relay())
+	go first.StartHubListener()
+	first.Register(newTestSubscription("office", "pam"))
+
+	// the second instance starts after pam joined, it never sees her Joined event
+	second := newHub()
+	second.SetRelay(broker.Relay())
+	go second.StartHubListener()
+
+	assert.Eventually(t, func() bool {
+		online := second.Online("office")
+		return len(online) == 1 && online[0] == "pam"
+	}, time.Second, 10*time.Millisecond)
+}
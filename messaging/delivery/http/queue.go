@@ -0,0 +1,161 @@
+package http
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"log"
+	"sync/atomic"
+)
+
+// sendBufferSize is how many events can wait for a connection's writePump before the overflow policy kicks in
+const sendBufferSize = 64
+
+// OverflowPolicy decides what the hub does with an event for a connection whose send queue is full. The hub never
+// waits for a connection, so a slow client can't hold up the rest of the room
+type OverflowPolicy int
+
+const (
+	// Coalesce keeps only the latest typing and presence event of each student in the queue to make room. If the
+	// queue is still full, the connection is disconnected like with Disconnect
+	Coalesce OverflowPolicy = iota
+	// DropOldest drops the event that waited the longest to make room for the new one
+	DropOldest
+	// Disconnect closes the connection with CloseTryAgainLater. The client can reconnect with since to get the
+	// messages it missed
+	Disconnect
+)
+
+const overflowCloseReason = "send queue overflow"
+
+// ParseOverflowPolicy reads the policy from its name. An empty name is the default policy, Coalesce
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "", "coalesce":
+		return Coalesce, nil
+	case "drop_oldest":
+		return DropOldest, nil
+	case "disconnect":
+		return Disconnect, nil
+	}
+	return Coalesce, fmt.Errorf("unknown overflow policy %q, must be one of coalesce, drop_oldest or disconnect", name)
+}
+
+// QueueStats counts what the overflow policy did since the hub started
+type QueueStats struct {
+	Dropped      int64 `json:"dropped"`
+	Coalesced    int64 `json:"coalesced"`
+	Disconnected int64 `json:"disconnected"`
+}
+
+type queueCounters struct {
+	dropped      int64
+	coalesced    int64
+	disconnected int64
+}
+
+// SetOverflowPolicy changes what happens to the events of connections that can't keep up. It must be called before
+// anything is registered
+func (h *hub) SetOverflowPolicy(p OverflowPolicy) {
+	h.overflowPolicy = p
+}
+
+// QueueStats returns the counters of the hub. It is safe to call from any goroutine
+func (h *hub) QueueStats() QueueStats {
+	return QueueStats{
+		Dropped:      atomic.LoadInt64(&h.counters.dropped),
+		Coalesced:    atomic.LoadInt64(&h.counters.coalesced),
+		Disconnected: atomic.LoadInt64(&h.counters.disconnected),
+	}
+}
+
+// overflow applies the policy to an event that didn't fit in the connection's queue. The queue of a multiplexed
+// connection is shared by the loops of its rooms, so it can fill up again while this runs, and every send is
+// non-blocking
+func (r *roomHub) overflow(s subscription, m Event) {
+	h := r.hub
+	switch h.overflowPolicy {
+	case DropOldest:
+		select {
+		case <-s.conn.send:
+		default:
+		}
+		select {
+		case s.conn.send <- m:
+		default:
+		}
+		atomic.AddInt64(&h.counters.dropped, 1)
+	case Disconnect:
+		atomic.AddInt64(&h.counters.disconnected, 1)
+		r.disconnect(s, websocket.CloseTryAgainLater, overflowCloseReason)
+	default:
+		queued := drain(s.conn.send)
+		events := coalesce(append(queued, m))
+		if len(events) > cap(s.conn.send) {
+			atomic.AddInt64(&h.counters.disconnected, 1)
+			r.disconnect(s, websocket.CloseTryAgainLater, overflowCloseReason)
+			return
+		}
+		for _, e := range events {
+			select {
+			case s.conn.send <- e:
+			default:
+				atomic.AddInt64(&h.counters.disconnected, 1)
+				r.disconnect(s, websocket.CloseTryAgainLater, overflowCloseReason)
+				return
+			}
+		}
+		atomic.AddInt64(&h.counters.coalesced, int64(len(queued)+1-len(events)))
+	}
+}
+
+// disconnect unregisters the subscription, and its writePump says goodbye with the close code and reason. A
+// multiplexed connection is closed as a whole, which unsubscribes it from its other rooms
+func (r *roomHub) disconnect(s subscription, code int, reason string) {
+	log.Printf("disconnecting %s from room %s: %s", s.userID, s.roomID, reason)
+	s.conn.end(code, reason)
+	r.UnregisterCase(s)
+}
+
+func drain(send chan Event) []Event {
+	var events []Event
+	for {
+		select {
+		case e, ok := <-send:
+			if !ok {
+				return events
+			}
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+// coalesce keeps the latest typing event and the latest presence event of each student, everything else is kept as
+// is and in order
+func coalesce(events []Event) []Event {
+	latest := make(map[string]int)
+	for i, e := range events {
+		if key, ok := coalesceKey(e); ok {
+			latest[key] = i
+		}
+	}
+	kept := events[:0]
+	for i, e := range events {
+		if key, ok := coalesceKey(e); ok && latest[key] != i {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+func coalesceKey(e Event) (string, bool) {
+	switch e.MessageType {
+	case Typing:
+		return "typing/" + e.Message.RoomID + "/" + e.Message.FromStudentID, true
+	case Joined, Left:
+		return "presence/" + e.Message.RoomID + "/" + e.Message.FromStudentID, true
+	}
+	return "", false
+}
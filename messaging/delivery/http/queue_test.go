@@ -0,0 +1,124 @@
+package http
+
+import (
+	"chat/domain"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newSlowSubscription(roomID, userID string) subscription {
+	return subscription{conn: &connection{send: make(chan Event, 2)}, roomID: roomID, userID: userID}
+}
+
+func queued(s subscription) []Event {
+	return drain(s.conn.send)
+}
+
+func message(body string) Event {
+	return NewSendEvent(domain.Message{RoomID: "office", FromStudentID: "michael", MessageBody: body})
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	t.Run("drop oldest", func(t *testing.T) {
+		h := newHub()
+		h.SetOverflowPolicy(DropOldest)
+		r := newRoomHub(h, "office")
+		slow := newSlowSubscription("office", "jim")
+		r.RegisterCase(slow)
+
+		for _, body := range []string{"1", "2", "3"} {
+			r.BroadcastCase(message(body))
+		}
+
+		events := queued(slow)
+		assert.Len(t, events, 2)
+		assert.Equal(t, "2", events[0].Message.MessageBody)
+		assert.Equal(t, "3", events[1].Message.MessageBody)
+		assert.Equal(t, QueueStats{Dropped: 1}, h.QueueStats())
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		h := newHub()
+		h.SetOverflowPolicy(Disconnect)
+		r := newRoomHub(h, "office")
+		slow := newSlowSubscription("office", "jim")
+		fast := newTestSubscription("office", "pam")
+		r.RegisterCase(slow)
+		r.RegisterCase(fast)
+
+		for _, body := range []string{"1", "2", "3"} {
+			r.BroadcastCase(message(body))
+		}
+
+		_, stillRegistered := r.subs[slow]
+		assert.False(t, stillRegistered)
+		assert.Equal(t, websocket.CloseTryAgainLater, slow.conn.closeCode)
+		assert.Equal(t, overflowCloseReason, slow.conn.closeReason)
+		assert.Len(t, queued(fast), 4, "the other connections get every event, and jim leaving")
+		assert.Equal(t, QueueStats{Disconnected: 1}, h.QueueStats())
+	})
+
+	t.Run("coalesce typing and presence", func(t *testing.T) {
+		h := newHub()
+		r := newRoomHub(h, "office")
+		slow := newSlowSubscription("office", "jim")
+		r.RegisterCase(slow)
+
+		r.BroadcastCase(NewTypingEvent("office", "pam", true))
+		r.BroadcastCase(message("1"))
+		r.BroadcastCase(NewTypingEvent("office", "pam", false))
+
+		events := queued(slow)
+		assert.Len(t, events, 2)
+		assert.Equal(t, Send, events[0].MessageType)
+		assert.Equal(t, Typing, events[1].MessageType)
+		assert.False(t, events[1].Typing)
+		assert.Equal(t, QueueStats{Coalesced: 1}, h.QueueStats())
+	})
+
+	t.Run("coalesce can't make room", func(t *testing.T) {
+		h := newHub()
+		r := newRoomHub(h, "office")
+		slow := newSlowSubscription("office", "jim")
+		r.RegisterCase(slow)
+
+		for _, body := range []string{"1", "2", "3"} {
+			r.BroadcastCase(message(body))
+		}
+
+		_, stillRegistered := r.subs[slow]
+		assert.False(t, stillRegistered)
+		assert.Equal(t, websocket.CloseTryAgainLater, slow.conn.closeCode)
+		assert.Equal(t, QueueStats{Disconnected: 1}, h.QueueStats())
+	})
+}
+
+func TestCoalesce(t *testing.T) {
+	events := coalesce([]Event{
+		NewJoinedEvent("office", "pam"),
+		NewTypingEvent("office", "pam", true),
+		NewTypingEvent("office", "dwight", true),
+		message("1"),
+		NewLeftEvent("office", "pam"),
+		NewTypingEvent("office", "pam", false),
+	})
+
+	assert.Equal(t, []Event{
+		NewTypingEvent("office", "dwight", true),
+		message("1"),
+		NewLeftEvent("office", "pam"),
+		NewTypingEvent("office", "pam", false),
+	}, events)
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for name, expected := range map[string]OverflowPolicy{"": Coalesce, "coalesce": Coalesce, "drop_oldest": DropOldest, "disconnect": Disconnect} {
+		policy, err := ParseOverflowPolicy(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, policy)
+	}
+
+	_, err := ParseOverflowPolicy("ignore")
+	assert.Error(t, err)
+}
@@ -0,0 +1,233 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/streadway/amqp"
+	"log"
+	"sync"
+)
+
+const relayExchange = "chat.events"
+
+// RelayMessage is what travels between instances. Origin identifies the instance that published the event so that
+// it can ignore its own echo when the exchange fans the event back out to it. UserID is set for the events addressed
+// to a student's multiplexed connections rather than to a room. Heartbeat carries the presence of a room instead of
+// an event, and SyncPresence asks every other instance for the heartbeats of its rooms right away
+type RelayMessage struct {
+	Origin       string             `json:"origin"`
+	Event        Event              `json:"event"`
+	UserID       string             `json:"user_id,omitempty"`
+	Heartbeat    *PresenceHeartbeat `json:"heartbeat,omitempty"`
+	SyncPresence bool               `json:"sync_presence,omitempty"`
+}
+
+// Relay carries hub events between the instances of the service. Publish sends an event out to every instance,
+// including the one publishing it, and Messages returns the stream of events published by all the instances
+type Relay interface {
+	Publish(message RelayMessage) error
+	Messages() (<-chan RelayMessage, error)
+}
+
+// AMQPRelay is the relay over RabbitMQ. It has its own connection, which it dials again when Messages is called after
+// the connection dropped
+type AMQPRelay struct {
+	dial func() (*amqp.Connection, error)
+
+	// mu guards the connection, its channel and the instance's queue on it. stale is set once the consumer of the
+	// queue stopped, closed by Close
+	mu     sync.Mutex
+	conn   *amqp.Connection
+	ch     *amqp.Channel
+	queue  string
+	stale  bool
+	closed bool
+}
+
+// errRelayClosed is returned by Messages once the relay is closed
+var errRelayClosed = errors.New("relay is closed")
+
+// NewAMQPRelay dials the relay's connection and declares the fanout exchange and an exclusive queue bound to it on
+// it. Each instance gets its own queue so that every event reaches every instance
+func NewAMQPRelay(dial func() (*amqp.Connection, error)) (*AMQPRelay, error) {
+	r := &AMQPRelay{dial: dial}
+	if err := r.connect(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// connect dials a new connection and declares the exchange and the instance's queue on it. The queue is exclusive, so
+// the queue of a previous connection went away with it
+func (r *AMQPRelay) connect() error {
+	conn, err := r.dial()
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	err = ch.ExchangeDeclare(
+		relayExchange, // name
+		"fanout",      // type
+		true,          // durable
+		false,         // auto-deleted
+		false,         // internal
+		false,         // no-wait
+		nil,           // arguments
+	)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	q, err := ch.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	err = ch.QueueBind(
+		q.Name,        // queue name
+		"",            // routing key
+		relayExchange, // exchange
+		false,
+		nil)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	r.conn, r.ch, r.queue, r.stale = conn, ch, q.Name, false
+	return nil
+}
+
+// Publish marshals the message and publishes it to the exchange. While the connection is down, it fails
+func (r *AMQPRelay) Publish(message RelayMessage) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	ch := r.ch
+	r.mu.Unlock()
+	return ch.Publish(
+		relayExchange, // exchange
+		"",            // routing key
+		false,         // mandatory
+		false,         // immediate
+		amqp.Publishing{
+			ContentType: "application/json",
+			Body:        body,
+		})
+}
+
+// Messages consumes the instance's queue, on a new connection if the previous one dropped or its consumer stopped.
+// Events are only useful to sockets that are currently connected, so the deliveries are auto acked and anything that
+// can't be decoded is dropped. The channel is closed when the connection drops
+func (r *AMQPRelay) Messages() (<-chan RelayMessage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, errRelayClosed
+	}
+	if r.stale || r.conn.IsClosed() {
+		r.conn.Close()
+		if err := r.connect(); err != nil {
+			r.stale = true
+			return nil, err
+		}
+	}
+
+	deliveries, err := r.ch.Consume(
+		r.queue, // queue
+		"",      // consumer
+		true,    // auto ack
+		true,    // exclusive
+		false,   // no local
+		false,   // no wait
+		nil,     // args
+	)
+	if err != nil {
+		r.stale = true
+		return nil, err
+	}
+
+	messages := make(chan RelayMessage)
+	go func() {
+		defer close(messages)
+		for d := range deliveries {
+			var m RelayMessage
+			if err := json.Unmarshal(d.Body, &m); err != nil {
+				log.Printf("dropping relay message that couldn't be decoded: %s", err.Error())
+				continue
+			}
+			messages <- m
+		}
+		r.mu.Lock()
+		r.stale = true
+		r.mu.Unlock()
+	}()
+	return messages, nil
+}
+
+// Close closes the relay's connection, Messages fails from then on
+func (r *AMQPRelay) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return r.conn.Close()
+}
+
+// LocalBroker is an in-memory stand-in for the exchange. Every relay created from it receives whatever any of them
+// publishes, which is enough to run several hubs side by side in one process
+type LocalBroker struct {
+	mu     sync.Mutex
+	queues []chan RelayMessage
+}
+
+// NewLocalBroker is a constructor
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{}
+}
+
+// Relay attaches a new relay, with its own queue, to the broker
+func (b *LocalBroker) Relay() Relay {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q := make(chan RelayMessage, 64)
+	b.queues = append(b.queues, q)
+	return &localRelay{broker: b, queue: q}
+}
+
+type localRelay struct {
+	broker *LocalBroker
+	queue  chan RelayMessage
+}
+
+// Publish copies the message into the queue of every relay attached to the broker
+func (r *localRelay) Publish(message RelayMessage) error {
+	r.broker.mu.Lock()
+	defer r.broker.mu.Unlock()
+
+	for _, q := range r.broker.queues {
+		q <- message
+	}
+	return nil
+}
+
+// Messages returns the relay's queue
+func (r *localRelay) Messages() (<-chan RelayMessage, error) {
+	return r.queue, nil
+}
@@ -0,0 +1,131 @@
+package http
+
+import (
+	"chat/domain"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSubscription(roomID, userID string) subscription {
+	return subscription{conn: &connection{send: make(chan Event, 8)}, roomID: roomID, userID: userID}
+}
+
+// nextMessage returns the next event that isn't about presence, which depends on the order the subscriptions were
+// registered in
+func nextMessage(s subscription, wait time.Duration) (Event, bool) {
+	timeout := time.After(wait)
+	for {
+		select {
+		case e := <-s.conn.send:
+			if e.MessageType == Joined || e.MessageType == Left {
+				continue
+			}
+			return e, true
+		case <-timeout:
+			return Event{}, false
+		}
+	}
+}
+
+func expectEvent(t *testing.T, s subscription, body string) {
+	e, ok := nextMessage(s, time.Second)
+	if !ok {
+		assert.Fail(t, "expected an event for "+s.userID)
+		return
+	}
+	assert.Equal(t, body, e.Message.MessageBody)
+}
+
+func expectNoEvent(t *testing.T, s subscription) {
+	if e, ok := nextMessage(s, 100*time.Millisecond); ok {
+		assert.Fail(t, "received an unexpected event", e.Message.MessageBody)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	broker := NewLocalBroker()
+	first := newHub()
+	first.SetRelay(broker.Relay())
+	second := newHub()
+	second.SetRelay(broker.Relay())
+	go first.StartHubListener()
+	go second.StartHubListener()
+
+	local := newTestSubscription("office", "jim")
+	remote := newTestSubscription("office", "pam")
+	otherRoom := newTestSubscription("allstars", "kevin")
+	first.Register(local)
+	second.Register(remote)
+	second.Register(otherRoom)
+
+	t.Run("delivered on both instances exactly once", func(t *testing.T) {
+		first.broadcast(NewSendEvent(domain.Message{RoomID: "office", FromStudentID: "dwight", MessageBody: "first"}))
+
+		expectEvent(t, local, "first")
+		expectEvent(t, remote, "first")
+		expectNoEvent(t, local)
+		expectNoEvent(t, otherRoom)
+	})
+
+	t.Run("sender's connections on remote instance", func(t *testing.T) {
+		first.broadcast(NewSendEvent(domain.Message{RoomID: "office", FromStudentID: "jim", MessageBody: "second"}).from(local.conn))
+
+		expectEvent(t, remote, "second")
+		expectNoEvent(t, local)
+	})
+
+	t.Run("remote events are not published again", func(t *testing.T) {
+		second.broadcast(NewSendEvent(domain.Message{RoomID: "office", FromStudentID: "dwight", MessageBody: "third"}))
+
+		expectEvent(t, remote, "third")
+		expectEvent(t, local, "third")
+		expectNoEvent(t, remote)
+		expectNoEvent(t, local)
+	})
+}
+
+// droppingRelay fails to listen once, then drops the first stream it returns, before it listens for good
+type droppingRelay struct {
+	Relay
+	mu    sync.Mutex
+	calls int
+}
+
+func (r *droppingRelay) Messages() (<-chan RelayMessage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	switch r.calls {
+	case 1:
+		return nil, errors.New("connection refused")
+	case 2:
+		dropped := make(chan RelayMessage)
+		close(dropped)
+		return dropped, nil
+	}
+	return r.Relay.Messages()
+}
+
+func TestRelayReconnects(t *testing.T) {
+	broker := NewLocalBroker()
+	relay := &droppingRelay{Relay: broker.Relay()}
+	first := newHub()
+	first.relayBackoff = 10 * time.Millisecond
+	first.SetRelay(relay)
+	second := newHub()
+	second.SetRelay(broker.Relay())
+	go first.StartHubListener()
+	go second.StartHubListener()
+
+	local := newTestSubscription("office", "jim")
+	first.Register(local)
+	second.broadcast(NewSendEvent(domain.Message{RoomID: "office", FromStudentID: "dwight", MessageBody: "still there?"}))
+
+	expectEvent(t, local, "still there?")
+	relay.mu.Lock()
+	assert.Equal(t, 3, relay.calls)
+	relay.mu.Unlock()
+}
@@ -0,0 +1,119 @@
+package http
+
+import (
+	"chat/domain"
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	replayIncompleteTooMany = "more messages were missed than are replayed"
+	replayIncompleteFailed  = "the missed messages couldn't be loaded"
+)
+
+// replayCursor is where a reconnecting client resumes from: the last message it received, or the time it was sent
+// at for the clients that only kept that. Messages sent in the same millisecond are only told apart by their id
+type replayCursor struct {
+	messageID string
+	since     time.Time
+}
+
+// parseReplayCursor reads the id of a message, or an RFC3339 timestamp
+func parseReplayCursor(value string) (replayCursor, bool) {
+	if validMessageID(value) {
+		return replayCursor{messageID: value}, true
+	}
+	since, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil || since.IsZero() {
+		return replayCursor{}, false
+	}
+	return replayCursor{since: since}, true
+}
+
+func (c replayCursor) isZero() bool {
+	return c.messageID == "" && c.since.IsZero()
+}
+
+// NewReplayIncompleteEvent tells a reconnecting client that the messages it missed after the cursor weren't all
+// replayed, and why. Message carries the cursor: the client loads the rest of the history after Message.MessageID, or
+// after Message.SentTimestamp when it has no id
+func NewReplayIncompleteEvent(roomID string, cursor replayCursor, reason string) Event {
+	return Event{
+		MessageType: ReplayIncomplete,
+		Message:     domain.Message{RoomID: roomID, MessageID: cursor.messageID, SentTimestamp: cursor.since},
+		Error:       reason,
+	}
+}
+
+// loadMissed loads the events a client of the subscription's room missed after the cursor in the background
+func (h *MessageHandler) loadMissed(s subscription, cursor replayCursor) <-chan []Event {
+	replay := make(chan []Event, 1)
+	go func() {
+		replay <- h.missedEvents(context.Background(), s, cursor)
+	}()
+	return replay
+}
+
+// missedEvents loads the messages sent after the cursor a page at a time, until it is caught up or has
+// maxReplayMessages. When they couldn't all be loaded, a ReplayIncomplete event after the last one loaded ends them
+func (h *MessageHandler) missedEvents(ctx context.Context, s subscription, cursor replayCursor) []Event {
+	events := []Event{}
+	for {
+		// once the page would reach the maximum, one more message is loaded to tell if there are more
+		remaining := maxReplayMessages - len(events)
+		limit := replayPageSize
+		if remaining < limit {
+			limit = remaining + 1
+		}
+
+		var page []domain.Message
+		var err error
+		if cursor.messageID == "" {
+			page, err = h.u.GetMessagesSince(ctx, s.roomID, cursor.since, limit)
+		} else {
+			page, err = h.u.GetMessagesAfter(ctx, s.roomID, cursor.messageID, limit)
+		}
+		if err != nil {
+			log.Printf("couldn't load missed messages for %s in room %s with err %s", s.userID, s.roomID, err.Error())
+			return append(events, NewReplayIncompleteEvent(s.roomID, cursor, replayIncompleteFailed))
+		}
+
+		tooMany := len(page) > remaining
+		if tooMany {
+			page = page[:remaining]
+		}
+		for _, m := range page {
+			events = append(events, NewSendEvent(m))
+		}
+		if len(page) > 0 {
+			cursor = replayCursor{messageID: page[len(page)-1].MessageID}
+		}
+		if tooMany {
+			return append(events, NewReplayIncompleteEvent(s.roomID, cursor, replayIncompleteTooMany))
+		}
+		if len(page) < limit {
+			return events
+		}
+	}
+}
+
+// afterReplay returns the events to write once the missed messages are loaded: the replayed events, then the live
+// events held back in the meantime, without those for messages that were already replayed
+func afterReplay(replayed []Event, pending []Event) []Event {
+	events := make([]Event, 0, len(replayed)+len(pending))
+	sent := make(map[string]bool, len(replayed))
+	for _, e := range replayed {
+		events = append(events, e)
+		if e.MessageType == Send {
+			sent[e.Message.MessageID] = true
+		}
+	}
+	for _, e := range pending {
+		if e.MessageType == Send && sent[e.Message.MessageID] {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events
+}
@@ -0,0 +1,114 @@
+package http
+
+import (
+	"chat/domain"
+	"chat/domain/mocks"
+	"context"
+	"errors"
+	"github.com/gocql/gocql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+// missedPage returns n messages of the room, oldest first
+func missedPage(roomID string, n int) []domain.Message {
+	page := make([]domain.Message, n)
+	for i := range page {
+		page[i] = domain.Message{RoomID: roomID, MessageID: gocql.TimeUUID().String()}
+	}
+	return page
+}
+
+func TestParseReplayCursor(t *testing.T) {
+	id := gocql.TimeUUID().String()
+	cursor, ok := parseReplayCursor(id)
+	assert.True(t, ok)
+	assert.Equal(t, replayCursor{messageID: id}, cursor)
+
+	cursor, ok = parseReplayCursor("2021-11-03T14:05:07.123Z")
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2021, time.November, 3, 14, 5, 7, 123000000, time.UTC), cursor.since)
+
+	_, ok = parseReplayCursor("yesterday")
+	assert.False(t, ok)
+	random, _ := gocql.RandomUUID()
+	_, ok = parseReplayCursor(random.String())
+	assert.False(t, ok)
+}
+
+func TestMissedEvents(t *testing.T) {
+	s := subscription{roomID: "office", userID: "jim"}
+	since := time.Now().Add(-time.Hour)
+
+	t.Run("pages until caught up", func(t *testing.T) {
+		u := new(mocks.MessageUseCase)
+		h := NewMessageHandler(u, nil)
+		first, second := missedPage("office", replayPageSize), missedPage("office", 2)
+		u.On("GetMessagesSince", mock.Anything, "office", since, replayPageSize).Return(first, nil).Once()
+		u.On("GetMessagesAfter", mock.Anything, "office", first[replayPageSize-1].MessageID, replayPageSize).
+			Return(second, nil).Once()
+
+		events := h.missedEvents(context.Background(), s, replayCursor{since: since})
+
+		assert.Len(t, events, replayPageSize+2)
+		assert.Equal(t, second[1].MessageID, events[len(events)-1].Message.MessageID)
+		u.AssertExpectations(t)
+	})
+
+	t.Run("resumes after a message", func(t *testing.T) {
+		u := new(mocks.MessageUseCase)
+		h := NewMessageHandler(u, nil)
+		last := gocql.TimeUUID().String()
+		u.On("GetMessagesAfter", mock.Anything, "office", last, replayPageSize).Return([]domain.Message{}, nil).Once()
+
+		events := h.missedEvents(context.Background(), s, replayCursor{messageID: last})
+
+		assert.Empty(t, events)
+		u.AssertExpectations(t)
+	})
+
+	t.Run("more than are replayed", func(t *testing.T) {
+		u := new(mocks.MessageUseCase)
+		h := NewMessageHandler(u, nil)
+		pages := maxReplayMessages / replayPageSize
+		u.On("GetMessagesSince", mock.Anything, "office", since, replayPageSize).
+			Return(missedPage("office", replayPageSize), nil).Once()
+		u.On("GetMessagesAfter", mock.Anything, "office", mock.Anything, replayPageSize).
+			Return(func(context.Context, string, string, int) []domain.Message {
+				return missedPage("office", replayPageSize)
+			}, nil).Times(pages - 1)
+		// one more message tells there are more
+		u.On("GetMessagesAfter", mock.Anything, "office", mock.Anything, 1).
+			Return(missedPage("office", 1), nil).Once()
+
+		events := h.missedEvents(context.Background(), s, replayCursor{since: since})
+
+		assert.Len(t, events, maxReplayMessages+1)
+		incomplete := events[maxReplayMessages]
+		assert.Equal(t, ReplayIncomplete, incomplete.MessageType)
+		assert.Equal(t, replayIncompleteTooMany, incomplete.Error)
+		assert.Equal(t, events[maxReplayMessages-1].Message.MessageID, incomplete.Message.MessageID)
+		u.AssertExpectations(t)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		u := new(mocks.MessageUseCase)
+		h := NewMessageHandler(u, nil)
+		first := missedPage("office", replayPageSize)
+		u.On("GetMessagesSince", mock.Anything, "office", since, replayPageSize).Return(first, nil).Once()
+		u.On("GetMessagesAfter", mock.Anything, "office", mock.Anything, replayPageSize).
+			Return(nil, errors.New("error")).Once()
+
+		events := h.missedEvents(context.Background(), s, replayCursor{since: since})
+
+		// the client is told where the replay stopped rather than left with a hole it can't see
+		assert.Len(t, events, replayPageSize+1)
+		incomplete := events[replayPageSize]
+		assert.Equal(t, ReplayIncomplete, incomplete.MessageType)
+		assert.Equal(t, replayIncompleteFailed, incomplete.Error)
+		assert.Equal(t, first[replayPageSize-1].MessageID, incomplete.Message.MessageID)
+		u.AssertExpectations(t)
+	})
+}
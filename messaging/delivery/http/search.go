@@ -0,0 +1,68 @@
+package http
+
+import (
+	"chat/domain"
+	"chat/utils/errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+// maxSearchLimit bounds how many hits a page of search results holds
+const maxSearchLimit = 50
+
+// SearchHit is a message a search found. Snippet is the HTML escaped part of the body around the terms, each of them
+// wrapped in <mark>. Cursor is a history cursor of the message: before and after of the history take it to load the
+// messages on either side, and its message id is what around takes
+type SearchHit struct {
+	Message domain.Message `json:"message"`
+	Snippet string         `json:"snippet"`
+	Cursor  string         `json:"cursor"`
+}
+
+// SearchPage is a page of search hits, newest first. Next loads the older hits, it is left out after the last one
+type SearchPage struct {
+	Hits []SearchHit `json:"hits"`
+	Next string      `json:"next,omitempty"`
+}
+
+// SearchMessages searches the messages of the room, or of every room of the user on the route without one, for the
+// words of q. A message is found when it has every word, whatever their case. before takes the next cursor of another
+// page, limit is 10 by default
+func (h *MessageHandler) SearchMessages(c *gin.Context) {
+	key, _ := c.Get("loggedID")
+	loggedID, _ := key.(string)
+
+	query := domain.SearchQuery{Text: c.Query("q"), RoomID: c.Param("roomID"), Limit: 10}
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit > 0 {
+		query.Limit = limit
+	}
+	if query.Limit > maxSearchLimit {
+		query.Limit = maxSearchLimit
+	}
+	var ok bool
+	if query.Before, ok = decodeCursor(c.Query("before")); !ok {
+		c.JSON(http.StatusBadRequest, errors.NewBadRequestError("before must be the next cursor of a page"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	result, err := h.u.SearchMessages(ctx, loggedID, query)
+	if err != nil {
+		errors.SetRESTError(err, c)
+		return
+	}
+
+	response := SearchPage{Hits: []SearchHit{}}
+	for _, hit := range result.Hits {
+		response.Hits = append(response.Hits, SearchHit{
+			Message: hit.Message,
+			Snippet: hit.Snippet,
+			Cursor:  encodeCursor(hit.Message.MessageID),
+		})
+	}
+	if result.HasMore && len(response.Hits) > 0 {
+		response.Next = response.Hits[len(response.Hits)-1].Cursor
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,87 @@
+package http
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"sync/atomic"
+)
+
+const shutdownCloseReason = "server shutting down"
+
+// Shutdown closes every connection of this instance with CloseGoingAway, so the clients know to reconnect to
+// another instance. The events already queued for a connection are written before its close frame, and the frames
+// its readPump is handling, e.g. a message being saved, are finished before Shutdown returns. Then the events still
+// waiting for the relay are published. Connections registered afterwards are closed right away. It must be called
+// once the server no longer accepts connections, and gives up when ctx is done
+func (h *hub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.stopped = true
+	rooms := make([]*roomHub, 0, len(h.rooms))
+	for _, r := range h.rooms {
+		rooms = append(rooms, r)
+	}
+	h.mu.Unlock()
+
+	for _, r := range rooms {
+		closed := make(chan struct{})
+		select {
+		case r.inbox <- func(r *roomHub) {
+			r.closeAll(websocket.CloseGoingAway, shutdownCloseReason)
+			close(closed)
+		}:
+		case <-r.done:
+			continue
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := wait(ctx, closed); err != nil {
+			return err
+		}
+	}
+	// the multiplexed connections that aren't subscribed to any room
+	h.endUsers(websocket.CloseGoingAway, shutdownCloseReason)
+	if err := wait(ctx, h.pumpsDone()); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.relayClosed = true
+	close(h.outbound)
+	h.mu.Unlock()
+	if atomic.LoadInt32(&h.publishing) == 1 {
+		return wait(ctx, h.published)
+	}
+	return nil
+}
+
+func (h *hub) isStopped() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.stopped
+}
+
+// pumpsDone is closed once the pumps of every connection have returned
+func (h *hub) pumpsDone() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		h.pumps.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func wait(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeAll disconnects every subscription to the room on this instance
+func (r *roomHub) closeAll(code int, reason string) {
+	for s := range r.subs {
+		r.disconnect(s, code, reason)
+	}
+}
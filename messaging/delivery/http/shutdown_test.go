@@ -0,0 +1,55 @@
+package http
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	broker := NewLocalBroker()
+	first := newHub()
+	first.SetRelay(broker.Relay())
+	second := newHub()
+	second.SetRelay(broker.Relay())
+	go first.StartHubListener()
+	go second.StartHubListener()
+
+	jim := newTestSubscription("office", "jim")
+	pam := newTestSubscription("office", "pam")
+	first.Register(jim)
+	assert.Eventually(t, func() bool { return len(second.Online("office")) == 1 }, time.Second, 10*time.Millisecond)
+	second.Register(pam)
+	expectPresence(t, jim, Joined, "pam")
+
+	first.broadcast(message("see you tomorrow"))
+	expectEvent(t, pam, "see you tomorrow")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, first.Shutdown(ctx))
+
+	t.Run("queued events are written before the close frame", func(t *testing.T) {
+		var events []Event
+		for e := range jim.conn.send {
+			events = append(events, e)
+		}
+		assert.Len(t, events, 1)
+		assert.Equal(t, "see you tomorrow", events[0].Message.MessageBody)
+		assert.Equal(t, websocket.CloseGoingAway, jim.conn.closeCode)
+		assert.Equal(t, shutdownCloseReason, jim.conn.closeReason)
+	})
+
+	t.Run("other instances are told before the relay closes", func(t *testing.T) {
+		expectPresence(t, pam, Left, "jim")
+	})
+
+	t.Run("connections registered afterwards are closed", func(t *testing.T) {
+		late := newTestSubscription("office", "kevin")
+		first.Register(late)
+		expectClosed(t, late, websocket.CloseGoingAway)
+		expectNoPresence(t, pam)
+	})
+}
@@ -0,0 +1,149 @@
+package http
+
+import (
+	"chat/utils/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// StreamClose is the payload of the close event that ends a stream, the equivalent of a websocket close frame
+type StreamClose struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// StreamEvents streams the events of the room as server-sent events, for the clients whose network blocks websocket
+// upgrades. Each event carries the same json a websocket gets. Messages carry their id as event id, so a client
+// reconnecting with Last-Event-ID gets the messages it missed before any live event, like with since on a websocket.
+// When the hub closes the subscription, the stream ends with a close event. Sending goes through the REST endpoints
+func (h *MessageHandler) StreamEvents(c *gin.Context) {
+	roomID := c.Param("roomID")
+	key, _ := c.Get("loggedID")
+	loggedID, _ := key.(string)
+
+	ctx := c.Request.Context()
+	if !h.u.IsAuthorized(ctx, loggedID, roomID) {
+		c.JSON(http.StatusUnauthorized, errors.NewUnauthorizedError("Not authorized to enter the room number "+roomID))
+		return
+	}
+
+	// the streams opened before messages had ids as event ids resume from their timestamp
+	var cursor replayCursor
+	if lastEventID := c.GetHeader("Last-Event-ID"); lastEventID != "" {
+		var ok bool
+		if cursor, ok = parseReplayCursor(lastEventID); !ok {
+			c.JSON(http.StatusBadRequest, errors.NewBadRequestError("Last-Event-ID must be the id of a message event"))
+			return
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// proxies like nginx buffer responses unless told otherwise, which holds the events back
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	s := subscription{&connection{send: make(chan Event, sendBufferSize)}, roomID, loggedID}
+	mainHub.Register(s)
+	defer mainHub.unregister(s)
+
+	// like for a websocket, the subscription is registered before the missed messages are loaded
+	var replay <-chan []Event
+	if !cursor.isZero() {
+		replay = h.loadMissed(s, cursor)
+	}
+	s.streamPump(c.Writer, replay, ctx.Done())
+}
+
+// streamPump writes the events of the subscription to the stream until the hub closes it or the client goes away.
+// Live events are held back until the missed messages are written, like in writePump. Once the hub is shutting down,
+// the events already queued are written before the close event
+func (s *subscription) streamPump(w gin.ResponseWriter, replay <-chan []Event, gone <-chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	replaying := replay != nil
+	var pending []Event
+	for {
+		select {
+		case replayed := <-replay:
+			for _, e := range afterReplay(replayed, pending) {
+				if err := writeStreamEvent(w, e); err != nil {
+					return
+				}
+			}
+			replay, replaying, pending = nil, false, nil
+		case message, ok := <-s.conn.send:
+			if !ok {
+				writeStreamClose(w, s.conn.closeCode, s.conn.closeReason)
+				return
+			}
+			if replaying {
+				pending = append(pending, message)
+				continue
+			}
+			if err := writeStreamEvent(w, message); err != nil {
+				return
+			}
+		case <-mainHub.streamsStopped:
+			for _, e := range append(pending, drain(s.conn.send)...) {
+				if err := writeStreamEvent(w, e); err != nil {
+					return
+				}
+			}
+			writeStreamClose(w, websocket.CloseGoingAway, shutdownCloseReason)
+			return
+		case <-ticker.C:
+			// a comment keeps proxies from closing an idle stream, and a failed write tells the client went away
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			w.Flush()
+		case <-gone:
+			return
+		}
+	}
+}
+
+// writeStreamEvent writes the event as a server-sent event. Only messages have an id, their own, since that is what a
+// client resumes from
+func writeStreamEvent(w gin.ResponseWriter, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("message %s couldn't be streamed to room %s.", e.Message.MessageID, e.Message.RoomID)
+		return nil
+	}
+	if e.MessageType == Send {
+		if _, err = fmt.Fprintf(w, "id: %s\n", e.Message.MessageID); err != nil {
+			return err
+		}
+	}
+	if _, err = fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// writeStreamClose ends the stream with a close event, which has the code and reason a websocket would get
+func writeStreamClose(w gin.ResponseWriter, code int, reason string) {
+	if code == 0 {
+		code = websocket.CloseNormalClosure
+	}
+	data, _ := json.Marshal(StreamClose{Code: code, Reason: reason})
+	fmt.Fprintf(w, "event: close\ndata: %s\n\n", data)
+	w.Flush()
+}
+
+// StopStreams ends every stream with a close event, after the events already queued for it. Streams are plain
+// requests, so the server waits for them when shutting down: this must be registered with RegisterOnShutdown
+func (h *hub) StopStreams() {
+	h.stopStreams.Do(func() { close(h.streamsStopped) })
+}
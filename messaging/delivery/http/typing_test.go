@@ -0,0 +1,62 @@
+package http
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTypingThrottle(t *testing.T) {
+	t.Run("toggling is broadcast once per interval with the final state", func(t *testing.T) {
+		var throttle typingThrottle
+		broadcasts := make(chan bool, 10)
+		broadcast := func(typing bool) { broadcasts <- typing }
+
+		now := time.Now()
+		for i := 0; i < 10; i++ {
+			throttle.offer(i%2 == 0, now, broadcast)
+		}
+		// the client ends up not typing
+		throttle.offer(false, now, broadcast)
+
+		assert.True(t, <-broadcasts)
+		select {
+		case typing := <-broadcasts:
+			assert.False(t, typing)
+		case <-time.After(typingMinInterval * 2):
+			assert.Fail(t, "the final state was never broadcast")
+		}
+		assert.Empty(t, broadcasts)
+	})
+
+	t.Run("going back to the broadcast state within the interval sends nothing", func(t *testing.T) {
+		var throttle typingThrottle
+		broadcasts := make(chan bool, 10)
+		broadcast := func(typing bool) { broadcasts <- typing }
+
+		now := time.Now()
+		throttle.offer(true, now, broadcast)
+		throttle.offer(false, now, broadcast)
+		throttle.offer(true, now, broadcast)
+
+		assert.True(t, <-broadcasts)
+		time.Sleep(typingMinInterval + typingMinInterval/2)
+		assert.Empty(t, broadcasts)
+	})
+
+	t.Run("stop drops the state held back", func(t *testing.T) {
+		var throttle typingThrottle
+		broadcasts := make(chan bool, 10)
+		broadcast := func(typing bool) { broadcasts <- typing }
+
+		now := time.Now()
+		throttle.offer(true, now, broadcast)
+		throttle.offer(false, now, broadcast)
+		throttle.stop()
+		throttle.offer(false, now.Add(typingInterval), broadcast)
+
+		assert.True(t, <-broadcasts)
+		time.Sleep(typingMinInterval + typingMinInterval/2)
+		assert.Empty(t, broadcasts)
+	})
+}
@@ -0,0 +1,237 @@
+package http
+
+import (
+	"chat/domain"
+	"chat/utils/ratelimit"
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// NewSubscribedEvent confirms to a multiplexed connection that it now gets the events of the room
+func NewSubscribedEvent(roomID string, clientMsgID string) Event {
+	return Event{
+		MessageType: Subscribed,
+		Message:     domain.Message{RoomID: roomID},
+		ClientMsgID: clientMsgID,
+	}
+}
+
+// NewUnsubscribedEvent confirms to a multiplexed connection that it no longer gets the events of the room
+func NewUnsubscribedEvent(roomID string, clientMsgID string) Event {
+	return Event{
+		MessageType: Unsubscribed,
+		Message:     domain.Message{RoomID: roomID},
+		ClientMsgID: clientMsgID,
+	}
+}
+
+// userSocket is a student's multiplexed connection, subscribed to any number of their rooms
+type userSocket struct {
+	conn   *connection
+	userID string
+
+	// mu guards rooms, the rooms the connection is subscribed to with their typing throttle. The student losing
+	// access to a room removes it from another goroutine
+	mu    sync.Mutex
+	rooms map[string]*typingThrottle
+}
+
+// ServeUserWs is the handleFunc for a student's multiplexed websocket, a single connection for all their rooms. The
+// client subscribes to the rooms it wants with subscribe frames, each authorized like a room's websocket, and every
+// other frame says which room it is for. Events are tagged with their room. The student is also told when they are
+// added to a room, removed from one or when one of their rooms is deleted, whether they are subscribed to it or not.
+// Missed messages aren't replayed, the client loads them with the history endpoints
+func (h *MessageHandler) ServeUserWs(w http.ResponseWriter, r *http.Request) {
+	userID, ok := h.loggedInUser(r)
+	if !ok {
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	c := &connection{send: make(chan Event, sendBufferSize), ws: ws, multiplexed: true, closed: make(chan struct{})}
+	u := &userSocket{conn: c, userID: userID, rooms: make(map[string]*typingThrottle)}
+	if !mainHub.addUser(u) {
+		c.end(websocket.CloseGoingAway, shutdownCloseReason)
+	}
+
+	s := subscription{conn: c, userID: userID}
+	mainHub.pumps.Add(2)
+	go s.writePump(nil)
+	go u.readPump(h.u, h.limiter)
+}
+
+func (u *userSocket) readPump(uc domain.MessageUseCase, limiter *ratelimit.Limiter) {
+	c := u.conn
+	defer func() {
+		mainHub.removeUser(u)
+		u.mu.Lock()
+		rooms := u.rooms
+		u.rooms = make(map[string]*typingThrottle)
+		u.mu.Unlock()
+		for roomID, throttle := range rooms {
+			throttle.stop()
+			mainHub.unregister(u.subscription(roomID))
+		}
+		c.end(websocket.CloseNormalClosure, "")
+		mainHub.pumps.Done()
+		c.ws.Close()
+	}()
+	c.readFrames(u.reply, func(frame InboundFrame) {
+		switch frame.Type {
+		case FrameSubscribe:
+			u.subscribe(uc, frame)
+		case FrameUnsubscribe:
+			u.unsubscribe(frame)
+		case FrameSend, FrameTyping, FrameRead:
+			u.mu.Lock()
+			throttle, ok := u.rooms[frame.RoomID]
+			u.mu.Unlock()
+			if !ok {
+				u.reply(NewErrorEvent(frame.ClientMsgID, "not subscribed to room "+frame.RoomID))
+				return
+			}
+			s := u.subscription(frame.RoomID)
+			switch frame.Type {
+			case FrameSend:
+				s.handleSend(uc, limiter, frame)
+			case FrameTyping:
+				s.handleTyping(throttle, frame)
+			case FrameRead:
+				s.handleRead(uc, frame)
+			}
+		default:
+			u.reply(NewErrorEvent(frame.ClientMsgID, fmt.Sprintf("unknown frame type %q", frame.Type)))
+		}
+	})
+}
+
+func (u *userSocket) subscription(roomID string) subscription {
+	return subscription{conn: u.conn, roomID: roomID, userID: u.userID}
+}
+
+// subscribe registers the connection in the room, as long as the student is a member. The confirmation goes through
+// the room, so it comes before any event of the room
+func (u *userSocket) subscribe(uc domain.MessageUseCase, frame InboundFrame) {
+	if frame.RoomID == "" {
+		u.reply(NewErrorEvent(frame.ClientMsgID, "subscribe frame must have a room_id"))
+		return
+	}
+	if !uc.IsAuthorized(context.Background(), u.userID, frame.RoomID) {
+		u.reply(NewErrorEvent(frame.ClientMsgID, "Not authorized to enter the room number "+frame.RoomID))
+		return
+	}
+
+	u.mu.Lock()
+	if _, ok := u.rooms[frame.RoomID]; !ok {
+		u.rooms[frame.RoomID] = &typingThrottle{}
+	}
+	u.mu.Unlock()
+	s := u.subscription(frame.RoomID)
+	mainHub.Register(s)
+	s.reply(NewSubscribedEvent(frame.RoomID, frame.ClientMsgID))
+}
+
+// unsubscribe removes the connection from the room. The confirmation is the last event of the room it gets
+func (u *userSocket) unsubscribe(frame InboundFrame) {
+	u.mu.Lock()
+	throttle, ok := u.rooms[frame.RoomID]
+	delete(u.rooms, frame.RoomID)
+	u.mu.Unlock()
+	if !ok {
+		u.reply(NewErrorEvent(frame.ClientMsgID, "not subscribed to room "+frame.RoomID))
+		return
+	}
+	throttle.stop()
+
+	s := u.subscription(frame.RoomID)
+	s.reply(NewUnsubscribedEvent(frame.RoomID, frame.ClientMsgID))
+	mainHub.unregister(s)
+}
+
+// reply queues an event that isn't about a room the connection is subscribed to. The send queue of a multiplexed
+// connection is never closed, so it is safe from any goroutine. If the queue is full, the connection is closed
+func (u *userSocket) reply(e Event) {
+	select {
+	case u.conn.send <- e:
+	default:
+		atomic.AddInt64(&mainHub.counters.disconnected, 1)
+		u.conn.end(websocket.CloseTryAgainLater, overflowCloseReason)
+	}
+}
+
+// deliver queues a change to the student's rooms, tagged with the room. Once the student lost access to the room,
+// frames for it are refused
+func (u *userSocket) deliver(h *hub, e Event) {
+	if e.MessageType == MemberRemoved || e.MessageType == RoomDeleted {
+		u.mu.Lock()
+		delete(u.rooms, e.Message.RoomID)
+		u.mu.Unlock()
+	}
+	e.RoomID = e.Message.RoomID
+	select {
+	case u.conn.send <- e:
+	default:
+		atomic.AddInt64(&h.counters.disconnected, 1)
+		u.conn.end(websocket.CloseTryAgainLater, overflowCloseReason)
+	}
+}
+
+// addUser makes the multiplexed connection reachable by notifyUser. Once the hub is shutting down, it returns false
+func (h *hub) addUser(u *userSocket) bool {
+	h.usersMu.Lock()
+	defer h.usersMu.Unlock()
+	if h.isStopped() {
+		return false
+	}
+	if h.users[u.userID] == nil {
+		h.users[u.userID] = make(map[*userSocket]bool)
+	}
+	h.users[u.userID][u] = true
+	return true
+}
+
+func (h *hub) removeUser(u *userSocket) {
+	h.usersMu.Lock()
+	defer h.usersMu.Unlock()
+	delete(h.users[u.userID], u)
+	if len(h.users[u.userID]) == 0 {
+		delete(h.users, u.userID)
+	}
+}
+
+// notifyUser delivers the event to the multiplexed connections of the student, on every instance
+func (h *hub) notifyUser(userID string, e Event) {
+	h.deliverToUser(userID, e)
+	if h.relay != nil {
+		h.queueForRelay(RelayMessage{Event: e, UserID: userID})
+	}
+}
+
+// deliverToUser delivers the event to the multiplexed connections of the student on this instance
+func (h *hub) deliverToUser(userID string, e Event) {
+	h.usersMu.Lock()
+	defer h.usersMu.Unlock()
+	for u := range h.users[userID] {
+		u.deliver(h, e)
+	}
+}
+
+// endUsers closes every multiplexed connection of this instance
+func (h *hub) endUsers(code int, reason string) {
+	h.usersMu.Lock()
+	defer h.usersMu.Unlock()
+	for _, sockets := range h.users {
+		for u := range sockets {
+			u.conn.end(code, reason)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package http
+
+import (
+	"chat/domain"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestUserSocket(h *hub, userID string) *userSocket {
+	c := &connection{send: make(chan Event, 8), multiplexed: true, closed: make(chan struct{})}
+	u := &userSocket{conn: c, userID: userID, rooms: make(map[string]*typingThrottle)}
+	h.addUser(u)
+	return u
+}
+
+// subscribeTo registers the socket in the room like a subscribe frame, skipping the confirmation
+func subscribeTo(h *hub, u *userSocket, roomID string) {
+	u.rooms[roomID] = &typingThrottle{}
+	h.Register(u.subscription(roomID))
+}
+
+func expectTagged(t *testing.T, u *userSocket, messageType MessageType, roomID string) {
+	e, ok := nextMessage(subscription{conn: u.conn}, time.Second)
+	if !ok {
+		assert.Fail(t, "expected an event for "+u.userID)
+		return
+	}
+	assert.Equal(t, messageType, e.MessageType)
+	assert.Equal(t, roomID, e.RoomID)
+}
+
+func TestUserSocket(t *testing.T) {
+	broker := NewLocalBroker()
+	first := newHub()
+	first.SetRelay(broker.Relay())
+	second := newHub()
+	second.SetRelay(broker.Relay())
+	go first.StartHubListener()
+	go second.StartHubListener()
+
+	pam := newTestUserSocket(first, "pam")
+	subscribeTo(first, pam, "office")
+	subscribeTo(first, pam, "warehouse")
+
+	t.Run("events of every room, tagged", func(t *testing.T) {
+		first.broadcast(NewSendEvent(domain.Message{RoomID: "office", FromStudentID: "jim", MessageBody: "hi"}))
+		expectTagged(t, pam, Send, "office")
+		first.broadcast(NewSendEvent(domain.Message{RoomID: "warehouse", FromStudentID: "darryl", MessageBody: "yo"}))
+		expectTagged(t, pam, Send, "warehouse")
+	})
+
+	t.Run("unsubscribing keeps the connection open", func(t *testing.T) {
+		first.unregister(pam.subscription("warehouse"))
+		delete(pam.rooms, "warehouse")
+		first.broadcast(NewSendEvent(domain.Message{RoomID: "warehouse", FromStudentID: "darryl", MessageBody: "gone?"}))
+		first.broadcast(NewSendEvent(domain.Message{RoomID: "office", FromStudentID: "jim", MessageBody: "still here"}))
+		expectTagged(t, pam, Send, "office")
+		assert.Equal(t, 0, pam.conn.closeCode)
+	})
+
+	t.Run("added to a room on another instance", func(t *testing.T) {
+		second.MemberAdded("accounting", "pam")
+		expectTagged(t, pam, MemberAdded, "accounting")
+	})
+
+	t.Run("removed from a subscribed room", func(t *testing.T) {
+		second.MemberRemoved("office", "pam")
+		expectTagged(t, pam, MemberRemoved, "office")
+		assert.Eventually(t, func() bool {
+			pam.mu.Lock()
+			defer pam.mu.Unlock()
+			_, subscribed := pam.rooms["office"]
+			return !subscribed
+		}, time.Second, 10*time.Millisecond)
+		assert.Eventually(t, func() bool { return len(first.Online("office")) == 0 }, time.Second, 10*time.Millisecond)
+		select {
+		case <-pam.conn.closed:
+			assert.Fail(t, "the connection should stay open")
+		default:
+		}
+	})
+
+	t.Run("room deleted", func(t *testing.T) {
+		second.RoomDeleted("accounting", []string{"pam", "kevin"})
+		expectTagged(t, pam, RoomDeleted, "accounting")
+	})
+
+	t.Run("removed from a room where the socket isn't subscribed, on another instance", func(t *testing.T) {
+		second.MemberRemoved("annex", "pam")
+		expectTagged(t, pam, MemberRemoved, "annex")
+	})
+
+	t.Run("overflow closes the whole connection", func(t *testing.T) {
+		subscribeTo(first, pam, "office")
+		for i := 0; i <= cap(pam.conn.send); i++ {
+			first.broadcast(NewSendEvent(domain.Message{RoomID: "office", FromStudentID: "jim", MessageBody: "spam"}))
+		}
+		select {
+		case <-pam.conn.closed:
+			assert.Equal(t, websocket.CloseTryAgainLater, pam.conn.closeCode)
+		case <-time.After(time.Second):
+			assert.Fail(t, "expected the connection to be closed")
+		}
+	})
+}
@@ -12,6 +12,9 @@ type BatchInterface interface {
 
 	// WithContext returns a BatchInterface for the BatchInterface.
 	WithContext(ctx context.Context) BatchInterface
+
+	// WithTimestamp returns a BatchInterface written at the timestamp, in microseconds since the epoch.
+	WithTimestamp(timestamp int64) BatchInterface
 }
 
 // BatchKind is the kind of Batch. The choice of kind mostly affects performance.
@@ -45,3 +48,9 @@ func (b *Batch) WithContext(ctx context.Context) BatchInterface {
 	b.B.WithContext(ctx)
 	return b
 }
+
+// WithTimestamp wraps the batch's WithTimestamp method
+func (b *Batch) WithTimestamp(timestamp int64) BatchInterface {
+	b.B.WithTimestamp(timestamp)
+	return b
+}
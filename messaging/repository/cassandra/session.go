@@ -27,7 +27,6 @@ func NewSession(s *gocql.Session) SessionInterface {
 // session is a gocql.Session wrapper
 type session struct {
 	s *gocql.Session
-	b *Batch
 }
 
 // Close wraps the session's Close method
@@ -35,15 +34,15 @@ func (s *session) Close() {
 	s.s.Close()
 }
 
-// ExecuteBatch wraps the session's ExecuteBatch method
+// ExecuteBatch wraps the session's ExecuteBatch method. The batch is the one given rather than the last one created,
+// so that concurrent requests each execute their own
 func (s *session) ExecuteBatch(batch BatchInterface) error {
-	return s.s.ExecuteBatch(s.b.B)
+	return s.s.ExecuteBatch(batch.(*Batch).B)
 }
 
 // NewBatch wraps the session's NewBatch method
 func (s *session) NewBatch(kind BatchKind) BatchInterface {
-	s.b = &Batch{B: s.s.NewBatch(gocql.BatchType(kind)), s: s.s}
-	return s.b
+	return &Batch{B: s.s.NewBatch(gocql.BatchType(kind)), s: s.s}
 }
 
 // Query wraps the session's Query method
@@ -0,0 +1,21 @@
+package cassandra
+
+import (
+	"github.com/gocql/gocql"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestExecuteBatchExecutesTheGivenBatch(t *testing.T) {
+	s := NewSession(&gocql.Session{})
+	tooLarge := s.NewBatch(BatchLogged)
+	for i := 0; i <= gocql.BatchSizeMaximum; i++ {
+		tooLarge.AddBatchEntry(&gocql.BatchEntry{Stmt: "INSERT"})
+	}
+	// another request creates its batch before the first one is executed
+	s.NewBatch(BatchLogged)
+
+	err := s.ExecuteBatch(tooLarge)
+
+	assert.Equal(t, gocql.ErrTooManyStmts, err)
+}
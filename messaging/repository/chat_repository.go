@@ -4,54 +4,184 @@ import (
 	"chat/domain"
 	"chat/messaging/repository/cassandra"
 	"chat/utils/errors"
+	"chat/utils/search"
 	"context"
+	"github.com/gocql/gocql"
 	"time"
 )
 
+// the messages are partitioned by room and bucket, the month they were sent in, so that the partitions of a room stay
+// bounded however long it lives. chat.message_buckets lists the buckets of each room, so the queries going past a
+// bucket only read the ones that have messages. In a bucket, the messages are clustered by their timeuuid, so the
+// queries by time compare it to the smallest or largest timeuuid of the millisecond. chat.messages_by_author has the
+// same messages partitioned by author too, both are written in one logged batch with the terms of chat.message_terms
 const (
-	insertMessage = `INSERT INTO chat.messages (room_id, from_student_id, message_body, sent_timestamp) VALUES (?, ?, ?, ?)`
-	editMessage   = `UPDATE chat.messages SET message_body=? WHERE room_id=? AND sent_timestamp=? IF EXISTS;`
-	getMessage    = `SELECT * FROM chat.messages where room_id=? AND sent_timestamp =?`
-	getMessages   = `SELECT * FROM chat.messages WHERE room_id=? AND sent_timestamp <? limit ?`
-	deleteMessage = `DELETE FROM chat.messages WHERE room_id=? AND sent_timestamp=? IF EXISTS`
+	insertMessage       = `INSERT INTO chat.messages_by_bucket (room_id, bucket, message_id, sent_timestamp, from_student_id, message_body) VALUES (?, ?, ?, ?, ?, ?)`
+	insertAuthorMessage = `INSERT INTO chat.messages_by_author (room_id, from_student_id, bucket, message_id, sent_timestamp, message_body) VALUES (?, ?, ?, ?, ?, ?)`
+	editMessage         = `UPDATE chat.messages_by_bucket SET message_body=?, edited_at=?, edit_count=? WHERE room_id=? AND bucket=? AND message_id=? IF message_body=? AND edit_count=? AND deleted_at=null;`
+	editAuthorMessage   = `UPDATE chat.messages_by_author SET message_body=?, edited_at=?, edit_count=? WHERE room_id=? AND from_student_id=? AND bucket=? AND message_id=?`
+	getMessage          = `SELECT room_id, message_id, sent_timestamp, from_student_id, message_body, edited_at, edit_count, deleted_at, deleted_by FROM chat.messages_by_bucket where room_id=? AND bucket=? AND message_id=?`
+
+	// a deleted message is kept as a tombstone. Its body is written again with the retention window as its time to
+	// live, so that Cassandra purges it, or deleted right away without a retention window. Like an edit, marking it
+	// deleted is a lightweight transaction on the body, so that an edit and a delete racing each other can't both apply
+	markDeleted       = `UPDATE chat.messages_by_bucket SET deleted_at=?, deleted_by=? WHERE room_id=? AND bucket=? AND message_id=? IF message_body=? AND deleted_at=null`
+	markAuthorDeleted = `UPDATE chat.messages_by_author SET deleted_at=?, deleted_by=? WHERE room_id=? AND from_student_id=? AND bucket=? AND message_id=?`
+	retainBody        = `UPDATE chat.messages_by_bucket USING TTL ? SET message_body=? WHERE room_id=? AND bucket=? AND message_id=?`
+	retainAuthorBody  = `UPDATE chat.messages_by_author USING TTL ? SET message_body=? WHERE room_id=? AND from_student_id=? AND bucket=? AND message_id=?`
+	purgeBody         = `DELETE message_body FROM chat.messages_by_bucket WHERE room_id=? AND bucket=? AND message_id=?`
+	purgeAuthorBody   = `DELETE message_body FROM chat.messages_by_author WHERE room_id=? AND from_student_id=? AND bucket=? AND message_id=?`
+
+	// chat.message_revisions queries, the bodies the edits of a message replaced
+	insertRevision  = `INSERT INTO chat.message_revisions (room_id, message_id, revision, message_body, written_at) VALUES (?, ?, ?, ?, ?)`
+	getRevisions    = `SELECT revision, message_body, written_at FROM chat.message_revisions WHERE room_id=? AND message_id=?`
+	deleteRevisions = `DELETE FROM chat.message_revisions WHERE room_id=? AND message_id=?`
+
+	// chat.message_buckets queries, the buckets are clustered newest first
+	insertBucket         = `INSERT INTO chat.message_buckets (room_id, bucket) VALUES (?, ?)`
+	getBucketsDescending = `SELECT bucket FROM chat.message_buckets WHERE room_id=? AND bucket >= ? AND bucket <= ?`
+	getBucketsAscending  = `SELECT bucket FROM chat.message_buckets WHERE room_id=? AND bucket >= ? AND bucket <= ? ORDER BY bucket ASC`
+
+	// chat.read_positions queries
+	saveReadPosition = `INSERT INTO chat.read_positions (room_id, student_id, last_read) VALUES (?, ?, ?)`
+	getReadPosition  = `SELECT room_id, student_id, last_read FROM chat.read_positions WHERE room_id=? AND student_id=?`
+	getReadPositions = `SELECT room_id, student_id, last_read FROM chat.read_positions WHERE room_id=?`
+
+	// chat.message_idempotency_keys queries
+	claimIdempotencyKey   = `INSERT INTO chat.message_idempotency_keys (room_id, student_id, idempotency_key, message_id) VALUES (?, ?, ?, ?) IF NOT EXISTS`
+	releaseIdempotencyKey = `DELETE FROM chat.message_idempotency_keys WHERE room_id=? AND student_id=? AND idempotency_key=?`
 )
 
+// DefaultRetention is how long the body of a deleted message is kept when SetRetention isn't called
+const DefaultRetention = time.Hour * 24 * 30
+
 type MessageRepository struct {
 	dbSession cassandra.SessionInterface
+	retention time.Duration
 }
 
 // NewChatRepository is the constructor
 func NewChatRepository(session cassandra.SessionInterface) *MessageRepository {
 	return &MessageRepository{
 		dbSession: session,
+		retention: DefaultRetention,
+	}
+}
+
+// SetRetention sets how long the body of a deleted message is kept before it is purged. Under a second, it is purged
+// as soon as the message is deleted
+func (m *MessageRepository) SetRetention(retention time.Duration) {
+	m.retention = retention
+}
+
+// bucketOf is the bucket of the messages sent at the time, i.e. its month as yyyymm
+func bucketOf(t time.Time) int {
+	t = t.UTC()
+	return t.Year()*100 + int(t.Month())
+}
+
+// messageTime is the time the message was sent, read from its id
+func messageTime(messageID string) (time.Time, error) {
+	id, err := gocql.ParseUUID(messageID)
+	if err != nil || id.Version() != 1 {
+		return time.Time{}, errors.NewBadRequestError("messageID must be the timeuuid of a message")
 	}
+	return id.Time(), nil
 }
 
+// messageBucket is the bucket of the message, read from the time of its id
+func messageBucket(messageID string) (int, error) {
+	t, err := messageTime(messageID)
+	if err != nil {
+		return 0, err
+	}
+	return bucketOf(t), nil
+}
+
+// SaveMessage lists the bucket of the message before inserting it, so a message is never in a bucket the queries
+// don't read
 func (m *MessageRepository) SaveMessage(ctx context.Context, message *domain.Message) error {
-	return m.dbSession.Query(insertMessage, message.RoomID, message.FromStudentID, message.MessageBody, message.SentTimestamp).WithContext(ctx).Exec()
+	bucket, err := messageBucket(message.MessageID)
+	if err != nil {
+		return err
+	}
+	err = m.dbSession.Query(insertBucket, message.RoomID, bucket).WithContext(ctx).Exec()
+	if err != nil {
+		return err
+	}
+
+	batch := m.dbSession.NewBatch(cassandra.BatchLogged).WithContext(ctx)
+	batch.AddBatchEntry(&gocql.BatchEntry{
+		Stmt: insertMessage,
+		Args: []interface{}{message.RoomID, bucket, message.MessageID, message.SentTimestamp, message.FromStudentID, message.MessageBody},
+	})
+	batch.AddBatchEntry(&gocql.BatchEntry{
+		Stmt: insertAuthorMessage,
+		Args: []interface{}{message.RoomID, message.FromStudentID, bucket, message.MessageID, message.SentTimestamp, message.MessageBody},
+	})
+	addTermEntries(batch, insertTerm, message, bucket, search.Terms(message.MessageBody))
+	return m.dbSession.ExecuteBatch(batch)
 }
 
-func (m *MessageRepository) EditMessage(ctx context.Context, message *domain.Message) error {
-	var editedMsg domain.Message
-	applied, err := m.dbSession.Query(editMessage, message.MessageBody, message.RoomID, message.SentTimestamp).WithContext(ctx).
-		ScanCAS(&editedMsg.RoomID, &editedMsg.SentTimestamp, &editedMsg.FromStudentID, &editedMsg.MessageBody)
+// EditMessage only updates the message of the author, records the previous revision and updates the terms once the
+// body and the revision are known to have been the previous ones, a lightweight transaction can't be batched with
+// another partition. The revision is checked too since a body can come back, and an edit that read an older revision
+// would write its edit count back and replace a recorded revision. The terms the previous body had and the new one
+// doesn't are deleted, the new ones inserted
+func (m *MessageRepository) EditMessage(ctx context.Context, message *domain.Message, previous domain.MessageRevision) error {
+	bucket, err := messageBucket(message.MessageID)
+	if err != nil {
+		return err
+	}
+	// a message that was never edited has no edit count
+	var previousEditCount interface{}
+	if previous.Revision > 0 {
+		previousEditCount = previous.Revision
+	}
+	var currentBody string
+	var currentEditCount int
+	var deletedAt time.Time
+	applied, err := m.dbSession.Query(editMessage, message.MessageBody, message.EditedAt, message.EditCount, message.RoomID,
+		bucket, message.MessageID, previous.MessageBody, previousEditCount).WithContext(ctx).
+		ScanCAS(&currentBody, &currentEditCount, &deletedAt)
 
 	if err != nil {
 		return err
 	}
 
 	if !applied {
-		return errors.NewInternalServerError("Unable to save the message")
+		return domain.ErrMessageChanged
 	}
 
-	return nil
+	// the rest of the edit is written at the time of the edit, so that if the message is deleted before it lands, the
+	// later writes of the delete still win and the body, revision and terms of the edit don't outlive it
+	terms, previousTerms := search.Terms(message.MessageBody), search.Terms(previous.MessageBody)
+	batch := m.dbSession.NewBatch(cassandra.BatchLogged).WithContext(ctx).
+		WithTimestamp(message.EditedAt.UnixNano() / int64(time.Microsecond))
+	batch.AddBatchEntry(&gocql.BatchEntry{
+		Stmt: editAuthorMessage,
+		Args: []interface{}{message.MessageBody, message.EditedAt, message.EditCount, message.RoomID, message.FromStudentID,
+			bucket, message.MessageID},
+	})
+	batch.AddBatchEntry(&gocql.BatchEntry{
+		Stmt: insertRevision,
+		Args: []interface{}{message.RoomID, message.MessageID, previous.Revision, previous.MessageBody, previous.WrittenAt},
+	})
+	addTermEntries(batch, deleteTerm, message, bucket, missingTerms(previousTerms, terms))
+	addTermEntries(batch, insertTerm, message, bucket, missingTerms(terms, previousTerms))
+	return m.dbSession.ExecuteBatch(batch)
 }
 
-func (m *MessageRepository) GetMessage(ctx context.Context, roomID string, timeStamp time.Time) (*domain.Message, error) {
+func (m *MessageRepository) GetMessage(ctx context.Context, roomID string, messageID string) (*domain.Message, error) {
+	bucket, err := messageBucket(messageID)
+	if err != nil {
+		return nil, err
+	}
 	var retrievedMsg domain.Message
 
-	err := m.dbSession.Query(getMessage, roomID, timeStamp).WithContext(ctx).
-		Scan(&retrievedMsg.RoomID, &retrievedMsg.SentTimestamp, &retrievedMsg.FromStudentID, &retrievedMsg.MessageBody)
+	err = m.dbSession.Query(getMessage, roomID, bucket, messageID).WithContext(ctx).
+		Scan(&retrievedMsg.RoomID, &retrievedMsg.MessageID, &retrievedMsg.SentTimestamp, &retrievedMsg.FromStudentID, &retrievedMsg.MessageBody,
+			&retrievedMsg.EditedAt, &retrievedMsg.EditCount, &retrievedMsg.DeletedAt, &retrievedMsg.DeletedBy)
 	if err != nil {
 		return nil, err
 	}
@@ -59,29 +189,189 @@ func (m *MessageRepository) GetMessage(ctx context.Context, roomID string, timeS
 	return &retrievedMsg, err
 }
 
-func (m *MessageRepository) GetMessages(ctx context.Context, roomID string, timeStamp time.Time, limit int) ([]domain.Message, error) {
-	retrievedMessages := []domain.Message{}
-	var scanner cassandra.ScannerInterface
+// GetMessages returns the messages of the filter sent before the timestamp, newest first. It walks the buckets of the
+// room back from the one of the timestamp until it has limit messages
+func (m *MessageRepository) GetMessages(ctx context.Context, roomID string, timeStamp time.Time, limit int, filter domain.MessageFilter) ([]domain.Message, error) {
+	return m.walk(ctx, newWindow(roomID, nil, beforeTime(timeStamp), filter), false, limit)
+}
+
+// GetMessagesSince returns the messages sent after the timestamp, oldest first. It walks the buckets of the room
+// forward from the one of the timestamp until it has limit messages
+func (m *MessageRepository) GetMessagesSince(ctx context.Context, roomID string, timeStamp time.Time, limit int) ([]domain.Message, error) {
+	return m.walk(ctx, newWindow(roomID, sinceTime(timeStamp), nil, domain.MessageFilter{}), true, limit)
+}
+
+// GetMessagesBefore returns the messages of the filter sent before the message, newest first, like GetMessages
+func (m *MessageRepository) GetMessagesBefore(ctx context.Context, roomID string, messageID string, limit int, filter domain.MessageFilter) ([]domain.Message, error) {
+	upper, err := beforeMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+	return m.walk(ctx, newWindow(roomID, nil, upper, filter), false, limit)
+}
+
+// GetMessagesAfter returns the messages of the filter sent after the message, oldest first, like GetMessagesSince
+func (m *MessageRepository) GetMessagesAfter(ctx context.Context, roomID string, messageID string, limit int, filter domain.MessageFilter) ([]domain.Message, error) {
+	lower, err := afterMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+	return m.walk(ctx, newWindow(roomID, lower, nil, filter), true, limit)
+}
 
-	scanner = m.dbSession.Query(getMessages, roomID, timeStamp, limit).WithContext(ctx).Iter().Scanner()
+// getBuckets reads the buckets of the room from lower to upper, in the order of the query
+func (m *MessageRepository) getBuckets(ctx context.Context, query string, roomID string, lower int, upper int) ([]int, error) {
+	buckets := []int{}
 
+	scanner := m.dbSession.Query(query, roomID, lower, upper).WithContext(ctx).Iter().Scanner()
 	for scanner.Next() {
-		var msg domain.Message
-		err := scanner.Scan(&msg.RoomID, &msg.SentTimestamp, &msg.FromStudentID, &msg.MessageBody)
+		var bucket int
+		if err := scanner.Scan(&bucket); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bucket)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return buckets, nil
+}
 
+// scanMessages appends the messages of the scanner to messages
+func scanMessages(scanner cassandra.ScannerInterface, messages []domain.Message) ([]domain.Message, error) {
+	for scanner.Next() {
+		var msg domain.Message
+		err := scanner.Scan(&msg.RoomID, &msg.MessageID, &msg.SentTimestamp, &msg.FromStudentID, &msg.MessageBody,
+			&msg.EditedAt, &msg.EditCount, &msg.DeletedAt, &msg.DeletedBy)
 		if err != nil {
 			return nil, err
 		}
-		retrievedMessages = append(retrievedMessages, msg)
+		messages = append(messages, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// DeleteMessage marks the message and the message of the author deleted, schedules or does the purge of their body,
+// and deletes the revisions and the terms of the message in one logged batch
+func (m *MessageRepository) DeleteMessage(ctx context.Context, message *domain.Message) error {
+	bucket, err := messageBucket(message.MessageID)
+	if err != nil {
+		return err
+	}
+	key := []interface{}{message.RoomID, bucket, message.MessageID}
+	authorKey := []interface{}{message.RoomID, message.FromStudentID, bucket, message.MessageID}
+
+	var currentBody string
+	var deletedAt time.Time
+	applied, err := m.dbSession.Query(markDeleted, message.DeletedAt, message.DeletedBy, message.RoomID, bucket,
+		message.MessageID, message.MessageBody).WithContext(ctx).ScanCAS(&currentBody, &deletedAt)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return domain.ErrMessageChanged
+	}
+
+	batch := m.dbSession.NewBatch(cassandra.BatchLogged).WithContext(ctx)
+	batch.AddBatchEntry(&gocql.BatchEntry{
+		Stmt: markAuthorDeleted,
+		Args: append([]interface{}{message.DeletedAt, message.DeletedBy}, authorKey...),
+	})
+	if ttl := int(m.retention / time.Second); ttl > 0 {
+		batch.AddBatchEntry(&gocql.BatchEntry{
+			Stmt: retainBody,
+			Args: append([]interface{}{ttl, message.MessageBody}, key...),
+		})
+		batch.AddBatchEntry(&gocql.BatchEntry{
+			Stmt: retainAuthorBody,
+			Args: append([]interface{}{ttl, message.MessageBody}, authorKey...),
+		})
+	} else {
+		batch.AddBatchEntry(&gocql.BatchEntry{Stmt: purgeBody, Args: key})
+		batch.AddBatchEntry(&gocql.BatchEntry{Stmt: purgeAuthorBody, Args: authorKey})
+	}
+	batch.AddBatchEntry(&gocql.BatchEntry{
+		Stmt: deleteRevisions,
+		Args: []interface{}{message.RoomID, message.MessageID},
+	})
+	addTermEntries(batch, deleteTerm, message, bucket, search.Terms(message.MessageBody))
+	return m.dbSession.ExecuteBatch(batch)
+}
+
+// GetRevisions returns the revisions the edits of the message replaced, they are clustered oldest first
+func (m *MessageRepository) GetRevisions(ctx context.Context, roomID string, messageID string) ([]domain.MessageRevision, error) {
+	revisions := []domain.MessageRevision{}
+
+	scanner := m.dbSession.Query(getRevisions, roomID, messageID).WithContext(ctx).Iter().Scanner()
+	for scanner.Next() {
+		var revision domain.MessageRevision
+		if err := scanner.Scan(&revision.Revision, &revision.MessageBody, &revision.WrittenAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+func (m *MessageRepository) SaveReadPosition(ctx context.Context, position *domain.ReadPosition) error {
+	return m.dbSession.Query(saveReadPosition, position.RoomID, position.StudentID, position.LastRead).WithContext(ctx).Exec()
+}
+
+func (m *MessageRepository) GetReadPosition(ctx context.Context, roomID string, studentID string) (*domain.ReadPosition, error) {
+	var position domain.ReadPosition
+
+	err := m.dbSession.Query(getReadPosition, roomID, studentID).WithContext(ctx).
+		Scan(&position.RoomID, &position.StudentID, &position.LastRead)
+	if err != nil {
+		return nil, err
+	}
+
+	return &position, nil
+}
+
+func (m *MessageRepository) GetReadPositions(ctx context.Context, roomID string) ([]domain.ReadPosition, error) {
+	positions := []domain.ReadPosition{}
 
+	scanner := m.dbSession.Query(getReadPositions, roomID).WithContext(ctx).Iter().Scanner()
+	for scanner.Next() {
+		var position domain.ReadPosition
+		err := scanner.Scan(&position.RoomID, &position.StudentID, &position.LastRead)
+		if err != nil {
+			return nil, err
+		}
+		positions = append(positions, position)
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
 
-	return retrievedMessages, nil
+	return positions, nil
+}
+
+// ClaimIdempotencyKey inserts the key unless it exists. When it does, the existing row is scanned to return the
+// message it was claimed for
+func (m *MessageRepository) ClaimIdempotencyKey(ctx context.Context, roomID string, studentID string, key string, messageID string) (string, bool, error) {
+	var existingRoomID, existingStudentID, existingKey, existingMessageID string
+	applied, err := m.dbSession.Query(claimIdempotencyKey, roomID, studentID, key, messageID).WithContext(ctx).
+		ScanCAS(&existingRoomID, &existingStudentID, &existingKey, &existingMessageID)
+	if err != nil {
+		return "", false, err
+	}
+	if applied {
+		return messageID, true, nil
+	}
+	return existingMessageID, false, nil
 }
 
-func (m *MessageRepository) DeleteMessage(ctx context.Context, roomID string, timeStamp time.Time) error {
-	return m.dbSession.Query(deleteMessage, roomID, timeStamp).WithContext(ctx).Exec()
+func (m *MessageRepository) ReleaseIdempotencyKey(ctx context.Context, roomID string, studentID string, key string) error {
+	return m.dbSession.Query(releaseIdempotencyKey, roomID, studentID, key).WithContext(ctx).Exec()
 }
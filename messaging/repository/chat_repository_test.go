@@ -2,13 +2,16 @@ package repository
 
 import (
 	"chat/domain"
+	"chat/messaging/repository/cassandra"
 	"chat/messaging/repository/mocks"
 	"context"
 	"errors"
 	"github.com/bxcodec/faker/v3"
+	"github.com/gocql/gocql"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"testing"
+	"time"
 )
 
 var query = &mocks.QueryInterface{}
@@ -16,15 +19,25 @@ var session = &mocks.SessionInterface{}
 var cr = NewChatRepository(session)
 var iter = &mocks.IterInterface{}
 var scannerMock = &mocks.ScannerInterface{}
+var batch = &mocks.BatchInterface{}
 
 func reset() {
 	query = &mocks.QueryInterface{}
 	session = &mocks.SessionInterface{}
 	iter = &mocks.IterInterface{}
 	scannerMock = &mocks.ScannerInterface{}
+	batch = &mocks.BatchInterface{}
 	cr = NewChatRepository(session)
 }
 
+// the queries of the message windows the tests read
+const (
+	getMessages       = `SELECT room_id, message_id, sent_timestamp, from_student_id, message_body, edited_at, edit_count, deleted_at, deleted_by FROM chat.messages_by_bucket WHERE room_id=? AND bucket=? AND message_id < minTimeuuid(?) limit ?`
+	getMessagesSince  = `SELECT room_id, message_id, sent_timestamp, from_student_id, message_body, edited_at, edit_count, deleted_at, deleted_by FROM chat.messages_by_bucket WHERE room_id=? AND bucket=? AND message_id > maxTimeuuid(?) ORDER BY message_id ASC limit ?`
+	getMessagesBefore = `SELECT room_id, message_id, sent_timestamp, from_student_id, message_body, edited_at, edit_count, deleted_at, deleted_by FROM chat.messages_by_bucket WHERE room_id=? AND bucket=? AND message_id < ? limit ?`
+	getMessagesAfter  = `SELECT room_id, message_id, sent_timestamp, from_student_id, message_body, edited_at, edit_count, deleted_at, deleted_by FROM chat.messages_by_bucket WHERE room_id=? AND bucket=? AND message_id > ? ORDER BY message_id ASC limit ?`
+)
+
 const errorMessage = "Actual error, expected no error"
 const internalErrorMessage = "Internal Error"
 const errorMessage2 = "Actual no error, expected error"
@@ -34,20 +47,33 @@ func TestSaveMessageSuccess(t *testing.T){
 	reset()
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
+	mockMessage.MessageID = gocql.TimeUUID().String()
+	mockMessage.MessageBody = "Lunch at noon? Lunch!"
 
-	session.On("Query", mock.AnythingOfType("string"), mock.Anything, mock.Anything,
-		mock.Anything, mock.Anything).
+	session.On("Query", insertBucket, mockMessage.RoomID, mock.AnythingOfType("int")).
 		Return(query)
 	query.On("WithContext", mock.Anything).
 		Return(query)
 	query.On("Exec").
 		Return(nil)
+	session.On("NewBatch", cassandra.BatchLogged).Return(batch)
+	batch.On("WithContext", mock.Anything).Return(batch)
+	batch.On("AddBatchEntry", mock.MatchedBy(func(entry *gocql.BatchEntry) bool { return entry.Stmt == insertMessage })).Once()
+	batch.On("AddBatchEntry", mock.MatchedBy(func(entry *gocql.BatchEntry) bool { return entry.Stmt == insertAuthorMessage })).Once()
+	for _, term := range []string{"lunch", "at", "noon"} {
+		term := term
+		batch.On("AddBatchEntry", mock.MatchedBy(func(entry *gocql.BatchEntry) bool {
+			return entry.Stmt == insertTerm && entry.Args[2] == term
+		})).Once()
+	}
+	session.On("ExecuteBatch", batch).Return(nil)
 
 	err := cr.SaveMessage(context.Background(), &mockMessage)
 
 	assert.NoError(t, err)
 
 	session.AssertExpectations(t)
+	batch.AssertExpectations(t)
 	//reset()
 }
 
@@ -55,9 +81,9 @@ func TestSaveMessageError(t *testing.T) {
 	reset()
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
+	mockMessage.MessageID = gocql.TimeUUID().String()
 
-	session.On("Query", mock.AnythingOfType("string"), mock.Anything, mock.Anything,
-		mock.Anything, mock.Anything).
+	session.On("Query", insertBucket, mockMessage.RoomID, mock.AnythingOfType("int")).
 		Return(query)
 	query.On("WithContext", mock.Anything).
 		Return(query)
@@ -75,36 +101,64 @@ func TestEditMessageSuccess(t *testing.T) {
 	reset()
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
+	mockMessage.MessageID = gocql.TimeUUID().String()
+	mockMessage.MessageBody = "Lunch at one"
+	mockMessage.EditCount = 2
+	previous := domain.MessageRevision{Revision: 1, MessageBody: "Lunch at noon?", WrittenAt: time.Now()}
 
-	session.On("Query", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything).
+	session.On("Query", editMessage, mockMessage.MessageBody, mockMessage.EditedAt, 2, mockMessage.RoomID,
+		mock.AnythingOfType("int"), mockMessage.MessageID, "Lunch at noon?", 1).
 		Return(query)
 	query.On("WithContext", mock.Anything).
 		Return(query)
-	query.On("ScanCAS", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+	query.On("ScanCAS", mock.Anything, mock.Anything, mock.Anything).
 		Return(true, nil).
 		Once()
-
-	err := cr.EditMessage(context.Background(), &mockMessage)
+	session.On("NewBatch", cassandra.BatchLogged).Return(batch)
+	batch.On("WithContext", mock.Anything).Return(batch)
+	// the rest of the edit is written at the time of the edit, so a delete written after it wins
+	batch.On("WithTimestamp", mockMessage.EditedAt.UnixNano()/int64(time.Microsecond)).Return(batch).Once()
+	batch.On("AddBatchEntry", mock.MatchedBy(func(entry *gocql.BatchEntry) bool {
+		return entry.Stmt == editAuthorMessage && entry.Args[0] == mockMessage.MessageBody && entry.Args[2] == 2
+	})).Once()
+	// the body it replaces is recorded
+	batch.On("AddBatchEntry", mock.MatchedBy(func(entry *gocql.BatchEntry) bool {
+		return entry.Stmt == insertRevision && entry.Args[2] == 1 && entry.Args[3] == previous.MessageBody &&
+			entry.Args[4] == previous.WrittenAt
+	})).Once()
+	// only the terms that changed are rewritten
+	batch.On("AddBatchEntry", mock.MatchedBy(func(entry *gocql.BatchEntry) bool {
+		return entry.Stmt == deleteTerm && entry.Args[2] == "noon"
+	})).Once()
+	batch.On("AddBatchEntry", mock.MatchedBy(func(entry *gocql.BatchEntry) bool {
+		return entry.Stmt == insertTerm && entry.Args[2] == "one"
+	})).Once()
+	session.On("ExecuteBatch", batch).Return(nil)
+
+	err := cr.EditMessage(context.Background(), &mockMessage, previous)
 
 	assert.NoError(t, err)
 
 	session.AssertExpectations(t)
+	batch.AssertExpectations(t)
 }
 
 func TestEditMessageFail(t *testing.T) {
 	reset()
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
+	mockMessage.MessageID = gocql.TimeUUID().String()
 
-	session.On("Query", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything).
+	session.On("Query", editMessage, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything).
 		Return(query)
 	query.On("WithContext", mock.Anything).
 		Return(query)
-	query.On("ScanCAS", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+	query.On("ScanCAS", mock.Anything, mock.Anything, mock.Anything).
 		Return(false, errors.New("error")).
 		Once()
 
-	err := cr.EditMessage(context.Background(), &mockMessage)
+	err := cr.EditMessage(context.Background(), &mockMessage, domain.MessageRevision{MessageBody: "Lunch at noon?"})
 
 	assert.Error(t, err)
 
@@ -115,35 +169,124 @@ func TestEditMessageUnableToUpdate(t *testing.T) {
 	reset()
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
+	mockMessage.MessageID = gocql.TimeUUID().String()
 
-	session.On("Query", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything).
+	session.On("Query", editMessage, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything).
 		Return(query)
 	query.On("WithContext", mock.Anything).
 		Return(query)
-	query.On("ScanCAS", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+	query.On("ScanCAS", mock.Anything, mock.Anything, mock.Anything).
 		Return(false, nil).
 		Once()
 
-	err := cr.EditMessage(context.Background(), &mockMessage)
+	err := cr.EditMessage(context.Background(), &mockMessage, domain.MessageRevision{MessageBody: "Lunch at noon?"})
 
-	assert.Error(t, err)
+	assert.Equal(t, domain.ErrMessageChanged, err)
 
 	session.AssertExpectations(t)
 }
 
+func TestEditMessageDeletedMeanwhile(t *testing.T) {
+	reset()
+	var mockMessage domain.Message
+	faker.FakeData(&mockMessage)
+	mockMessage.MessageID = gocql.TimeUUID().String()
+	deletedAt := time.Now()
+
+	// the message was deleted after the edit read it: the body is still the one the edit replaces, only deleted_at
+	// tells the edit apart from one on a live message
+	session.On("Query", editMessage, mockMessage.MessageBody, mock.Anything, mock.Anything, mockMessage.RoomID,
+		mock.AnythingOfType("int"), mockMessage.MessageID, "Lunch at noon?", nil).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("ScanCAS", mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			*args.Get(0).(*string) = "Lunch at noon?"
+			*args.Get(2).(*time.Time) = deletedAt
+		}).
+		Return(false, nil).
+		Once()
+
+	err := cr.EditMessage(context.Background(), &mockMessage, domain.MessageRevision{MessageBody: "Lunch at noon?"})
+
+	assert.Equal(t, domain.ErrMessageChanged, err)
+	assert.Contains(t, editMessage, "IF message_body=? AND edit_count=? AND deleted_at=null")
+	session.AssertNotCalled(t, "NewBatch", mock.Anything)
+	session.AssertExpectations(t)
+}
+
+func TestEditMessageStaleAfterTheBodyCameBack(t *testing.T) {
+	reset()
+	message := domain.Message{RoomID: "office", MessageID: gocql.TimeUUID().String(), FromStudentID: "jim", MessageBody: "A"}
+	// the row the lightweight transactions are applied to, an edit count of 0 standing for null
+	body, editCount := "A", 0
+	var set, condition []interface{}
+	session.On("Query", editMessage, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			set, condition = args[1:4], args[7:9]
+		}).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("ScanCAS", mock.Anything, mock.Anything, mock.Anything).
+		Return(func(...interface{}) bool {
+			previousEditCount := 0
+			if condition[1] != nil {
+				previousEditCount = condition[1].(int)
+			}
+			if condition[0] != body || previousEditCount != editCount {
+				return false
+			}
+			body, editCount = set[0].(string), set[2].(int)
+			return true
+		}, nil)
+	session.On("NewBatch", cassandra.BatchLogged).Return(batch)
+	batch.On("WithContext", mock.Anything).Return(batch)
+	batch.On("WithTimestamp", mock.Anything).Return(batch)
+	var revisions []interface{}
+	batch.On("AddBatchEntry", mock.Anything).
+		Run(func(args mock.Arguments) {
+			if entry := args.Get(0).(*gocql.BatchEntry); entry.Stmt == insertRevision {
+				revisions = append(revisions, entry.Args[2])
+			}
+		})
+	session.On("ExecuteBatch", batch).Return(nil)
+
+	edit := func(newBody string, previous domain.MessageRevision) error {
+		edited := message
+		edited.MessageBody, edited.EditedAt, edited.EditCount = newBody, time.Now(), previous.Revision+1
+		return cr.EditMessage(context.Background(), &edited, previous)
+	}
+	assert.NoError(t, edit("B", domain.MessageRevision{Revision: 0, MessageBody: "A"}))
+	assert.NoError(t, edit("A", domain.MessageRevision{Revision: 1, MessageBody: "B"}))
+
+	// an edit that read the message before the other two finds the same body, at another revision
+	err := edit("C", domain.MessageRevision{Revision: 0, MessageBody: "A"})
+
+	assert.Equal(t, domain.ErrMessageChanged, err)
+	assert.Equal(t, "A", body)
+	assert.Equal(t, 2, editCount)
+	assert.Equal(t, []interface{}{0, 1}, revisions)
+}
+
 func TestGetMessageSuccess(t *testing.T) {
 	reset()
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
+	mockMessage.MessageID = gocql.TimeUUID().String()
 
-	session.On("Query", mock.AnythingOfType("string"), mock.Anything, mock.Anything).
+	session.On("Query", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything).
 		Return(query)
 	query.On("WithContext", mock.Anything).
 		Return(query)
-	query.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+	query.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything).
 		Return(nil)
 
-	_, err := cr.GetMessage(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp)
+	_, err := cr.GetMessage(context.Background(), mockMessage.RoomID, mockMessage.MessageID)
 
 	assert.NoError(t, err)
 
@@ -154,27 +297,54 @@ func TestGetMessageError(t *testing.T) {
 	reset()
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
+	mockMessage.MessageID = gocql.TimeUUID().String()
 
-	session.On("Query", mock.AnythingOfType("string"), mock.Anything, mock.Anything).
+	session.On("Query", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything).
 		Return(query)
 	query.On("WithContext", mock.Anything).
 		Return(query)
-	query.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+	query.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything).
 		Return(errors.New("error"))
 
-	_, err := cr.GetMessage(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp)
+	_, err := cr.GetMessage(context.Background(), mockMessage.RoomID, mockMessage.MessageID)
 
 	assert.Error(t, err)
 
 	session.AssertExpectations(t)
 }
 
+// mockBuckets answers the buckets query of the room with the buckets
+func mockBuckets(bucketsQuery string, roomID string, buckets ...int) {
+	bucketQuery := &mocks.QueryInterface{}
+	bucketIter := &mocks.IterInterface{}
+	bucketScanner := &mocks.ScannerInterface{}
+	session.On("Query", bucketsQuery, roomID, mock.AnythingOfType("int"), mock.AnythingOfType("int")).
+		Return(bucketQuery)
+	bucketQuery.On("WithContext", mock.Anything).
+		Return(bucketQuery)
+	bucketQuery.On("Iter").
+		Return(bucketIter)
+	bucketIter.On("Scanner").
+		Return(bucketScanner)
+	for _, bucket := range buckets {
+		bucket := bucket
+		bucketScanner.On("Next").Return(true).Once()
+		bucketScanner.On("Scan", mock.Anything).
+			Run(func(args mock.Arguments) { *args.Get(0).(*int) = bucket }).
+			Return(nil).Once()
+	}
+	bucketScanner.On("Next").Return(false)
+	bucketScanner.On("Err").Return(nil)
+}
+
 func TestGetMessagesSuccess(t *testing.T) {
 	reset()
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
 
-	session.On("Query", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything).
+	mockBuckets(getBucketsDescending, mockMessage.RoomID, 202111)
+	session.On("Query", getMessages, mockMessage.RoomID, 202111, mockMessage.SentTimestamp, 2).
 		Return(query)
 	query.On("WithContext", mock.Anything).
 		Return(query)
@@ -185,23 +355,70 @@ func TestGetMessagesSuccess(t *testing.T) {
 
 	scannerMock.On("Next").Return(true).Once()
 	scannerMock.On("Next").Return(false)
-	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything).
 		Return(nil)
 	scannerMock.On("Err").Return(nil)
 
-	_, err := cr.GetMessages(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp, 2)
+	_, err := cr.GetMessages(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp, 2, domain.MessageFilter{})
 
 	assert.NoError(t, err)
 
 	session.AssertExpectations(t)
 }
 
+func TestGetMessagesWalksBuckets(t *testing.T) {
+	reset()
+	var mockMessage domain.Message
+	faker.FakeData(&mockMessage)
+	olderIter := &mocks.IterInterface{}
+	olderScanner := &mocks.ScannerInterface{}
+
+	// the bucket of the timestamp only has one message, the rest are read from the previous bucket that has any
+	mockBuckets(getBucketsDescending, mockMessage.RoomID, 202111, 202108, 202101)
+	session.On("Query", getMessages, mockMessage.RoomID, 202111, mockMessage.SentTimestamp, 3).
+		Return(query).Once()
+	session.On("Query", getMessages, mockMessage.RoomID, 202108, mockMessage.SentTimestamp, 2).
+		Return(query).Once()
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter).Once()
+	query.On("Iter").
+		Return(olderIter).Once()
+	iter.On("Scanner").
+		Return(scannerMock)
+	olderIter.On("Scanner").
+		Return(olderScanner)
+
+	scannerMock.On("Next").Return(true).Once()
+	scannerMock.On("Next").Return(false)
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything).
+		Return(nil)
+	scannerMock.On("Err").Return(nil)
+	olderScanner.On("Next").Return(true).Twice()
+	olderScanner.On("Next").Return(false)
+	olderScanner.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything).
+		Return(nil)
+	olderScanner.On("Err").Return(nil)
+
+	messages, err := cr.GetMessages(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp, 3, domain.MessageFilter{})
+
+	assert.NoError(t, err)
+	assert.Len(t, messages, 3)
+
+	session.AssertExpectations(t)
+}
+
 func TestGetMessagesScanError(t *testing.T) {
 	reset()
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
 
-	session.On("Query", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything).
+	mockBuckets(getBucketsDescending, mockMessage.RoomID, 202111)
+	session.On("Query", getMessages, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
 		Return(query)
 	query.On("WithContext", mock.Anything).
 		Return(query)
@@ -211,10 +428,11 @@ func TestGetMessagesScanError(t *testing.T) {
 		Return(scannerMock)
 
 	scannerMock.On("Next").Return(true).Once()
-	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything).
 		Return(errors.New(internalErrorMessage))
 
-	_, err := cr.GetMessages(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp, 2)
+	_, err := cr.GetMessages(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp, 2, domain.MessageFilter{})
 
 	assert.Error(t, err)
 
@@ -226,7 +444,87 @@ func TestGetMessagesError(t *testing.T) {
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
 
-	session.On("Query", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything).
+	mockBuckets(getBucketsDescending, mockMessage.RoomID, 202111)
+	session.On("Query", getMessages, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter)
+	iter.On("Scanner").
+		Return(scannerMock)
+
+	scannerMock.On("Next").Return(false).Once()
+	scannerMock.On("Err").Return(errors.New("error"))
+
+	_, err := cr.GetMessages(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp, 2, domain.MessageFilter{})
+
+	assert.Error(t, err)
+
+	session.AssertExpectations(t)
+}
+
+func TestGetMessagesBucketsError(t *testing.T) {
+	reset()
+	var mockMessage domain.Message
+	faker.FakeData(&mockMessage)
+
+	session.On("Query", getBucketsDescending, mock.Anything, mock.Anything, mock.Anything).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter)
+	iter.On("Scanner").
+		Return(scannerMock)
+
+	scannerMock.On("Next").Return(false).Once()
+	scannerMock.On("Err").Return(errors.New("error"))
+
+	_, err := cr.GetMessages(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp, 2, domain.MessageFilter{})
+
+	assert.Error(t, err)
+
+	session.AssertExpectations(t)
+}
+
+func TestGetMessagesSinceSuccess(t *testing.T) {
+	reset()
+	var mockMessage domain.Message
+	faker.FakeData(&mockMessage)
+
+	mockBuckets(getBucketsAscending, mockMessage.RoomID, 202111)
+	session.On("Query", getMessagesSince, mockMessage.RoomID, 202111, mockMessage.SentTimestamp, 10).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter)
+	iter.On("Scanner").
+		Return(scannerMock)
+
+	scannerMock.On("Next").Return(true).Twice()
+	scannerMock.On("Next").Return(false)
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything).
+		Return(nil)
+	scannerMock.On("Err").Return(nil)
+
+	messages, err := cr.GetMessagesSince(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp, 10)
+
+	assert.NoError(t, err)
+	assert.Len(t, messages, 2)
+
+	session.AssertExpectations(t)
+}
+
+func TestGetMessagesSinceError(t *testing.T) {
+	reset()
+	var mockMessage domain.Message
+	faker.FakeData(&mockMessage)
+
+	mockBuckets(getBucketsAscending, mockMessage.RoomID, 202111)
+	session.On("Query", getMessagesSince, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
 		Return(query)
 	query.On("WithContext", mock.Anything).
 		Return(query)
@@ -238,7 +536,165 @@ func TestGetMessagesError(t *testing.T) {
 	scannerMock.On("Next").Return(false).Once()
 	scannerMock.On("Err").Return(errors.New("error"))
 
-	_, err := cr.GetMessages(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp, 2)
+	_, err := cr.GetMessagesSince(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp, 10)
+
+	assert.Error(t, err)
+
+	session.AssertExpectations(t)
+}
+
+func TestSaveReadPosition(t *testing.T) {
+	reset()
+	var position domain.ReadPosition
+	faker.FakeData(&position)
+
+	session.On("Query", mock.AnythingOfType("string"), position.RoomID, position.StudentID, position.LastRead).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Exec").
+		Return(nil)
+
+	err := cr.SaveReadPosition(context.Background(), &position)
+
+	assert.NoError(t, err)
+
+	session.AssertExpectations(t)
+}
+
+func TestGetReadPositionSuccess(t *testing.T) {
+	reset()
+
+	session.On("Query", mock.AnythingOfType("string"), "office", "jim").
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Scan", mock.Anything, mock.Anything, mock.Anything).
+		Return(nil)
+
+	_, err := cr.GetReadPosition(context.Background(), "office", "jim")
+
+	assert.NoError(t, err)
+
+	session.AssertExpectations(t)
+}
+
+func TestGetReadPositionError(t *testing.T) {
+	reset()
+
+	session.On("Query", mock.AnythingOfType("string"), "office", "jim").
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Scan", mock.Anything, mock.Anything, mock.Anything).
+		Return(errors.New("not found"))
+
+	_, err := cr.GetReadPosition(context.Background(), "office", "jim")
+
+	assert.Error(t, err)
+
+	session.AssertExpectations(t)
+}
+
+func TestGetReadPositionsSuccess(t *testing.T) {
+	reset()
+
+	session.On("Query", mock.AnythingOfType("string"), "office").
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter)
+	iter.On("Scanner").
+		Return(scannerMock)
+
+	scannerMock.On("Next").Return(true).Once()
+	scannerMock.On("Next").Return(false)
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything).
+		Return(nil)
+	scannerMock.On("Err").Return(nil)
+
+	positions, err := cr.GetReadPositions(context.Background(), "office")
+
+	assert.NoError(t, err)
+	assert.Len(t, positions, 1)
+
+	session.AssertExpectations(t)
+}
+
+func TestGetReadPositionsScanError(t *testing.T) {
+	reset()
+
+	session.On("Query", mock.AnythingOfType("string"), "office").
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter)
+	iter.On("Scanner").
+		Return(scannerMock)
+
+	scannerMock.On("Next").Return(true).Once()
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything).
+		Return(errors.New(internalErrorMessage))
+
+	_, err := cr.GetReadPositions(context.Background(), "office")
+
+	assert.Error(t, err)
+
+	session.AssertExpectations(t)
+}
+
+func TestGetRevisionsSuccess(t *testing.T) {
+	reset()
+	messageID := gocql.TimeUUID().String()
+
+	session.On("Query", getRevisions, "office", messageID).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter)
+	iter.On("Scanner").
+		Return(scannerMock)
+
+	for i, body := range []string{"Lunch at noon?", "Lunch at one?"} {
+		i, body := i, body
+		scannerMock.On("Next").Return(true).Once()
+		scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything).
+			Run(func(args mock.Arguments) {
+				*args.Get(0).(*int) = i
+				*args.Get(1).(*string) = body
+			}).
+			Return(nil).Once()
+	}
+	scannerMock.On("Next").Return(false)
+	scannerMock.On("Err").Return(nil)
+
+	revisions, err := cr.GetRevisions(context.Background(), "office", messageID)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.MessageRevision{{Revision: 0, MessageBody: "Lunch at noon?"}, {Revision: 1, MessageBody: "Lunch at one?"}}, revisions)
+
+	session.AssertExpectations(t)
+}
+
+func TestGetRevisionsScanError(t *testing.T) {
+	reset()
+
+	session.On("Query", getRevisions, "office", mock.Anything).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter)
+	iter.On("Scanner").
+		Return(scannerMock)
+	scannerMock.On("Next").Return(true).Once()
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything).
+		Return(errors.New(internalErrorMessage))
+
+	_, err := cr.GetRevisions(context.Background(), "office", gocql.TimeUUID().String())
 
 	assert.Error(t, err)
 
@@ -249,34 +705,213 @@ func TestDeleteMessageSuccess(t *testing.T) {
 	reset()
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
+	mockMessage.MessageID = gocql.TimeUUID().String()
+	mockMessage.MessageBody = "Lunch at noon?"
+	mockMessage.DeletedAt, mockMessage.DeletedBy = time.Now(), "jim"
+	cr.SetRetention(time.Hour * 24)
 
-	session.On("Query", mock.AnythingOfType("string"), mock.Anything, mock.Anything).
+	session.On("Query", markDeleted, mockMessage.DeletedAt, mockMessage.DeletedBy, mockMessage.RoomID,
+		mock.AnythingOfType("int"), mockMessage.MessageID, mockMessage.MessageBody).
 		Return(query)
 	query.On("WithContext", mock.Anything).
 		Return(query)
-	query.On("Exec").Return(nil)
+	query.On("ScanCAS", mock.Anything, mock.Anything, mock.Anything).
+		Return(true, nil).
+		Once()
+	session.On("NewBatch", cassandra.BatchLogged).Return(batch)
+	batch.On("WithContext", mock.Anything).Return(batch)
+	batch.On("AddBatchEntry", mock.MatchedBy(func(entry *gocql.BatchEntry) bool {
+		return entry.Stmt == markAuthorDeleted && entry.Args[0] == mockMessage.DeletedAt && entry.Args[1] == "jim"
+	})).Once()
+	// the body is kept for the retention window
+	batch.On("AddBatchEntry", mock.MatchedBy(func(entry *gocql.BatchEntry) bool {
+		return (entry.Stmt == retainBody || entry.Stmt == retainAuthorBody) && entry.Args[0] == 86400 &&
+			entry.Args[1] == mockMessage.MessageBody
+	})).Twice()
+	batch.On("AddBatchEntry", mock.MatchedBy(func(entry *gocql.BatchEntry) bool { return entry.Stmt == deleteRevisions })).Once()
+	batch.On("AddBatchEntry", mock.MatchedBy(func(entry *gocql.BatchEntry) bool { return entry.Stmt == deleteTerm })).Times(3)
+	session.On("ExecuteBatch", batch).Return(nil)
+
+	err := cr.DeleteMessage(context.Background(), &mockMessage)
 
-	err := cr.DeleteMessage(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp)
+	assert.NoError(t, err)
+
+	session.AssertExpectations(t)
+	batch.AssertExpectations(t)
+}
+
+func TestDeleteMessageWithoutRetention(t *testing.T) {
+	reset()
+	var mockMessage domain.Message
+	faker.FakeData(&mockMessage)
+	mockMessage.MessageID = gocql.TimeUUID().String()
+	mockMessage.MessageBody = "Lunch"
+	cr.SetRetention(0)
+
+	session.On("Query", markDeleted, mockMessage.DeletedAt, mockMessage.DeletedBy, mockMessage.RoomID,
+		mock.AnythingOfType("int"), mockMessage.MessageID, mockMessage.MessageBody).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("ScanCAS", mock.Anything, mock.Anything, mock.Anything).
+		Return(true, nil).
+		Once()
+	session.On("NewBatch", cassandra.BatchLogged).Return(batch)
+	batch.On("WithContext", mock.Anything).Return(batch)
+	batch.On("AddBatchEntry", mock.MatchedBy(func(entry *gocql.BatchEntry) bool {
+		return entry.Stmt == markAuthorDeleted || entry.Stmt == deleteRevisions || entry.Stmt == deleteTerm
+	})).Times(3)
+	// the body is purged right away
+	batch.On("AddBatchEntry", mock.MatchedBy(func(entry *gocql.BatchEntry) bool {
+		return entry.Stmt == purgeBody || entry.Stmt == purgeAuthorBody
+	})).Twice()
+	session.On("ExecuteBatch", batch).Return(nil)
+
+	err := cr.DeleteMessage(context.Background(), &mockMessage)
 
 	assert.NoError(t, err)
 
 	session.AssertExpectations(t)
+	batch.AssertExpectations(t)
 }
 
 func TestDeleteMessageError(t *testing.T) {
 	reset()
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
+	mockMessage.MessageID = gocql.TimeUUID().String()
+
+	session.On("Query", markDeleted, mockMessage.DeletedAt, mockMessage.DeletedBy, mockMessage.RoomID,
+		mock.AnythingOfType("int"), mockMessage.MessageID, mockMessage.MessageBody).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("ScanCAS", mock.Anything, mock.Anything, mock.Anything).
+		Return(true, nil).
+		Once()
+	session.On("NewBatch", cassandra.BatchLogged).Return(batch)
+	batch.On("WithContext", mock.Anything).Return(batch)
+	batch.On("AddBatchEntry", mock.Anything)
+	session.On("ExecuteBatch", batch).Return(errors.New(internalErrorMessage))
+
+	err := cr.DeleteMessage(context.Background(), &mockMessage)
+
+	assert.Error(t, err)
+
+	session.AssertExpectations(t)
+}
+
+func TestDeleteMessageEditedMeanwhile(t *testing.T) {
+	reset()
+	var mockMessage domain.Message
+	faker.FakeData(&mockMessage)
+	mockMessage.MessageID = gocql.TimeUUID().String()
+	mockMessage.MessageBody = "Lunch at noon?"
+
+	// an edit applied after the delete read the message, so the body the delete would retain is no longer the body
+	session.On("Query", markDeleted, mock.Anything, mock.Anything, mockMessage.RoomID, mock.AnythingOfType("int"),
+		mockMessage.MessageID, "Lunch at noon?").
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("ScanCAS", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) { *args.Get(0).(*string) = "Lunch at one" }).
+		Return(false, nil).
+		Once()
+
+	err := cr.DeleteMessage(context.Background(), &mockMessage)
+
+	assert.Equal(t, domain.ErrMessageChanged, err)
+	session.AssertNotCalled(t, "NewBatch", mock.Anything)
+	session.AssertExpectations(t)
+}
+
+func TestDeleteMessageInvalidID(t *testing.T) {
+	reset()
+
+	err := cr.DeleteMessage(context.Background(), &domain.Message{RoomID: "office", MessageID: "2021-11-03T14:05:07Z"})
+
+	assert.Error(t, err)
+
+	session.AssertExpectations(t)
+}
+
+func TestClaimIdempotencyKeyApplied(t *testing.T) {
+	reset()
+	var mockMessage domain.Message
+	faker.FakeData(&mockMessage)
+
+	session.On("Query", claimIdempotencyKey, mockMessage.RoomID, mockMessage.FromStudentID, "key", mockMessage.MessageID).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("ScanCAS", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(true, nil)
+
+	messageID, claimed, err := cr.ClaimIdempotencyKey(context.Background(), mockMessage.RoomID, mockMessage.FromStudentID, "key", mockMessage.MessageID)
+
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	assert.Equal(t, mockMessage.MessageID, messageID)
+
+	session.AssertExpectations(t)
+}
+
+func TestClaimIdempotencyKeyAlreadyClaimed(t *testing.T) {
+	reset()
+	var mockMessage domain.Message
+	faker.FakeData(&mockMessage)
+	const firstMessageID = "3f5c5a4e-8d1a-11ec-a8a3-0242ac120002"
 
-	session.On("Query", mock.AnythingOfType("string"), mock.Anything, mock.Anything).
+	session.On("Query", claimIdempotencyKey, mockMessage.RoomID, mockMessage.FromStudentID, "key", mockMessage.MessageID).
 		Return(query)
 	query.On("WithContext", mock.Anything).
 		Return(query)
-	query.On("Exec").Return(errors.New(internalErrorMessage))
+	query.On("ScanCAS", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) { *args.Get(3).(*string) = firstMessageID }).
+		Return(false, nil)
+
+	messageID, claimed, err := cr.ClaimIdempotencyKey(context.Background(), mockMessage.RoomID, mockMessage.FromStudentID, "key", mockMessage.MessageID)
+
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Equal(t, firstMessageID, messageID)
 
-	err := cr.DeleteMessage(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp)
+	session.AssertExpectations(t)
+}
+
+func TestClaimIdempotencyKeyError(t *testing.T) {
+	reset()
+	var mockMessage domain.Message
+	faker.FakeData(&mockMessage)
+
+	session.On("Query", claimIdempotencyKey, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("ScanCAS", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(false, errors.New(internalErrorMessage))
+
+	_, claimed, err := cr.ClaimIdempotencyKey(context.Background(), mockMessage.RoomID, mockMessage.FromStudentID, "key", mockMessage.MessageID)
 
 	assert.Error(t, err)
+	assert.False(t, claimed)
+
+	session.AssertExpectations(t)
+}
+
+func TestReleaseIdempotencyKey(t *testing.T) {
+	reset()
+
+	session.On("Query", releaseIdempotencyKey, "office", "jim", "key").
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Exec").Return(nil)
+
+	err := cr.ReleaseIdempotencyKey(context.Background(), "office", "jim", "key")
+
+	assert.NoError(t, err)
 
 	session.AssertExpectations(t)
 }
@@ -292,7 +927,7 @@ func TestDeleteMessageError(t *testing.T) {
 //			Return(query)
 //		query.On("Exec").Return(nil)
 //
-//		err := cr.DeleteMessage(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp)
+//		err := cr.DeleteMessage(context.Background(), mockMessage.RoomID, mockMessage.MessageID)
 //
 //		assert.NoError(t, err)
 //
@@ -307,7 +942,7 @@ func TestDeleteMessageError(t *testing.T) {
 //			Return(query)
 //		query.On("Exec").Return(errors.New(internalErrorMessage))
 //
-//		err := cr.DeleteMessage(context.Background(), mockMessage.RoomID, mockMessage.SentTimestamp)
+//		err := cr.DeleteMessage(context.Background(), mockMessage.RoomID, mockMessage.MessageID)
 //
 //		assert.Error(t, err)
 //
@@ -315,3 +950,128 @@ func TestDeleteMessageError(t *testing.T) {
 //		reset()
 //	})
 //}
+
+func TestGetMessagesBeforeSuccess(t *testing.T) {
+	reset()
+	messageID := gocql.UUIDFromTime(time.Date(2021, time.November, 3, 14, 5, 7, 0, time.UTC)).String()
+
+	mockBuckets(getBucketsDescending, "office", 202111)
+	session.On("Query", getMessagesBefore, "office", 202111, messageID, 2).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter)
+	iter.On("Scanner").
+		Return(scannerMock)
+
+	scannerMock.On("Next").Return(true).Twice()
+	scannerMock.On("Next").Return(false)
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything).
+		Return(nil)
+	scannerMock.On("Err").Return(nil)
+
+	messages, err := cr.GetMessagesBefore(context.Background(), "office", messageID, 2, domain.MessageFilter{})
+
+	assert.NoError(t, err)
+	assert.Len(t, messages, 2)
+
+	session.AssertExpectations(t)
+}
+
+func TestGetMessagesAfterSuccess(t *testing.T) {
+	reset()
+	messageID := gocql.UUIDFromTime(time.Date(2021, time.November, 3, 14, 5, 7, 0, time.UTC)).String()
+
+	mockBuckets(getBucketsAscending, "office", 202111)
+	session.On("Query", getMessagesAfter, "office", 202111, messageID, 10).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter)
+	iter.On("Scanner").
+		Return(scannerMock)
+
+	scannerMock.On("Next").Return(true).Once()
+	scannerMock.On("Next").Return(false)
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything).
+		Return(nil)
+	scannerMock.On("Err").Return(nil)
+
+	messages, err := cr.GetMessagesAfter(context.Background(), "office", messageID, 10, domain.MessageFilter{})
+
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+
+	session.AssertExpectations(t)
+}
+
+func TestGetMessagesAfterInvalidID(t *testing.T) {
+	reset()
+
+	_, err := cr.GetMessagesAfter(context.Background(), "office", "not an id", 10, domain.MessageFilter{})
+
+	assert.Error(t, err)
+
+	session.AssertExpectations(t)
+}
+
+func TestGetMessagesFiltered(t *testing.T) {
+	reset()
+	from := time.Date(2021, time.November, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2021, time.November, 20, 0, 0, 0, 0, time.UTC)
+	filter := domain.MessageFilter{FromStudentID: "jim", From: from, To: to}
+
+	// only the author's partition of the buckets of the window is read
+	mockBuckets(getBucketsDescending, "office", 202111)
+	session.On("Query", `SELECT room_id, message_id, sent_timestamp, from_student_id, message_body, edited_at, edit_count, deleted_at, deleted_by FROM chat.messages_by_author WHERE room_id=? AND from_student_id=? AND bucket=? AND message_id >= minTimeuuid(?) AND message_id < minTimeuuid(?) limit ?`,
+		"office", "jim", 202111, from, to, 10).
+		Return(query).Once()
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter)
+	iter.On("Scanner").
+		Return(scannerMock)
+
+	scannerMock.On("Next").Return(true).Once()
+	scannerMock.On("Next").Return(false)
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything).
+		Return(nil)
+	scannerMock.On("Err").Return(nil)
+
+	messages, err := cr.GetMessages(context.Background(), "office", time.Now(), 10, filter)
+
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+
+	session.AssertExpectations(t)
+	session.AssertCalled(t, "Query", getBucketsDescending, "office", 202111, 202111)
+}
+
+func TestNewWindow(t *testing.T) {
+	sent := time.Date(2021, time.November, 3, 14, 5, 7, 123456700, time.UTC)
+	messageID := gocql.UUIDFromTime(sent).String()
+	before, _ := beforeMessage(messageID)
+	after, _ := afterMessage(messageID)
+
+	// a filter ending in the millisecond of the message is tighter than the message
+	w := newWindow("office", nil, before, domain.MessageFilter{To: sent.Truncate(time.Millisecond)})
+	assert.Equal(t, "message_id < minTimeuuid(?)", w.upper.clause)
+	w = newWindow("office", nil, before, domain.MessageFilter{To: sent.Add(time.Millisecond)})
+	assert.Equal(t, before, w.upper)
+
+	// and one starting in it isn't
+	w = newWindow("office", after, nil, domain.MessageFilter{From: sent})
+	assert.Equal(t, after, w.lower)
+	w = newWindow("office", after, nil, domain.MessageFilter{From: sent.Add(time.Millisecond)})
+	assert.Equal(t, "message_id >= minTimeuuid(?)", w.lower.clause)
+
+	lower, upper := newWindow("office", nil, nil, domain.MessageFilter{}).buckets()
+	assert.Equal(t, 0, lower)
+	assert.Equal(t, maxBucket, upper)
+}
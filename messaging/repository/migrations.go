@@ -0,0 +1,255 @@
+package repository
+
+import (
+	"chat/domain"
+	"chat/messaging/repository/cassandra"
+	"chat/utils/search"
+	"context"
+	"github.com/gocql/gocql"
+	"hash/fnv"
+	"time"
+)
+
+// chat.messages is the table the messages were kept in before they had an id, keyed by (room_id, sent_timestamp).
+// chat.messages_by_id is the table they were kept in before they were bucketed, with the whole room in one partition
+const (
+	getLegacyMessages     = `SELECT room_id, sent_timestamp, from_student_id, message_body, writetime(message_body) FROM chat.messages`
+	getUnbucketedRooms    = `SELECT DISTINCT room_id FROM chat.messages_by_id`
+	getUnbucketedMessages = `SELECT message_id, sent_timestamp, from_student_id, message_body, writetime(message_body) FROM chat.messages_by_id WHERE room_id=?`
+	getBucketedRooms      = `SELECT DISTINCT room_id FROM chat.message_buckets`
+	getBucketedMessages   = `SELECT message_id, sent_timestamp, from_student_id, message_body, writetime(message_body), ttl(message_body), edited_at, edit_count, deleted_at, deleted_by FROM chat.messages_by_bucket WHERE room_id=? AND bucket=?`
+	// the old row's write time is kept, so running a migration again never overwrites a message edited since. The body
+	// of a message's author copy is written apart, with the time to live a deleted message's retained body has left
+	migrateMessage       = `INSERT INTO chat.messages_by_bucket (room_id, bucket, message_id, sent_timestamp, from_student_id, message_body) VALUES (?, ?, ?, ?, ?, ?) USING TIMESTAMP ?`
+	migrateAuthorMessage = `INSERT INTO chat.messages_by_author (room_id, from_student_id, bucket, message_id, sent_timestamp, edited_at, edit_count, deleted_at, deleted_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) USING TIMESTAMP ?`
+	migrateAuthorBody    = `UPDATE chat.messages_by_author USING TTL ? AND TIMESTAMP ? SET message_body=? WHERE room_id=? AND from_student_id=? AND bucket=? AND message_id=?`
+	migrateTerm          = `INSERT INTO chat.message_terms (room_id, bucket, term, message_id) VALUES (?, ?, ?, ?) USING TIMESTAMP ?`
+)
+
+// gregorianOffset is the number of 100ns intervals between the start of the gregorian calendar, where timeuuids
+// start, and the unix epoch
+const gregorianOffset = 0x01B21DD213814000
+
+// migratedRow is what a migration keeps of the row it copies a message from besides the message: the write time of
+// its body and the time to live the body has left, 0 when it has none
+type migratedRow struct {
+	writeTime int64
+	ttl       int
+}
+
+// LegacyMessageID is the id a message of chat.messages gets when it is migrated. It only depends on the room and the
+// sent timestamp, which were the key of the message, so it is unique and the same every time the migration runs
+func LegacyMessageID(roomID string, sentTimestamp time.Time) string {
+	h := fnv.New64a()
+	h.Write([]byte(roomID))
+	sum := h.Sum64()
+	node := []byte{byte(sum >> 40), byte(sum >> 32), byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)}
+	return gocql.TimeUUIDWith(sentTimestamp.UnixNano()/100+gregorianOffset, uint32(sum>>48), node).String()
+}
+
+// MigrateMessageIDs copies every message of chat.messages to its bucket and returns how many were copied. It can be
+// stopped and run again, the messages already copied are written with the same id
+func (m *MessageRepository) MigrateMessageIDs(ctx context.Context) (int, error) {
+	migrated := 0
+
+	scanner := m.dbSession.Query(getLegacyMessages).WithContext(ctx).Iter().Scanner()
+	for scanner.Next() {
+		var msg domain.Message
+		var row migratedRow
+		if err := scanner.Scan(&msg.RoomID, &msg.SentTimestamp, &msg.FromStudentID, &msg.MessageBody, &row.writeTime); err != nil {
+			return migrated, err
+		}
+		msg.MessageID = LegacyMessageID(msg.RoomID, msg.SentTimestamp)
+		if err := m.migrateMessage(ctx, &msg, row); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	if err := scanner.Err(); err != nil {
+		return migrated, err
+	}
+
+	return migrated, nil
+}
+
+// MigrateMessageBuckets rewrites every room of chat.messages_by_id into its buckets, one room at a time, and returns
+// how many messages were copied. It can be stopped and run again
+func (m *MessageRepository) MigrateMessageBuckets(ctx context.Context) (int, error) {
+	migrated := 0
+
+	rooms, err := m.getRooms(ctx, getUnbucketedRooms)
+	if err != nil {
+		return migrated, err
+	}
+	for _, roomID := range rooms {
+		n, err := m.migrateMessages(ctx, roomID, m.dbSession.Query(getUnbucketedMessages, roomID), scanUnbucketed,
+			m.migrateMessage)
+		migrated += n
+		if err != nil {
+			return migrated, err
+		}
+	}
+
+	return migrated, nil
+}
+
+// MigrateMessageAuthors copies the messages of every bucket of every room to chat.messages_by_author and returns how
+// many were copied. The messages saved since it was added are already there. It can be stopped and run again
+func (m *MessageRepository) MigrateMessageAuthors(ctx context.Context) (int, error) {
+	return m.migrateBuckets(ctx, m.migrateAuthorMessage)
+}
+
+// MigrateMessageTerms indexes the messages of every bucket of every room in chat.message_terms and returns how many
+// were indexed. The messages saved since it was added are already there. It can be stopped and run again
+func (m *MessageRepository) MigrateMessageTerms(ctx context.Context) (int, error) {
+	return m.migrateBuckets(ctx, m.migrateTerms)
+}
+
+// migrateBuckets runs migrate on the messages of every bucket of every room, one bucket at a time, and returns how
+// many it migrated
+func (m *MessageRepository) migrateBuckets(ctx context.Context, migrate func(context.Context, *domain.Message, migratedRow) error) (int, error) {
+	migrated := 0
+
+	rooms, err := m.getRooms(ctx, getBucketedRooms)
+	if err != nil {
+		return migrated, err
+	}
+	for _, roomID := range rooms {
+		buckets, err := m.getBuckets(ctx, getBucketsAscending, roomID, 0, maxBucket)
+		if err != nil {
+			return migrated, err
+		}
+		for _, bucket := range buckets {
+			n, err := m.migrateMessages(ctx, roomID, m.dbSession.Query(getBucketedMessages, roomID, bucket), scanBucketed,
+				migrate)
+			migrated += n
+			if err != nil {
+				return migrated, err
+			}
+		}
+	}
+
+	return migrated, nil
+}
+
+// getRooms reads the rooms the query lists
+func (m *MessageRepository) getRooms(ctx context.Context, query string) ([]string, error) {
+	rooms := []string{}
+
+	scanner := m.dbSession.Query(query).WithContext(ctx).Iter().Scanner()
+	for scanner.Next() {
+		var roomID string
+		if err := scanner.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, roomID)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rooms, nil
+}
+
+// scanUnbucketed reads a message of chat.messages_by_id, which was never edited nor deleted
+func scanUnbucketed(scanner cassandra.ScannerInterface, msg *domain.Message, row *migratedRow) error {
+	return scanner.Scan(&msg.MessageID, &msg.SentTimestamp, &msg.FromStudentID, &msg.MessageBody, &row.writeTime)
+}
+
+// scanBucketed reads a message of chat.messages_by_bucket with its edit and its deletion
+func scanBucketed(scanner cassandra.ScannerInterface, msg *domain.Message, row *migratedRow) error {
+	return scanner.Scan(&msg.MessageID, &msg.SentTimestamp, &msg.FromStudentID, &msg.MessageBody, &row.writeTime,
+		&row.ttl, &msg.EditedAt, &msg.EditCount, &msg.DeletedAt, &msg.DeletedBy)
+}
+
+// migrateMessages runs migrate on every message of the room the query reads with scan, and returns how many it
+// migrated
+func (m *MessageRepository) migrateMessages(ctx context.Context, roomID string, query cassandra.QueryInterface,
+	scan func(cassandra.ScannerInterface, *domain.Message, *migratedRow) error,
+	migrate func(context.Context, *domain.Message, migratedRow) error) (int, error) {
+	migrated := 0
+
+	scanner := query.WithContext(ctx).Iter().Scanner()
+	for scanner.Next() {
+		msg := domain.Message{RoomID: roomID}
+		var row migratedRow
+		if err := scan(scanner, &msg, &row); err != nil {
+			return migrated, err
+		}
+		if err := migrate(ctx, &msg, row); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	if err := scanner.Err(); err != nil {
+		return migrated, err
+	}
+
+	return migrated, nil
+}
+
+// migrateMessage writes the message to its bucket and to its author's as of the write time of the row it is copied
+// from
+func (m *MessageRepository) migrateMessage(ctx context.Context, msg *domain.Message, row migratedRow) error {
+	bucket, err := messageBucket(msg.MessageID)
+	if err != nil {
+		return err
+	}
+	err = m.dbSession.Query(insertBucket, msg.RoomID, bucket).WithContext(ctx).Exec()
+	if err != nil {
+		return err
+	}
+	err = m.dbSession.Query(migrateMessage, msg.RoomID, bucket, msg.MessageID, msg.SentTimestamp, msg.FromStudentID,
+		msg.MessageBody, row.writeTime).WithContext(ctx).Exec()
+	if err != nil {
+		return err
+	}
+	return m.migrateAuthorMessage(ctx, msg, row)
+}
+
+// migrateAuthorMessage writes the message to its author's bucket as of the write time of the row it is copied from,
+// with its edit and its deletion. The body of a deleted message is only written while it is retained, and expires
+// when the one it is copied from does
+func (m *MessageRepository) migrateAuthorMessage(ctx context.Context, msg *domain.Message, row migratedRow) error {
+	bucket, err := messageBucket(msg.MessageID)
+	if err != nil {
+		return err
+	}
+	// a message never edited has no edit count, the edits compare it to null
+	var editCount, deletedBy interface{}
+	if msg.EditCount > 0 {
+		editCount = msg.EditCount
+	}
+	if msg.DeletedBy != "" {
+		deletedBy = msg.DeletedBy
+	}
+	err = m.dbSession.Query(migrateAuthorMessage, msg.RoomID, msg.FromStudentID, bucket, msg.MessageID,
+		msg.SentTimestamp, msg.EditedAt, editCount, msg.DeletedAt, deletedBy, row.writeTime).WithContext(ctx).Exec()
+	if err != nil {
+		return err
+	}
+	if !msg.DeletedAt.IsZero() && row.ttl == 0 {
+		return nil
+	}
+	return m.dbSession.Query(migrateAuthorBody, row.ttl, row.writeTime, msg.MessageBody, msg.RoomID, msg.FromStudentID,
+		bucket, msg.MessageID).WithContext(ctx).Exec()
+}
+
+// migrateTerms writes the terms of the message as of the write time of the row they are read from, so the terms of a
+// body edited since are deleted again. A deleted message isn't searchable, its terms aren't written
+func (m *MessageRepository) migrateTerms(ctx context.Context, msg *domain.Message, row migratedRow) error {
+	if !msg.DeletedAt.IsZero() {
+		return nil
+	}
+	bucket, err := messageBucket(msg.MessageID)
+	if err != nil {
+		return err
+	}
+	for _, term := range search.Terms(msg.MessageBody) {
+		err = m.dbSession.Query(migrateTerm, msg.RoomID, bucket, term, msg.MessageID, row.writeTime).WithContext(ctx).Exec()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,447 @@
+package repository
+
+import (
+	"chat/messaging/repository/mocks"
+	"context"
+	"errors"
+	"github.com/gocql/gocql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+func TestLegacyMessageID(t *testing.T) {
+	sent := time.Date(2021, time.November, 3, 14, 5, 7, 123000000, time.UTC)
+
+	id := LegacyMessageID("office", sent)
+	assert.Equal(t, id, LegacyMessageID("office", sent))
+	assert.NotEqual(t, id, LegacyMessageID("allstars", sent))
+	assert.NotEqual(t, id, LegacyMessageID("office", sent.Add(time.Millisecond)))
+
+	uuid, err := gocql.ParseUUID(id)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, uuid.Version())
+	assert.True(t, sent.Equal(uuid.Time()))
+}
+
+func TestMigrateMessageIDsSuccess(t *testing.T) {
+	reset()
+	sent := time.Date(2021, time.November, 3, 14, 5, 7, 123000000, time.UTC)
+	insert := &mocks.QueryInterface{}
+
+	session.On("Query", getLegacyMessages).
+		Return(query)
+	session.On("Query", insertBucket, "office", 202111).
+		Return(insert).Twice()
+	session.On("Query", migrateMessage, "office", 202111, LegacyMessageID("office", sent), sent, "jim", "bears", int64(42)).
+		Return(insert).Twice()
+	session.On("Query", migrateAuthorMessage, "office", "jim", 202111, LegacyMessageID("office", sent), sent, time.Time{}, nil,
+		time.Time{}, nil, int64(42)).
+		Return(insert).Twice()
+	session.On("Query", migrateAuthorBody, 0, int64(42), "bears", "office", "jim", 202111, LegacyMessageID("office", sent)).
+		Return(insert).Twice()
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter)
+	iter.On("Scanner").
+		Return(scannerMock)
+	insert.On("WithContext", mock.Anything).
+		Return(insert)
+	insert.On("Exec").
+		Return(nil)
+
+	scannerMock.On("Next").Return(true).Twice()
+	scannerMock.On("Next").Return(false)
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			*args.Get(0).(*string) = "office"
+			*args.Get(1).(*time.Time) = sent
+			*args.Get(2).(*string) = "jim"
+			*args.Get(3).(*string) = "bears"
+			*args.Get(4).(*int64) = 42
+		}).
+		Return(nil)
+	scannerMock.On("Err").Return(nil)
+
+	migrated, err := cr.MigrateMessageIDs(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, migrated)
+
+	session.AssertExpectations(t)
+	insert.AssertExpectations(t)
+}
+
+func TestMigrateMessageIDsInsertError(t *testing.T) {
+	reset()
+	insert := &mocks.QueryInterface{}
+
+	session.On("Query", getLegacyMessages).
+		Return(query)
+	session.On("Query", insertBucket, mock.Anything, mock.Anything).
+		Return(insert)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter)
+	iter.On("Scanner").
+		Return(scannerMock)
+	insert.On("WithContext", mock.Anything).
+		Return(insert)
+	insert.On("Exec").
+		Return(errors.New(internalErrorMessage))
+
+	scannerMock.On("Next").Return(true)
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) { *args.Get(1).(*time.Time) = time.Now() }).
+		Return(nil)
+
+	migrated, err := cr.MigrateMessageIDs(context.Background())
+
+	assert.Error(t, err)
+	assert.Equal(t, 0, migrated)
+
+	session.AssertExpectations(t)
+}
+
+func TestMigrateMessageIDsError(t *testing.T) {
+	reset()
+
+	session.On("Query", getLegacyMessages).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter)
+	iter.On("Scanner").
+		Return(scannerMock)
+
+	scannerMock.On("Next").Return(false)
+	scannerMock.On("Err").Return(errors.New(internalErrorMessage))
+
+	_, err := cr.MigrateMessageIDs(context.Background())
+
+	assert.Error(t, err)
+
+	session.AssertExpectations(t)
+}
+
+func TestMigrateMessageBucketsSuccess(t *testing.T) {
+	reset()
+	messageID := gocql.UUIDFromTime(time.Date(2021, time.November, 3, 14, 5, 7, 0, time.UTC)).String()
+	insert := &mocks.QueryInterface{}
+	roomsIter := &mocks.IterInterface{}
+	roomsScanner := &mocks.ScannerInterface{}
+
+	session.On("Query", getUnbucketedRooms).
+		Return(query).Once()
+	session.On("Query", getUnbucketedMessages, "office").
+		Return(query).Once()
+	session.On("Query", insertBucket, "office", 202111).
+		Return(insert).Once()
+	session.On("Query", migrateMessage, "office", 202111, messageID, mock.Anything, "jim", "bears", int64(42)).
+		Return(insert).Once()
+	session.On("Query", migrateAuthorMessage, "office", "jim", 202111, messageID, mock.Anything, time.Time{}, nil,
+		time.Time{}, nil, int64(42)).
+		Return(insert).Once()
+	session.On("Query", migrateAuthorBody, 0, int64(42), "bears", "office", "jim", 202111, messageID).
+		Return(insert).Once()
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(roomsIter).Once()
+	query.On("Iter").
+		Return(iter).Once()
+	roomsIter.On("Scanner").
+		Return(roomsScanner)
+	iter.On("Scanner").
+		Return(scannerMock)
+	insert.On("WithContext", mock.Anything).
+		Return(insert)
+	insert.On("Exec").
+		Return(nil)
+
+	roomsScanner.On("Next").Return(true).Once()
+	roomsScanner.On("Next").Return(false)
+	roomsScanner.On("Scan", mock.Anything).
+		Run(func(args mock.Arguments) { *args.Get(0).(*string) = "office" }).
+		Return(nil)
+	roomsScanner.On("Err").Return(nil)
+	scannerMock.On("Next").Return(true).Once()
+	scannerMock.On("Next").Return(false)
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			*args.Get(0).(*string) = messageID
+			*args.Get(2).(*string) = "jim"
+			*args.Get(3).(*string) = "bears"
+			*args.Get(4).(*int64) = 42
+		}).
+		Return(nil)
+	scannerMock.On("Err").Return(nil)
+
+	migrated, err := cr.MigrateMessageBuckets(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, migrated)
+
+	session.AssertExpectations(t)
+	insert.AssertExpectations(t)
+}
+
+func TestMigrateMessageBucketsError(t *testing.T) {
+	reset()
+
+	session.On("Query", getUnbucketedRooms).
+		Return(query)
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(iter)
+	iter.On("Scanner").
+		Return(scannerMock)
+
+	scannerMock.On("Next").Return(false)
+	scannerMock.On("Err").Return(errors.New(internalErrorMessage))
+
+	_, err := cr.MigrateMessageBuckets(context.Background())
+
+	assert.Error(t, err)
+
+	session.AssertExpectations(t)
+}
+
+func TestMigrateMessageAuthorsSuccess(t *testing.T) {
+	reset()
+	messageID := gocql.UUIDFromTime(time.Date(2021, time.November, 3, 14, 5, 7, 0, time.UTC)).String()
+	insert := &mocks.QueryInterface{}
+	roomsIter := &mocks.IterInterface{}
+	roomsScanner := &mocks.ScannerInterface{}
+
+	session.On("Query", getBucketedRooms).
+		Return(query).Once()
+	mockBuckets(getBucketsAscending, "office", 202111)
+	session.On("Query", getBucketedMessages, "office", 202111).
+		Return(query).Once()
+	session.On("Query", migrateAuthorMessage, "office", "jim", 202111, messageID, mock.Anything, time.Time{}, nil,
+		time.Time{}, nil, int64(42)).
+		Return(insert).Once()
+	session.On("Query", migrateAuthorBody, 0, int64(42), "bears", "office", "jim", 202111, messageID).
+		Return(insert).Once()
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(roomsIter).Once()
+	query.On("Iter").
+		Return(iter).Once()
+	roomsIter.On("Scanner").
+		Return(roomsScanner)
+	iter.On("Scanner").
+		Return(scannerMock)
+	insert.On("WithContext", mock.Anything).
+		Return(insert)
+	insert.On("Exec").
+		Return(nil)
+
+	roomsScanner.On("Next").Return(true).Once()
+	roomsScanner.On("Next").Return(false)
+	roomsScanner.On("Scan", mock.Anything).
+		Run(func(args mock.Arguments) { *args.Get(0).(*string) = "office" }).
+		Return(nil)
+	roomsScanner.On("Err").Return(nil)
+	scannerMock.On("Next").Return(true).Once()
+	scannerMock.On("Next").Return(false)
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			*args.Get(0).(*string) = messageID
+			*args.Get(2).(*string) = "jim"
+			*args.Get(3).(*string) = "bears"
+			*args.Get(4).(*int64) = 42
+		}).
+		Return(nil)
+	scannerMock.On("Err").Return(nil)
+
+	migrated, err := cr.MigrateMessageAuthors(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, migrated)
+
+	session.AssertExpectations(t)
+	insert.AssertExpectations(t)
+}
+
+func TestMigrateMessageTermsSuccess(t *testing.T) {
+	reset()
+	messageID := gocql.UUIDFromTime(time.Date(2021, time.November, 3, 14, 5, 7, 0, time.UTC)).String()
+	insert := &mocks.QueryInterface{}
+	roomsIter := &mocks.IterInterface{}
+	roomsScanner := &mocks.ScannerInterface{}
+
+	session.On("Query", getBucketedRooms).
+		Return(query).Once()
+	mockBuckets(getBucketsAscending, "office", 202111)
+	session.On("Query", getBucketedMessages, "office", 202111).
+		Return(query).Once()
+	session.On("Query", migrateTerm, "office", 202111, "bears", messageID, int64(42)).
+		Return(insert).Once()
+	session.On("Query", migrateTerm, "office", 202111, "beets", messageID, int64(42)).
+		Return(insert).Once()
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(roomsIter).Once()
+	query.On("Iter").
+		Return(iter).Once()
+	roomsIter.On("Scanner").
+		Return(roomsScanner)
+	iter.On("Scanner").
+		Return(scannerMock)
+	insert.On("WithContext", mock.Anything).
+		Return(insert)
+	insert.On("Exec").
+		Return(nil)
+
+	roomsScanner.On("Next").Return(true).Once()
+	roomsScanner.On("Next").Return(false)
+	roomsScanner.On("Scan", mock.Anything).
+		Run(func(args mock.Arguments) { *args.Get(0).(*string) = "office" }).
+		Return(nil)
+	roomsScanner.On("Err").Return(nil)
+	scannerMock.On("Next").Return(true).Once()
+	scannerMock.On("Next").Return(false)
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			*args.Get(0).(*string) = messageID
+			*args.Get(2).(*string) = "jim"
+			*args.Get(3).(*string) = "Bears, beets"
+			*args.Get(4).(*int64) = 42
+		}).
+		Return(nil)
+	scannerMock.On("Err").Return(nil)
+
+	migrated, err := cr.MigrateMessageTerms(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, migrated)
+
+	session.AssertExpectations(t)
+	insert.AssertExpectations(t)
+}
+
+// mockDeletedBucket lists the room office with a bucket holding one message jim deleted, edited once before, whose
+// body is retained for ttl more seconds, or purged when ttl is 0
+func mockDeletedBucket(messageID string, editedAt time.Time, deletedAt time.Time, ttl int) {
+	roomsIter := &mocks.IterInterface{}
+	roomsScanner := &mocks.ScannerInterface{}
+
+	session.On("Query", getBucketedRooms).
+		Return(query).Once()
+	mockBuckets(getBucketsAscending, "office", 202111)
+	session.On("Query", getBucketedMessages, "office", 202111).
+		Return(query).Once()
+	query.On("WithContext", mock.Anything).
+		Return(query)
+	query.On("Iter").
+		Return(roomsIter).Once()
+	query.On("Iter").
+		Return(iter).Once()
+	roomsIter.On("Scanner").
+		Return(roomsScanner)
+	iter.On("Scanner").
+		Return(scannerMock)
+
+	roomsScanner.On("Next").Return(true).Once()
+	roomsScanner.On("Next").Return(false)
+	roomsScanner.On("Scan", mock.Anything).
+		Run(func(args mock.Arguments) { *args.Get(0).(*string) = "office" }).
+		Return(nil)
+	roomsScanner.On("Err").Return(nil)
+	scannerMock.On("Next").Return(true).Once()
+	scannerMock.On("Next").Return(false)
+	scannerMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			*args.Get(0).(*string) = messageID
+			*args.Get(2).(*string) = "jim"
+			if ttl > 0 {
+				*args.Get(3).(*string) = "Bears, beets"
+			}
+			*args.Get(4).(*int64) = 42
+			*args.Get(5).(*int) = ttl
+			*args.Get(6).(*time.Time) = editedAt
+			*args.Get(7).(*int) = 1
+			*args.Get(8).(*time.Time) = deletedAt
+			*args.Get(9).(*string) = "michael"
+		}).
+		Return(nil)
+	scannerMock.On("Err").Return(nil)
+}
+
+func TestMigrateMessageAuthorsDeleted(t *testing.T) {
+	messageID := gocql.UUIDFromTime(time.Date(2021, time.November, 3, 14, 5, 7, 0, time.UTC)).String()
+	editedAt := time.Date(2021, time.November, 3, 14, 6, 0, 0, time.UTC)
+	deletedAt := time.Date(2021, time.November, 3, 14, 7, 0, 0, time.UTC)
+
+	t.Run("the retained body expires with the one it is copied from", func(t *testing.T) {
+		reset()
+		insert := &mocks.QueryInterface{}
+		mockDeletedBucket(messageID, editedAt, deletedAt, 3600)
+		session.On("Query", migrateAuthorMessage, "office", "jim", 202111, messageID, mock.Anything, editedAt, 1,
+			deletedAt, "michael", int64(42)).
+			Return(insert).Once()
+		session.On("Query", migrateAuthorBody, 3600, int64(42), "Bears, beets", "office", "jim", 202111, messageID).
+			Return(insert).Once()
+		insert.On("WithContext", mock.Anything).
+			Return(insert)
+		insert.On("Exec").
+			Return(nil)
+
+		migrated, err := cr.MigrateMessageAuthors(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, migrated)
+
+		session.AssertExpectations(t)
+		insert.AssertExpectations(t)
+	})
+
+	t.Run("a purged body isn't written", func(t *testing.T) {
+		reset()
+		insert := &mocks.QueryInterface{}
+		mockDeletedBucket(messageID, editedAt, deletedAt, 0)
+		session.On("Query", migrateAuthorMessage, "office", "jim", 202111, messageID, mock.Anything, editedAt, 1,
+			deletedAt, "michael", int64(42)).
+			Return(insert).Once()
+		insert.On("WithContext", mock.Anything).
+			Return(insert)
+		insert.On("Exec").
+			Return(nil)
+
+		migrated, err := cr.MigrateMessageAuthors(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, migrated)
+
+		session.AssertExpectations(t)
+		session.AssertNotCalled(t, "Query", migrateAuthorBody, mock.Anything, mock.Anything, mock.Anything,
+			mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestMigrateMessageTermsDeleted(t *testing.T) {
+	reset()
+	messageID := gocql.UUIDFromTime(time.Date(2021, time.November, 3, 14, 5, 7, 0, time.UTC)).String()
+	mockDeletedBucket(messageID, time.Time{}, time.Date(2021, time.November, 3, 14, 7, 0, 0, time.UTC), 3600)
+
+	migrated, err := cr.MigrateMessageTerms(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, migrated)
+
+	session.AssertExpectations(t)
+	session.AssertNotCalled(t, "Query", migrateTerm, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything)
+}
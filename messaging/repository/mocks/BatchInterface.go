@@ -36,3 +36,19 @@ func (_m *BatchInterface) WithContext(ctx context.Context) cassandra.BatchInterf
 
 	return r0
 }
+
+// WithTimestamp provides a mock function with given fields: timestamp
+func (_m *BatchInterface) WithTimestamp(timestamp int64) cassandra.BatchInterface {
+	ret := _m.Called(timestamp)
+
+	var r0 cassandra.BatchInterface
+	if rf, ok := ret.Get(0).(func(int64) cassandra.BatchInterface); ok {
+		r0 = rf(timestamp)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(cassandra.BatchInterface)
+		}
+	}
+
+	return r0
+}
@@ -0,0 +1,162 @@
+package repository
+
+import (
+	"chat/domain"
+	"chat/messaging/repository/cassandra"
+	"context"
+	"github.com/gocql/gocql"
+)
+
+// chat.message_terms indexes the messages by the terms of their body, partitioned by room, bucket and term like
+// chat.messages_by_bucket. The terms of a message are written in the same logged batch as the message, so the index
+// has every message once the batch is applied
+const (
+	insertTerm            = `INSERT INTO chat.message_terms (room_id, bucket, term, message_id) VALUES (?, ?, ?, ?)`
+	deleteTerm            = `DELETE FROM chat.message_terms WHERE room_id=? AND bucket=? AND term=? AND message_id=?`
+	getTermMessages       = `SELECT message_id FROM chat.message_terms WHERE room_id=? AND bucket=? AND term=? LIMIT ?`
+	getTermMessagesBefore = `SELECT message_id FROM chat.message_terms WHERE room_id=? AND bucket=? AND term=? AND message_id < ? LIMIT ?`
+	getTermMessagesIn     = `SELECT message_id FROM chat.message_terms WHERE room_id=? AND bucket=? AND term=? AND message_id IN ?`
+)
+
+// addTermEntries adds stmt, inserting or deleting a term of the message, to the batch for each of the terms
+func addTermEntries(batch cassandra.BatchInterface, stmt string, message *domain.Message, bucket int, terms []string) {
+	for _, term := range terms {
+		batch.AddBatchEntry(&gocql.BatchEntry{
+			Stmt: stmt,
+			Args: []interface{}{message.RoomID, bucket, term, message.MessageID},
+		})
+	}
+}
+
+// missingTerms returns the terms others doesn't have
+func missingTerms(terms []string, others []string) []string {
+	has := map[string]bool{}
+	for _, term := range others {
+		has[term] = true
+	}
+	missing := []string{}
+	for _, term := range terms {
+		if !has[term] {
+			missing = append(missing, term)
+		}
+	}
+	return missing
+}
+
+// SearchMessages walks the buckets of the room back from the one of before, and loads the messages of each bucket
+// that have every term until it has limit messages. The messages of a bucket are matched a page of limit messages of
+// the first term at a time, a common term can have the whole bucket
+func (m *MessageRepository) SearchMessages(ctx context.Context, roomID string, terms []string, before string, limit int) ([]domain.Message, error) {
+	foundMessages := []domain.Message{}
+	if len(terms) == 0 {
+		return foundMessages, nil
+	}
+
+	upper := maxBucket
+	if before != "" {
+		bucket, err := messageBucket(before)
+		if err != nil {
+			return nil, err
+		}
+		upper = bucket
+	}
+	buckets, err := m.getBuckets(ctx, getBucketsDescending, roomID, 0, upper)
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range buckets {
+		if len(foundMessages) >= limit {
+			break
+		}
+		cursor, more := before, true
+		for more && len(foundMessages) < limit {
+			var ids []string
+			ids, cursor, more, err = m.matchingMessages(ctx, roomID, bucket, terms, cursor, limit)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				if len(foundMessages) >= limit {
+					break
+				}
+				msg, err := m.GetMessage(ctx, roomID, id)
+				if err == gocql.ErrNotFound {
+					// deleted before the messages had tombstones
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				if !msg.DeletedAt.IsZero() {
+					// the terms are deleted with the message, unless the delete failed after marking it deleted
+					continue
+				}
+				foundMessages = append(foundMessages, *msg)
+			}
+		}
+	}
+
+	return foundMessages, nil
+}
+
+// matchingMessages reads the next page of the messages of the bucket that have the first term, sent before the message
+// unless before is empty, and returns the ids of the page that have every other term too, newest first. It returns the
+// last id of the page to read the next one from, and if there may be one
+func (m *MessageRepository) matchingMessages(ctx context.Context, roomID string, bucket int, terms []string, before string, pageSize int) ([]string, string, bool, error) {
+	page, err := m.getTermMessages(ctx, roomID, bucket, terms[0], before, pageSize)
+	if err != nil || len(page) == 0 {
+		return nil, "", false, err
+	}
+	last, more := page[len(page)-1], len(page) == pageSize
+
+	matching := page
+	for _, term := range terms[1:] {
+		if len(matching) == 0 {
+			break
+		}
+		ids, err := m.readIDs(ctx, m.dbSession.Query(getTermMessagesIn, roomID, bucket, term, matching))
+		if err != nil {
+			return nil, "", false, err
+		}
+		has := map[string]bool{}
+		for _, id := range ids {
+			has[id] = true
+		}
+		kept := []string{}
+		for _, id := range matching {
+			if has[id] {
+				kept = append(kept, id)
+			}
+		}
+		matching = kept
+	}
+	return matching, last, more, nil
+}
+
+// getTermMessages reads the ids of at most limit messages of the bucket that have the term, sent before the message
+// unless before is empty
+func (m *MessageRepository) getTermMessages(ctx context.Context, roomID string, bucket int, term string, before string, limit int) ([]string, error) {
+	if before == "" {
+		return m.readIDs(ctx, m.dbSession.Query(getTermMessages, roomID, bucket, term, limit))
+	}
+	return m.readIDs(ctx, m.dbSession.Query(getTermMessagesBefore, roomID, bucket, term, before, limit))
+}
+
+// readIDs reads the message ids the query selects
+func (m *MessageRepository) readIDs(ctx context.Context, query cassandra.QueryInterface) ([]string, error) {
+	ids := []string{}
+
+	scanner := query.WithContext(ctx).Iter().Scanner()
+	for scanner.Next() {
+		var id string
+		if err := scanner.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
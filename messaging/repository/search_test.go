@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"chat/domain"
+	"chat/messaging/repository/mocks"
+	"context"
+	"github.com/gocql/gocql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+// mockIDs answers the query of the message ids with the ids
+func mockIDs(stmt string, args []interface{}, ids ...string) {
+	idQuery := &mocks.QueryInterface{}
+	idIter := &mocks.IterInterface{}
+	idScanner := &mocks.ScannerInterface{}
+	session.On("Query", append([]interface{}{stmt}, args...)...).
+		Return(idQuery)
+	idQuery.On("WithContext", mock.Anything).
+		Return(idQuery)
+	idQuery.On("Iter").
+		Return(idIter)
+	idIter.On("Scanner").
+		Return(idScanner)
+	for _, id := range ids {
+		id := id
+		idScanner.On("Next").Return(true).Once()
+		idScanner.On("Scan", mock.Anything).
+			Run(func(args mock.Arguments) { *args.Get(0).(*string) = id }).
+			Return(nil).Once()
+	}
+	idScanner.On("Next").Return(false)
+	idScanner.On("Err").Return(nil)
+}
+
+// mockTermMessages answers the page of limit messages of the term in the bucket before the message with the ids
+func mockTermMessages(roomID string, bucket int, term string, before string, limit int, ids ...string) {
+	mockIDs(getTermMessagesBefore, []interface{}{roomID, bucket, term, before, limit}, ids...)
+}
+
+// mockTermMessagesIn answers which of the messages in have the term in the bucket with the ids
+func mockTermMessagesIn(roomID string, bucket int, term string, in []string, ids ...string) {
+	mockIDs(getTermMessagesIn, []interface{}{roomID, bucket, term, in}, ids...)
+}
+
+// mockMessage answers the query of the message with the message, or err
+func mockMessage(roomID string, bucket int, messageID string, err error) {
+	messageQuery := &mocks.QueryInterface{}
+	session.On("Query", getMessage, roomID, bucket, messageID).
+		Return(messageQuery)
+	messageQuery.On("WithContext", mock.Anything).
+		Return(messageQuery)
+	messageQuery.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			*args.Get(0).(*string) = roomID
+			*args.Get(1).(*string) = messageID
+		}).
+		Return(err)
+}
+
+func TestSearchMessagesSuccess(t *testing.T) {
+	reset()
+	roomID := "office"
+	idOf := func(day int, month time.Month) string {
+		return gocql.UUIDFromTime(time.Date(2021, month, day, 12, 0, 0, 0, time.UTC)).String()
+	}
+	before := idOf(20, time.November)
+	deleted, found, older, lunchOnly := idOf(10, time.November), idOf(3, time.November), idOf(28, time.October), idOf(2, time.October)
+
+	mockBuckets(getBucketsDescending, roomID, 202111, 202110, 202109)
+	mockTermMessages(roomID, 202111, "lunch", before, 2, deleted, found)
+	mockTermMessagesIn(roomID, 202111, "noon", []string{deleted, found}, deleted, found)
+	mockTermMessages(roomID, 202111, "lunch", found, 2)
+	mockTermMessages(roomID, 202110, "lunch", before, 2, older, lunchOnly)
+	mockTermMessagesIn(roomID, 202110, "noon", []string{older, lunchOnly}, older)
+	mockMessage(roomID, 202111, deleted, gocql.ErrNotFound)
+	mockMessage(roomID, 202111, found, nil)
+	mockMessage(roomID, 202110, older, nil)
+
+	messages, err := cr.SearchMessages(context.Background(), roomID, []string{"lunch", "noon"}, before, 2)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{found, older}, []string{messages[0].MessageID, messages[1].MessageID})
+	// the search stops once it has enough messages
+	session.AssertCalled(t, "Query", getBucketsDescending, roomID, 0, 202111)
+	session.AssertNotCalled(t, "Query", getTermMessagesBefore, roomID, 202109, mock.Anything, mock.Anything, mock.Anything)
+	session.AssertExpectations(t)
+}
+
+func TestSearchMessagesPagesTheFirstTerm(t *testing.T) {
+	reset()
+	roomID := "office"
+	idOf := func(day int) string {
+		return gocql.UUIDFromTime(time.Date(2021, time.November, day, 12, 0, 0, 0, time.UTC)).String()
+	}
+	lunchOnly, alsoLunchOnly, found := idOf(10), idOf(9), idOf(3)
+
+	mockBuckets(getBucketsDescending, roomID, 202111)
+	mockIDs(getTermMessages, []interface{}{roomID, 202111, "lunch", 2}, lunchOnly, alsoLunchOnly)
+	mockTermMessagesIn(roomID, 202111, "noon", []string{lunchOnly, alsoLunchOnly})
+	mockTermMessages(roomID, 202111, "lunch", alsoLunchOnly, 2, found)
+	mockTermMessagesIn(roomID, 202111, "noon", []string{found}, found)
+	mockMessage(roomID, 202111, found, nil)
+
+	messages, err := cr.SearchMessages(context.Background(), roomID, []string{"lunch", "noon"}, "", 2)
+
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+	assert.Equal(t, found, messages[0].MessageID)
+	session.AssertExpectations(t)
+}
+
+func TestSearchMessagesNoTerms(t *testing.T) {
+	reset()
+
+	messages, err := cr.SearchMessages(context.Background(), "office", []string{}, "", 10)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Message{}, messages)
+	session.AssertNotCalled(t, "Query", mock.Anything)
+}
+
+func TestSearchMessagesInvalidBefore(t *testing.T) {
+	reset()
+
+	_, err := cr.SearchMessages(context.Background(), "office", []string{"lunch"}, "2021-11-03T14:05:07Z", 10)
+
+	assert.Error(t, err)
+	session.AssertExpectations(t)
+}
@@ -0,0 +1,145 @@
+package repository
+
+import (
+	"chat/domain"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const messageColumns = `room_id, message_id, sent_timestamp, from_student_id, message_body, edited_at, edit_count, deleted_at, deleted_by`
+
+// maxBucket is past the bucket of any message, it bounds the buckets of a window without an upper bound
+const maxBucket = 999912
+
+// bound restricts the message ids a window reads on one side. time is when the bound is, which tells its bucket and
+// which of two bounds is tighter
+type bound struct {
+	clause string
+	value  interface{}
+	time   time.Time
+}
+
+func beforeTime(t time.Time) *bound {
+	return &bound{clause: "message_id < minTimeuuid(?)", value: t, time: t}
+}
+
+func sinceTime(t time.Time) *bound {
+	return &bound{clause: "message_id > maxTimeuuid(?)", value: t, time: t}
+}
+
+func fromTime(t time.Time) *bound {
+	return &bound{clause: "message_id >= minTimeuuid(?)", value: t, time: t}
+}
+
+func beforeMessage(messageID string) (*bound, error) {
+	t, err := messageTime(messageID)
+	if err != nil {
+		return nil, err
+	}
+	return &bound{clause: "message_id < ?", value: messageID, time: t}, nil
+}
+
+func afterMessage(messageID string) (*bound, error) {
+	t, err := messageTime(messageID)
+	if err != nil {
+		return nil, err
+	}
+	return &bound{clause: "message_id > ?", value: messageID, time: t}, nil
+}
+
+// window is the messages of a room between the bounds, a nil bound leaving its side open. With an author, they are
+// read from chat.messages_by_author, so the messages of the others aren't read at all
+type window struct {
+	roomID        string
+	fromStudentID string
+	lower         *bound
+	upper         *bound
+}
+
+// newWindow is the window of the room between the bounds, narrowed to the filter. Cassandra takes a single bound on
+// each side, so the tighter one is kept. The filter's are in milliseconds, so on a tie they are the tighter upper
+// bound and the looser lower one
+func newWindow(roomID string, lower *bound, upper *bound, filter domain.MessageFilter) window {
+	w := window{roomID: roomID, fromStudentID: filter.FromStudentID, lower: lower, upper: upper}
+	filter.From, filter.To = filter.From.Truncate(time.Millisecond), filter.To.Truncate(time.Millisecond)
+	if !filter.From.IsZero() && (w.lower == nil || w.lower.time.Before(filter.From)) {
+		w.lower = fromTime(filter.From)
+	}
+	if !filter.To.IsZero() && (w.upper == nil || !w.upper.time.Before(filter.To)) {
+		w.upper = beforeTime(filter.To)
+	}
+	return w
+}
+
+// query is the query of the messages of a bucket in the window, newest first unless ascending, and its values but the
+// limit
+func (w window) query(bucket int, ascending bool) (string, []interface{}) {
+	table := "chat.messages_by_bucket"
+	where := []string{"room_id=?"}
+	values := []interface{}{w.roomID}
+	if w.fromStudentID != "" {
+		table = "chat.messages_by_author"
+		where = append(where, "from_student_id=?")
+		values = append(values, w.fromStudentID)
+	}
+	where = append(where, "bucket=?")
+	values = append(values, bucket)
+	for _, b := range []*bound{w.lower, w.upper} {
+		if b != nil {
+			where = append(where, b.clause)
+			values = append(values, b.value)
+		}
+	}
+	order := ""
+	if ascending {
+		order = " ORDER BY message_id ASC"
+	}
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s%s limit ?", messageColumns, table, strings.Join(where, " AND "), order), values
+}
+
+// buckets is the range of buckets the window spans
+func (w window) buckets() (int, int) {
+	lower, upper := 0, maxBucket
+	if w.lower != nil {
+		lower = bucketOf(w.lower.time)
+	}
+	if w.upper != nil {
+		upper = bucketOf(w.upper.time)
+	}
+	return lower, upper
+}
+
+// walk reads the messages of the window bucket by bucket, from its upper bound down or, when ascending, from its
+// lower bound up, until it has limit messages
+func (m *MessageRepository) walk(ctx context.Context, w window, ascending bool, limit int) ([]domain.Message, error) {
+	retrievedMessages := []domain.Message{}
+	if w.lower != nil && w.upper != nil && !w.lower.time.Before(w.upper.time) {
+		return retrievedMessages, nil
+	}
+
+	bucketsQuery := getBucketsDescending
+	if ascending {
+		bucketsQuery = getBucketsAscending
+	}
+	lower, upper := w.buckets()
+	buckets, err := m.getBuckets(ctx, bucketsQuery, w.roomID, lower, upper)
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range buckets {
+		if len(retrievedMessages) >= limit {
+			break
+		}
+		stmt, values := w.query(bucket, ascending)
+		values = append(values, limit-len(retrievedMessages))
+		scanner := m.dbSession.Query(stmt, values...).WithContext(ctx).Iter().Scanner()
+		retrievedMessages, err = scanMessages(scanner, retrievedMessages)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return retrievedMessages, nil
+}
@@ -5,10 +5,14 @@ import (
 	"chat/domain"
 	"chat/utils"
 	"chat/utils/errors"
+	"chat/utils/search"
 	"context"
 	"fmt"
+	"github.com/gocql/gocql"
+	"log"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"text/template"
 	"time"
@@ -51,19 +55,128 @@ func (u *messageUseCase) IsAuthorized(ctx context.Context, userID, roomID string
 	return
 }
 
+// assignID gives the message its timeuuid unless it has one. The id holds the time the message was sent, so the ids
+// sort like the messages, and its clock sequence keeps apart the messages sent in the same millisecond
+func assignID(message *domain.Message) {
+	if message.MessageID == "" {
+		message.MessageID = gocql.UUIDFromTime(message.SentTimestamp).String()
+	}
+}
+
 func (u *messageUseCase) SaveMessage(ctx context.Context, message *domain.Message) error {
 	c, cancel := context.WithTimeout(ctx, u.timeout)
 	defer cancel()
 
-	return u.messageRepository.SaveMessage(c, message)
+	assignID(message)
+	err := u.messageRepository.SaveMessage(c, message)
+	if err != nil {
+		return err
+	}
+
+	room, err := u.roomRepository.GetRoom(c, message.RoomID)
+	if err != nil {
+		log.Printf("couldn't update activity of room %s: %s", message.RoomID, err.Error())
+		return nil
+	}
+	u.recordActivity(c, room, message)
+	return nil
 }
 
-func (u *messageUseCase) EditMessage(ctx context.Context, roomID string, userID string, timeStamp time.Time, message string) (*domain.Message, error) {
+// SendMessage claims the idempotency key before saving the message, so that a retry finds the message the key was
+// claimed for instead of saving it again. If the message can't be saved, the key is released for the retry
+func (u *messageUseCase) SendMessage(ctx context.Context, message *domain.Message, idempotencyKey string) (*domain.Message, bool, error) {
+	if idempotencyKey == "" {
+		return message, false, u.SaveMessage(ctx, message)
+	}
+
 	c, cancel := context.WithTimeout(ctx, u.timeout)
 	defer cancel()
 
-	existingMessage, err := u.messageRepository.GetMessage(ctx, roomID, timeStamp)
+	assignID(message)
+	messageID, claimed, err := u.messageRepository.ClaimIdempotencyKey(c, message.RoomID, message.FromStudentID, idempotencyKey, message.MessageID)
+	if err != nil {
+		return nil, false, errors.NewInternalServerError(err.Error())
+	}
+	if !claimed {
+		existingMessage, err := u.messageRepository.GetMessage(c, message.RoomID, messageID)
+		if err != nil {
+			// the request that claimed the key hasn't saved the message yet
+			return nil, false, errors.NewConflictError("A message with this idempotency key is still being sent")
+		}
+		return existingMessage, true, nil
+	}
+
+	err = u.SaveMessage(ctx, message)
+	if err != nil {
+		if releaseErr := u.messageRepository.ReleaseIdempotencyKey(c, message.RoomID, message.FromStudentID, idempotencyKey); releaseErr != nil {
+			log.Printf("couldn't release idempotency key of room %s: %s", message.RoomID, releaseErr.Error())
+		}
+		return nil, false, errors.NewInternalServerError(err.Error())
+	}
+	return message, false, nil
+}
+
+// recordActivity makes the message the room's last message and counts it as unread for every member but the sender.
+// The message is already saved by then, so failures are only logged
+func (u *messageUseCase) recordActivity(ctx context.Context, room *domain.ChatRoom, message *domain.Message) {
+	err := u.roomRepository.SaveLastMessage(ctx, message)
+	if err != nil {
+		log.Printf("couldn't save last message of room %s: %s", room.RoomID, err.Error())
+	}
+
+	var recipients []string
+	for _, student := range room.Students {
+		if student.ID != message.FromStudentID && !student.IsPending {
+			recipients = append(recipients, student.ID)
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+	err = u.roomRepository.AddUnread(ctx, message, recipients)
+	if err != nil {
+		log.Printf("couldn't update unread counts of room %s: %s", room.RoomID, err.Error())
+	}
+}
+
+// clearUnread stops counting the messages the student read up to the read position as unread. The position is
+// already saved by then, so failures are only logged
+func (u *messageUseCase) clearUnread(ctx context.Context, position *domain.ReadPosition) {
+	err := u.roomRepository.ClearUnread(ctx, position.RoomID, position.StudentID, position.LastRead)
+	if err != nil {
+		log.Printf("couldn't clear unread messages of %s in room %s: %s", position.StudentID, position.RoomID, err.Error())
+	}
+}
+
+// removeUnread stops counting the deleted message as unread for the members of its room. The message is already
+// deleted by then, so failures are only logged
+func (u *messageUseCase) removeUnread(ctx context.Context, message *domain.Message) {
+	room, err := u.roomRepository.GetRoom(ctx, message.RoomID)
+	if err != nil {
+		log.Printf("couldn't get room %s to remove the unread message: %s", message.RoomID, err.Error())
+		return
+	}
+	var recipients []string
+	for _, student := range room.Students {
+		if student.ID != message.FromStudentID {
+			recipients = append(recipients, student.ID)
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+	err = u.roomRepository.RemoveUnread(ctx, message, recipients)
 	if err != nil {
+		log.Printf("couldn't remove unread message of room %s: %s", message.RoomID, err.Error())
+	}
+}
+
+func (u *messageUseCase) EditMessage(ctx context.Context, roomID string, userID string, messageID string, message string) (*domain.Message, error) {
+	c, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	existingMessage, err := u.messageRepository.GetMessage(ctx, roomID, messageID)
+	if err != nil || !existingMessage.DeletedAt.IsZero() {
 		return nil, errors.NewNotFoundError("Message does not exist")
 	}
 
@@ -76,50 +189,355 @@ func (u *messageUseCase) EditMessage(ctx context.Context, roomID string, userID
 	}
 
 	if message == "" {
-		return nil, u.messageRepository.DeleteMessage(c, roomID, timeStamp)
+		return u.deleteMessage(c, existingMessage, userID)
 	}
 
+	previous := currentRevision(existingMessage)
 	existingMessage.MessageBody = message
-	err = u.messageRepository.EditMessage(c, existingMessage)
+	existingMessage.EditedAt = time.Now().UTC().Truncate(time.Millisecond)
+	existingMessage.EditCount++
+	err = u.messageRepository.EditMessage(c, existingMessage, previous)
 
+	if err == domain.ErrMessageChanged {
+		return nil, errors.NewConflictError("The message was edited or deleted meanwhile")
+	}
 	if err != nil {
 		return nil, errors.NewInternalServerError(err.Error())
 	}
 
+	u.refreshLastMessage(c, existingMessage)
 	return existingMessage, nil
 }
 
-func (u *messageUseCase) GetMessages(ctx context.Context, roomID string, timeStamp time.Time, limit int) ([]domain.Message, error) {
+// refreshLastMessage writes the new revision or the tombstone of the message as the room's last message, which only
+// replaces it if the message is the last one. The message is already saved by then, so failures are only logged
+func (u *messageUseCase) refreshLastMessage(ctx context.Context, message *domain.Message) {
+	err := u.roomRepository.SaveLastMessage(ctx, message)
+	if err != nil {
+		log.Printf("couldn't refresh last message of room %s: %s", message.RoomID, err.Error())
+	}
+}
+
+// currentRevision is the revision the body of the message is, written when it was sent or last edited
+func currentRevision(message *domain.Message) domain.MessageRevision {
+	revision := domain.MessageRevision{Revision: message.EditCount, MessageBody: message.MessageBody, WrittenAt: message.SentTimestamp}
+	if message.EditCount > 0 {
+		revision.WrittenAt = message.EditedAt
+	}
+	return revision
+}
+
+func (u *messageUseCase) GetRevisions(ctx context.Context, roomID string, userID string, messageID string) ([]domain.MessageRevision, error) {
+	c, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	if !u.IsAuthorized(c, userID, roomID) {
+		return nil, errors.NewUnauthorizedError("Users can only see the edits of messages of their own rooms")
+	}
+
+	existingMessage, err := u.messageRepository.GetMessage(c, roomID, messageID)
+	if err != nil || !existingMessage.DeletedAt.IsZero() {
+		return nil, errors.NewNotFoundError("Message does not exist")
+	}
+
+	revisions, err := u.messageRepository.GetRevisions(c, roomID, messageID)
+	if err != nil {
+		return nil, errors.NewInternalServerError(err.Error())
+	}
+
+	return append(revisions, currentRevision(existingMessage)), nil
+}
+
+func (u *messageUseCase) GetMessages(ctx context.Context, roomID string, timeStamp time.Time, limit int, filter domain.MessageFilter) ([]domain.Message, error) {
+	c, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	retrievedMessages, err := u.messageRepository.GetMessages(c, roomID, timeStamp, limit, filter)
+
+	if err != nil {
+		return nil, errors.NewInternalServerError(err.Error())
+	}
+	redactDeleted(retrievedMessages)
+	return retrievedMessages, nil
+}
+
+func (u *messageUseCase) GetMessagesSince(ctx context.Context, roomID string, timeStamp time.Time, limit int) ([]domain.Message, error) {
 	c, cancel := context.WithTimeout(ctx, u.timeout)
 	defer cancel()
 
-	retrievedMessages, err := u.messageRepository.GetMessages(c, roomID, timeStamp, limit)
+	retrievedMessages, err := u.messageRepository.GetMessagesSince(c, roomID, timeStamp, limit)
 
 	if err != nil {
 		return nil, errors.NewInternalServerError(err.Error())
 	}
+	redactDeleted(retrievedMessages)
 	return retrievedMessages, nil
 }
 
-func (u *messageUseCase) DeleteMessage(ctx context.Context, roomID string, timeStamp time.Time, userID string) (*domain.Message, error) {
+func (u *messageUseCase) GetMessagesAfter(ctx context.Context, roomID string, messageID string, limit int) ([]domain.Message, error) {
 	c, cancel := context.WithTimeout(ctx, u.timeout)
 	defer cancel()
 
-	existingMessage, err := u.messageRepository.GetMessage(ctx, roomID, timeStamp)
+	retrievedMessages, err := u.messageRepository.GetMessagesAfter(c, roomID, messageID, limit, domain.MessageFilter{})
+
 	if err != nil {
+		return nil, errors.NewInternalServerError(err.Error())
+	}
+	redactDeleted(retrievedMessages)
+	return retrievedMessages, nil
+}
+
+// GetHistory loads one more message than the limit in the directions the page can grow in, to tell if there are more
+func (u *messageUseCase) GetHistory(ctx context.Context, roomID string, userID string, query domain.HistoryQuery) (*domain.MessagePage, error) {
+	c, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	if !u.IsAuthorized(c, userID, roomID) {
+		return nil, errors.NewUnauthorizedError("Users can only read the history of their own rooms")
+	}
+
+	page := domain.MessagePage{Messages: []domain.Message{}}
+	switch {
+	case query.After != "":
+		newer, err := u.messageRepository.GetMessagesAfter(c, roomID, query.After, query.Limit, query.Filter)
+		if err != nil {
+			return nil, errors.NewInternalServerError(err.Error())
+		}
+		page.Messages, page.HasOlder = newer, true
+	case query.Around != "":
+		target, err := u.messageRepository.GetMessage(c, roomID, query.Around)
+		if err != nil {
+			return nil, errors.NewNotFoundError("Message does not exist")
+		}
+		older, hasOlder, err := u.olderMessages(c, roomID, query.Around, query.Limit/2, query.Filter)
+		if err != nil {
+			return nil, err
+		}
+		page.Messages = append(older, *target)
+		if remaining := query.Limit - len(page.Messages); remaining > 0 {
+			newer, err := u.messageRepository.GetMessagesAfter(c, roomID, query.Around, remaining, query.Filter)
+			if err != nil {
+				return nil, errors.NewInternalServerError(err.Error())
+			}
+			page.Messages = append(page.Messages, newer...)
+		}
+		page.HasOlder = hasOlder
+	case query.Before != "":
+		older, hasOlder, err := u.olderMessages(c, roomID, query.Before, query.Limit, query.Filter)
+		if err != nil {
+			return nil, err
+		}
+		page.Messages, page.HasOlder = older, hasOlder
+	default:
+		latest, err := u.messageRepository.GetMessages(c, roomID, time.Now().UTC(), query.Limit+1, query.Filter)
+		if err != nil {
+			return nil, errors.NewInternalServerError(err.Error())
+		}
+		page.Messages, page.HasOlder = oldestFirst(latest, query.Limit)
+	}
+	if u.hasDeleted(page.Messages) && !u.isAdmin(c, userID, roomID) {
+		redactDeleted(page.Messages)
+	}
+	return &page, nil
+}
+
+// isAdmin tells if the user is the admin of the room
+func (u *messageUseCase) isAdmin(ctx context.Context, userID string, roomID string) bool {
+	room, err := u.roomRepository.GetRoom(ctx, roomID)
+	return err == nil && room.Admin.ID == userID
+}
+
+// hasDeleted tells if one of the messages is a tombstone
+func (u *messageUseCase) hasDeleted(messages []domain.Message) bool {
+	for _, msg := range messages {
+		if !msg.DeletedAt.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// redactDeleted blanks the body of the tombstones among the messages and who deleted them, which only the admin of the
+// room sees
+func redactDeleted(messages []domain.Message) {
+	for i := range messages {
+		if !messages[i].DeletedAt.IsZero() {
+			messages[i].MessageBody, messages[i].DeletedBy = "", ""
+		}
+	}
+}
+
+// olderMessages returns up to limit messages of the filter sent before the message, oldest first, and whether there are more
+func (u *messageUseCase) olderMessages(ctx context.Context, roomID string, messageID string, limit int, filter domain.MessageFilter) ([]domain.Message, bool, error) {
+	older, err := u.messageRepository.GetMessagesBefore(ctx, roomID, messageID, limit+1, filter)
+	if err != nil {
+		return nil, false, errors.NewInternalServerError(err.Error())
+	}
+	messages, hasOlder := oldestFirst(older, limit)
+	return messages, hasOlder, nil
+}
+
+// oldestFirst keeps the limit newest of the messages, which come newest first, and reverses them. It also tells if
+// some were left out
+func oldestFirst(messages []domain.Message, limit int) ([]domain.Message, bool) {
+	hasOlder := len(messages) > limit
+	if hasOlder {
+		messages = messages[:limit]
+	}
+	reversed := make([]domain.Message, len(messages))
+	for i, message := range messages {
+		reversed[len(messages)-1-i] = message
+	}
+	return reversed, hasOlder
+}
+
+func (u *messageUseCase) DeleteMessage(ctx context.Context, roomID string, messageID string, userID string) (*domain.Message, error) {
+	c, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	existingMessage, err := u.messageRepository.GetMessage(ctx, roomID, messageID)
+	if err != nil || !existingMessage.DeletedAt.IsZero() {
 		return nil, errors.NewNotFoundError("Message does not exist")
 	}
 
-	if userID != existingMessage.FromStudentID {
-		return nil, errors.NewUnauthorizedError("Users can only delete their own messages")
+	if userID != existingMessage.FromStudentID && !u.isAdmin(c, userID, roomID) {
+		return nil, errors.NewUnauthorizedError("Users can only delete their own messages, or those of the rooms they admin")
 	}
 
-	err = u.messageRepository.DeleteMessage(c, roomID, timeStamp)
+	return u.deleteMessage(c, existingMessage, userID)
+}
+
+// deleteMessage turns the message into a tombstone deleted by the user, and returns it as the members see it
+func (u *messageUseCase) deleteMessage(ctx context.Context, message *domain.Message, userID string) (*domain.Message, error) {
+	message.DeletedAt = time.Now().UTC().Truncate(time.Millisecond)
+	message.DeletedBy = userID
+	err := u.messageRepository.DeleteMessage(ctx, message)
+	if err == domain.ErrMessageChanged {
+		return nil, errors.NewConflictError("The message was edited or deleted meanwhile")
+	}
 	if err != nil {
 		return nil, errors.NewInternalServerError(err.Error())
 	}
 
-	return existingMessage, nil
+	u.removeUnread(ctx, message)
+	tombstone := []domain.Message{*message}
+	redactDeleted(tombstone)
+	u.refreshLastMessage(ctx, &tombstone[0])
+	return &tombstone[0], nil
+}
+
+// maxSearchTerms bounds the terms of a search, each is read from every bucket searched
+const maxSearchTerms = 8
+
+// SearchMessages searches the room of the query or, without one, every room of the user. Each room is searched for
+// one more message than the limit, before the same message, and their hits are merged newest first
+func (u *messageUseCase) SearchMessages(ctx context.Context, userID string, query domain.SearchQuery) (*domain.SearchResult, error) {
+	c, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	terms := search.Terms(query.Text)
+	if len(terms) == 0 {
+		return nil, errors.NewBadRequestError("Search for at least one word of two letters or more")
+	}
+	if len(terms) > maxSearchTerms {
+		return nil, errors.NewBadRequestError(fmt.Sprintf("Search for at most %d words", maxSearchTerms))
+	}
+
+	roomIDs := []string{query.RoomID}
+	if query.RoomID == "" {
+		studentChatRooms, err := u.roomRepository.GetRoomsFor(c, userID)
+		if err != nil {
+			return nil, errors.NewInternalServerError(err.Error())
+		}
+		roomIDs = []string{}
+		for _, room := range studentChatRooms.Rooms {
+			roomIDs = append(roomIDs, room.RoomID)
+		}
+	} else if !u.IsAuthorized(c, userID, query.RoomID) {
+		return nil, errors.NewUnauthorizedError("Users can only search their own rooms")
+	}
+
+	foundMessages := []domain.Message{}
+	for _, roomID := range roomIDs {
+		messages, err := u.messageRepository.SearchMessages(c, roomID, terms, query.Before, query.Limit+1)
+		if err != nil {
+			return nil, errors.NewInternalServerError(err.Error())
+		}
+		foundMessages = append(foundMessages, messages...)
+	}
+	// the hits are ordered by id like the messages of a room, so that the id of the last one is the before cursor of
+	// the next page
+	sort.SliceStable(foundMessages, func(i, j int) bool {
+		return newerMessageID(foundMessages[i].MessageID, foundMessages[j].MessageID)
+	})
+
+	result := domain.SearchResult{Hits: []domain.SearchHit{}}
+	if len(foundMessages) > query.Limit {
+		foundMessages = foundMessages[:query.Limit]
+		result.HasMore = true
+	}
+	for _, msg := range foundMessages {
+		result.Hits = append(result.Hits, domain.SearchHit{Message: msg, Snippet: search.Snippet(msg.MessageBody, terms)})
+	}
+
+	return &result, nil
+}
+
+// newerMessageID tells if the message id a comes after b the way Cassandra orders timeuuids, by their time and then
+// by their clock sequence and node compared as signed bytes
+func newerMessageID(a string, b string) bool {
+	idA, errA := gocql.ParseUUID(a)
+	idB, errB := gocql.ParseUUID(b)
+	if errA != nil || errB != nil {
+		return a > b
+	}
+	if idA.Timestamp() != idB.Timestamp() {
+		return idA.Timestamp() > idB.Timestamp()
+	}
+	for i := 8; i < len(idA); i++ {
+		if idA[i] != idB[i] {
+			return int8(idA[i]) > int8(idB[i])
+		}
+	}
+	return false
+}
+
+func (u *messageUseCase) MarkRead(ctx context.Context, roomID string, userID string, timeStamp time.Time) (*domain.ReadPosition, error) {
+	c, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	if !u.IsAuthorized(c, userID, roomID) {
+		return nil, errors.NewUnauthorizedError("Users can only read messages of their own rooms")
+	}
+
+	existingPosition, err := u.messageRepository.GetReadPosition(c, roomID, userID)
+	if err == nil && !timeStamp.After(existingPosition.LastRead) {
+		return existingPosition, nil
+	}
+
+	position := domain.ReadPosition{RoomID: roomID, StudentID: userID, LastRead: timeStamp}
+	err = u.messageRepository.SaveReadPosition(c, &position)
+	if err != nil {
+		return nil, errors.NewInternalServerError(err.Error())
+	}
+	u.clearUnread(c, &position)
+
+	return &position, nil
+}
+
+func (u *messageUseCase) GetReadPositions(ctx context.Context, roomID string, userID string) ([]domain.ReadPosition, error) {
+	c, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	if !u.IsAuthorized(c, userID, roomID) {
+		return nil, errors.NewUnauthorizedError("Users can only see read positions of their own rooms")
+	}
+
+	positions, err := u.messageRepository.GetReadPositions(c, roomID)
+	if err != nil {
+		return nil, errors.NewInternalServerError(err.Error())
+	}
+	return positions, nil
 }
 
 func (u *messageUseCase) JoinRequest(ctx context.Context, roomID string, userID string, timeStamp time.Time) error {
@@ -153,7 +571,13 @@ func (u *messageUseCase) JoinRequest(ctx context.Context, roomID string, userID
 		FromStudentID: userID,
 		MessageBody:   fmt.Sprintf("%s %s has requested to join your group.", student.FirstName, student.LastName)}
 
-	return u.messageRepository.SaveMessage(c, &m)
+	assignID(&m)
+	err = u.messageRepository.SaveMessage(c, &m)
+	if err != nil {
+		return err
+	}
+	u.recordActivity(c, room, &m)
+	return nil
 }
 
 func (u *messageUseCase) SendRejection(ctx context.Context, roomID string, userID string, loggedID string) error {
@@ -3,10 +3,12 @@ package usecase
 import (
 	"chat/domain"
 	"chat/domain/mocks"
+	restErrors "chat/utils/errors"
 	mocks2 "chat/utils/mocks"
 	"context"
 	"errors"
 	"github.com/bxcodec/faker/v3"
+	"github.com/gocql/gocql"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"os"
@@ -21,21 +23,58 @@ const messageType = "*domain.Message"
 func TestSaveMessage(t *testing.T) {
 	t.Parallel()
 	mockMessageRepository := new(mocks.MessageRepository)
+	mockRoomRepository := new(mocks.RoomRepository)
 
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
-	u := NewMessageUseCase(time.Second*2, mockMessageRepository, nil, nil, nil)
+	room := domain.ChatRoom{RoomID: mockMessage.RoomID, Students: []domain.Student{
+		{ID: mockMessage.FromStudentID},
+		{ID: "jim"},
+		{ID: "pam", IsPending: true},
+	}}
+	u := NewMessageUseCase(time.Second*2, mockMessageRepository, mockRoomRepository, nil, nil)
 
 	t.Run("success", func(t *testing.T) {
 		mockMessageRepository.
 			On("SaveMessage", mock.Anything, mock.AnythingOfType(messageType)).
 			Return(nil).Once()
+		mockRoomRepository.
+			On("GetRoom", mock.Anything, mockMessage.RoomID).
+			Return(&room, nil).Once()
+		mockRoomRepository.
+			On("SaveLastMessage", mock.Anything, &mockMessage).
+			Return(nil).Once()
+		mockRoomRepository.
+			On("AddUnread", mock.Anything, &mockMessage, []string{"jim"}).
+			Return(nil).Once()
 
 		err := u.SaveMessage(context.TODO(), &mockMessage)
 
 		assert.NoError(t, err)
 
 		mockMessageRepository.AssertExpectations(t)
+		mockRoomRepository.AssertExpectations(t)
+	})
+
+	t.Run("saved even if activity can't be updated", func(t *testing.T) {
+		mockMessageRepository.
+			On("SaveMessage", mock.Anything, mock.AnythingOfType(messageType)).
+			Return(nil).Once()
+		mockRoomRepository.
+			On("GetRoom", mock.Anything, mockMessage.RoomID).
+			Return(&room, nil).Once()
+		mockRoomRepository.
+			On("SaveLastMessage", mock.Anything, &mockMessage).
+			Return(errors.New("error")).Once()
+		mockRoomRepository.
+			On("AddUnread", mock.Anything, &mockMessage, []string{"jim"}).
+			Return(errors.New("error")).Once()
+
+		err := u.SaveMessage(context.TODO(), &mockMessage)
+
+		assert.NoError(t, err)
+
+		mockRoomRepository.AssertExpectations(t)
 	})
 
 	t.Run("error case", func(t *testing.T) {
@@ -49,30 +88,184 @@ func TestSaveMessage(t *testing.T) {
 
 		mockMessageRepository.AssertExpectations(t)
 	})
+
+	t.Run("messages sent in the same millisecond get their own id", func(t *testing.T) {
+		sent := time.Now().UTC().Truncate(time.Millisecond)
+		first := domain.Message{RoomID: mockMessage.RoomID, FromStudentID: "jim", SentTimestamp: sent}
+		second := first
+		mockMessageRepository.
+			On("SaveMessage", mock.Anything, mock.AnythingOfType(messageType)).
+			Return(nil).Twice()
+		mockRoomRepository.
+			On("GetRoom", mock.Anything, mockMessage.RoomID).
+			Return(nil, errors.New("error")).Twice()
+
+		assert.NoError(t, u.SaveMessage(context.TODO(), &first))
+		assert.NoError(t, u.SaveMessage(context.TODO(), &second))
+
+		assert.NotEqual(t, first.MessageID, second.MessageID)
+		for _, m := range []domain.Message{first, second} {
+			id, err := gocql.ParseUUID(m.MessageID)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, id.Version())
+			assert.Equal(t, sent, id.Time().UTC())
+		}
+	})
+}
+
+func TestSendMessage(t *testing.T) {
+	t.Parallel()
+	mockMessageRepository := new(mocks.MessageRepository)
+	mockRoomRepository := new(mocks.RoomRepository)
+
+	var mockMessage domain.Message
+	faker.FakeData(&mockMessage)
+	room := domain.ChatRoom{RoomID: mockMessage.RoomID, Students: []domain.Student{{ID: mockMessage.FromStudentID}}}
+	const idempotencyKey = "retry-me"
+	u := NewMessageUseCase(time.Second*2, mockMessageRepository, mockRoomRepository, nil, nil)
+
+	t.Run("without idempotency key", func(t *testing.T) {
+		mockMessageRepository.On("SaveMessage", mock.Anything, &mockMessage).Return(nil).Once()
+		mockRoomRepository.On("GetRoom", mock.Anything, mockMessage.RoomID).Return(&room, nil).Once()
+		mockRoomRepository.On("SaveLastMessage", mock.Anything, &mockMessage).Return(nil).Once()
+
+		saved, duplicate, err := u.SendMessage(context.TODO(), &mockMessage, "")
+
+		assert.NoError(t, err)
+		assert.False(t, duplicate)
+		assert.Equal(t, &mockMessage, saved)
+		mockMessageRepository.AssertExpectations(t)
+		mockMessageRepository.AssertNotCalled(t, "ClaimIdempotencyKey")
+	})
+
+	t.Run("first use of the key", func(t *testing.T) {
+		mockMessageRepository.
+			On("ClaimIdempotencyKey", mock.Anything, mockMessage.RoomID, mockMessage.FromStudentID, idempotencyKey, mockMessage.MessageID).
+			Return(mockMessage.MessageID, true, nil).Once()
+		mockMessageRepository.On("SaveMessage", mock.Anything, &mockMessage).Return(nil).Once()
+		mockRoomRepository.On("GetRoom", mock.Anything, mockMessage.RoomID).Return(&room, nil).Once()
+		mockRoomRepository.On("SaveLastMessage", mock.Anything, &mockMessage).Return(nil).Once()
+
+		saved, duplicate, err := u.SendMessage(context.TODO(), &mockMessage, idempotencyKey)
+
+		assert.NoError(t, err)
+		assert.False(t, duplicate)
+		assert.Equal(t, &mockMessage, saved)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("retry returns the saved message", func(t *testing.T) {
+		retry := mockMessage
+		retry.MessageID = ""
+		retry.SentTimestamp = mockMessage.SentTimestamp.Add(time.Second)
+		mockMessageRepository.
+			On("ClaimIdempotencyKey", mock.Anything, mockMessage.RoomID, mockMessage.FromStudentID, idempotencyKey, mock.AnythingOfType("string")).
+			Return(mockMessage.MessageID, false, nil).Once()
+		mockMessageRepository.On("GetMessage", mock.Anything, mockMessage.RoomID, mockMessage.MessageID).
+			Return(&mockMessage, nil).Once()
+
+		saved, duplicate, err := u.SendMessage(context.TODO(), &retry, idempotencyKey)
+
+		assert.NoError(t, err)
+		assert.True(t, duplicate)
+		assert.Equal(t, &mockMessage, saved)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("retry while the message is being saved", func(t *testing.T) {
+		mockMessageRepository.
+			On("ClaimIdempotencyKey", mock.Anything, mockMessage.RoomID, mockMessage.FromStudentID, idempotencyKey, mockMessage.MessageID).
+			Return(mockMessage.MessageID, false, nil).Once()
+		mockMessageRepository.On("GetMessage", mock.Anything, mockMessage.RoomID, mockMessage.MessageID).
+			Return(nil, errors.New("not found")).Once()
+
+		_, _, err := u.SendMessage(context.TODO(), &mockMessage, idempotencyKey)
+
+		assert.Equal(t, restErrors.NewConflictError("A message with this idempotency key is still being sent"), err)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("key is released when the message can't be saved", func(t *testing.T) {
+		mockMessageRepository.
+			On("ClaimIdempotencyKey", mock.Anything, mockMessage.RoomID, mockMessage.FromStudentID, idempotencyKey, mockMessage.MessageID).
+			Return(mockMessage.MessageID, true, nil).Once()
+		mockMessageRepository.On("SaveMessage", mock.Anything, &mockMessage).Return(errors.New("error")).Once()
+		mockMessageRepository.
+			On("ReleaseIdempotencyKey", mock.Anything, mockMessage.RoomID, mockMessage.FromStudentID, idempotencyKey).
+			Return(nil).Once()
+
+		_, _, err := u.SendMessage(context.TODO(), &mockMessage, idempotencyKey)
+
+		assert.Error(t, err)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("key can't be claimed", func(t *testing.T) {
+		mockMessageRepository.
+			On("ClaimIdempotencyKey", mock.Anything, mockMessage.RoomID, mockMessage.FromStudentID, idempotencyKey, mockMessage.MessageID).
+			Return("", false, errors.New("error")).Once()
+
+		_, _, err := u.SendMessage(context.TODO(), &mockMessage, idempotencyKey)
+
+		assert.Error(t, err)
+		mockMessageRepository.AssertExpectations(t)
+	})
 }
 
 func TestEditMessage(t *testing.T) {
 	t.Parallel()
 	mockMessageRepository := new(mocks.MessageRepository)
+	mockRoomRepository := new(mocks.RoomRepository)
 
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
-	u := NewMessageUseCase(time.Second*2, mockMessageRepository, nil, nil, nil)
+	mockMessage.EditedAt, mockMessage.EditCount = time.Time{}, 0
+	mockMessage.DeletedAt, mockMessage.DeletedBy = time.Time{}, ""
+	u := NewMessageUseCase(time.Second*2, mockMessageRepository, mockRoomRepository, nil, nil)
 
 	t.Run("success", func(t *testing.T) {
+		sent := domain.MessageRevision{Revision: 0, MessageBody: mockMessage.MessageBody, WrittenAt: mockMessage.SentTimestamp}
 		mockMessageRepository.
 			On("GetMessage", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
 			Return(&mockMessage, nil).Once()
 		mockMessageRepository.
-			On("EditMessage", mock.Anything, mock.AnythingOfType(messageType)).
+			On("EditMessage", mock.Anything, mock.AnythingOfType(messageType), sent).
 			Return(nil).Once()
+		// the room's last message is refreshed, it is only replaced if it is the edited one
+		mockRoomRepository.On("SaveLastMessage", mock.Anything, mock.MatchedBy(func(message *domain.Message) bool {
+			return message.MessageBody == "edited message" && message.EditCount == 1
+		})).Return(nil).Once()
 
 		editedMsg, err := u.EditMessage(context.TODO(), mockMessage.RoomID, mockMessage.FromStudentID,
-			mockMessage.SentTimestamp, "edited message")
+			mockMessage.MessageID, "edited message")
 
 		assert.NoError(t, err)
 
-		assert.Equal(t, mockMessage.MessageBody, editedMsg.MessageBody)
+		assert.Equal(t, "edited message", editedMsg.MessageBody)
+		assert.Equal(t, 1, editedMsg.EditCount)
+		assert.WithinDuration(t, time.Now(), editedMsg.EditedAt, time.Second)
+
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("edited again", func(t *testing.T) {
+		edited := mockMessage
+		edited.MessageBody, edited.EditCount, edited.EditedAt = "edited message", 1, time.Now().Add(-time.Hour)
+		mockMessageRepository.
+			On("GetMessage", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
+			Return(&edited, nil).Once()
+		mockMessageRepository.
+			On("EditMessage", mock.Anything, mock.AnythingOfType(messageType),
+				domain.MessageRevision{Revision: 1, MessageBody: "edited message", WrittenAt: edited.EditedAt}).
+			Return(nil).Once()
+		mockRoomRepository.On("SaveLastMessage", mock.Anything, mock.AnythingOfType(messageType)).
+			Return(errors.New("error")).Once()
+
+		editedMsg, err := u.EditMessage(context.TODO(), mockMessage.RoomID, mockMessage.FromStudentID,
+			mockMessage.MessageID, "edited twice")
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, editedMsg.EditCount)
 
 		mockMessageRepository.AssertExpectations(t)
 	})
@@ -83,7 +276,7 @@ func TestEditMessage(t *testing.T) {
 			Return(&mockMessage, nil).Once()
 
 		editedMsg, err := u.EditMessage(context.TODO(), mockMessage.RoomID, mockMessage.FromStudentID,
-			mockMessage.SentTimestamp, mockMessage.MessageBody)
+			mockMessage.MessageID, mockMessage.MessageBody)
 
 		assert.NoError(t, err)
 
@@ -98,7 +291,7 @@ func TestEditMessage(t *testing.T) {
 			Return(nil, errors.New("error")).Once()
 
 		_, err := u.EditMessage(context.TODO(), mockMessage.RoomID, mockMessage.FromStudentID,
-			mockMessage.SentTimestamp, mockMessage.MessageBody)
+			mockMessage.MessageID, mockMessage.MessageBody)
 
 		assert.Error(t, err)
 
@@ -113,7 +306,7 @@ func TestEditMessage(t *testing.T) {
 			Return(&msg, nil).Once()
 
 		_, err := u.EditMessage(context.TODO(), mockMessage.RoomID, mockMessage.FromStudentID,
-			mockMessage.SentTimestamp, mockMessage.MessageBody)
+			mockMessage.MessageID, mockMessage.MessageBody)
 
 		assert.Error(t, err)
 
@@ -121,18 +314,46 @@ func TestEditMessage(t *testing.T) {
 	})
 
 	t.Run("message is empty", func(t *testing.T) {
+		existing := mockMessage
 		mockMessageRepository.
 			On("GetMessage", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
-			Return(&mockMessage, nil).Once()
+			Return(&existing, nil).Once()
 
 		mockMessageRepository.
-			On("DeleteMessage", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
+			On("DeleteMessage", mock.Anything, mock.AnythingOfType(messageType)).
 			Return(nil).Once()
 
-		_, err := u.EditMessage(context.TODO(), mockMessage.RoomID, mockMessage.FromStudentID,
-			mockMessage.SentTimestamp, "")
+		mockRoomRepository.On("GetRoom", mock.Anything, mockMessage.RoomID).
+			Return(&domain.ChatRoom{RoomID: mockMessage.RoomID}, nil).Once()
+		mockRoomRepository.On("SaveLastMessage", mock.Anything, mock.AnythingOfType(messageType)).Return(nil).Once()
+
+		tombstone, err := u.EditMessage(context.TODO(), mockMessage.RoomID, mockMessage.FromStudentID,
+			mockMessage.MessageID, "")
 
 		assert.NoError(t, err)
+		assert.False(t, tombstone.DeletedAt.IsZero())
+		assert.Empty(t, tombstone.MessageBody)
+		assert.Empty(t, tombstone.DeletedBy)
+		// the stored message keeps its body until the retention ends
+		assert.Equal(t, mockMessage.MessageBody, existing.MessageBody)
+		assert.Equal(t, mockMessage.FromStudentID, existing.DeletedBy)
+
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error: edited or deleted meanwhile", func(t *testing.T) {
+		existing := mockMessage
+		mockMessageRepository.
+			On("GetMessage", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
+			Return(&existing, nil).Once()
+		mockMessageRepository.
+			On("EditMessage", mock.Anything, mock.AnythingOfType(messageType), mock.AnythingOfType("domain.MessageRevision")).
+			Return(domain.ErrMessageChanged).Once()
+
+		_, err := u.EditMessage(context.TODO(), mockMessage.RoomID, mockMessage.FromStudentID,
+			mockMessage.MessageID, "edited at the same time")
+
+		assert.Equal(t, restErrors.NewConflictError("The message was edited or deleted meanwhile"), err)
 
 		mockMessageRepository.AssertExpectations(t)
 	})
@@ -142,15 +363,85 @@ func TestEditMessage(t *testing.T) {
 			On("GetMessage", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
 			Return(&mockMessage, nil).Once()
 		mockMessageRepository.
-			On("EditMessage", mock.Anything, mock.AnythingOfType(messageType)).
+			On("EditMessage", mock.Anything, mock.AnythingOfType(messageType), mock.AnythingOfType("domain.MessageRevision")).
 			Return(errors.New("error")).Once()
 
 		_, err := u.EditMessage(context.TODO(), mockMessage.RoomID, mockMessage.FromStudentID,
-			mockMessage.SentTimestamp, "editedMessage")
+			mockMessage.MessageID, "editedMessage")
 
 		assert.Error(t, err)
 
 		mockMessageRepository.AssertExpectations(t)
+		mockRoomRepository.AssertExpectations(t)
+	})
+}
+
+func TestGetRevisions(t *testing.T) {
+	t.Parallel()
+	mockMessageRepository := new(mocks.MessageRepository)
+	mockRoomRepository := new(mocks.RoomRepository)
+	rooms := domain.StudentChatRooms{Rooms: []domain.ChatRoom{{RoomID: "1"}}}
+	u := NewMessageUseCase(time.Second*2, mockMessageRepository, mockRoomRepository, nil, nil)
+	sent := time.Now().Add(-time.Hour)
+	message := domain.Message{RoomID: "1", MessageID: "c", SentTimestamp: sent, MessageBody: "lunch at one?",
+		EditedAt: sent.Add(time.Minute), EditCount: 1}
+
+	t.Run("success", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetMessage", mock.Anything, "1", "c").Return(&message, nil).Once()
+		mockMessageRepository.On("GetRevisions", mock.Anything, "1", "c").
+			Return([]domain.MessageRevision{{Revision: 0, MessageBody: "lunch at noon?", WrittenAt: sent}}, nil).Once()
+
+		revisions, err := u.GetRevisions(context.TODO(), "1", "jim", "c")
+
+		assert.NoError(t, err)
+		assert.Equal(t, []domain.MessageRevision{
+			{Revision: 0, MessageBody: "lunch at noon?", WrittenAt: sent},
+			{Revision: 1, MessageBody: "lunch at one?", WrittenAt: sent.Add(time.Minute)},
+		}, revisions)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error: not a member", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+
+		_, err := u.GetRevisions(context.TODO(), "2", "jim", "c")
+
+		assert.Equal(t, restErrors.NewUnauthorizedError("Users can only see the edits of messages of their own rooms"), err)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error: message doesn't exist", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetMessage", mock.Anything, "1", "x").Return(nil, gocql.ErrNotFound).Once()
+
+		_, err := u.GetRevisions(context.TODO(), "1", "jim", "x")
+
+		assert.Equal(t, restErrors.NewNotFoundError("Message does not exist"), err)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error: message deleted", func(t *testing.T) {
+		tombstone := message
+		tombstone.DeletedAt = time.Now()
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetMessage", mock.Anything, "1", "c").Return(&tombstone, nil).Once()
+
+		_, err := u.GetRevisions(context.TODO(), "1", "jim", "c")
+
+		assert.Equal(t, restErrors.NewNotFoundError("Message does not exist"), err)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error in repo", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetMessage", mock.Anything, "1", "c").Return(&message, nil).Once()
+		mockMessageRepository.On("GetRevisions", mock.Anything, "1", "c").Return(nil, errors.New("error")).Once()
+
+		_, err := u.GetRevisions(context.TODO(), "1", "jim", "c")
+
+		assert.Error(t, err)
+		mockMessageRepository.AssertExpectations(t)
 	})
 }
 
@@ -164,10 +455,10 @@ func TestGetMessages(t *testing.T) {
 
 	t.Run("success", func(t *testing.T) {
 		mockMessageRepository.
-			On("GetMessages", mock.Anything, mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("int")).
+			On("GetMessages", mock.Anything, mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("int"), domain.MessageFilter{}).
 			Return(mockMessage[:1], nil).Once()
 
-		retrievedMsgs, err := u.GetMessages(context.TODO(), mockMessage[0].RoomID, mockMessage[0].SentTimestamp, 1)
+		retrievedMsgs, err := u.GetMessages(context.TODO(), mockMessage[0].RoomID, mockMessage[0].SentTimestamp, 1, domain.MessageFilter{})
 
 		assert.NotNil(t, retrievedMsgs)
 		assert.NoError(t, err)
@@ -178,41 +469,382 @@ func TestGetMessages(t *testing.T) {
 
 	t.Run("error", func(t *testing.T) {
 		mockMessageRepository.
-			On("GetMessages", mock.Anything, mock.AnythingOfType("string"), mock.Anything, 5).
+			On("GetMessages", mock.Anything, mock.AnythingOfType("string"), mock.Anything, 5, domain.MessageFilter{}).
+			Return(nil, errors.New("error")).Once()
+
+		retrievedMsgs, err := u.GetMessages(context.TODO(), mockMessage[0].RoomID, mockMessage[0].SentTimestamp, 5, domain.MessageFilter{})
+
+		assert.Nil(t, retrievedMsgs)
+		assert.Error(t, err)
+
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+}
+
+func TestGetMessagesSince(t *testing.T) {
+	t.Parallel()
+	mockMessageRepository := new(mocks.MessageRepository)
+	since := time.Date(2021, time.November, 3, 14, 5, 7, 0, time.UTC)
+	messages := []domain.Message{
+		{RoomID: "1", MessageID: "d", SentTimestamp: since.Add(time.Second), FromStudentID: "jim", MessageBody: "lunch?"},
+		{RoomID: "1", MessageID: "e", SentTimestamp: since.Add(time.Minute), FromStudentID: "pam", MessageBody: "sure"},
+	}
+	u := NewMessageUseCase(time.Second*2, mockMessageRepository, nil, nil, nil)
+
+	t.Run("success", func(t *testing.T) {
+		mockMessageRepository.
+			On("GetMessagesSince", mock.Anything, "1", since, 10).
+			Return(messages, nil).Once()
+
+		retrievedMsgs, err := u.GetMessagesSince(context.TODO(), "1", since, 10)
+
+		assert.Equal(t, messages, retrievedMsgs)
+		assert.NoError(t, err)
+
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		mockMessageRepository.
+			On("GetMessagesSince", mock.Anything, "1", since, 10).
+			Return(nil, errors.New("error")).Once()
+
+		retrievedMsgs, err := u.GetMessagesSince(context.TODO(), "1", since, 10)
+
+		assert.Nil(t, retrievedMsgs)
+		assert.Error(t, err)
+
+		mockMessageRepository.AssertExpectations(t)
+	})
+}
+
+func TestGetMessagesAfter(t *testing.T) {
+	t.Parallel()
+	mockMessageRepository := new(mocks.MessageRepository)
+	u := NewMessageUseCase(time.Second*2, mockMessageRepository, nil, nil, nil)
+	deletedAt := time.Now()
+
+	t.Run("success", func(t *testing.T) {
+		mockMessageRepository.On("GetMessagesAfter", mock.Anything, "1", "c", 10, domain.MessageFilter{}).
+			Return([]domain.Message{{MessageID: "d", MessageBody: "lunch?"}, {MessageID: "e", MessageBody: "gone", DeletedAt: deletedAt}}, nil).Once()
+
+		retrievedMsgs, err := u.GetMessagesAfter(context.TODO(), "1", "c", 10)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []domain.Message{{MessageID: "d", MessageBody: "lunch?"}, {MessageID: "e", DeletedAt: deletedAt}}, retrievedMsgs)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		mockMessageRepository.On("GetMessagesAfter", mock.Anything, "1", "c", 10, domain.MessageFilter{}).
 			Return(nil, errors.New("error")).Once()
 
-		retrievedMsgs, err := u.GetMessages(context.TODO(), mockMessage[0].RoomID, mockMessage[0].SentTimestamp, 5)
+		retrievedMsgs, err := u.GetMessagesAfter(context.TODO(), "1", "c", 10)
 
 		assert.Nil(t, retrievedMsgs)
 		assert.Error(t, err)
+		mockMessageRepository.AssertExpectations(t)
+	})
+}
+
+func TestGetHistory(t *testing.T) {
+	t.Parallel()
+	mockMessageRepository := new(mocks.MessageRepository)
+	mockRoomRepository := new(mocks.RoomRepository)
+	rooms := domain.StudentChatRooms{Rooms: []domain.ChatRoom{{RoomID: "1"}}}
+	u := NewMessageUseCase(time.Second*2, mockMessageRepository, mockRoomRepository, nil, nil)
+	// the repository returns the messages before a message newest first, and those after it oldest first
+	m := func(body string) domain.Message { return domain.Message{RoomID: "1", MessageBody: body} }
+
+	t.Run("latest", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetMessages", mock.Anything, "1", mock.Anything, 3, domain.MessageFilter{}).
+			Return([]domain.Message{m("c"), m("b"), m("a")}, nil).Once()
+
+		page, err := u.GetHistory(context.TODO(), "1", "jim", domain.HistoryQuery{Limit: 2})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []domain.Message{m("b"), m("c")}, page.Messages)
+		assert.True(t, page.HasOlder)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("before a message", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetMessagesBefore", mock.Anything, "1", "c", 3, domain.MessageFilter{}).
+			Return([]domain.Message{m("b"), m("a")}, nil).Once()
+
+		page, err := u.GetHistory(context.TODO(), "1", "jim", domain.HistoryQuery{Before: "c", Limit: 2})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []domain.Message{m("a"), m("b")}, page.Messages)
+		assert.False(t, page.HasOlder)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("after a message", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetMessagesAfter", mock.Anything, "1", "a", 2, domain.MessageFilter{}).
+			Return([]domain.Message{m("b"), m("c")}, nil).Once()
+
+		page, err := u.GetHistory(context.TODO(), "1", "jim", domain.HistoryQuery{After: "a", Limit: 2})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []domain.Message{m("b"), m("c")}, page.Messages)
+		assert.True(t, page.HasOlder)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("around a message", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		target := m("c")
+		mockMessageRepository.On("GetMessage", mock.Anything, "1", "c").Return(&target, nil).Once()
+		mockMessageRepository.On("GetMessagesBefore", mock.Anything, "1", "c", 3, domain.MessageFilter{}).
+			Return([]domain.Message{m("b"), m("a")}, nil).Once()
+		mockMessageRepository.On("GetMessagesAfter", mock.Anything, "1", "c", 2, domain.MessageFilter{}).
+			Return([]domain.Message{m("d")}, nil).Once()
+
+		page, err := u.GetHistory(context.TODO(), "1", "jim", domain.HistoryQuery{Around: "c", Limit: 5})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []domain.Message{m("a"), m("b"), m("c"), m("d")}, page.Messages)
+		assert.False(t, page.HasOlder)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("filtered", func(t *testing.T) {
+		filter := domain.MessageFilter{FromStudentID: "pam", From: time.Now().Add(-time.Hour)}
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetMessagesBefore", mock.Anything, "1", "c", 3, filter).
+			Return([]domain.Message{m("a")}, nil).Once()
+
+		page, err := u.GetHistory(context.TODO(), "1", "jim", domain.HistoryQuery{Before: "c", Limit: 2, Filter: filter})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []domain.Message{m("a")}, page.Messages)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("deleted messages", func(t *testing.T) {
+		deletedAt := time.Now().UTC()
+		tombstone := domain.Message{RoomID: "1", MessageBody: "b", DeletedAt: deletedAt, DeletedBy: "michael"}
+		redacted := domain.Message{RoomID: "1", DeletedAt: deletedAt}
+		room := domain.ChatRoom{RoomID: "1", Admin: domain.Student{ID: "michael"}}
+
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockRoomRepository.On("GetRoom", mock.Anything, "1").Return(&room, nil).Once()
+		mockMessageRepository.On("GetMessagesBefore", mock.Anything, "1", "c", 3, domain.MessageFilter{}).
+			Return([]domain.Message{tombstone, m("a")}, nil).Once()
+
+		page, err := u.GetHistory(context.TODO(), "1", "jim", domain.HistoryQuery{Before: "c", Limit: 2})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []domain.Message{m("a"), redacted}, page.Messages)
+
+		// the admin of the room sees the body and who deleted it
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "michael").Return(&rooms, nil).Once()
+		mockRoomRepository.On("GetRoom", mock.Anything, "1").Return(&room, nil).Once()
+		mockMessageRepository.On("GetMessagesBefore", mock.Anything, "1", "c", 3, domain.MessageFilter{}).
+			Return([]domain.Message{tombstone, m("a")}, nil).Once()
+
+		page, err = u.GetHistory(context.TODO(), "1", "michael", domain.HistoryQuery{Before: "c", Limit: 2})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []domain.Message{m("a"), tombstone}, page.Messages)
+		mockMessageRepository.AssertExpectations(t)
+		mockRoomRepository.AssertExpectations(t)
+	})
+
+	t.Run("error: around a message that doesn't exist", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetMessage", mock.Anything, "1", "x").Return(nil, gocql.ErrNotFound).Once()
+
+		_, err := u.GetHistory(context.TODO(), "1", "jim", domain.HistoryQuery{Around: "x", Limit: 5})
+
+		assert.Equal(t, restErrors.NewNotFoundError("Message does not exist"), err)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error: not a member", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+
+		_, err := u.GetHistory(context.TODO(), "2", "jim", domain.HistoryQuery{Limit: 5})
+
+		assert.Error(t, err)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error in repo", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetMessagesAfter", mock.Anything, "1", "a", 5, domain.MessageFilter{}).Return(nil, errors.New("error")).Once()
+
+		_, err := u.GetHistory(context.TODO(), "1", "jim", domain.HistoryQuery{After: "a", Limit: 5})
+
+		assert.Error(t, err)
+		mockMessageRepository.AssertExpectations(t)
+	})
+}
+
+func TestSearchMessages(t *testing.T) {
+	t.Parallel()
+	mockMessageRepository := new(mocks.MessageRepository)
+	mockRoomRepository := new(mocks.RoomRepository)
+	rooms := domain.StudentChatRooms{Rooms: []domain.ChatRoom{{RoomID: "1"}, {RoomID: "2"}}}
+	u := NewMessageUseCase(time.Second*2, mockMessageRepository, mockRoomRepository, nil, nil)
+	now := time.Now()
+	m := func(roomID string, minutes int, body string) domain.Message {
+		sent := now.Add(time.Duration(minutes) * time.Minute)
+		return domain.Message{MessageID: gocql.MinTimeUUID(sent).String(), RoomID: roomID, SentTimestamp: sent, MessageBody: body}
+	}
+
+	t.Run("in a room", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("SearchMessages", mock.Anything, "1", []string{"lunch"}, "c", 3).
+			Return([]domain.Message{m("1", -1, "lunch?"), m("1", -2, "Lunch!")}, nil).Once()
+
+		result, err := u.SearchMessages(context.TODO(), "jim", domain.SearchQuery{Text: "Lunch", RoomID: "1", Before: "c", Limit: 2})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []domain.SearchHit{
+			{Message: m("1", -1, "lunch?"), Snippet: "<mark>lunch</mark>?"},
+			{Message: m("1", -2, "Lunch!"), Snippet: "<mark>Lunch</mark>!"},
+		}, result.Hits)
+		assert.False(t, result.HasMore)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("in every room, newest first", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("SearchMessages", mock.Anything, "1", []string{"lunch"}, "", 3).
+			Return([]domain.Message{m("1", -1, "lunch"), m("1", -4, "lunch")}, nil).Once()
+		mockMessageRepository.On("SearchMessages", mock.Anything, "2", []string{"lunch"}, "", 3).
+			Return([]domain.Message{m("2", -2, "lunch"), m("2", -3, "lunch")}, nil).Once()
+
+		result, err := u.SearchMessages(context.TODO(), "jim", domain.SearchQuery{Text: "lunch", Limit: 2})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []domain.Message{m("1", -1, "lunch"), m("2", -2, "lunch")},
+			[]domain.Message{result.Hits[0].Message, result.Hits[1].Message})
+		assert.True(t, result.HasMore)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("in every room, by id", func(t *testing.T) {
+		// sent at the same time, only the node of their ids tells which came first, compared as signed bytes
+		sent := time.Date(2021, time.November, 3, 14, 5, 7, 0, time.UTC)
+		first := domain.Message{MessageID: gocql.MinTimeUUID(sent).String(), RoomID: "1", SentTimestamp: sent, MessageBody: "lunch"}
+		second := domain.Message{MessageID: gocql.MaxTimeUUID(sent).String(), RoomID: "2", SentTimestamp: sent, MessageBody: "lunch"}
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("SearchMessages", mock.Anything, "1", []string{"lunch"}, "", 3).
+			Return([]domain.Message{first}, nil).Once()
+		mockMessageRepository.On("SearchMessages", mock.Anything, "2", []string{"lunch"}, "", 3).
+			Return([]domain.Message{second}, nil).Once()
 
+		result, err := u.SearchMessages(context.TODO(), "jim", domain.SearchQuery{Text: "lunch", Limit: 2})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{second.MessageID, first.MessageID},
+			[]string{result.Hits[0].Message.MessageID, result.Hits[1].Message.MessageID})
 		mockMessageRepository.AssertExpectations(t)
 	})
 
+	t.Run("error: no words", func(t *testing.T) {
+		_, err := u.SearchMessages(context.TODO(), "jim", domain.SearchQuery{Text: "a ?", RoomID: "1", Limit: 2})
+
+		assert.Equal(t, restErrors.NewBadRequestError("Search for at least one word of two letters or more"), err)
+	})
+
+	t.Run("error: too many words", func(t *testing.T) {
+		_, err := u.SearchMessages(context.TODO(), "jim", domain.SearchQuery{Text: "one two three four five six seven eight nine", RoomID: "1", Limit: 2})
+
+		assert.Equal(t, restErrors.NewBadRequestError("Search for at most 8 words"), err)
+	})
+
+	t.Run("error: not a member", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+
+		_, err := u.SearchMessages(context.TODO(), "jim", domain.SearchQuery{Text: "lunch", RoomID: "3", Limit: 2})
+
+		assert.Equal(t, restErrors.NewUnauthorizedError("Users can only search their own rooms"), err)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error in repo", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("SearchMessages", mock.Anything, "1", []string{"lunch"}, "", 3).
+			Return(nil, errors.New("error")).Once()
+
+		_, err := u.SearchMessages(context.TODO(), "jim", domain.SearchQuery{Text: "lunch", RoomID: "1", Limit: 2})
+
+		assert.Error(t, err)
+		mockMessageRepository.AssertExpectations(t)
+	})
 }
 
 func TestDeleteMessage(t *testing.T) {
 	t.Parallel()
 	mockMessageRepository := new(mocks.MessageRepository)
+	mockRoomRepository := new(mocks.RoomRepository)
 	var mockMessage domain.Message
 	faker.FakeData(&mockMessage)
-	u := NewMessageUseCase(time.Second*2, mockMessageRepository, nil, nil, nil)
+	mockMessage.DeletedAt, mockMessage.DeletedBy = time.Time{}, ""
+	u := NewMessageUseCase(time.Second*2, mockMessageRepository, mockRoomRepository, nil, nil)
 
 	t.Run("success", func(t *testing.T) {
+		existing := mockMessage
 		mockMessageRepository.
-			On("DeleteMessage", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
+			On("DeleteMessage", mock.Anything, mock.AnythingOfType(messageType)).
 			Return(nil).Once()
 
 		mockMessageRepository.
 			On("GetMessage", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
-			Return(&mockMessage, nil).Once()
+			Return(&existing, nil).Once()
+
+		// the message is no longer unread for the other members
+		room := domain.ChatRoom{RoomID: mockMessage.RoomID, Students: []domain.Student{{ID: mockMessage.FromStudentID}, {ID: "jim"}}}
+		mockRoomRepository.On("GetRoom", mock.Anything, mockMessage.RoomID).Return(&room, nil).Once()
+		mockRoomRepository.On("RemoveUnread", mock.Anything, mock.AnythingOfType(messageType), []string{"jim"}).Return(nil).Once()
 
-		returnedMessage, err := u.DeleteMessage(context.TODO(), mockMessage.RoomID, mockMessage.SentTimestamp, mockMessage.FromStudentID)
+		// the room's last message is replaced by the tombstone if it was the deleted one, so its body doesn't linger
+		mockRoomRepository.On("SaveLastMessage", mock.Anything, mock.MatchedBy(func(message *domain.Message) bool {
+			return message.MessageID == mockMessage.MessageID && message.MessageBody == "" && !message.DeletedAt.IsZero()
+		})).Return(nil).Once()
+
+		returnedMessage, err := u.DeleteMessage(context.TODO(), mockMessage.RoomID, mockMessage.MessageID, mockMessage.FromStudentID)
 
-		mockMessage.MessageBody = ""
 		assert.NoError(t, err)
-		assert.EqualValues(t, mockMessage, *returnedMessage)
+		assert.Equal(t, mockMessage.FromStudentID, existing.DeletedBy)
+		assert.Equal(t, mockMessage.MessageBody, existing.MessageBody)
+		expected := mockMessage
+		expected.MessageBody = ""
+		expected.DeletedAt = existing.DeletedAt
+		assert.False(t, expected.DeletedAt.IsZero())
+		assert.EqualValues(t, expected, *returnedMessage)
 		mockMessageRepository.AssertExpectations(t)
+		mockRoomRepository.AssertExpectations(t)
+	})
+
+	t.Run("the admin deletes the message of another member", func(t *testing.T) {
+		existing := mockMessage
+		room := domain.ChatRoom{RoomID: mockMessage.RoomID, Admin: domain.Student{ID: "admin"}}
+		mockMessageRepository.
+			On("GetMessage", mock.Anything, mockMessage.RoomID, mockMessage.MessageID).
+			Return(&existing, nil).Once()
+		mockRoomRepository.On("GetRoom", mock.Anything, mockMessage.RoomID).Return(&room, nil).Twice()
+		mockMessageRepository.
+			On("DeleteMessage", mock.Anything, mock.AnythingOfType(messageType)).
+			Return(nil).Once()
+
+		mockRoomRepository.On("SaveLastMessage", mock.Anything, mock.AnythingOfType(messageType)).Return(nil).Once()
+
+		returnedMessage, err := u.DeleteMessage(context.TODO(), mockMessage.RoomID, mockMessage.MessageID, "admin")
+
+		assert.NoError(t, err)
+		assert.Equal(t, "admin", existing.DeletedBy)
+		assert.Empty(t, returnedMessage.DeletedBy)
+		mockMessageRepository.AssertExpectations(t)
+		mockRoomRepository.AssertExpectations(t)
 	})
 
 	t.Run("error: message does not exist", func(t *testing.T) {
@@ -220,7 +852,22 @@ func TestDeleteMessage(t *testing.T) {
 			On("GetMessage", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
 			Return(nil, errors.New("error")).Once()
 
-		msg, err := u.DeleteMessage(context.TODO(), mockMessage.RoomID, mockMessage.SentTimestamp, mockMessage.FromStudentID)
+		msg, err := u.DeleteMessage(context.TODO(), mockMessage.RoomID, mockMessage.MessageID, mockMessage.FromStudentID)
+
+		assert.Error(t, err)
+		assert.Nil(t, msg)
+
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error: message already deleted", func(t *testing.T) {
+		tombstone := mockMessage
+		tombstone.DeletedAt = time.Now()
+		mockMessageRepository.
+			On("GetMessage", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
+			Return(&tombstone, nil).Once()
+
+		msg, err := u.DeleteMessage(context.TODO(), mockMessage.RoomID, mockMessage.MessageID, mockMessage.FromStudentID)
 
 		assert.Error(t, err)
 		assert.Nil(t, msg)
@@ -229,31 +876,50 @@ func TestDeleteMessage(t *testing.T) {
 	})
 
 	t.Run("error unauthorized deletion", func(t *testing.T) {
-		var msg domain.Message
-		faker.FakeData(msg)
+		existing := mockMessage
+		room := domain.ChatRoom{RoomID: mockMessage.RoomID, Admin: domain.Student{ID: "admin"}}
 		mockMessageRepository.
 			On("GetMessage", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
-			Return(&msg, nil).Once()
+			Return(&existing, nil).Once()
+		mockRoomRepository.On("GetRoom", mock.Anything, mockMessage.RoomID).Return(&room, nil).Once()
 
-		message, err := u.DeleteMessage(context.TODO(), mockMessage.RoomID, mockMessage.SentTimestamp, mockMessage.FromStudentID)
+		message, err := u.DeleteMessage(context.TODO(), mockMessage.RoomID, mockMessage.MessageID, "stranger")
 
 		assert.Error(t, err)
 		assert.Nil(t, message)
 
 		mockMessageRepository.AssertExpectations(t)
+		mockRoomRepository.AssertExpectations(t)
+	})
+
+	t.Run("error: edited meanwhile", func(t *testing.T) {
+		existing := mockMessage
+		mockMessageRepository.
+			On("GetMessage", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
+			Return(&existing, nil).Once()
+		mockMessageRepository.
+			On("DeleteMessage", mock.Anything, mock.AnythingOfType(messageType)).
+			Return(domain.ErrMessageChanged).Once()
+
+		message, err := u.DeleteMessage(context.TODO(), mockMessage.RoomID, mockMessage.MessageID, mockMessage.FromStudentID)
 
+		assert.Equal(t, restErrors.NewConflictError("The message was edited or deleted meanwhile"), err)
+		assert.Nil(t, message)
+
+		mockMessageRepository.AssertExpectations(t)
 	})
 
 	t.Run("error unable to delete", func(t *testing.T) {
+		existing := mockMessage
 		mockMessageRepository.
-			On("DeleteMessage", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
+			On("DeleteMessage", mock.Anything, mock.AnythingOfType(messageType)).
 			Return(errors.New("error")).Once()
 
 		mockMessageRepository.
 			On("GetMessage", mock.Anything, mock.AnythingOfType("string"), mock.Anything).
-			Return(&mockMessage, nil).Once()
+			Return(&existing, nil).Once()
 
-		message, err := u.DeleteMessage(context.TODO(), mockMessage.RoomID, mockMessage.SentTimestamp, mockMessage.FromStudentID)
+		message, err := u.DeleteMessage(context.TODO(), mockMessage.RoomID, mockMessage.MessageID, mockMessage.FromStudentID)
 
 		assert.Error(t, err)
 		assert.Nil(t, message)
@@ -318,6 +984,115 @@ func TestIsAuthorized(t *testing.T) {
 	})
 }
 
+func TestMarkRead(t *testing.T) {
+	t.Parallel()
+	mockMessageRepository := new(mocks.MessageRepository)
+	mockRoomRepository := new(mocks.RoomRepository)
+	rooms := domain.StudentChatRooms{Rooms: []domain.ChatRoom{{RoomID: "1"}}}
+	now := time.Now().UTC()
+	existing := domain.ReadPosition{RoomID: "1", StudentID: "jim", LastRead: now}
+	u := NewMessageUseCase(time.Second*2, mockMessageRepository, mockRoomRepository, nil, nil)
+
+	t.Run("success: first read", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetReadPosition", mock.Anything, "1", "jim").Return(nil, errors.New("not found")).Once()
+		mockMessageRepository.On("SaveReadPosition", mock.Anything, mock.AnythingOfType("*domain.ReadPosition")).Return(nil).Once()
+		mockRoomRepository.On("ClearUnread", mock.Anything, "1", "jim", now).Return(nil).Once()
+
+		position, err := u.MarkRead(context.TODO(), "1", "jim", now)
+
+		assert.NoError(t, err)
+		assert.Equal(t, now, position.LastRead)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("success: moves forward", func(t *testing.T) {
+		later := now.Add(time.Minute)
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetReadPosition", mock.Anything, "1", "jim").Return(&existing, nil).Once()
+		mockMessageRepository.On("SaveReadPosition", mock.Anything, mock.AnythingOfType("*domain.ReadPosition")).Return(nil).Once()
+		// the position is saved even if the messages read can't be cleared
+		mockRoomRepository.On("ClearUnread", mock.Anything, "1", "jim", later).Return(errors.New("error")).Once()
+
+		position, err := u.MarkRead(context.TODO(), "1", "jim", later)
+
+		assert.NoError(t, err)
+		assert.Equal(t, later, position.LastRead)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("older timestamp keeps the position", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetReadPosition", mock.Anything, "1", "jim").Return(&existing, nil).Once()
+
+		position, err := u.MarkRead(context.TODO(), "1", "jim", now.Add(-time.Minute))
+
+		assert.NoError(t, err)
+		assert.Equal(t, now, position.LastRead)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error: not a member", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+
+		_, err := u.MarkRead(context.TODO(), "2", "jim", now)
+
+		assert.Error(t, err)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error: cannot save", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetReadPosition", mock.Anything, "1", "jim").Return(nil, errors.New("not found")).Once()
+		mockMessageRepository.On("SaveReadPosition", mock.Anything, mock.AnythingOfType("*domain.ReadPosition")).Return(errors.New("error")).Once()
+
+		_, err := u.MarkRead(context.TODO(), "1", "jim", now)
+
+		assert.Error(t, err)
+		mockMessageRepository.AssertExpectations(t)
+	})
+}
+
+func TestGetReadPositions(t *testing.T) {
+	t.Parallel()
+	mockMessageRepository := new(mocks.MessageRepository)
+	mockRoomRepository := new(mocks.RoomRepository)
+	rooms := domain.StudentChatRooms{Rooms: []domain.ChatRoom{{RoomID: "1"}}}
+	var positions []domain.ReadPosition
+	faker.FakeData(&positions)
+	u := NewMessageUseCase(time.Second*2, mockMessageRepository, mockRoomRepository, nil, nil)
+
+	t.Run("success", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetReadPositions", mock.Anything, "1").Return(positions, nil).Once()
+
+		retrieved, err := u.GetReadPositions(context.TODO(), "1", "jim")
+
+		assert.NoError(t, err)
+		assert.Equal(t, positions, retrieved)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error: not a member", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+
+		_, err := u.GetReadPositions(context.TODO(), "2", "jim")
+
+		assert.Error(t, err)
+		mockMessageRepository.AssertExpectations(t)
+	})
+
+	t.Run("error in repo", func(t *testing.T) {
+		mockRoomRepository.On("GetRoomsFor", mock.Anything, "jim").Return(&rooms, nil).Once()
+		mockMessageRepository.On("GetReadPositions", mock.Anything, "1").Return(nil, errors.New("error")).Once()
+
+		_, err := u.GetReadPositions(context.TODO(), "1", "jim")
+
+		assert.Error(t, err)
+		mockMessageRepository.AssertExpectations(t)
+	})
+}
+
 func TestJoinRequest(t *testing.T) {
 	t.Parallel()
 	mockMessageRepository := new(mocks.MessageRepository)
@@ -346,6 +1121,14 @@ func TestJoinRequest(t *testing.T) {
 			On("SaveMessage", mock.Anything, mock.Anything).
 			Return(nil).Once()
 
+		mockRoomRepository.
+			On("SaveLastMessage", mock.Anything, mock.Anything).
+			Return(nil).Once()
+
+		mockRoomRepository.
+			On("AddUnread", mock.Anything, mock.Anything, mock.Anything).
+			Return(nil).Maybe()
+
 		err := u.JoinRequest(context.TODO(), "", "", time.Now())
 
 		assert.NoError(t, err)
@@ -380,7 +1163,7 @@ func TestJoinRequest(t *testing.T) {
 
 	t.Run("error: user already in room", func(t *testing.T) {
 		students := []domain.Student{
-			{"","","","", false},
+			{ID: "", FirstName: "", LastName: "", Email: "", IsPending: false},
 		}
 		room := &domain.ChatRoom{Students: students}
 		mockStudentRepository.
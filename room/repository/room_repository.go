@@ -5,6 +5,7 @@ import (
 	"chat/messaging/repository/cassandra"
 	"context"
 	"github.com/gocql/gocql"
+	"time"
 )
 
 type RoomRepository struct {
@@ -30,6 +31,17 @@ const (
 	addRoomForParticipant    = `UPDATE chat.student_rooms SET rooms = rooms +? WHERE student=?;`
 	getRoomsFor              = `SELECT * FROM chat.student_rooms WHERE student=?;`
 	removeRoomForParticipant = `UPDATE chat.student_rooms SET rooms = rooms-? WHERE student=?;`
+
+	// chat.room_activity queries
+	saveLastMessage = `INSERT INTO chat.room_activity (room_id, message_id, from_student_id, message_body, sent_timestamp, edited_at, deleted_at) VALUES (?,?,?,?,?,?,?) USING TIMESTAMP ?;`
+	getLastMessage  = `SELECT room_id, message_id, sent_timestamp, from_student_id, message_body, edited_at, deleted_at FROM chat.room_activity WHERE room_id=?;`
+
+	// chat.unread_messages queries
+	addUnread      = `INSERT INTO chat.unread_messages (student_id, room_id, sent_timestamp, message_id) VALUES (?,?,?,?) USING TIMESTAMP ?;`
+	removeUnread   = `DELETE FROM chat.unread_messages WHERE student_id=? AND room_id=? AND sent_timestamp=? AND message_id=?;`
+	clearUnread    = `DELETE FROM chat.unread_messages WHERE student_id=? AND room_id=? AND sent_timestamp<=?;`
+	// the unread messages are counted as they are read, so the count only reads as many rows as it is capped to
+	getUnread = `SELECT message_id FROM chat.unread_messages WHERE student_id=? AND room_id=? LIMIT ?;`
 )
 
 func (r RoomRepository) UpdateParticipantPendingState(ctx context.Context, roomID string, userID string, isPending bool) error {
@@ -154,6 +166,93 @@ func (r RoomRepository) RemoveRoomForParticipants(ctx context.Context, roomID st
 	return nil
 }
 
+// maxPreviewRevision is the last revision of a message that is written after the previous one in chat.room_activity.
+// The tombstone of the message comes after it
+const maxPreviewRevision = 998
+
+// previewWriteTime is the message's timestamp in microseconds plus its revision, so that each edit of the message is
+// written after the previous one, its tombstone after all of them, and a message sent at least a millisecond later
+// after the tombstone
+func previewWriteTime(message *domain.Message) int64 {
+	revision := message.EditCount
+	if revision > maxPreviewRevision {
+		revision = maxPreviewRevision
+	}
+	if !message.DeletedAt.IsZero() {
+		revision = maxPreviewRevision + 1
+	}
+	return message.SentTimestamp.Truncate(time.Millisecond).UnixNano()/int64(time.Microsecond) + int64(revision)
+}
+
+// SaveLastMessage writes with the message's timestamp and revision as the write time, so that cassandra keeps the
+// newest message whatever order the writes arrive in. An edit or the tombstone of the last message replaces it, those
+// of an older one are ignored
+func (r RoomRepository) SaveLastMessage(ctx context.Context, message *domain.Message) error {
+	return r.dbSession.Query(saveLastMessage, message.RoomID, message.MessageID, message.FromStudentID, message.MessageBody,
+		message.SentTimestamp, message.EditedAt, message.DeletedAt, previewWriteTime(message)).WithContext(ctx).Consistency(gocql.One).Exec()
+}
+
+func (r RoomRepository) GetLastMessage(ctx context.Context, roomID string) (*domain.Message, error) {
+	var message domain.Message
+	err := r.dbSession.Query(getLastMessage, roomID).WithContext(ctx).Consistency(gocql.One).
+		Scan(&message.RoomID, &message.MessageID, &message.SentTimestamp, &message.FromStudentID, &message.MessageBody,
+			&message.EditedAt, &message.DeletedAt)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// AddUnread writes the unread message at the time it was sent, so that a student reading up to it or its deletion
+// removes it even when they are written first
+func (r RoomRepository) AddUnread(ctx context.Context, message *domain.Message, userIDs []string) error {
+	sent := message.SentTimestamp.Truncate(time.Millisecond)
+	batch := r.dbSession.NewBatch(cassandra.BatchUnlogged).WithContext(ctx)
+	for _, id := range userIDs {
+		batch.AddBatchEntry(&gocql.BatchEntry{
+			Stmt: addUnread,
+			Args: []interface{}{id, message.RoomID, sent, message.MessageID, sent.UnixNano() / int64(time.Microsecond)},
+		})
+	}
+	return r.dbSession.ExecuteBatch(batch)
+}
+
+func (r RoomRepository) RemoveUnread(ctx context.Context, message *domain.Message, userIDs []string) error {
+	batch := r.dbSession.NewBatch(cassandra.BatchUnlogged).WithContext(ctx)
+	for _, id := range userIDs {
+		batch.AddBatchEntry(&gocql.BatchEntry{
+			Stmt: removeUnread,
+			Args: []interface{}{id, message.RoomID, message.SentTimestamp.Truncate(time.Millisecond), message.MessageID},
+		})
+	}
+	return r.dbSession.ExecuteBatch(batch)
+}
+
+func (r RoomRepository) ClearUnread(ctx context.Context, roomID string, userID string, timeStamp time.Time) error {
+	return r.dbSession.Query(clearUnread, userID, roomID, timeStamp).WithContext(ctx).Exec()
+}
+
+// GetUnreadCount returns 0 for a student that never had anything unread in the room, and stops counting at
+// domain.MaxUnreadCount
+func (r RoomRepository) GetUnreadCount(ctx context.Context, roomID string, userID string) (int64, error) {
+	var unread int64
+	scanner := r.dbSession.Query(getUnread, userID, roomID, domain.MaxUnreadCount).WithContext(ctx).Consistency(gocql.One).Iter().Scanner()
+	for scanner.Next() {
+		var messageID string
+		if err := scanner.Scan(&messageID); err != nil {
+			return 0, err
+		}
+		unread++
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return unread, nil
+}
+
 func (r RoomRepository) SaveRoomAndAddRoomForAllParticipants(ctx context.Context, room *domain.ChatRoom) error {
 	batch := r.dbSession.NewBatch(cassandra.BatchUnlogged).WithContext(ctx)
 
@@ -5,8 +5,10 @@ import (
 	"chat/messaging/repository/mocks"
 	"context"
 	"errors"
+	"github.com/gocql/gocql"
 	"github.com/stretchr/testify/mock"
 	"testing"
+	"time"
 )
 
 var batchMock = &mocks.BatchInterface{}
@@ -29,6 +31,7 @@ func resetFields() {
 	sessionMock = &mocks.SessionInterface{}
 	queryMock = &mocks.QueryInterface{}
 	mockIter = &mocks.IterInterface{}
+	scannerMock = &mocks.ScannerInterface{}
 	ctx = context.Background()
 	rr = NewRoomRepository(sessionMock)
 	room = &domain.ChatRoom{
@@ -194,7 +197,7 @@ func TestRemoveRoomForParticipantsSuccess(t *testing.T) {
 	queryMock.On("Consistency", mock.Anything).Return(queryMock)
 	queryMock.On("Exec").Return(nil)
 
-	if err := rr.RemoveRoomForParticipants(ctx, mock.Anything, []domain.Student{{"userID1", "", "", "", false}}); err != nil {
+	if err := rr.RemoveRoomForParticipants(ctx, mock.Anything, []domain.Student{{ID: "userID1"}}); err != nil {
 		t.Errorf(errorMessage)
 	}
 	sessionMock.AssertExpectations(t)
@@ -207,7 +210,7 @@ func TestRemoveRoomForParticipantsFail(t *testing.T) {
 	queryMock.On("Consistency", mock.Anything).Return(queryMock)
 	queryMock.On("Exec").Return(errors.New(internalErrorMessage))
 
-	if err := rr.RemoveRoomForParticipants(ctx, mock.Anything, []domain.Student{{"userID1", "", "", "", false}}); err == nil {
+	if err := rr.RemoveRoomForParticipants(ctx, mock.Anything, []domain.Student{{ID: "userID1"}}); err == nil {
 		t.Errorf(errorMessage2)
 	}
 	sessionMock.AssertExpectations(t)
@@ -334,3 +337,190 @@ func TestUpdateParticipantPendingState(t *testing.T) {
 	sessionMock.AssertExpectations(t)
 	resetFields()
 }
+
+func TestSaveLastMessageSuccess(t *testing.T) {
+	sessionMock.On("Query", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.AnythingOfType("int64")).Return(queryMock)
+	queryMock.On("WithContext", ctx).Return(queryMock)
+	queryMock.On("Consistency", mock.Anything).Return(queryMock)
+	queryMock.On("Exec").Return(nil)
+
+	if err := rr.SaveLastMessage(ctx, &domain.Message{}); err != nil {
+		t.Errorf(errorMessage)
+	}
+	sessionMock.AssertExpectations(t)
+	resetFields()
+}
+
+func TestSaveLastMessageEdited(t *testing.T) {
+	sent := time.Date(2021, time.November, 3, 14, 5, 7, 123000000, time.UTC)
+	sentMicros := sent.UnixNano() / int64(time.Microsecond)
+	// each edit is written after the previous revision, and all of them before a message sent a millisecond later
+	sessionMock.On("Query", saveLastMessage, "office", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, sentMicros+2).Return(queryMock)
+	queryMock.On("WithContext", ctx).Return(queryMock)
+	queryMock.On("Consistency", mock.Anything).Return(queryMock)
+	queryMock.On("Exec").Return(nil)
+
+	if err := rr.SaveLastMessage(ctx, &domain.Message{RoomID: "office", SentTimestamp: sent, EditCount: 2}); err != nil {
+		t.Errorf(errorMessage)
+	}
+	sessionMock.AssertExpectations(t)
+	resetFields()
+}
+
+func TestSaveLastMessageDeleted(t *testing.T) {
+	sent := time.Date(2021, time.November, 3, 14, 5, 7, 123000000, time.UTC)
+	sentMicros := sent.UnixNano() / int64(time.Microsecond)
+	deletedAt := sent.Add(time.Hour)
+	// the tombstone is written after every edit, and before a message sent a millisecond later
+	sessionMock.On("Query", saveLastMessage, "office", mock.Anything, mock.Anything, "", mock.Anything, mock.Anything,
+		deletedAt, sentMicros+999).Return(queryMock)
+	queryMock.On("WithContext", ctx).Return(queryMock)
+	queryMock.On("Consistency", mock.Anything).Return(queryMock)
+	queryMock.On("Exec").Return(nil)
+
+	tombstone := &domain.Message{RoomID: "office", SentTimestamp: sent, EditCount: 5000, DeletedAt: deletedAt}
+	if err := rr.SaveLastMessage(ctx, tombstone); err != nil {
+		t.Errorf(errorMessage)
+	}
+	sessionMock.AssertExpectations(t)
+	resetFields()
+}
+
+func TestGetLastMessageNotFound(t *testing.T) {
+	sessionMock.On("Query", mock.Anything, mock.Anything).Return(queryMock)
+	queryMock.On("WithContext", ctx).Return(queryMock)
+	queryMock.On("Consistency", mock.Anything).Return(queryMock)
+	queryMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(gocql.ErrNotFound)
+
+	message, err := rr.GetLastMessage(ctx, mock.Anything)
+
+	if err != nil {
+		t.Errorf(errorMessage)
+	}
+	if message != nil {
+		t.Errorf("Actual message, expected nil")
+	}
+	sessionMock.AssertExpectations(t)
+	resetFields()
+}
+
+func TestGetLastMessageFail(t *testing.T) {
+	sessionMock.On("Query", mock.Anything, mock.Anything).Return(queryMock)
+	queryMock.On("WithContext", ctx).Return(queryMock)
+	queryMock.On("Consistency", mock.Anything).Return(queryMock)
+	queryMock.On("Scan", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(errors.New(internalErrorMessage))
+
+	if _, err := rr.GetLastMessage(ctx, mock.Anything); err == nil {
+		t.Errorf(errorMessage2)
+	}
+	sessionMock.AssertExpectations(t)
+	resetFields()
+}
+
+func TestAddUnreadSuccess(t *testing.T) {
+	sent := time.Date(2021, time.November, 3, 14, 5, 7, 123456789, time.UTC)
+	message := &domain.Message{RoomID: "office", MessageID: mock.Anything, SentTimestamp: sent}
+	sessionMock.On("NewBatch", mock.Anything).Return(batchMock)
+	batchMock.On("WithContext", ctx).Return(batchMock)
+	// written at the time the message was sent, so that reading up to it removes it even if it comes first
+	batchMock.On("AddBatchEntry", mock.MatchedBy(func(entry *gocql.BatchEntry) bool {
+		return entry.Stmt == addUnread && entry.Args[4] == sent.Truncate(time.Millisecond).UnixNano()/int64(time.Microsecond)
+	}))
+	sessionMock.On("ExecuteBatch", batchMock).Return(nil)
+
+	if err := rr.AddUnread(ctx, message, []string{"userID1", "userID2"}); err != nil {
+		t.Errorf(errorMessage)
+	}
+	sessionMock.AssertExpectations(t)
+	batchMock.AssertNumberOfCalls(t, "AddBatchEntry", 2)
+	resetFields()
+}
+
+func TestRemoveUnreadSuccess(t *testing.T) {
+	sessionMock.On("NewBatch", mock.Anything).Return(batchMock)
+	batchMock.On("WithContext", ctx).Return(batchMock)
+	batchMock.On("AddBatchEntry", mock.Anything)
+	sessionMock.On("ExecuteBatch", batchMock).Return(nil)
+
+	if err := rr.RemoveUnread(ctx, &domain.Message{RoomID: "office"}, []string{"userID1", "userID2"}); err != nil {
+		t.Errorf(errorMessage)
+	}
+	sessionMock.AssertExpectations(t)
+	batchMock.AssertNumberOfCalls(t, "AddBatchEntry", 2)
+	resetFields()
+}
+
+func TestClearUnreadFail(t *testing.T) {
+	lastRead := time.Now()
+	sessionMock.On("Query", clearUnread, "userID1", "office", lastRead).Return(queryMock)
+	queryMock.On("WithContext", ctx).Return(queryMock)
+	queryMock.On("Exec").Return(errors.New(internalErrorMessage))
+
+	if err := rr.ClearUnread(ctx, "office", "userID1", lastRead); err == nil {
+		t.Errorf(errorMessage2)
+	}
+	sessionMock.AssertExpectations(t)
+	resetFields()
+}
+
+func TestGetUnreadCountNone(t *testing.T) {
+	sessionMock.On("Query", getUnread, "userID1", "office", domain.MaxUnreadCount).Return(queryMock)
+	queryMock.On("WithContext", ctx).Return(queryMock)
+	queryMock.On("Consistency", mock.Anything).Return(queryMock)
+	queryMock.On("Iter").Return(mockIter)
+	mockIter.On("Scanner").Return(scannerMock)
+	scannerMock.On("Next").Return(false).Once()
+	scannerMock.On("Err").Return(nil).Once()
+
+	unread, err := rr.GetUnreadCount(ctx, "office", "userID1")
+
+	if err != nil {
+		t.Errorf(errorMessage)
+	}
+	if unread != 0 {
+		t.Errorf("Actual %d unread, expected 0", unread)
+	}
+	sessionMock.AssertExpectations(t)
+	resetFields()
+}
+
+func TestGetUnreadCountSuccess(t *testing.T) {
+	sessionMock.On("Query", getUnread, "userID1", "office", domain.MaxUnreadCount).Return(queryMock)
+	queryMock.On("WithContext", ctx).Return(queryMock)
+	queryMock.On("Consistency", mock.Anything).Return(queryMock)
+	queryMock.On("Iter").Return(mockIter)
+	mockIter.On("Scanner").Return(scannerMock)
+	scannerMock.On("Next").Return(true).Times(3)
+	scannerMock.On("Scan", mock.Anything).Return(nil).Times(3)
+	scannerMock.On("Next").Return(false).Once()
+	scannerMock.On("Err").Return(nil).Once()
+
+	unread, err := rr.GetUnreadCount(ctx, "office", "userID1")
+
+	if err != nil {
+		t.Errorf(errorMessage)
+	}
+	if unread != 3 {
+		t.Errorf("Actual %d unread, expected 3", unread)
+	}
+	sessionMock.AssertExpectations(t)
+	resetFields()
+}
+
+func TestGetUnreadCountFail(t *testing.T) {
+	sessionMock.On("Query", getUnread, "userID1", "office", domain.MaxUnreadCount).Return(queryMock)
+	queryMock.On("WithContext", ctx).Return(queryMock)
+	queryMock.On("Consistency", mock.Anything).Return(queryMock)
+	queryMock.On("Iter").Return(mockIter)
+	mockIter.On("Scanner").Return(scannerMock)
+	scannerMock.On("Next").Return(false).Once()
+	scannerMock.On("Err").Return(errors.New(internalErrorMessage)).Once()
+
+	if _, err := rr.GetUnreadCount(ctx, "office", "userID1"); err == nil {
+		t.Errorf(errorMessage2)
+	}
+	sessionMock.AssertExpectations(t)
+	resetFields()
+}
@@ -5,6 +5,7 @@ import (
 	"chat/utils/errors"
 	"context"
 	"fmt"
+	"log"
 	_ "reflect"
 	"time"
 )
@@ -18,16 +19,18 @@ import (
 	DeleteRoom( userID string, roomID string) error
 */
 type roomUseCase struct {
-	rr      domain.RoomRepository
-	sr      domain.StudentRepository
-	timeout time.Duration
+	rr       domain.RoomRepository
+	sr       domain.StudentRepository
+	notifier domain.SubscriptionNotifier
+	timeout  time.Duration
 }
 
-func NewRoomUseCase(rr domain.RoomRepository, sr domain.StudentRepository, t time.Duration) domain.RoomUseCase {
-	return &roomUseCase{rr: rr, sr: sr, timeout: t}
+func NewRoomUseCase(rr domain.RoomRepository, sr domain.StudentRepository, n domain.SubscriptionNotifier, t time.Duration) domain.RoomUseCase {
+	return &roomUseCase{rr: rr, sr: sr, notifier: n, timeout: t}
 }
 
-// SaveRoom should add room to chat.room & chat.student_rooms for all participants
+// SaveRoom should add room to chat.room & chat.student_rooms for all participants, then tell each of them they were
+// added, so the room shows up on their sockets
 func (u *roomUseCase) SaveRoom(ctx context.Context, room *domain.ChatRoom) error {
 	ctx, cancel := context.WithTimeout(ctx, u.timeout)
 	defer cancel()
@@ -52,7 +55,14 @@ func (u *roomUseCase) SaveRoom(ctx context.Context, room *domain.ChatRoom) error
 		}
 	}
 
-	return u.rr.SaveRoomAndAddRoomForAllParticipants(ctx, room)
+	err = u.rr.SaveRoomAndAddRoomForAllParticipants(ctx, room)
+	if err != nil {
+		return err
+	}
+	for _, participant := range room.Students {
+		u.notifier.MemberAdded(room.RoomID, participant.ID)
+	}
+	return nil
 }
 
 // AddUserToRoom should add user to room in chat.room and add room to student in chat.student_rooms
@@ -76,10 +86,16 @@ func (u *roomUseCase) AddUserToRoom(ctx context.Context, roomID string, userID s
 		}
 	}
 
-	if isPendingFalseCount < room.MaxParticipants {
-		return u.rr.AddParticipantToRoomAndAddRoomForParticipant(ctx, roomID, userID)
+	if isPendingFalseCount >= room.MaxParticipants {
+		return errors.NewConflictError("Room is full")
+	}
+
+	err = u.rr.AddParticipantToRoomAndAddRoomForParticipant(ctx, roomID, userID)
+	if err != nil {
+		return err
 	}
-	return errors.NewConflictError("Room is full")
+	u.notifier.MemberAdded(roomID, userID)
+	return nil
 }
 
 // RemoveUserFromRoom should remove user from room in chat.room and remove room from user in chat.student_rooms
@@ -96,8 +112,13 @@ func (u *roomUseCase) RemoveUserFromRoom(ctx context.Context, roomID string, use
 		return errors.NewUnauthorizedError("Unauthorized, you cannot remove someone else unless you are the admin")
 	}
 
-
-	return u.rr.RemoveParticipantFromRoomAndRemoveRoomForParticipant(ctx, roomID, userID)
+	err = u.rr.RemoveParticipantFromRoomAndRemoveRoomForParticipant(ctx, roomID, userID)
+	if err != nil {
+		return err
+	}
+	// the student may still have the room open, they shouldn't keep getting its messages
+	u.notifier.MemberRemoved(roomID, userID)
+	return nil
 }
 
 // GetChatRoomsFor should get rooms for user in chat.student_rooms
@@ -147,6 +168,18 @@ func (u *roomUseCase) GetChatRoomsFor(ctx context.Context, userID string) (*doma
 			studentChatRooms.Rooms[i].Students[j].FirstName = student.FirstName
 			studentChatRooms.Rooms[i].Students[j].LastName = student.LastName
 		}
+
+		// the activity of a room only decorates the list, a room it can't be read for is listed without it
+		studentChatRooms.Rooms[i].LastMessage, err = u.rr.GetLastMessage(ctx, room.RoomID)
+		if err != nil {
+			log.Printf("couldn't get last message of room %s: %s", room.RoomID, err.Error())
+			studentChatRooms.Rooms[i].LastMessage = nil
+		}
+		studentChatRooms.Rooms[i].UnreadCount, err = u.rr.GetUnreadCount(ctx, room.RoomID, userID)
+		if err != nil {
+			log.Printf("couldn't count unread messages of %s in room %s: %s", userID, room.RoomID, err.Error())
+			studentChatRooms.Rooms[i].UnreadCount = 0
+		}
 	}
 	return studentChatRooms, nil
 }
@@ -208,5 +241,14 @@ func (u *roomUseCase) DeleteRoom(ctx context.Context, userID string, roomID stri
 		return errors.NewUnauthorizedError("Unauthorized to delete room, you are not Admin")
 	}
 
-	return u.rr.RemoveRoomForParticipantsAndDeleteRoom(ctx, room)
+	err = u.rr.RemoveRoomForParticipantsAndDeleteRoom(ctx, room)
+	if err != nil {
+		return err
+	}
+	members := make([]string, 0, len(room.Students))
+	for _, student := range room.Students {
+		members = append(members, student.ID)
+	}
+	u.notifier.RoomDeleted(roomID, members)
+	return nil
 }
@@ -14,6 +14,7 @@ import (
 
 var mockRoomRepo *mocks.RoomRepository
 var mockStudentRepo *mocks.StudentRepository
+var mockNotifier *mocks.SubscriptionNotifier
 var mockStudent domain.Student
 var mockRoom domain.ChatRoom
 var mockStudentChatRoom domain.StudentChatRooms
@@ -21,6 +22,7 @@ var mockStudentChatRoom domain.StudentChatRooms
 func resetRoomUsecaseTestFields() {
 	mockRoomRepo = new(mocks.RoomRepository)
 	mockStudentRepo = new(mocks.StudentRepository)
+	mockNotifier = new(mocks.SubscriptionNotifier)
 	faker.FakeData(&mockStudent)
 	faker.FakeData(&mockRoom)
 	faker.FakeData(&mockStudentChatRoom)
@@ -39,19 +41,40 @@ func TestSaveRoom(t *testing.T) {
 			Return(&mockStudent, nil)
 		mockRoomRepo.On("SaveRoomAndAddRoomForAllParticipants", mock.Anything, mock.Anything).
 			Return(nil).Once()
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		mockNotifier.On("MemberAdded", mockRoom.RoomID, mock.AnythingOfType("string"))
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err := u.SaveRoom(context.TODO(), &mockRoom)
 		assert.NoError(t, err)
 		mockRoomRepo.AssertExpectations(t)
 	})
 
+	t.Run("every participant is told they were added", func(t *testing.T) {
+		resetRoomUsecaseTestFields()
+		room := domain.ChatRoom{RoomID: "office", Admin: domain.Student{ID: "michael"},
+			Students: []domain.Student{{ID: "jim"}, {ID: "pam"}}}
+		mockRoomRepo.On("GetRoom", mock.Anything, "office").
+			Return(nil, errors.New("error")).
+			Once()
+		mockStudentRepo.On("GetStudent", mock.Anything, mock.AnythingOfType("string")).
+			Return(&mockStudent, nil)
+		mockRoomRepo.On("SaveRoomAndAddRoomForAllParticipants", mock.Anything, &room).
+			Return(nil).Once()
+		for _, id := range []string{"jim", "pam", "michael"} {
+			mockNotifier.On("MemberAdded", "office", id).Once()
+		}
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
+		err := u.SaveRoom(context.TODO(), &room)
+		assert.NoError(t, err)
+		mockNotifier.AssertExpectations(t)
+	})
+
 	t.Run("case room exists", func(t *testing.T) {
 		resetRoomUsecaseTestFields()
 		mockRoomRepo.On("GetRoom", mock.Anything, mock.Anything).
 			Return(&mockRoom, nil).
 			Once()
 
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err := u.SaveRoom(context.TODO(), &mockRoom)
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
@@ -65,7 +88,7 @@ func TestSaveRoom(t *testing.T) {
 		mockStudentRepo.On("GetStudent", mock.Anything, mock.AnythingOfType("string")).
 			Return(nil, errors.New("Participant with ID does not exist")).Once()
 
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err := u.SaveRoom(context.TODO(), &mockRoom)
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
@@ -80,10 +103,11 @@ func TestSaveRoom(t *testing.T) {
 			Return(&mockStudent, nil)
 		mockRoomRepo.On("SaveRoomAndAddRoomForAllParticipants", mock.Anything, mock.Anything).
 			Return(errors.New("error")).Once()
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err := u.SaveRoom(context.TODO(), &mockRoom)
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
+		mockNotifier.AssertNotCalled(t, "MemberAdded", mock.Anything, mock.Anything)
 	})
 
 	t.Run("error: participant does not exist", func(t *testing.T) {
@@ -95,7 +119,7 @@ func TestSaveRoom(t *testing.T) {
 			Return(&mockStudent, nil).Once()
 		mockStudentRepo.On("GetStudent", mock.Anything, mock.AnythingOfType("string")).
 			Return(nil, errors.New("")).Once()
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err := u.SaveRoom(context.TODO(), &mockRoom)
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
@@ -113,10 +137,12 @@ func TestAddUserToRoom(t *testing.T) {
 			Once()
 		mockRoomRepo.On("AddParticipantToRoomAndAddRoomForParticipant", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).
 			Return(nil).Once()
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		mockNotifier.On("MemberAdded", room.RoomID, mockStudent.ID).Once()
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err := u.AddUserToRoom(context.TODO(), room.RoomID, mockStudent.ID, loggedID)
 		assert.NoError(t, err)
 		mockRoomRepo.AssertExpectations(t)
+		mockNotifier.AssertExpectations(t)
 
 	})
 	t.Run("error: get room", func(t *testing.T) {
@@ -124,7 +150,7 @@ func TestAddUserToRoom(t *testing.T) {
 		mockRoomRepo.On("GetRoom", mock.Anything, mock.Anything).
 			Return(nil, errors.New("")).
 			Once()
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err := u.AddUserToRoom(context.TODO(), mockRoom.RoomID, mockStudent.ID, loggedID)
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
@@ -135,7 +161,7 @@ func TestAddUserToRoom(t *testing.T) {
 		mockRoomRepo.On("GetRoom", mock.Anything, mock.Anything).
 			Return(room, nil).
 			Once()
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err := u.AddUserToRoom(context.TODO(), room.RoomID, mockStudent.ID, loggedID)
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
@@ -146,11 +172,24 @@ func TestAddUserToRoom(t *testing.T) {
 		mockRoomRepo.On("GetRoom", mock.Anything, mock.Anything).
 			Return(room, nil).
 			Once()
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err := u.AddUserToRoom(context.TODO(), room.RoomID, mockStudent.ID, loggedID)
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
 	})
+	t.Run(caseErrorInRepo, func(t *testing.T) {
+		room := &domain.ChatRoom{RoomID: "", MaxParticipants: 2, Admin: domain.Student{ID: loggedID}, Students: []domain.Student{{ID: "1", IsPending: false}}}
+		resetRoomUsecaseTestFields()
+		mockRoomRepo.On("GetRoom", mock.Anything, mock.Anything).
+			Return(room, nil).
+			Once()
+		mockRoomRepo.On("AddParticipantToRoomAndAddRoomForParticipant", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+			Return(errors.New("error")).Once()
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
+		err := u.AddUserToRoom(context.TODO(), room.RoomID, mockStudent.ID, loggedID)
+		assert.Error(t, err)
+		mockNotifier.AssertNotCalled(t, "MemberAdded", mock.Anything, mock.Anything)
+	})
 
 }
 
@@ -163,11 +202,13 @@ func TestRemoveUserFromRoom(t *testing.T) {
 			Once()
 		mockRoomRepo.On("RemoveParticipantFromRoomAndRemoveRoomForParticipant",mock.Anything,mock.AnythingOfType("string"),mock.AnythingOfType("string")).
 			Return(nil).Once()
-		u := NewRoomUseCase(mockRoomRepo,mockStudentRepo,time.Second)
+		mockNotifier.On("MemberRemoved", mockRoom.RoomID, mockStudent.ID).Once()
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err:=u.RemoveUserFromRoom(context.TODO(),mockRoom.RoomID,mockStudent.ID, mockStudent.ID)
 
 		assert.NoError(t, err)
 		mockRoomRepo.AssertExpectations(t)
+		mockNotifier.AssertExpectations(t)
 
 	})
 
@@ -175,7 +216,7 @@ func TestRemoveUserFromRoom(t *testing.T) {
 		resetRoomUsecaseTestFields()
 		mockRoomRepo.On("GetRoom",mock.Anything, mock.Anything).
 			Return(nil, errors.New("")).Once()
-		u := NewRoomUseCase(mockRoomRepo,mockStudentRepo,time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err:=u.RemoveUserFromRoom(context.TODO(),mockRoom.RoomID,mockStudent.ID,mockRoom.Admin.ID)
 
 		assert.Error(t, err)
@@ -186,12 +227,26 @@ func TestRemoveUserFromRoom(t *testing.T) {
 		resetRoomUsecaseTestFields()
 		mockRoomRepo.On("GetRoom",mock.Anything, mock.Anything).
 			Return(&mockRoom, nil).Once()
-		u := NewRoomUseCase(mockRoomRepo,mockStudentRepo,time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err:=u.RemoveUserFromRoom(context.TODO(),mockRoom.RoomID,"1","2")
 
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
 	})
+
+	t.Run(caseErrorInRepo, func(t *testing.T) {
+		resetRoomUsecaseTestFields()
+		mockRoomRepo.On("GetRoom", mock.Anything, mock.Anything).
+			Return(&mockRoom, nil).
+			Once()
+		mockRoomRepo.On("RemoveParticipantFromRoomAndRemoveRoomForParticipant", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+			Return(errors.New("error")).Once()
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
+		err := u.RemoveUserFromRoom(context.TODO(), mockRoom.RoomID, mockStudent.ID, mockStudent.ID)
+
+		assert.Error(t, err)
+		mockNotifier.AssertNotCalled(t, "MemberRemoved", mock.Anything, mock.Anything)
+	})
 }
 func TestGetChatRoomsFor(t *testing.T) {
 
@@ -206,7 +261,7 @@ func TestGetChatRoomsFor(t *testing.T) {
 		mockRoomRepo.On("GetRoom", mock.Anything, mock.Anything).
 			Return(nil, errors.New("error")).Maybe()
 
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		chatroom, err := u.GetChatRoomsFor(context.TODO(), mockStudent.ID)
 		assert.Error(t, err)
 		assert.Nil(t, chatroom)
@@ -228,7 +283,7 @@ func TestGetChatRoomsFor(t *testing.T) {
 		mockStudentRepo.On("GetStudent", mock.Anything, mock.AnythingOfType("string")).
 			Return(nil, errors.New("error"))
 
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		chatroom, err := u.GetChatRoomsFor(context.TODO(), mockStudent.ID)
 		assert.Error(t, err)
 		assert.Nil(t, chatroom)
@@ -250,7 +305,7 @@ func TestGetChatRoomsFor(t *testing.T) {
 		mockStudentRepo.On("GetStudent", mock.Anything, mock.AnythingOfType("string")).
 			Return(&mockStudent, nil).Maybe()
 
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		chatroom, err := u.GetChatRoomsFor(context.TODO(), mockStudent.ID)
 		assert.Error(t, err)
 		assert.Nil(t, chatroom)
@@ -265,7 +320,7 @@ func TestGetChatRoomsFor(t *testing.T) {
 
 		mockStudentRepo.On("GetStudent", mock.Anything, mock.AnythingOfType("string")).
 			Return(&mockStudent, nil).Maybe()
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		chatroom, err := u.GetChatRoomsFor(context.TODO(), mockStudent.ID)
 		assert.Error(t, err)
 		assert.Nil(t, chatroom)
@@ -287,10 +342,51 @@ func TestGetChatRoomsFor(t *testing.T) {
 		mockStudentRepo.On("GetStudent", mock.Anything, mock.AnythingOfType("string")).
 			Return(&mockStudent, nil)
 
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		var lastMessage domain.Message
+		faker.FakeData(&lastMessage)
+		mockRoomRepo.On("GetLastMessage", mock.Anything, mock.Anything).
+			Return(&lastMessage, nil)
+
+		mockRoomRepo.On("GetUnreadCount", mock.Anything, mock.Anything, mockStudent.ID).
+			Return(int64(3), nil)
+
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
+		chatroom, err := u.GetChatRoomsFor(context.TODO(), mockStudent.ID)
+		assert.NoError(t, err)
+		assert.NotNil(t, chatroom)
+		for _, room := range chatroom.Rooms {
+			assert.Equal(t, &lastMessage, room.LastMessage)
+			assert.Equal(t, int64(3), room.UnreadCount)
+		}
+
+		mockRoomRepo.AssertExpectations(t)
+	})
+
+	t.Run("case error getting room activity lists the room without it", func(t *testing.T) {
+		resetRoomUsecaseTestFields()
+		mockStudentRepo.On("GetStudent", mock.Anything, mock.AnythingOfType("string")).
+			Return(&mockStudent, nil)
+
+		mockRoomRepo.On("GetRoomsFor", mock.Anything, mock.Anything).
+			Return(&mockStudentChatRoom, nil).Once()
+
+		mockRoomRepo.On("GetRoom", mock.Anything, mock.Anything).
+			Return(&mockRoom, nil)
+
+		mockRoomRepo.On("GetLastMessage", mock.Anything, mock.Anything).
+			Return(nil, errors.New("error"))
+
+		mockRoomRepo.On("GetUnreadCount", mock.Anything, mock.Anything, mockStudent.ID).
+			Return(int64(0), errors.New("error"))
+
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		chatroom, err := u.GetChatRoomsFor(context.TODO(), mockStudent.ID)
 		assert.NoError(t, err)
 		assert.NotNil(t, chatroom)
+		for _, room := range chatroom.Rooms {
+			assert.Nil(t, room.LastMessage)
+			assert.Equal(t, int64(0), room.UnreadCount)
+		}
 
 		mockRoomRepo.AssertExpectations(t)
 	})
@@ -318,7 +414,7 @@ func TestGetChatRoomsFor(t *testing.T) {
 		mockStudentRepo.On("GetStudent", mock.Anything, mock.AnythingOfType("string")).
 			Return(nil, errors.New("")).Once()
 
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		chatroom, err := u.GetChatRoomsFor(context.TODO(), mockStudent.ID)
 		assert.Error(t, err)
 		assert.Nil(t, chatroom)
@@ -337,7 +433,7 @@ func TestDeleteRoom(t *testing.T) {
 		mockRoomRepo.On("RemoveRoomForParticipantsAndDeleteRoom", mock.Anything, &mockRoom).
 			Return(errors.New("error"))
 
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err := u.DeleteRoom(context.TODO(), mockStudent.ID, mockRoom.RoomID)
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
@@ -349,7 +445,7 @@ func TestDeleteRoom(t *testing.T) {
 		mockRoomRepo.On("GetRoom", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).
 			Return(&mockRoom, nil)
 
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err := u.DeleteRoom(context.TODO(), mockStudent.ID, mockRoom.RoomID)
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
@@ -362,7 +458,7 @@ func TestDeleteRoom(t *testing.T) {
 		mockRoomRepo.On("GetRoom", mock.Anything, mock.AnythingOfType("string"), mock.AnythingOfType("string")).
 			Return(nil, errors.New("error"))
 
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err := u.DeleteRoom(context.TODO(), mockStudent.ID, mockRoom.RoomID)
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
@@ -377,10 +473,16 @@ func TestDeleteRoom(t *testing.T) {
 		mockRoomRepo.On("RemoveRoomForParticipantsAndDeleteRoom", mock.Anything, &mockRoom).
 			Return(nil)
 		mockRoom.Admin.ID = mockStudent.ID
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		members := []string{}
+		for _, student := range mockRoom.Students {
+			members = append(members, student.ID)
+		}
+		mockNotifier.On("RoomDeleted", mockRoom.RoomID, members).Once()
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		err := u.DeleteRoom(context.TODO(), mockStudent.ID, mockRoom.RoomID)
 		assert.NoError(t, err)
 		mockRoomRepo.AssertExpectations(t)
+		mockNotifier.AssertExpectations(t)
 	})
 }
 
@@ -405,7 +507,7 @@ func TestGetChatRoomsByClass(t *testing.T) {
 
 		mockStudentRepo.On("GetStudent", mock.Anything, mock.AnythingOfType("string")).
 			Return(&student, nil).Once()
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		_, err := u.GetChatRoomsByClass(context.TODO(), "")
 		assert.NoError(t, err)
 		mockRoomRepo.AssertExpectations(t)
@@ -416,7 +518,7 @@ func TestGetChatRoomsByClass(t *testing.T) {
 
 		mockRoomRepo.On("GetChatRoomsByClass", mock.Anything, mock.AnythingOfType("string")).
 			Return(nil, errors.New(""))
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		_, err := u.GetChatRoomsByClass(context.TODO(), "")
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
@@ -436,7 +538,7 @@ func TestGetChatRoomsByClass(t *testing.T) {
 		mockRoomRepo.On("GetRoom", mock.Anything, mock.Anything).
 			Return(nil, errors.New("")).Once()
 
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		_, err := u.GetChatRoomsByClass(context.TODO(), "")
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
@@ -459,7 +561,7 @@ func TestGetChatRoomsByClass(t *testing.T) {
 		mockStudentRepo.On("GetStudent", mock.Anything, mock.AnythingOfType("string")).
 			Return(nil, errors.New("")).Once()
 
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		_, err := u.GetChatRoomsByClass(context.TODO(), "")
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
@@ -485,7 +587,7 @@ func TestGetChatRoomsByClass(t *testing.T) {
 		mockStudentRepo.On("GetStudent", mock.Anything, mock.AnythingOfType("string")).
 			Return(nil, errors.New("")).Once()
 
-		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, time.Second)
+		u := NewRoomUseCase(mockRoomRepo, mockStudentRepo, mockNotifier, time.Second)
 		_, err := u.GetChatRoomsByClass(context.TODO(), "")
 		assert.Error(t, err)
 		mockRoomRepo.AssertExpectations(t)
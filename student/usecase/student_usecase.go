@@ -15,6 +15,9 @@ const (
 	failedBindQueue = "Failed to bind a queue"
 )
 
+// operations are the profile events the listeners consume
+var operations = []string{"created", "updated", "deleted"}
+
 type studentUseCase struct {
 	sr domain.StudentRepository
 }
@@ -30,70 +33,74 @@ func failOnError(err error, msg string) {
 }
 
 func (s studentUseCase) ListenStudentCreation(ch *amqp.Channel) {
-	err, msgs, forever := s.QueueListener(ch, "created")
-
-	go func() {
-		for d := range msgs {
-			var st domain.Student
-			json.Unmarshal(d.Body, &st)
-			err = s.sr.SaveStudent(context.Background(), &st)
-			if err != nil {
-				log.Println("couldn't save student ", err)
-				continue
-			}
-			d.Ack(false)
-			log.Println("saved a student")
-		}
-	}()
+	err, msgs := s.QueueListener(ch, "created")
 
 	log.Printf(" [*] Waiting for student creation.")
-	<-forever
+	for d := range msgs {
+		var st domain.Student
+		json.Unmarshal(d.Body, &st)
+		err = s.sr.SaveStudent(context.Background(), &st)
+		if err != nil {
+			log.Println("couldn't save student ", err)
+			continue
+		}
+		d.Ack(false)
+		log.Println("saved a student")
+	}
 }
 
 // ListenStudentEdit listens to the
 func (s studentUseCase) ListenStudentEdit(ch *amqp.Channel) {
-	err, msgs, forever := s.QueueListener(ch, "updated")
-
-	go func() {
-		for d := range msgs {
-			var st domain.Student
-			json.Unmarshal(d.Body, &st)
-			err = s.sr.EditStudent(context.Background(), &st)
-			if err != nil {
-				log.Println("couldn't edit student ", err)
-				continue
-			}
-			d.Ack(false)
-			log.Println("edited a student")
-		}
-	}()
+	err, msgs := s.QueueListener(ch, "updated")
 
 	log.Printf(" [*] Waiting for student update.")
-	<-forever
+	for d := range msgs {
+		var st domain.Student
+		json.Unmarshal(d.Body, &st)
+		err = s.sr.EditStudent(context.Background(), &st)
+		if err != nil {
+			log.Println("couldn't edit student ", err)
+			continue
+		}
+		d.Ack(false)
+		log.Println("edited a student")
+	}
 }
 
 // ListenStudentDelete listens to the queue for any deleted students
 func (s studentUseCase) ListenStudentDelete(ch *amqp.Channel) {
-	err, msgs, forever := s.QueueListener(ch, "deleted")
-
-	go func() {
-		for d := range msgs {
-			id := string(d.Body)
-			err = s.sr.DeleteStudent(context.Background(), id)
-			if err != nil {
-				log.Println("couldn't delete student ", err)
-				continue
-			}
-			d.Ack(false)
-			log.Println("deleted a student")
-		}
-	}()
+	err, msgs := s.QueueListener(ch, "deleted")
 
 	log.Printf(" [*] Waiting for delete")
-	<-forever
+	for d := range msgs {
+		id := string(d.Body)
+		err = s.sr.DeleteStudent(context.Background(), id)
+		if err != nil {
+			log.Println("couldn't delete student ", err)
+			continue
+		}
+		d.Ack(false)
+		log.Println("deleted a student")
+	}
+}
+
+// StopListening cancels the consumers of the three listeners. The broker stops delivering, and each listener returns
+// once it has handled the deliveries it already received, so none is left unacked
+func (s studentUseCase) StopListening(ch *amqp.Channel) error {
+	for _, operation := range operations {
+		if err := ch.Cancel(consumerTag(operation), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consumerTag names the consumer of the operation, so StopListening can cancel it
+func consumerTag(operation string) string {
+	return "chat.profile." + operation
 }
 
-func (s studentUseCase) QueueListener(ch *amqp.Channel, operation string) (error, <-chan amqp.Delivery, chan bool) {
+func (s studentUseCase) QueueListener(ch *amqp.Channel, operation string) (error, <-chan amqp.Delivery) {
 	q, err := ch.QueueDeclare(
 		"",    // name
 		false, // durable
@@ -113,16 +120,15 @@ func (s studentUseCase) QueueListener(ch *amqp.Channel, operation string) (error
 	failOnError(err, failedBindQueue)
 
 	msgs, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		false,  // auto ack
-		false,  // exclusive
-		false,  // no local
-		false,  // no wait
-		nil,    // args
+		q.Name,                 // queue
+		consumerTag(operation), // consumer
+		false,                  // auto ack
+		false,                  // exclusive
+		false,                  // no local
+		false,                  // no wait
+		nil,                    // args
 	)
 	failOnError(err, failedToRegisterConsumer)
 
-	forever := make(chan bool)
-	return err, msgs, forever
+	return err, msgs
 }
\ No newline at end of file
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewVerifierFromEnv builds the verifier AUTH_MODE asks for:
+//   - hmac checks the signature with SECRET_KEY
+//   - key checks the signature with the PEM encoded RSA or ECDSA public key in AUTH_PUBLIC_KEY_FILE
+//   - jwks checks the signature with the keys of the JWKS file AUTH_JWKS_FILE
+//   - remote asks the auth service at AUTH_URL, and trusts the claims of the tokens it accepts without checking
+//     their signature, the student's id included
+//
+// When AUTH_MODE isn't set, it is hmac, the remote mode is only used when asked for. The remote mode is tuned with
+// AUTH_TIMEOUT, AUTH_BREAKER_FAILURES, AUTH_BREAKER_INTERVAL, AUTH_BREAKER_OPEN_TIMEOUT, AUTH_BREAKER_MAX_REQUESTS,
+// AUTH_CACHE_TTL and AUTH_CACHE_SIZE, see RemoteOptions. AUTH_AUDIENCE is a comma separated
+// list of accepted audiences, and AUTH_USER_CLAIM the claim holding the student's id, iss by default
+func NewVerifierFromEnv() (TokenVerifier, error) {
+	opts := Options{UserClaim: os.Getenv("AUTH_USER_CLAIM")}
+	for _, aud := range strings.Split(os.Getenv("AUTH_AUDIENCE"), ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			opts.Audience = append(opts.Audience, aud)
+		}
+	}
+
+	mode := os.Getenv("AUTH_MODE")
+	if mode == "" {
+		mode = "hmac"
+	}
+	switch mode {
+	case "hmac":
+		secret := os.Getenv("SECRET_KEY")
+		if secret == "" {
+			return nil, fmt.Errorf("SECRET_KEY must be set when AUTH_MODE is hmac")
+		}
+		return NewHMACVerifier([]byte(secret), opts), nil
+	case "key":
+		pemKey, err := ioutil.ReadFile(os.Getenv("AUTH_PUBLIC_KEY_FILE"))
+		if err != nil {
+			return nil, fmt.Errorf("AUTH_PUBLIC_KEY_FILE must be a readable file when AUTH_MODE is key: %w", err)
+		}
+		return NewPublicKeyVerifier(pemKey, opts)
+	case "jwks":
+		return NewJWKSVerifier(os.Getenv("AUTH_JWKS_FILE"), opts)
+	case "remote":
+		url := os.Getenv("AUTH_URL")
+		if url == "" {
+			return nil, fmt.Errorf("AUTH_URL must be set when AUTH_MODE is remote")
+		}
+		remote, err := remoteOptionsFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewRemoteVerifier(url, remote, opts), nil
+	}
+	return nil, fmt.Errorf("unknown AUTH_MODE %q, must be one of hmac, key, jwks or remote", mode)
+}
+
+// remoteOptionsFromEnv reads the RemoteOptions, the durations are like 30s and an unset variable is the default
+func remoteOptionsFromEnv() (RemoteOptions, error) {
+	var o RemoteOptions
+	var err error
+	durations := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"AUTH_TIMEOUT", &o.Timeout},
+		{"AUTH_BREAKER_INTERVAL", &o.Interval},
+		{"AUTH_BREAKER_OPEN_TIMEOUT", &o.OpenTimeout},
+		{"AUTH_CACHE_TTL", &o.CacheTTL},
+	}
+	for _, d := range durations {
+		value := os.Getenv(d.name)
+		if value == "" {
+			continue
+		}
+		if *d.value, err = time.ParseDuration(value); err != nil || *d.value <= 0 {
+			return o, fmt.Errorf("%s must be a positive duration, e.g. 30s, got %q", d.name, value)
+		}
+	}
+	counts := []struct {
+		name  string
+		value *uint32
+	}{
+		{"AUTH_BREAKER_FAILURES", &o.Failures},
+		{"AUTH_BREAKER_MAX_REQUESTS", &o.MaxRequests},
+	}
+	for _, c := range counts {
+		value := os.Getenv(c.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || n == 0 {
+			return o, fmt.Errorf("%s must be a positive number, got %q", c.name, value)
+		}
+		*c.value = uint32(n)
+	}
+	if value := os.Getenv("AUTH_CACHE_SIZE"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return o, fmt.Errorf("AUTH_CACHE_SIZE must be a number, 0 disables the cache, got %q", value)
+		}
+		if n == 0 {
+			o.CacheTTL = -1
+		}
+		o.CacheSize = n
+	}
+	return o, nil
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"math/big"
+)
+
+// NewHMACVerifier verifies tokens signed with the shared secret, with HS256, HS384 or HS512
+func NewHMACVerifier(secret []byte, opts Options) TokenVerifier {
+	return &localVerifier{
+		keyFunc: func(token *jwt.Token) (interface{}, error) {
+			return keyFor(token, secret)
+		},
+		opts: opts,
+	}
+}
+
+// NewPublicKeyVerifier verifies tokens signed with the private key of the PEM encoded RSA or ECDSA public key
+func NewPublicKeyVerifier(pemKey []byte, opts Options) (TokenVerifier, error) {
+	var key interface{}
+	if rsaKey, err := jwt.ParseRSAPublicKeyFromPEM(pemKey); err == nil {
+		key = rsaKey
+	} else if ecKey, err := jwt.ParseECPublicKeyFromPEM(pemKey); err == nil {
+		key = ecKey
+	} else {
+		return nil, errors.New("public key must be a PEM encoded RSA or ECDSA public key")
+	}
+	return &localVerifier{
+		keyFunc: func(token *jwt.Token) (interface{}, error) {
+			return keyFor(token, key)
+		},
+		opts: opts,
+	}, nil
+}
+
+// NewJWKSVerifier verifies tokens signed with one of the RSA or ECDSA keys of the JWKS file. The key is picked by
+// the kid of the token, a token without kid is only accepted when the file has a single key. The file is read once,
+// rotating the keys takes a restart
+func NewJWKSVerifier(path string, opts Options) (TokenVerifier, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	return &localVerifier{
+		keyFunc: func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			key, ok := keys[kid]
+			if !ok && kid == "" && len(keys) == 1 {
+				for _, k := range keys {
+					key, ok = k, true
+				}
+			}
+			if !ok {
+				return nil, fmt.Errorf("unknown kid %q", kid)
+			}
+			return keyFor(token, key)
+		},
+		opts: opts,
+	}, nil
+}
+
+// keyFor returns the key if the token is signed with an algorithm of the key's type. Otherwise a token could be
+// signed with HS256 using the public key as secret
+func keyFor(token *jwt.Token, key interface{}) (interface{}, error) {
+	ok := false
+	switch key.(type) {
+	case []byte:
+		_, ok = token.Method.(*jwt.SigningMethodHMAC)
+	case *rsa.PublicKey:
+		_, isRSA := token.Method.(*jwt.SigningMethodRSA)
+		_, isPSS := token.Method.(*jwt.SigningMethodRSAPSS)
+		ok = isRSA || isPSS
+	case *ecdsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodECDSA)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+	return key, nil
+}
+
+// jwk is a key of a JWKS file, only the fields of RSA and EC public keys are read
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the signing keys of the JWKS by kid. Encryption keys are skipped
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in JWKS: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no signing key")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	if value == "" {
+		return nil, errors.New("missing key parameter")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sony/gobreaker"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RemoteOptions tune the requests to the auth service. The zero value of a field is its default
+type RemoteOptions struct {
+	// Timeout bounds a request to the auth service, 2s by default
+	Timeout time.Duration
+	// Failures is how many requests in a row must fail for the breaker to open, 5 by default
+	Failures uint32
+	// Interval is how often the breaker forgets the failures while closed, 60s by default
+	Interval time.Duration
+	// OpenTimeout is how long the breaker stays open before letting requests through again, 10s by default
+	OpenTimeout time.Duration
+	// MaxRequests is how many requests the half-open breaker lets through, 5 by default
+	MaxRequests uint32
+	// CacheTTL is how long a verified token is trusted without asking again, never past its exp. 1m by default, a
+	// negative value disables the cache
+	CacheTTL time.Duration
+	// CacheSize bounds how many tokens are cached, 10000 by default
+	CacheSize int
+}
+
+func (o RemoteOptions) withDefaults() RemoteOptions {
+	if o.Timeout == 0 {
+		o.Timeout = time.Second * 2
+	}
+	if o.Failures == 0 {
+		o.Failures = 5
+	}
+	if o.Interval == 0 {
+		o.Interval = time.Minute
+	}
+	if o.OpenTimeout == 0 {
+		o.OpenTimeout = time.Second * 10
+	}
+	if o.MaxRequests == 0 {
+		o.MaxRequests = 5
+	}
+	if o.CacheTTL == 0 {
+		o.CacheTTL = time.Minute
+	}
+	if o.CacheSize == 0 {
+		o.CacheSize = 10000
+	}
+	return o
+}
+
+// RemoteStats counts what the remote verifier did since it was created
+type RemoteStats struct {
+	BreakerState        string           `json:"breaker_state"`
+	BreakerStateChanges map[string]int64 `json:"breaker_state_changes"`
+	CacheHits           int64            `json:"cache_hits"`
+	CacheMisses         int64            `json:"cache_misses"`
+	CacheSize           int              `json:"cache_size"`
+}
+
+// RemoteVerifier asks the auth service to verify the token, then reads the claims without checking the signature.
+// All the requests go through one circuit breaker, so once the auth service is down they fail fast until it is back
+type RemoteVerifier struct {
+	url     string
+	client  *http.Client
+	cb      *gobreaker.CircuitBreaker
+	remote  RemoteOptions
+	opts    Options
+	now     func() time.Time
+	hits    int64
+	misses  int64
+	mu      sync.Mutex
+	cache   map[string]cachedToken
+	changes map[string]int64
+}
+
+// cachedToken is a verified token, trusted until expires
+type cachedToken struct {
+	userID  string
+	expires time.Time
+}
+
+// NewRemoteVerifier verifies tokens by sending them to the auth service at url, which answers 200 for a valid
+// token. The signature isn't checked here, the claims of a token the auth service accepts are trusted, the student's
+// id included. They are still checked locally, so an expired token or one meant for another audience is rejected
+// even if the auth service accepts it
+func NewRemoteVerifier(url string, remote RemoteOptions, opts Options) *RemoteVerifier {
+	remote = remote.withDefaults()
+	v := &RemoteVerifier{
+		url:     url,
+		client:  &http.Client{Timeout: remote.Timeout},
+		remote:  remote,
+		opts:    opts,
+		now:     time.Now,
+		cache:   make(map[string]cachedToken),
+		changes: make(map[string]int64),
+	}
+	v.cb = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        "auth",
+		MaxRequests: remote.MaxRequests,
+		Interval:    remote.Interval,
+		Timeout:     remote.OpenTimeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= remote.Failures
+		},
+		OnStateChange: v.stateChanged,
+	})
+	return v
+}
+
+func (v *RemoteVerifier) Verify(ctx context.Context, token string) (string, error) {
+	key := tokenKey(token)
+	if userID, ok := v.cached(key); ok {
+		atomic.AddInt64(&v.hits, 1)
+		return userID, nil
+	}
+	atomic.AddInt64(&v.misses, 1)
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+	}
+
+	// only the auth service failing counts against the breaker, a token it rejects doesn't. The request has its own
+	// context, so a client going away doesn't count as the auth service failing either
+	cbResponse, err := v.cb.Execute(func() (interface{}, error) {
+		requestCtx, cancel := context.WithTimeout(context.Background(), v.remote.Timeout)
+		defer cancel()
+		request, err := http.NewRequestWithContext(requestCtx, "GET", v.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+		response, err := v.client.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		response.Body.Close()
+		if response.StatusCode >= http.StatusInternalServerError {
+			return nil, fmt.Errorf("auth service answered %d", response.StatusCode)
+		}
+		return response.StatusCode, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+	}
+	if status, _ := cbResponse.(int); status != http.StatusOK {
+		return "", fmt.Errorf("%w: rejected by the auth service", ErrInvalidToken)
+	}
+
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidToken, err.Error())
+	}
+	if err := claims.Valid(); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidToken, err.Error())
+	}
+	userID, err := v.opts.userID(claims)
+	if err != nil {
+		return "", err
+	}
+	v.store(key, userID, claims)
+	return userID, nil
+}
+
+// Stats returns the counters of the verifier. It is safe to call from any goroutine
+func (v *RemoteVerifier) Stats() RemoteStats {
+	// reading the state may move the breaker to half-open, which calls stateChanged, so it is read before locking
+	state := v.cb.State()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	changes := make(map[string]int64, len(v.changes))
+	for change, count := range v.changes {
+		changes[change] = count
+	}
+	return RemoteStats{
+		BreakerState:        state.String(),
+		BreakerStateChanges: changes,
+		CacheHits:           atomic.LoadInt64(&v.hits),
+		CacheMisses:         atomic.LoadInt64(&v.misses),
+		CacheSize:           len(v.cache),
+	}
+}
+
+func (v *RemoteVerifier) stateChanged(name string, from gobreaker.State, to gobreaker.State) {
+	log.Printf("circuit breaker %s went from %s to %s", name, from, to)
+	v.mu.Lock()
+	v.changes[from.String()+"->"+to.String()]++
+	v.mu.Unlock()
+}
+
+// tokenKey is what the token is cached by, so the cache never holds a usable token
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (v *RemoteVerifier) cached(key string) (string, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, ok := v.cache[key]
+	if !ok {
+		return "", false
+	}
+	if !v.now().Before(entry.expires) {
+		delete(v.cache, key)
+		return "", false
+	}
+	return entry.userID, true
+}
+
+// store caches the verified token for CacheTTL, or until it expires if that is sooner. When the cache is full, the
+// expired tokens are dropped, and if it is still full the token isn't cached
+func (v *RemoteVerifier) store(key string, userID string, claims jwt.MapClaims) {
+	if v.remote.CacheTTL < 0 {
+		return
+	}
+	now := v.now()
+	expires := now.Add(v.remote.CacheTTL)
+	if exp, ok := claims["exp"].(float64); ok {
+		if tokenExpires := time.Unix(int64(exp), 0); tokenExpires.Before(expires) {
+			expires = tokenExpires
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.cache) >= v.remote.CacheSize {
+		for k, entry := range v.cache {
+			if !now.Before(entry.expires) {
+				delete(v.cache, k)
+			}
+		}
+		if len(v.cache) >= v.remote.CacheSize {
+			return
+		}
+	}
+	v.cache[key] = cachedToken{userID: userID, expires: expires}
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	// ErrInvalidToken is returned for a token that isn't signed by a trusted key, is expired, not valid yet, meant for
+	// another audience or has no user
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrUnavailable is returned when the token couldn't be checked, e.g. the auth service is down. It says nothing
+	// about the token itself
+	ErrUnavailable = errors.New("token verification unavailable")
+)
+
+// defaultUserClaim is the claim that holds the student's id, the auth service puts it in iss
+const defaultUserClaim = "iss"
+
+// TokenVerifier checks a jwt and returns the id of the student it was issued to. The same verifier is used for the
+// REST endpoints, the websockets and the event streams, so a token is accepted by all of them or by none
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) (string, error)
+}
+
+// Options are the checks every verifier applies to the claims, on top of exp and nbf which are always checked when
+// the token has them
+type Options struct {
+	// Audience is the list of accepted audiences. When set, the aud claim must contain one of them
+	Audience []string
+	// UserClaim is the claim holding the student's id, iss when empty
+	UserClaim string
+}
+
+// localVerifier checks the signature itself, with the key keyFunc picks for the token
+type localVerifier struct {
+	keyFunc jwt.Keyfunc
+	opts    Options
+}
+
+func (v *localVerifier) Verify(_ context.Context, token string) (string, error) {
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, v.keyFunc); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidToken, err.Error())
+	}
+	return v.opts.userID(claims)
+}
+
+// userID checks the audience of the claims, which jwt-go only does for a single audience, and reads the student
+func (o Options) userID(claims jwt.MapClaims) (string, error) {
+	if len(o.Audience) > 0 && !hasAudience(claims["aud"], o.Audience) {
+		return "", fmt.Errorf("%w: not meant for this audience", ErrInvalidToken)
+	}
+	claim := o.UserClaim
+	if claim == "" {
+		claim = defaultUserClaim
+	}
+	userID, _ := claims[claim].(string)
+	if userID == "" {
+		return "", fmt.Errorf("%w: missing %s claim", ErrInvalidToken, claim)
+	}
+	return userID, nil
+}
+
+// hasAudience tells if aud, a string or a list of strings, contains one of the accepted audiences
+func hasAudience(aud interface{}, accepted []string) bool {
+	var audiences []string
+	switch a := aud.(type) {
+	case string:
+		audiences = []string{a}
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+	for _, a := range audiences {
+		for _, b := range accepted {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,379 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func publicPEM(t *testing.T, key interface{}) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func TestHMACVerifier(t *testing.T) {
+	t.Parallel()
+	secret := []byte("secret")
+	v := NewHMACVerifier(secret, Options{Audience: []string{"chat"}})
+	ctx := context.Background()
+	now := time.Now()
+
+	t.Run("success", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"iss": "jim", "aud": "chat", "exp": now.Add(time.Hour).Unix()})
+		userID, err := v.Verify(ctx, token)
+		assert.NoError(t, err)
+		assert.Equal(t, "jim", userID)
+	})
+	t.Run("audience-list", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"iss": "jim", "aud": []string{"mail", "chat"}})
+		userID, err := v.Verify(ctx, token)
+		assert.NoError(t, err)
+		assert.Equal(t, "jim", userID)
+	})
+	t.Run("wrong-audience", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"iss": "jim", "aud": "mail"})
+		_, err := v.Verify(ctx, token)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+	t.Run("missing-audience", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"iss": "jim"})
+		_, err := v.Verify(ctx, token)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+	t.Run("expired", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"iss": "jim", "aud": "chat", "exp": now.Add(-time.Minute).Unix()})
+		_, err := v.Verify(ctx, token)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+	t.Run("not-valid-yet", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"iss": "jim", "aud": "chat", "nbf": now.Add(time.Hour).Unix()})
+		_, err := v.Verify(ctx, token)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+	t.Run("wrong-secret", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodHS256, []byte("other"), "", jwt.MapClaims{"iss": "jim", "aud": "chat"})
+		_, err := v.Verify(ctx, token)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+	t.Run("missing-user", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"aud": "chat"})
+		_, err := v.Verify(ctx, token)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+	t.Run("user-claim", func(t *testing.T) {
+		v := NewHMACVerifier(secret, Options{UserClaim: "sub"})
+		token := sign(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"iss": "auth", "sub": "pam"})
+		userID, err := v.Verify(ctx, token)
+		assert.NoError(t, err)
+		assert.Equal(t, "pam", userID)
+	})
+}
+
+func TestPublicKeyVerifier(t *testing.T) {
+	t.Parallel()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	claims := jwt.MapClaims{"iss": "jim"}
+
+	t.Run("rsa", func(t *testing.T) {
+		v, err := NewPublicKeyVerifier(publicPEM(t, &rsaKey.PublicKey), Options{})
+		assert.NoError(t, err)
+		userID, err := v.Verify(ctx, sign(t, jwt.SigningMethodRS256, rsaKey, "", claims))
+		assert.NoError(t, err)
+		assert.Equal(t, "jim", userID)
+		userID, err = v.Verify(ctx, sign(t, jwt.SigningMethodPS256, rsaKey, "", claims))
+		assert.NoError(t, err)
+		assert.Equal(t, "jim", userID)
+	})
+	t.Run("ecdsa", func(t *testing.T) {
+		v, err := NewPublicKeyVerifier(publicPEM(t, &ecKey.PublicKey), Options{})
+		assert.NoError(t, err)
+		userID, err := v.Verify(ctx, sign(t, jwt.SigningMethodES256, ecKey, "", claims))
+		assert.NoError(t, err)
+		assert.Equal(t, "jim", userID)
+	})
+	t.Run("other-key", func(t *testing.T) {
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(t, err)
+		v, err := NewPublicKeyVerifier(publicPEM(t, &rsaKey.PublicKey), Options{})
+		assert.NoError(t, err)
+		_, err = v.Verify(ctx, sign(t, jwt.SigningMethodRS256, other, "", claims))
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+	t.Run("public-key-as-secret", func(t *testing.T) {
+		pemKey := publicPEM(t, &rsaKey.PublicKey)
+		v, err := NewPublicKeyVerifier(pemKey, Options{})
+		assert.NoError(t, err)
+		_, err = v.Verify(ctx, sign(t, jwt.SigningMethodHS256, pemKey, "", claims))
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+	t.Run("invalid-pem", func(t *testing.T) {
+		_, err := NewPublicKeyVerifier([]byte("not a key"), Options{})
+		assert.Error(t, err)
+	})
+}
+
+func TestJWKSVerifier(t *testing.T) {
+	t.Parallel()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	claims := jwt.MapClaims{"iss": "jim"}
+
+	writeJWKS := func(t *testing.T, keys ...map[string]string) string {
+		data, err := json.Marshal(map[string]interface{}{"keys": keys})
+		assert.NoError(t, err)
+		path := filepath.Join(t.TempDir(), "jwks.json")
+		assert.NoError(t, os.WriteFile(path, data, 0600))
+		return path
+	}
+	rsaJWK := map[string]string{
+		"kty": "RSA", "kid": "rsa-1", "use": "sig",
+		"n": encodeInt(rsaKey.N), "e": encodeInt(big.NewInt(int64(rsaKey.E))),
+	}
+	ecJWK := map[string]string{
+		"kty": "EC", "kid": "ec-1", "crv": "P-256",
+		"x": encodeInt(ecKey.X), "y": encodeInt(ecKey.Y),
+	}
+
+	t.Run("success", func(t *testing.T) {
+		v, err := NewJWKSVerifier(writeJWKS(t, rsaJWK, ecJWK), Options{})
+		assert.NoError(t, err)
+		userID, err := v.Verify(ctx, sign(t, jwt.SigningMethodRS256, rsaKey, "rsa-1", claims))
+		assert.NoError(t, err)
+		assert.Equal(t, "jim", userID)
+		userID, err = v.Verify(ctx, sign(t, jwt.SigningMethodES256, ecKey, "ec-1", claims))
+		assert.NoError(t, err)
+		assert.Equal(t, "jim", userID)
+	})
+	t.Run("wrong-kid", func(t *testing.T) {
+		v, err := NewJWKSVerifier(writeJWKS(t, rsaJWK, ecJWK), Options{})
+		assert.NoError(t, err)
+		_, err = v.Verify(ctx, sign(t, jwt.SigningMethodRS256, rsaKey, "ec-1", claims))
+		assert.ErrorIs(t, err, ErrInvalidToken)
+		_, err = v.Verify(ctx, sign(t, jwt.SigningMethodRS256, rsaKey, "unknown", claims))
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+	t.Run("no-kid", func(t *testing.T) {
+		v, err := NewJWKSVerifier(writeJWKS(t, rsaJWK), Options{})
+		assert.NoError(t, err)
+		userID, err := v.Verify(ctx, sign(t, jwt.SigningMethodRS256, rsaKey, "", claims))
+		assert.NoError(t, err)
+		assert.Equal(t, "jim", userID)
+
+		v, err = NewJWKSVerifier(writeJWKS(t, rsaJWK, ecJWK), Options{})
+		assert.NoError(t, err)
+		_, err = v.Verify(ctx, sign(t, jwt.SigningMethodRS256, rsaKey, "", claims))
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+	t.Run("invalid-file", func(t *testing.T) {
+		_, err := NewJWKSVerifier(filepath.Join(t.TempDir(), "missing.json"), Options{})
+		assert.Error(t, err)
+		_, err = NewJWKSVerifier(writeJWKS(t, map[string]string{"kty": "EC", "kid": "bad", "crv": "P-256", "x": "AQ", "y": "AQ"}), Options{})
+		assert.Error(t, err)
+		_, err = NewJWKSVerifier(writeJWKS(t, map[string]string{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQ", "e": "AQ"}), Options{})
+		assert.Error(t, err)
+	})
+}
+
+func TestRemoteVerifier(t *testing.T) {
+	t.Parallel()
+	valid := sign(t, jwt.SigningMethodHS256, []byte("auth service secret"), "", jwt.MapClaims{"iss": "jim"})
+	expired := sign(t, jwt.SigningMethodHS256, []byte("auth service secret"), "", jwt.MapClaims{"iss": "jim", "exp": time.Now().Add(-time.Minute).Unix()})
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		switch r.Header.Get("Authorization") {
+		case "Bearer " + valid, "Bearer " + expired:
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	t.Run("success", func(t *testing.T) {
+		v := NewRemoteVerifier(server.URL, RemoteOptions{CacheTTL: -1}, Options{})
+		userID, err := v.Verify(ctx, valid)
+		assert.NoError(t, err)
+		assert.Equal(t, "jim", userID)
+	})
+	t.Run("rejected", func(t *testing.T) {
+		v := NewRemoteVerifier(server.URL, RemoteOptions{Failures: 1}, Options{})
+		for i := 0; i < 3; i++ {
+			_, err := v.Verify(ctx, sign(t, jwt.SigningMethodHS256, []byte("other"), "", jwt.MapClaims{"iss": "jim"}))
+			assert.ErrorIs(t, err, ErrInvalidToken)
+		}
+		// rejecting tokens is the auth service doing its job, the breaker stays closed
+		assert.Equal(t, "closed", v.Stats().BreakerState)
+		assert.Equal(t, 0, v.Stats().CacheSize)
+	})
+	t.Run("expired", func(t *testing.T) {
+		v := NewRemoteVerifier(server.URL, RemoteOptions{}, Options{})
+		_, err := v.Verify(ctx, expired)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+	t.Run("unavailable", func(t *testing.T) {
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+		v := NewRemoteVerifier(down.URL, RemoteOptions{Failures: 2}, Options{})
+		for i := 0; i < 3; i++ {
+			_, err := v.Verify(ctx, valid)
+			assert.ErrorIs(t, err, ErrUnavailable)
+		}
+		stats := v.Stats()
+		assert.Equal(t, "open", stats.BreakerState)
+		assert.Equal(t, int64(1), stats.BreakerStateChanges["closed->open"])
+	})
+	t.Run("stats-after-open-timeout", func(t *testing.T) {
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+		v := NewRemoteVerifier(down.URL, RemoteOptions{Failures: 1, OpenTimeout: time.Millisecond * 50}, Options{})
+		_, err := v.Verify(ctx, valid)
+		assert.ErrorIs(t, err, ErrUnavailable)
+		time.Sleep(time.Millisecond * 60)
+
+		// reading the state moves the breaker to half-open, which counts the change
+		stats := make(chan RemoteStats)
+		go func() { stats <- v.Stats() }()
+		select {
+		case s := <-stats:
+			assert.Equal(t, "half-open", s.BreakerState)
+			assert.Equal(t, int64(1), s.BreakerStateChanges["open->half-open"])
+		case <-time.After(time.Second):
+			assert.Fail(t, "Stats deadlocked")
+		}
+	})
+	t.Run("client-gone", func(t *testing.T) {
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Millisecond * 50)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer slow.Close()
+		v := NewRemoteVerifier(slow.URL, RemoteOptions{Failures: 1, CacheTTL: -1}, Options{})
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := v.Verify(cancelled, valid)
+		assert.Error(t, err)
+		gone, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+		defer cancel()
+		_, err = v.Verify(gone, valid)
+		assert.NoError(t, err)
+		// clients going away isn't the auth service failing, the breaker stays closed
+		assert.Equal(t, "closed", v.Stats().BreakerState)
+	})
+	t.Run("server-error", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer failing.Close()
+		_, err := NewRemoteVerifier(failing.URL, RemoteOptions{}, Options{}).Verify(ctx, valid)
+		assert.ErrorIs(t, err, ErrUnavailable)
+	})
+	t.Run("cache", func(t *testing.T) {
+		now := time.Now()
+		token := sign(t, jwt.SigningMethodHS256, []byte("auth service secret"), "", jwt.MapClaims{"iss": "pam", "exp": now.Add(time.Second * 30).Unix()})
+		cachedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&requests, 1)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer cachedServer.Close()
+		v := NewRemoteVerifier(cachedServer.URL, RemoteOptions{CacheTTL: time.Minute}, Options{})
+		v.now = func() time.Time { return now }
+
+		before := atomic.LoadInt64(&requests)
+		for i := 0; i < 3; i++ {
+			userID, err := v.Verify(ctx, token)
+			assert.NoError(t, err)
+			assert.Equal(t, "pam", userID)
+		}
+		assert.Equal(t, before+1, atomic.LoadInt64(&requests))
+		stats := v.Stats()
+		assert.Equal(t, int64(2), stats.CacheHits)
+		assert.Equal(t, int64(1), stats.CacheMisses)
+		assert.Equal(t, 1, stats.CacheSize)
+
+		// the token expires before the cache ttl is over, so it isn't trusted from the cache past its exp
+		v.now = func() time.Time { return now.Add(time.Second * 31) }
+		_, ok := v.cached(tokenKey(token))
+		assert.False(t, ok)
+		assert.Equal(t, 0, v.Stats().CacheSize)
+	})
+	t.Run("cache-full", func(t *testing.T) {
+		v := NewRemoteVerifier(server.URL, RemoteOptions{CacheSize: 1}, Options{})
+		other := sign(t, jwt.SigningMethodHS256, []byte("auth service secret"), "", jwt.MapClaims{"iss": "pam"})
+		_, err := v.Verify(ctx, valid)
+		assert.NoError(t, err)
+		_, err = v.Verify(ctx, other)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+		assert.Equal(t, 1, v.Stats().CacheSize)
+	})
+}
+
+func TestNewVerifierFromEnv(t *testing.T) {
+	t.Run("hmac by default, even with an auth service", func(t *testing.T) {
+		t.Setenv("AUTH_MODE", "")
+		t.Setenv("AUTH_URL", "http://auth.local/verify")
+		t.Setenv("SECRET_KEY", "secret")
+
+		v, err := NewVerifierFromEnv()
+
+		assert.NoError(t, err)
+		assert.IsType(t, &localVerifier{}, v)
+	})
+	t.Run("hmac without a secret", func(t *testing.T) {
+		t.Setenv("AUTH_MODE", "")
+		t.Setenv("AUTH_URL", "http://auth.local/verify")
+		t.Setenv("SECRET_KEY", "")
+
+		_, err := NewVerifierFromEnv()
+
+		assert.Error(t, err)
+	})
+	t.Run("remote when asked for", func(t *testing.T) {
+		t.Setenv("AUTH_MODE", "remote")
+		t.Setenv("AUTH_URL", "http://auth.local/verify")
+
+		v, err := NewVerifierFromEnv()
+
+		assert.NoError(t, err)
+		assert.IsType(t, &RemoteVerifier{}, v)
+	})
+}
@@ -55,6 +55,14 @@ func NewUnauthorizedError(message string) *RestError {
 	}
 }
 
+// NewTooManyRequestsError returns error with status code 429
+func NewTooManyRequestsError(message string) *RestError {
+	return &RestError{
+		Code:    http.StatusTooManyRequests,
+		Message: message,
+	}
+}
+
 func SetRESTError(err error, c *gin.Context) {
 	switch v := err.(type) {
 	case *RestError:
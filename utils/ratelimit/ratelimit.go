@@ -0,0 +1,182 @@
+package ratelimit
+
+import (
+	"chat/utils/errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Action is what a student is limited on. Each action has its own bucket per student, shared by all their
+// connections and requests to this instance
+type Action string
+
+const (
+	Send        Action = "send"
+	Edit        Action = "edit"
+	Delete      Action = "delete"
+	JoinRequest Action = "join_request"
+	RoomCreate  Action = "room_create"
+)
+
+// Actions lists every action, in the order they are configured
+var Actions = []Action{Send, Edit, Delete, JoinRequest, RoomCreate}
+
+// Rule is a token bucket: a student can do the action Burst times in a row, then once every Per/Burst as the bucket
+// refills
+type Rule struct {
+	Burst int
+	Per   time.Duration
+}
+
+// DefaultRules are the rules of the actions RATE_LIMIT_* doesn't configure
+var DefaultRules = map[Action]Rule{
+	Send:        {Burst: 20, Per: time.Second * 10},
+	Edit:        {Burst: 10, Per: time.Second * 10},
+	Delete:      {Burst: 10, Per: time.Second * 10},
+	JoinRequest: {Burst: 5, Per: time.Minute},
+	RoomCreate:  {Burst: 5, Per: time.Minute},
+}
+
+// sweepInterval is how often the buckets that refilled completely are forgotten
+const sweepInterval = time.Minute
+
+// Limiter keeps a token bucket per student and action. A nil Limiter allows everything
+type Limiter struct {
+	rules map[Action]Rule
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucketKey struct {
+	userID string
+	action Action
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a Limiter with the rules. An action without a rule isn't limited
+func New(rules map[Action]Rule) *Limiter {
+	return &Limiter{
+		rules:   rules,
+		buckets: make(map[bucketKey]*bucket),
+		now:     time.Now,
+	}
+}
+
+// NewFromEnv reads the rule of each action from RATE_LIMIT_<ACTION>, e.g. RATE_LIMIT_SEND=20/10s lets a student send
+// 20 messages in a row, then 2 per second. off disables the limit of the action, and an unset variable is the
+// action's default rule
+func NewFromEnv() (*Limiter, error) {
+	rules := make(map[Action]Rule)
+	for _, action := range Actions {
+		name := "RATE_LIMIT_" + strings.ToUpper(string(action))
+		value := os.Getenv(name)
+		switch value {
+		case "":
+			rules[action] = DefaultRules[action]
+		case "off":
+		default:
+			rule, err := ParseRule(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s", name, err.Error())
+			}
+			rules[action] = rule
+		}
+	}
+	return New(rules), nil
+}
+
+// ParseRule reads a rule written as <burst>/<period>, e.g. 20/10s or 5/1m
+func ParseRule(value string) (Rule, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return Rule{}, fmt.Errorf("must be written as <burst>/<period>, e.g. 20/10s, got %q", value)
+	}
+	burst, err := strconv.Atoi(parts[0])
+	if err != nil || burst < 1 {
+		return Rule{}, fmt.Errorf("must have a positive burst, got %q", value)
+	}
+	per, err := time.ParseDuration(parts[1])
+	if err != nil || per <= 0 {
+		return Rule{}, fmt.Errorf("must have a positive period, e.g. 10s, got %q", value)
+	}
+	return Rule{Burst: burst, Per: per}, nil
+}
+
+// Allow takes a token from the student's bucket for the action. When the bucket is empty, it returns false and how
+// long until the next token
+func (l *Limiter) Allow(userID string, action Action) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	rule, ok := l.rules[action]
+	if !ok {
+		return true, 0
+	}
+	rate := float64(rule.Burst) / float64(rule.Per)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	key := bucketKey{userID, action}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rule.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(rule.Burst), b.tokens+float64(now.Sub(b.last))*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration(math.Ceil((1 - b.tokens) / rate))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets the buckets that are full again, they are the same as a new one
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if rule, ok := l.rules[key.action]; !ok || now.Sub(b.last) >= rule.Per {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Handler limits the action for the logged in student of the request. Over the limit, the request is answered with
+// 429 and a Retry-After header, in seconds
+func (l *Limiter) Handler(action Action) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, _ := c.Get("loggedID")
+		loggedID, _ := key.(string)
+		if ok, retryAfter := l.Allow(loggedID, action); !ok {
+			seconds := RetryAfterSeconds(retryAfter)
+			c.Header("Retry-After", strconv.Itoa(seconds))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, errors.NewTooManyRequestsError(fmt.Sprintf("Too many %s requests, retry in %d seconds", action, seconds)))
+			return
+		}
+		c.Next()
+	}
+}
+
+// RetryAfterSeconds rounds the wait up to whole seconds, so a client retrying after it has a token
+func RetryAfterSeconds(retryAfter time.Duration) int {
+	return int(math.Ceil(retryAfter.Seconds()))
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	l := New(map[Action]Rule{Send: {Burst: 2, Per: time.Second * 10}})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		ok, _ := l.Allow("jim", Send)
+		assert.True(t, ok)
+	}
+	ok, retryAfter := l.Allow("jim", Send)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second*5, retryAfter)
+
+	// every student has their own bucket, and an action without a rule isn't limited
+	ok, _ = l.Allow("pam", Send)
+	assert.True(t, ok)
+	ok, _ = l.Allow("jim", Edit)
+	assert.True(t, ok)
+
+	// the bucket refills over time
+	l.now = func() time.Time { return now.Add(time.Second * 5) }
+	ok, _ = l.Allow("jim", Send)
+	assert.True(t, ok)
+	ok, _ = l.Allow("jim", Send)
+	assert.False(t, ok)
+
+	// the full buckets are forgotten
+	l.now = func() time.Time { return now.Add(time.Minute * 2) }
+	ok, _ = l.Allow("dwight", Send)
+	assert.True(t, ok)
+	assert.Len(t, l.buckets, 1)
+
+	var nilLimiter *Limiter
+	ok, _ = nilLimiter.Allow("jim", Send)
+	assert.True(t, ok)
+}
+
+func TestParseRule(t *testing.T) {
+	t.Parallel()
+	rule, err := ParseRule("20/10s")
+	assert.NoError(t, err)
+	assert.Equal(t, Rule{Burst: 20, Per: time.Second * 10}, rule)
+
+	for _, value := range []string{"20", "0/10s", "x/10s", "20/x", "20/-1s"} {
+		_, err = ParseRule(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestNewFromEnv(t *testing.T) {
+	os.Setenv("RATE_LIMIT_SEND", "3/1s")
+	os.Setenv("RATE_LIMIT_EDIT", "off")
+	defer os.Unsetenv("RATE_LIMIT_SEND")
+	defer os.Unsetenv("RATE_LIMIT_EDIT")
+
+	l, err := NewFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, Rule{Burst: 3, Per: time.Second}, l.rules[Send])
+	assert.NotContains(t, l.rules, Edit)
+	assert.Equal(t, DefaultRules[RoomCreate], l.rules[RoomCreate])
+
+	os.Setenv("RATE_LIMIT_SEND", "often")
+	_, err = NewFromEnv()
+	assert.Error(t, err)
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+	gin.SetMode(gin.TestMode)
+	l := New(map[Action]Rule{RoomCreate: {Burst: 1, Per: time.Minute}})
+	router := gin.New()
+	router.POST("/rooms", func(c *gin.Context) {
+		c.Set("loggedID", c.GetHeader("id"))
+	}, l.Handler(RoomCreate), func(c *gin.Context) {
+		c.Status(http.StatusCreated)
+	})
+
+	create := func(userID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/rooms", nil)
+		req.Header.Set("id", userID)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusCreated, create("jim").Code)
+	w := create("jim")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "Too many room_create requests")
+	assert.Equal(t, http.StatusCreated, create("pam").Code)
+}
@@ -0,0 +1,125 @@
+package search
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+const (
+	// minTermLength and maxTermLength bound the words that are indexed, in runes. Shorter words match too much to be
+	// worth a row each, longer ones are rather links or keys nobody searches for
+	minTermLength = 2
+	maxTermLength = 64
+
+	// snippetLength is how many runes of the body a snippet holds, snippetContext how many of them come before the
+	// first match
+	snippetLength  = 160
+	snippetContext = 40
+
+	markOpen  = "<mark>"
+	markClose = "</mark>"
+)
+
+// span is a word of a text, runes [start, end)
+type span struct {
+	start int
+	end   int
+	term  string
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// words splits the text in words, the runes between anything but letters and digits. Their terms are lower case
+func words(runes []rune) []span {
+	spans := []span{}
+	for i := 0; i < len(runes); i++ {
+		if !isWordRune(runes[i]) {
+			continue
+		}
+		start := i
+		for i < len(runes) && isWordRune(runes[i]) {
+			i++
+		}
+		spans = append(spans, span{start: start, end: i, term: strings.ToLower(string(runes[start:i]))})
+	}
+	return spans
+}
+
+func indexed(term string) bool {
+	n := len([]rune(term))
+	return n >= minTermLength && n <= maxTermLength
+}
+
+// Terms returns the distinct terms of the text that are indexed, in the order they first appear. A message is found
+// by the terms of its body, a search finds the messages that have every term of its text
+func Terms(text string) []string {
+	terms := []string{}
+	seen := map[string]bool{}
+	for _, word := range words([]rune(text)) {
+		if indexed(word.term) && !seen[word.term] {
+			seen[word.term] = true
+			terms = append(terms, word.term)
+		}
+	}
+	return terms
+}
+
+// Snippet returns the part of the body around the first of the terms, with every term in it wrapped in <mark>. The
+// body is HTML escaped, so the snippet can be rendered as is. A cut is marked with an ellipsis
+func Snippet(body string, terms []string) string {
+	runes := []rune(body)
+	wanted := map[string]bool{}
+	for _, term := range terms {
+		wanted[term] = true
+	}
+	matches := []span{}
+	for _, word := range words(runes) {
+		if wanted[word.term] {
+			matches = append(matches, word)
+		}
+	}
+
+	start := 0
+	if len(matches) > 0 && matches[0].start > snippetContext {
+		start = matches[0].start - snippetContext
+		// don't start in the middle of a word
+		for start < matches[0].start && isWordRune(runes[start-1]) {
+			start++
+		}
+	}
+	end := len(runes)
+	if end-start > snippetLength {
+		end = start + snippetLength
+		// nor end in the middle of one, unless the snippet is a single word
+		for cut := end; cut > start; cut-- {
+			if !isWordRune(runes[cut-1]) || !isWordRune(runes[cut]) {
+				end = cut
+				break
+			}
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	at := start
+	for _, match := range matches {
+		if match.start < start || match.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(string(runes[at:match.start])))
+		b.WriteString(markOpen)
+		b.WriteString(html.EscapeString(string(runes[match.start:match.end])))
+		b.WriteString(markClose)
+		at = match.end
+	}
+	b.WriteString(html.EscapeString(string(runes[at:end])))
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
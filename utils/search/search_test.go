@@ -0,0 +1,56 @@
+package search
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestTerms(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		text     string
+		expected []string
+	}{
+		{"words", "Who's up for lunch?", []string{"who", "up", "for", "lunch"}},
+		{"lower case and distinct", "Lunch, LUNCH and lunch", []string{"lunch", "and"}},
+		{"digits and letters of any script", "Café at 12 ñandú", []string{"café", "at", "12", "ñandú"}},
+		{"short and long words are left out", "a " + strings.Repeat("x", 65) + " ok", []string{"ok"}},
+		{"no words", "?!  ...", []string{}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, test.expected, Terms(test.text))
+		})
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	t.Parallel()
+	t.Run("short body", func(t *testing.T) {
+		t.Parallel()
+		assert.Equal(t, "Who&#39;s up for <mark>Lunch</mark>? <mark>lunch</mark>!",
+			Snippet("Who's up for Lunch? lunch!", []string{"lunch"}))
+	})
+
+	t.Run("long body", func(t *testing.T) {
+		t.Parallel()
+		body := strings.Repeat("filler words ", 10) + "the exam is on friday " + strings.Repeat("more filler ", 20)
+		snippet := Snippet(body, []string{"exam", "friday"})
+		assert.True(t, strings.HasPrefix(snippet, "…"))
+		assert.True(t, strings.HasSuffix(snippet, "…"))
+		assert.Contains(t, snippet, "the <mark>exam</mark> is on <mark>friday</mark>")
+		// the cuts are between words
+		assert.True(t, strings.HasPrefix(snippet, "…words ") || strings.HasPrefix(snippet, "…filler "), snippet)
+		assert.True(t, strings.HasSuffix(snippet, " …") || strings.HasSuffix(snippet, "filler…") ||
+			strings.HasSuffix(snippet, "more…"), snippet)
+	})
+
+	t.Run("no match", func(t *testing.T) {
+		t.Parallel()
+		assert.Equal(t, "a &lt;b&gt;", Snippet("a <b>", []string{"lunch"}))
+	})
+}